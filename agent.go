@@ -0,0 +1,260 @@
+package main
+
+import (
+	"aws-runas/lib/agent"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/dustin/go-humanize"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// agentSocket returns the path of the credential agent socket, which defaults to a file in the runas-agent directory,
+// next to the AWS config file.  The agent creates the directory, so only the user can access it, even if the directory
+// of the config file is writable by the user's group.
+func agentSocket() string {
+	if agentSock != nil && len(*agentSock) > 0 {
+		return *agentSock
+	}
+	return filepath.Join(filepath.Dir(defaults.SharedConfigFilename()), "runas-agent", "agent.sock")
+}
+
+// runAgent handles the agent sub-commands
+func runAgent(cmd string) {
+	c := agent.NewClient(agentSocket())
+
+	switch cmd {
+	case agentStop.FullCommand():
+		if err := c.Shutdown(); err != nil {
+			log.Fatalf("error stopping credential agent: %v", err)
+		}
+	case agentStatus.FullCommand():
+		p, err := c.Profiles()
+		if err != nil {
+			log.Fatalf("credential agent not running at %s: %v", c.Socket, err)
+		}
+
+		fmt.Printf("Credential agent running at %s\n", c.Socket)
+		for _, s := range p {
+			fmt.Printf("  %s (expires %s)\n", s.Profile, humanize.Time(s.Expiration))
+		}
+	default:
+		startAgent()
+	}
+}
+
+// startAgent runs the credential agent until it is stopped, or the program is interrupted.  Credentials for the
+// profiles on the command line are loaded before the agent starts serving requests, so they can prompt for input.
+func startAgent() {
+	// nothing reads from the terminal once the agent is running, so loading a profile, or refreshing credentials, which
+	// needs an MFA code or password fails instead of waiting for input
+	var started int32
+	interactive := func() bool { return atomic.LoadInt32(&started) == 0 }
+
+	a, err := agent.NewAgent(&agent.AgentInput{
+		Socket: agentSocket(),
+		Logger: log,
+		Loader: func(p string) (*credentials.Credentials, error) {
+			return credentials.NewCredentials(&agentProcessProvider{profile: p, interactive: interactive}), nil
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, p := range *agentArgs.profiles {
+		if _, err := a.Load(p); err != nil {
+			a.Shutdown(context.Background())
+			log.Fatalf("error loading credentials for profile %s: %v", p, err)
+		}
+	}
+	atomic.StoreInt32(&started, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Debugf("Got signal: %s", sig.String())
+		cancel()
+	}()
+
+	if err := a.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := a.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// agentCommand returns the command the agent runs to get the credentials for the profile, a var to allow tests to
+// substitute their own command
+var agentCommand = func(profile string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--no-agent", "--output", "json", profile}
+	if *verbose {
+		args = append([]string{"--verbose"}, args...)
+	}
+	return exec.Command(exe, args...), nil
+}
+
+// agentProcessProvider retrieves the credentials for a profile by running aws-runas in a separate process, which
+// prints the credentials as JSON, like a credential_process.  Each profile is resolved in its own process, using the
+// configuration, caches, and identity of the profile, so loading one profile never changes the state used to get the
+// credentials of another profile.
+type agentProcessProvider struct {
+	credentials.Expiry
+	profile string
+	// interactive returns true if the process may prompt for input on the terminal
+	interactive func() bool
+	// noExpiry is set if the last credentials retrieved don't expire
+	noExpiry bool
+}
+
+// Retrieve runs the process for the profile, and returns the credentials it prints.  The process reads from the
+// standard input of the agent only while the agent is interactive, otherwise its input is empty, so any prompt for an
+// MFA code or password fails instead of waiting for input.
+func (p *agentProcessProvider) Retrieve() (credentials.Value, error) {
+	cmd, err := agentCommand(p.profile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	cmd.Env = agentProcessEnv(os.Environ(), p.interactive())
+	cmd.Stderr = os.Stderr
+	if p.interactive() {
+		cmd.Stdin = os.Stdin
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("error getting credentials for profile %s: %v", p.profile, err)
+	}
+
+	jc := new(struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	})
+	if err := json.Unmarshal(out, jc); err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid credentials for profile %s: %v", p.profile, err)
+	}
+
+	if len(jc.AccessKeyId) < 1 || len(jc.SecretAccessKey) < 1 {
+		return credentials.Value{}, fmt.Errorf("incomplete credentials for profile %s", p.profile)
+	}
+
+	// a zero expiration means the credentials don't expire, otherwise refresh them in the last tenth of their lifetime,
+	// like the providers in the credentials lib
+	p.noExpiry = jc.Expiration.IsZero()
+	if !p.noExpiry {
+		p.SetExpiration(jc.Expiration, time.Until(jc.Expiration)/10)
+	}
+
+	return credentials.Value{
+		AccessKeyID:     jc.AccessKeyId,
+		SecretAccessKey: jc.SecretAccessKey,
+		SessionToken:    jc.SessionToken,
+		ProviderName:    agent.ProviderName,
+	}, nil
+}
+
+// IsExpired returns true if the credentials need to be retrieved.  The credentials.Expiry treats a zero expiration as
+// expired, so credentials which don't expire are tracked separately, and only retrieved once.
+func (p *agentProcessProvider) IsExpired() bool {
+	if p.noExpiry {
+		return false
+	}
+	return p.Expiry.IsExpired()
+}
+
+// agentProcessEnv returns the environment for the process getting the credentials of a profile.  The profile is passed
+// on the command line, so AWS_PROFILE is removed, and the process must not ask the agent for credentials.  The SAML
+// password from the agent command line is passed to every profile.  MFA codes are only good for one use, so the MFA code
+// is only passed on while the agent is interactive.
+func agentProcessEnv(environ []string, interactive bool) []string {
+	env := make([]string, 0, len(environ)+1)
+	for _, e := range environ {
+		k := strings.SplitN(e, "=", 2)[0]
+		if k == "AWS_PROFILE" || k == "RUNAS_NO_AGENT" || k == "MFA_CODE" || k == "SAML_PASSWORD" {
+			continue
+		}
+		env = append(env, e)
+	}
+
+	env = append(env, "RUNAS_NO_AGENT=true")
+	if interactive && mfaCode != nil && len(*mfaCode) > 0 {
+		env = append(env, "MFA_CODE="+*mfaCode)
+	}
+
+	if samlPass != nil && len(*samlPass) > 0 {
+		env = append(env, "SAML_PASSWORD="+*samlPass)
+	}
+	return env
+}
+
+// agentCredentials returns the credentials for the profile from the credential agent.  Nil is returned if the agent is
+// not running, or can't provide credentials for the profile, or if the command line has options which only apply to
+// this run of the program, so the caller gets the credentials itself.
+func agentCredentials() *credentials.Credentials {
+	if !useAgent() {
+		return nil
+	}
+
+	cl := agent.NewClient(agentSocket())
+	if !cl.Running() {
+		return nil
+	}
+
+	c := agent.NewCredentials(cl, *profile)
+	if _, err := c.Get(); err != nil {
+		log.Debugf("credential agent unable to provide credentials for %s: %v", *profile, err)
+		return nil
+	}
+
+	log.Debugf("using credentials from agent at %s", cl.Socket)
+	return c
+}
+
+// useAgent returns false if the agent is disabled, or the command line has options which change how credentials are
+// retrieved, or need the identity of the user
+func useAgent() bool {
+	for _, b := range []*bool{noAgent, refresh, sesCreds, listRoles, listMfa, updateFlag, diagFlag, ec2MdFlag} {
+		if b != nil && *b {
+			return false
+		}
+	}
+
+	for _, s := range []*string{mfaCode, mfaSerial, extnId, jumpArn, samlUser, samlPass, samlProvider, policyFile} {
+		if s != nil && len(*s) > 0 {
+			return false
+		}
+	}
+
+	for _, d := range []*time.Duration{duration, roleDuration} {
+		if d != nil && *d > 0 {
+			return false
+		}
+	}
+
+	if (samlUrl != nil && *samlUrl != nil) || (sessionTags != nil && len(*sessionTags) > 0) ||
+		(transitiveTags != nil && len(*transitiveTags) > 0) || (policyArns != nil && len(*policyArns) > 0) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"aws-runas/lib/agent"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentSocket(t *testing.T) {
+	defer func(s *string) { agentSock = s }(agentSock)
+
+	t.Run("default", func(t *testing.T) {
+		agentSock = aws.String("")
+
+		if s := agentSocket(); s != filepath.Join(filepath.Dir(cookieFile), "runas-agent", "agent.sock") {
+			t.Errorf("unexpected socket: %s", s)
+		}
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		agentSock = aws.String("/run/user/1000/runas.sock")
+		if s := agentSocket(); s != *agentSock {
+			t.Errorf("unexpected socket: %s", s)
+		}
+	})
+}
+
+func TestUseAgent(t *testing.T) {
+	defer func(m *string, r *bool, d *time.Duration) { mfaCode, refresh, roleDuration = m, r, d }(mfaCode, refresh, roleDuration)
+	mfaCode = aws.String("")
+	refresh = aws.Bool(false)
+	roleDuration = new(time.Duration)
+
+	t.Run("default", func(t *testing.T) {
+		if !useAgent() {
+			t.Error("agent not used")
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		refresh = aws.Bool(true)
+		defer func() { refresh = aws.Bool(false) }()
+
+		if useAgent() {
+			t.Error("agent used with --refresh")
+		}
+	})
+
+	t.Run("mfa code", func(t *testing.T) {
+		mfaCode = aws.String("123456")
+		defer func() { mfaCode = aws.String("") }()
+
+		if useAgent() {
+			t.Error("agent used with --otp")
+		}
+	})
+
+	t.Run("role duration", func(t *testing.T) {
+		d := 2 * time.Hour
+		roleDuration = &d
+		defer func() { roleDuration = new(time.Duration) }()
+
+		if useAgent() {
+			t.Error("agent used with --role-duration")
+		}
+	})
+}
+
+func TestAgentCredentials(t *testing.T) {
+	defer func(s, p, m *string) { agentSock, profile, mfaCode = s, p, m }(agentSock, profile, mfaCode)
+	mfaCode = aws.String("")
+	profile = aws.String("agent-profile")
+
+	d, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(d)
+	agentSock = aws.String(filepath.Join(d, "s"))
+
+	t.Run("not running", func(t *testing.T) {
+		if c := agentCredentials(); c != nil {
+			t.Error("received credentials without a running agent")
+		}
+	})
+
+	a, err := agent.NewAgent(&agent.AgentInput{
+		Socket: *agentSock,
+		Logger: log,
+		Loader: func(p string) (*credentials.Credentials, error) {
+			return credentials.NewStaticCredentials("AKIA"+p, "MockSecret", "MockToken"), nil
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := a.Start(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	t.Run("running", func(t *testing.T) {
+		c := agentCredentials()
+		if c == nil {
+			t.Error("nil credentials")
+			return
+		}
+
+		v, err := c.Get()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if v.AccessKeyID != "AKIAagent-profile" || v.ProviderName != agent.ProviderName {
+			t.Errorf("unexpected credentials: %+v", v)
+		}
+	})
+
+	t.Run("no agent", func(t *testing.T) {
+		noAgent = aws.Bool(true)
+		defer func() { noAgent = aws.Bool(false) }()
+
+		if c := agentCredentials(); c != nil {
+			t.Error("received credentials with --no-agent")
+		}
+	})
+}
+
+// TestAgentHelperProcess is run by the agentProcessProvider tests in place of aws-runas, printing credentials which
+// describe the environment of the process
+func TestAgentHelperProcess(t *testing.T) {
+	if os.Getenv("RUNAS_AGENT_HELPER") != "1" {
+		return
+	}
+
+	p := os.Args[len(os.Args)-1]
+	if p == "bad" {
+		os.Exit(1)
+	}
+
+	if p == "static" {
+		fmt.Printf(`{"AccessKeyId": "AKIA%s", "SecretAccessKey": "MockSecret", "Version": 1}`, p)
+		os.Exit(0)
+	}
+
+	fmt.Printf(`{"AccessKeyId": "AKIA%s", "SecretAccessKey": "MockSecret", "SessionToken": "%s", "Expiration": "%s", "Version": 1}`,
+		p, os.Getenv("MFA_CODE"), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	os.Exit(0)
+}
+
+func TestAgentProcessProvider(t *testing.T) {
+	defer func(f func(string) (*exec.Cmd, error), m *string) { agentCommand, mfaCode = f, m }(agentCommand, mfaCode)
+	mfaCode = aws.String("123456")
+
+	agentCommand = func(p string) (*exec.Cmd, error) {
+		c := exec.Command(os.Args[0], "-test.run=TestAgentHelperProcess", "--", p)
+		return c, nil
+	}
+	os.Setenv("RUNAS_AGENT_HELPER", "1")
+	defer os.Unsetenv("RUNAS_AGENT_HELPER")
+
+	t.Run("non-interactive", func(t *testing.T) {
+		c := credentials.NewCredentials(&agentProcessProvider{profile: "p1", interactive: func() bool { return false }})
+		v, err := c.Get()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// no MFA code
+		if v.AccessKeyID != "AKIAp1" || v.SessionToken != "" || v.ProviderName != agent.ProviderName {
+			t.Errorf("unexpected credentials: %+v", v)
+		}
+
+		if e, err := c.ExpiresAt(); err != nil || time.Until(e) < 50*time.Minute {
+			t.Errorf("unexpected expiration: %v %v", e, err)
+		}
+	})
+
+	t.Run("interactive", func(t *testing.T) {
+		c := credentials.NewCredentials(&agentProcessProvider{profile: "p2", interactive: func() bool { return true }})
+		v, err := c.Get()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if v.AccessKeyID != "AKIAp2" || v.SessionToken != "123456" {
+			t.Errorf("unexpected credentials: %+v", v)
+		}
+	})
+
+	t.Run("no expiration", func(t *testing.T) {
+		p := &agentProcessProvider{profile: "static", interactive: func() bool { return false }}
+		if !p.IsExpired() {
+			t.Error("credentials not expired before the first retrieval")
+			return
+		}
+
+		c := credentials.NewCredentials(p)
+		if _, err := c.Get(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c.IsExpired() {
+			t.Error("credentials without an expiration are expired")
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		c := credentials.NewCredentials(&agentProcessProvider{profile: "bad", interactive: func() bool { return false }})
+		if _, err := c.Get(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestAgentProcessEnv(t *testing.T) {
+	defer func(m, s *string) { mfaCode, samlPass = m, s }(mfaCode, samlPass)
+	mfaCode = aws.String("123456")
+	samlPass = aws.String("secret")
+
+	environ := []string{"HOME=/home/user", "AWS_PROFILE=other", "MFA_CODE=654321", "RUNAS_NO_AGENT=false"}
+
+	t.Run("interactive", func(t *testing.T) {
+		env := strings.Join(agentProcessEnv(environ, true), " ")
+		if env != "HOME=/home/user RUNAS_NO_AGENT=true MFA_CODE=123456 SAML_PASSWORD=secret" {
+			t.Errorf("unexpected environment: %s", env)
+		}
+	})
+
+	t.Run("non-interactive", func(t *testing.T) {
+		env := strings.Join(agentProcessEnv(environ, false), " ")
+		if env != "HOME=/home/user RUNAS_NO_AGENT=true SAML_PASSWORD=secret" {
+			t.Errorf("unexpected environment: %s", env)
+		}
+	})
+}
@@ -8,38 +8,70 @@ import (
 )
 
 var (
-	updateFlag   *bool
-	diagFlag     *bool
-	listRoles    *bool
-	listMfa      *bool
-	ec2MdFlag    *bool
-	verbose      *bool
-	envFlag      *bool
-	showExpire   *bool
-	refresh      *bool
-	sesCreds     *bool
-	whoAmI       *bool
-	duration     *time.Duration
-	roleDuration *time.Duration
-	mfaCode      *string
-	mfaSerial    *string
-	extnId       *string
-	jumpArn      *string
-	samlUrl      **url.URL
-	samlUser     *string
-	samlPass     *string
-	samlProvider *string
-	outputFmt    *string
+	updateFlag     *bool
+	diagFlag       *bool
+	listRoles      *bool
+	expandRoles    *bool
+	listMfa        *bool
+	explain        *bool
+	ec2MdFlag      *bool
+	ec2Routes      *map[string]string
+	ec2InstanceId  *string
+	ec2Region      *string
+	ec2AvailZone   *string
+	verbose        *bool
+	envFlag        *bool
+	ctrFlag        *bool
+	ctrAddr        *string
+	restrictUid    *bool
+	ssmNative      *bool
+	showExpire     *bool
+	refresh        *bool
+	sesCreds       *bool
+	whoAmI         *bool
+	duration       *time.Duration
+	roleDuration   *time.Duration
+	mfaCode        *string
+	sessionTags    *map[string]string
+	transitiveTags *[]string
+	policyFile     *string
+	policyArns     *[]string
+	mfaSerial      *string
+	extnId         *string
+	jumpArn        *string
+	samlUrl        **url.URL
+	samlUser       *string
+	samlPass       *string
+	samlProvider   *string
+	outputFmt      *string
+	noAgent        *bool
+	agentSock      *string
+	pickSaml       *bool
 
 	exe    *kingpin.CmdClause
 	shell  *kingpin.CmdClause
 	fwd    *kingpin.CmdClause
+	ssh    *kingpin.CmdClause
+	runCmd *kingpin.CmdClause
 	passwd *kingpin.CmdClause
+	pick   *kingpin.CmdClause
+
+	discover     *kingpin.CmdClause
+	discoverArgs = new(cmdArgs)
+
+	agentCmd    *kingpin.CmdClause
+	agentStart  *kingpin.CmdClause
+	agentStop   *kingpin.CmdClause
+	agentStatus *kingpin.CmdClause
+	agentArgs   = new(cmdArgs)
 
 	execArgs  = new(cmdArgs)
 	shellArgs = new(cmdArgs)
 	fwdArgs   = new(cmdArgs)
+	sshArgs   = new(cmdArgs)
+	runArgs   = new(cmdArgs)
 	pwdArgs   = new(cmdArgs)
+	pickArgs  = new(cmdArgs)
 )
 
 type cmdArgs struct {
@@ -47,6 +79,17 @@ type cmdArgs struct {
 	cmd       *[]string
 	target    *string
 	localPort *uint16
+	port      *string
+	remote    *string
+	mappings  *[]string
+	persist   *bool
+	targets   *[]string
+	recordDir *string
+	recordIn  *bool
+	profiles  *[]string
+	dryRun    *bool
+	aliases   *bool
+	nameTmpl  *string
 }
 
 func init() {
@@ -55,16 +98,30 @@ func init() {
 		updateArgDesc       = "Check for updates to aws-runas"
 		diagArgDesc         = "Run diagnostics to gather info to troubleshoot issues"
 		listRoleArgDesc     = "List role ARNs you are able to assume"
+		expandRoleArgDesc   = "Expand wildcard role ARNs in IAM policies using the roles in your account, with --list-roles"
 		listMfaArgDesc      = "List the ARN of the MFA device associated with your IAM account"
+		explainArgDesc      = "Show the source credentials and chain of roles used for the profile"
 		ec2ArgDesc          = "Run a mock EC2 metadata service to provide role credentials"
+		ec2RouteArgDesc     = "Serve EC2 metadata credentials for a profile to a local client, as uid:<uid>=<profile> or pid:<pid>=<profile> (Linux only)"
+		ec2InstIdArgDesc    = "Instance ID reported by the EC2 metadata service, default is a synthetic ID based on the hostname"
+		ec2RegionArgDesc    = "Region reported by the EC2 metadata service, default is the region of the active profile"
+		ec2AzArgDesc        = "Availability zone reported by the EC2 metadata service, default is the 'a' zone of the region"
 		verboseArgDesc      = "Print verbose/debug messages"
 		envArgDesc          = "Pass credentials to program as environment variables"
+		ctrArgDesc          = "Serve credentials to docker containers started by the program"
+		ctrAddrArgDesc      = "Address to serve container credentials on, default is the docker bridge address (implies --container)"
+		restrictUidArgDesc  = "Only serve credentials to processes running as your user, use --no-restrict-uid to disable (Linux only)"
+		ssmNativeArgDesc    = "Use the built-in SSM session client, instead of the session-manager-plugin"
 		showExpArgDesc      = "Show credential expiration time"
 		refreshArgDesc      = "Force a refresh of the cached credentials"
 		sesCredArgDesc      = "Print eval()-able session token info, or run command using session token credentials"
 		durationArgDesc     = "Duration of the retrieved session token"
 		roleDurationArgDesc = "Duration of the assume role credentials"
 		mfaCodeDesc         = "MFA token code"
+		sessionTagDesc      = "Session tag to set on the assumed role credentials, may be repeated"
+		transitiveTagDesc   = "Key of a session tag to pass to roles assumed using the role credentials, may be repeated"
+		policyFileDesc      = "File containing a JSON session policy to limit the permissions of the assumed role credentials"
+		policyArnDesc       = "ARN of a managed policy to limit the permissions of the assumed role credentials, may be repeated"
 		mfaSerialDesc       = "Serial number (or AWS ARN) of MFA device needed to perform Assume Role operation"
 		extnIdDesc          = "External ID to use to Assume the Role"
 		jumpArnDesc         = "ARN of the 'jump role' to use with SAML integration"
@@ -74,23 +131,41 @@ func init() {
 		samlProviderDesc    = "The name of the saml provider to use, and bypass auto-detection"
 		profileArgDesc      = "name of profile, or role ARN"
 		fwdPortDesc         = "The local port for the forwarded connection"
-		outputArgDesc       = "Credential output format, valid values: env (default) or json"
+		fwdMapDesc          = "Forward a local port to a port on the target, as local:target:remote, may be repeated (implies --persist)"
+		fwdPersistDesc      = "Keep the local port open, and reconnect the session when it ends"
+		outputArgDesc       = "Credential (or --list-roles) output format, valid values: env (default) or json"
 		whoAmIArgDesc       = "Print the AWS identity information for the provided profile"
+		noAgentArgDesc      = "Do not use the credential agent, even if it is running"
+		agentSockArgDesc    = "Path of the credential agent socket"
+		pickSamlArgDesc     = "Include the roles from the SAML identity provider of the default profile when choosing a profile"
 	)
 
 	// special flags
 	ec2MdFlag = kingpin.Flag("ec2", ec2ArgDesc).Bool()
+	ec2Routes = kingpin.Flag("ec2-route", ec2RouteArgDesc).PlaceHolder("uid:1000=PROFILE").StringMap()
+	ec2InstanceId = kingpin.Flag("ec2-instance-id", ec2InstIdArgDesc).Envar("RUNAS_EC2_INSTANCE_ID").PlaceHolder("ID").String()
+	ec2Region = kingpin.Flag("ec2-region", ec2RegionArgDesc).Envar("RUNAS_EC2_REGION").PlaceHolder("REGION").String()
+	ec2AvailZone = kingpin.Flag("ec2-availability-zone", ec2AzArgDesc).Envar("RUNAS_EC2_AVAILABILITY_ZONE").PlaceHolder("AZ").String()
 	verbose = kingpin.Flag("verbose", verboseArgDesc).Short('v').Envar("RUNAS_VERBOSE").Bool()
 	envFlag = kingpin.Flag("env", envArgDesc).Short('E').Envar("RUNAS_ENV_CREDENTIALS").Bool()
+	ctrFlag = kingpin.Flag("container", ctrArgDesc).Envar("RUNAS_CONTAINER").Bool()
+	ctrAddr = kingpin.Flag("container-addr", ctrAddrArgDesc).Envar("RUNAS_CONTAINER_ADDR").PlaceHolder("ADDR").String()
+	restrictUid = kingpin.Flag("restrict-uid", restrictUidArgDesc).Envar("RUNAS_RESTRICT_UID").Default("true").Bool()
+	ssmNative = kingpin.Flag("ssm-native", ssmNativeArgDesc).Envar("RUNAS_SSM_NATIVE").Bool()
 	showExpire = kingpin.Flag("expiration", showExpArgDesc).Short('e').Bool()
 	outputFmt = kingpin.Flag("output", outputArgDesc).Short('O').Envar("RUNAS_OUTPUT_FORMAT").Default("env").Enum("env", "json")
 	whoAmI = kingpin.Flag("whoami", whoAmIArgDesc).Short('w').Bool()
+	noAgent = kingpin.Flag("no-agent", noAgentArgDesc).Envar("RUNAS_NO_AGENT").Bool()
+	agentSock = kingpin.Flag("agent-socket", agentSockArgDesc).Envar("RUNAS_AGENT_SOCKET").PlaceHolder("PATH").String()
+	pickSaml = kingpin.Flag("pick-saml", pickSamlArgDesc).Envar("RUNAS_PICK_SAML").Bool()
 
 	// flags which don't actually do any credential stuff
 	updateFlag = kingpin.Flag("update", updateArgDesc).Short('u').Bool()
 	diagFlag = kingpin.Flag("diagnose", diagArgDesc).Short('D').Bool()
 	listRoles = kingpin.Flag("list-roles", listRoleArgDesc).Short('l').Bool()
+	expandRoles = kingpin.Flag("expand-roles", expandRoleArgDesc).Bool()
 	listMfa = kingpin.Flag("list-mfa", listMfaArgDesc).Short('m').Bool() // only relevant for non-SAML profiles
+	explain = kingpin.Flag("explain", explainArgDesc).Bool()
 
 	// flags which affect the configuration used for fetching credentials of any flavor
 	refresh = kingpin.Flag("refresh", refreshArgDesc).Short('r').Bool()
@@ -98,6 +173,10 @@ func init() {
 	duration = kingpin.Flag("duration", durationArgDesc).Short('d').Envar("SESSION_TOKEN_DURATION").Duration()
 	roleDuration = kingpin.Flag("role-duration", roleDurationArgDesc).Short('a').Envar("CREDENTIALS_DURATION").Duration()
 	mfaCode = kingpin.Flag("otp", mfaCodeDesc).Short('o').Envar("MFA_CODE").String() // valid for SAML and non-SAML profiles
+	sessionTags = kingpin.Flag("session-tag", sessionTagDesc).PlaceHolder("KEY=VALUE").StringMap()
+	transitiveTags = kingpin.Flag("transitive-tag", transitiveTagDesc).PlaceHolder("KEY").Strings()
+	policyFile = kingpin.Flag("policy-file", policyFileDesc).PlaceHolder("FILE").String()
+	policyArns = kingpin.Flag("policy-arn", policyArnDesc).PlaceHolder("ARN").Strings()
 
 	// flags which are only valid for non-SAML profiles
 	mfaSerial = kingpin.Flag("mfa-serial", mfaSerialDesc).Short('M').Envar("MFA_SERIAL").String()
@@ -117,17 +196,48 @@ func init() {
 	execArgs.cmd = exe.Arg("cmd", "command to execute using configured profile").Strings()
 
 	shell = kingpin.Command("shell", "Start an SSM shell session to the given target")
+	shellArgs.recordDir = shell.Flag("record-dir", "Record the session as an asciicast file in this directory").Envar("RUNAS_SSM_RECORD_DIR").PlaceHolder("DIR").String()
+	shellArgs.recordIn = shell.Flag("record-input", "Also record the session input, including any passwords typed, with --record-dir").Envar("RUNAS_SSM_RECORD_INPUT").Bool()
 	shellArgs.profile = profileEnvArg(shell, profileArgDesc)
 	shellArgs.target = shell.Arg("target", "The EC2 instance to connect via SSM").String()
 
 	fwd = kingpin.Command("forward", "Start an SSM port-forwarding session to the given target").Alias("fwd")
 	fwdArgs.localPort = fwd.Flag("port", fwdPortDesc).Short('p').Default("0").Uint16()
+	fwdArgs.mappings = fwd.Flag("map", fwdMapDesc).Short('L').PlaceHolder("LOCAL:TARGET:REMOTE").Strings()
+	fwdArgs.persist = fwd.Flag("persist", fwdPersistDesc).Bool()
 	fwdArgs.profile = profileEnvArg(fwd, profileArgDesc)
-	fwdArgs.target = fwd.Arg("target", "The EC2 instance id and remote port, separated by ':'").String()
+	fwdArgs.target = fwd.Arg("target", "The EC2 instance and remote port, separated by ':', or the EC2 instance used to reach the remote host").String()
+	fwdArgs.remote = fwd.Arg("remote", "The remote host and port, separated by ':', or rds:<identifier>[:port] for an RDS endpoint").String()
+
+	ssh = kingpin.Command("ssh-proxy", "Start an SSM ssh session to the given target, for use as the ssh ProxyCommand")
+	sshArgs.profile = profileEnvArg(ssh, profileArgDesc)
+	sshArgs.target = ssh.Arg("target", "The EC2 instance ID, Name tag, or private DNS name to connect via SSM").String()
+	sshArgs.port = ssh.Arg("port", "The ssh port on the target").Default("22").String()
+
+	// --targets may also be given after the profile, see runCommandArgs()
+	runCmd = kingpin.Command("run-command", "Run a shell command on the given targets using SSM Run Command")
+	runArgs.targets = runCmd.Flag("targets", "The instances to run the command on, may be repeated").Short('t').PlaceHolder("TARGET").Strings()
+	runArgs.profile = profileEnvArg(runCmd, profileArgDesc)
+	runArgs.cmd = runCmd.Arg("cmd", "The shell command to run, after '--'").Strings()
 
 	passwd = kingpin.Command("password", "Set the SAML password for the specified profile").Alias("pwd")
 	pwdArgs.profile = profileEnvArg(passwd, profileArgDesc)
 
+	discover = kingpin.Command("discover", "Add profiles for the roles available from the SAML identity provider to the AWS config file")
+	discoverArgs.dryRun = discover.Flag("dry-run", "Print the new and changed profiles, instead of writing them to the config file").Short('n').Bool()
+	discoverArgs.aliases = discover.Flag("aliases", "Look up the alias of each account, by assuming one of the roles in the account").Bool()
+	discoverArgs.nameTmpl = discover.Flag("name-template", "Template for the profile names, using {{.Alias}}, {{.AccountId}}, and {{.Role}}").Default(DefaultProfileNameTemplate).PlaceHolder("TEMPLATE").String()
+	discoverArgs.profile = profileEnvArg(discover, "name of the SAML profile used to authenticate")
+
+	pick = kingpin.Command("pick", "Choose the profile, or SAML role, interactively, then run the command using it")
+	pickArgs.cmd = pick.Arg("cmd", "command to execute using the chosen profile").Strings()
+
+	agentCmd = kingpin.Command("agent", "Manage the background credential agent")
+	agentStart = agentCmd.Command("start", "Start the credential agent, loading credentials for the given profiles first")
+	agentArgs.profiles = agentStart.Arg("profile", "profiles to load before the agent starts, may be repeated").Strings()
+	agentStatus = agentCmd.Command("status", "Show the profiles the credential agent holds credentials for")
+	agentStop = agentCmd.Command("stop", "Stop the credential agent")
+
 	kingpin.Version(Version)
 	kingpin.CommandLine.VersionFlag.Short('V')
 	kingpin.CommandLine.HelpFlag.Short('h')
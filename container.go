@@ -0,0 +1,173 @@
+package main
+
+import (
+	"aws-runas/lib/metadata"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// ecsCredentialsAddr is the address of the ECS credential endpoint.  SDKs fetch credentials from this address,
+	// using the path in the AWS_CONTAINER_CREDENTIALS_RELATIVE_URI environment variable, since only loopback addresses
+	// are allowed in AWS_CONTAINER_CREDENTIALS_FULL_URI.
+	ecsCredentialsAddr = "169.254.170.2:80"
+	// containerCredentialsPort is the default port for the container credential endpoint, a fixed port so requests for
+	// the ECS credential endpoint address can be forwarded to it
+	containerCredentialsPort = "51679"
+	dockerBridgeIface        = "docker0"
+)
+
+// docker and docker compose global options which take a value as the next argument
+var dockerValueOpts = map[string]bool{
+	"--config": true, "-c": true, "--context": true, "-H": true, "--host": true, "-l": true, "--log-level": true,
+	"--tlscacert": true, "--tlscert": true, "--tlskey": true, "-f": true, "--file": true, "-p": true,
+	"--project-name": true, "--project-directory": true, "--profile": true, "--env-file": true, "--ansi": true,
+	"--progress": true, "--parallel": true,
+}
+
+// containerAddress returns the address to bind the container credential endpoint to.  If the host is not provided, the
+// IPv4 address of the docker bridge interface is used, which is the default gateway address for containers, and if the
+// port is not provided, containerCredentialsPort is used.  Addresses which can not be reached from a container through
+// a port forward from the ECS credential endpoint address, loopback addresses and random ports, are rejected.
+func containerAddress(addr string) (string, error) {
+	host, port := addr, containerCredentialsPort
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+
+	if len(host) < 1 {
+		var err error
+		if host, err = bridgeAddress(); err != nil {
+			return "", err
+		}
+	}
+
+	if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" {
+		return "", fmt.Errorf("containers can not reach the loopback address %s", host)
+	}
+
+	if port == "0" {
+		return "", errors.New("a random port can not be forwarded from the ECS credential endpoint address")
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// bridgeAddress returns the IPv4 address of the docker bridge interface
+func bridgeAddress() (string, error) {
+	i, err := net.InterfaceByName(dockerBridgeIface)
+	if err != nil {
+		return "", fmt.Errorf("unable to find docker bridge interface, use --container-addr to set the address: %v", err)
+	}
+
+	addrs, err := i.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no IPv4 address found for interface %s, use --container-addr to set the address", dockerBridgeIface)
+}
+
+// newContainerServer creates the credential endpoint served to containers, listening on addr.  Requests from containers
+// can not be matched to a local user, so the authorization token is the only restriction on clients.
+func newContainerServer(c *credentials.Credentials, addr string) (*metadata.EcsMetadataServer, error) {
+	s, err := metadata.NewEcsMetadataServer(&metadata.EcsMetadataInput{Credentials: c, Logger: log, Address: addr})
+	if err != nil {
+		return nil, fmt.Errorf("unable to serve container credentials on %s: %v", addr, err)
+	}
+	return s, nil
+}
+
+// containerCredentialsEnv returns the environment variables SDKs in a container use to fetch credentials from the
+// server.  Only the path of the server url is passed, the SDKs always send the request to the ECS credential endpoint
+// address, which the host must forward to the server address.
+func containerCredentialsEnv(s *metadata.EcsMetadataServer) map[string]string {
+	return map[string]string{
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": s.Url.Path,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      s.AuthToken,
+	}
+}
+
+// injectContainerEnv adds '-e VAR' arguments for each of the provided environment variable names to docker run, create,
+// and exec commands, and docker compose run commands.  The values are passed through from the environment of the
+// docker command, so they are not visible in the process list.  Commands which are not recognized are returned
+// unchanged.
+func injectContainerEnv(cmd []string, vars ...string) []string {
+	if len(cmd) < 1 {
+		return cmd
+	}
+
+	var subCmds []string
+	switch filepath.Base(cmd[0]) {
+	case "docker", "docker.exe", "podman":
+		subCmds = []string{"run", "create", "exec", "container", "compose"}
+	case "docker-compose", "docker-compose.exe":
+		subCmds = []string{"run"}
+	default:
+		return cmd
+	}
+
+	idx := subCommandIndex(cmd, 1, subCmds...)
+	if idx < 0 {
+		log.Debugf("no container sub-command found in %v", cmd)
+		return cmd
+	}
+
+	// docker container run|create|exec, and docker compose run
+	switch cmd[idx] {
+	case "container":
+		idx = subCommandIndex(cmd, idx+1, "run", "create", "exec")
+	case "compose":
+		idx = subCommandIndex(cmd, idx+1, "run")
+	}
+
+	if idx < 0 {
+		log.Debugf("no container sub-command found in %v", cmd)
+		return cmd
+	}
+
+	env := make([]string, 0, len(vars)*2)
+	for _, v := range vars {
+		env = append(env, "-e", v)
+	}
+
+	newCmd := make([]string, 0, len(cmd)+len(env))
+	newCmd = append(newCmd, cmd[:idx+1]...)
+	newCmd = append(newCmd, env...)
+	newCmd = append(newCmd, cmd[idx+1:]...)
+
+	log.Debugf("CONTAINER CMD: %v", newCmd)
+	return newCmd
+}
+
+// subCommandIndex returns the index of the first non-option argument in cmd, starting at index start, if it is one of
+// the provided sub-commands.  Returns -1 if the argument is not found, or is not a wanted sub-command.
+func subCommandIndex(cmd []string, start int, want ...string) int {
+	for i := start; i < len(cmd); i++ {
+		a := cmd[i]
+		if strings.HasPrefix(a, "-") {
+			if dockerValueOpts[a] {
+				i++ // skip option value
+			}
+			continue
+		}
+
+		for _, w := range want {
+			if a == w {
+				return i
+			}
+		}
+		return -1
+	}
+	return -1
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInjectContainerEnv(t *testing.T) {
+	vars := []string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_AUTHORIZATION_TOKEN"}
+	env := "-e AWS_CONTAINER_CREDENTIALS_RELATIVE_URI -e AWS_CONTAINER_AUTHORIZATION_TOKEN"
+
+	tests := []struct {
+		name string
+		cmd  string
+		want string
+	}{
+		{"docker run", "docker run --rm -it amazon/aws-cli s3 ls", "docker run " + env + " --rm -it amazon/aws-cli s3 ls"},
+		{"docker exec", "/usr/bin/docker exec my-ctr aws s3 ls", "/usr/bin/docker exec " + env + " my-ctr aws s3 ls"},
+		{"docker container run", "docker container run img", "docker container run " + env + " img"},
+		{"global opts", "docker --context remote -D run img", "docker --context remote -D run " + env + " img"},
+		{"docker compose run", "docker compose -f dc.yml run app", "docker compose -f dc.yml run " + env + " app"},
+		{"docker-compose run", "docker-compose run app", "docker-compose run " + env + " app"},
+		{"docker ps", "docker ps -a", "docker ps -a"},
+		{"docker compose up", "docker compose up", "docker compose up"},
+		{"image named run", "docker images run", "docker images run"},
+		{"not docker", "aws s3 ls", "aws s3 ls"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := injectContainerEnv(strings.Fields(tc.cmd), vars...)
+			if strings.Join(cmd, " ") != tc.want {
+				t.Errorf("unexpected command: %v", cmd)
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		if cmd := injectContainerEnv([]string{}, vars...); len(cmd) > 0 {
+			t.Error("data mismatch")
+		}
+	})
+}
+
+func TestContainerAddress(t *testing.T) {
+	t.Run("explicit", func(t *testing.T) {
+		a, err := containerAddress("192.168.1.1:9999")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if a != "192.168.1.1:9999" {
+			t.Errorf("unexpected address: %s", a)
+		}
+	})
+
+	t.Run("default port", func(t *testing.T) {
+		a, err := containerAddress("192.168.1.1")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if a != "192.168.1.1:"+containerCredentialsPort {
+			t.Errorf("unexpected address: %s", a)
+		}
+	})
+
+	t.Run("ecs address", func(t *testing.T) {
+		a, err := containerAddress(ecsCredentialsAddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if a != ecsCredentialsAddr {
+			t.Errorf("unexpected address: %s", a)
+		}
+	})
+
+	t.Run("bridge", func(t *testing.T) {
+		a, err := containerAddress("")
+		if err != nil {
+			// not all test systems will have docker installed
+			t.Skip(err)
+		}
+
+		if !strings.HasSuffix(a, ":"+containerCredentialsPort) {
+			t.Errorf("unexpected address: %s", a)
+		}
+	})
+
+	t.Run("bridge with port", func(t *testing.T) {
+		a, err := containerAddress(":8080")
+		if err != nil {
+			t.Skip(err)
+		}
+
+		if !strings.HasSuffix(a, ":8080") || strings.HasPrefix(a, ":") {
+			t.Errorf("unexpected address: %s", a)
+		}
+	})
+
+	for _, addr := range []string{"127.0.0.1", "localhost:8080", "[::1]:8080", "192.168.1.1:0"} {
+		t.Run("unreachable "+addr, func(t *testing.T) {
+			if _, err := containerAddress(addr); err == nil {
+				t.Error("did not receive expected error")
+			}
+		})
+	}
+}
+
+func TestContainerCredentials(t *testing.T) {
+	c := credentials.NewStaticCredentials("AKIAMOCK", "MockSecret", "MockToken")
+
+	// the test can't configure the port forward from the ECS address to the docker bridge, so use the loopback address
+	s, err := newContainerServer(c, "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Shutdown(context.Background())
+
+	for k, v := range containerCredentialsEnv(s) {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	// stand in for the DNAT rule on the host, which forwards requests for the ECS address to the server
+	d := new(net.Dialer)
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr != ecsCredentialsAddr {
+				return nil, fmt.Errorf("unexpected address: %s", addr)
+			}
+			return d.DialContext(ctx, network, s.Url.Host)
+		},
+	}}
+
+	cfg := defaults.Config().WithHTTPClient(hc)
+	p := defaults.RemoteCredProvider(*cfg, defaults.Handlers())
+	if _, ok := p.(*endpointcreds.Provider); !ok {
+		t.Errorf("unexpected provider: %T", p)
+		return
+	}
+
+	v, err := credentials.NewCredentials(p).Get()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v.AccessKeyID != "AKIAMOCK" || v.SecretAccessKey != "MockSecret" || v.SessionToken != "MockToken" {
+		t.Errorf("unexpected credentials: %+v", v)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"aws-runas/lib/config"
+	"aws-runas/lib/httpclient"
 	"encoding/binary"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -78,14 +79,7 @@ func checkProfileCfg(p string, c *config.AwsConfig) {
 				log.Error("role_arn is a required parameter when using SAML integration")
 			}
 
-			u, err := http.Head(c.SamlAuthUrl.String())
-			if err != nil {
-				log.Errorf("error communicating with SAML metadata url: %v", err)
-			}
-
-			if u.StatusCode != http.StatusOK && u.StatusCode != http.StatusMethodNotAllowed {
-				log.Warnf("http status code %d when communicating with SAML metadaurl", u.StatusCode)
-			}
+			checkSamlUrl(c)
 		} else {
 			var cfgCreds bool
 
@@ -113,6 +107,25 @@ func checkProfileCfg(p string, c *config.AwsConfig) {
 	}
 }
 
+func checkSamlUrl(c *config.AwsConfig) {
+	hc, err := httpclient.New(c.HttpClientOptions())
+	if err != nil {
+		log.Errorf("invalid HTTP client configuration: %v", err)
+		return
+	}
+
+	u, err := hc.Head(c.SamlAuthUrl.String())
+	if err != nil {
+		log.Errorf("error communicating with SAML metadata url: %v", err)
+		return
+	}
+	defer u.Body.Close()
+
+	if u.StatusCode != http.StatusOK && u.StatusCode != http.StatusMethodNotAllowed {
+		log.Warnf("http status code %d when communicating with SAML metadaurl", u.StatusCode)
+	}
+}
+
 func checkCredentialProfile(profile string) bool {
 	cfg, err := cfglib.NewIniCredentialProvider(nil)
 	if err != nil {
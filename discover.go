@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/go-ini/ini"
+	cfglib "github.com/mmmorris1975/aws-config/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultProfileNameTemplate is the template for the names of discovered profiles, if --name-template isn't set
+const DefaultProfileNameTemplate = "{{.Alias}}-{{.Role}}"
+
+// discoveredRole is a role found in the SAMLResponse, and the data available to the profile name template
+type discoveredRole struct {
+	RoleArn   string
+	Principal string
+	AccountId string
+	// Alias is the account alias, or the account ID if the alias isn't known
+	Alias string
+	// Role is the name of the role, without the path
+	Role string
+}
+
+// discoverInput is the configuration for creating profiles for the roles available from the SAML identity provider
+type discoverInput struct {
+	// SourceProfile is the SAML profile used to authenticate, set as the source_profile of the new profiles
+	SourceProfile string
+	AuthUrl       string
+	Provider      string
+	NameTemplate  string
+	ConfigFile    string
+	DryRun        bool
+	// AliasLookup returns the account alias of the account of the role, if set
+	AliasLookup func(r *discoveredRole) (string, error)
+}
+
+// discoverProfiles authenticates with the SAML identity provider of the profile, and adds a profile for each role in
+// the SAMLResponse to the AWS config file, or prints them if --dry-run is set
+func discoverProfiles(w io.Writer) error {
+	if _, err := arn.Parse(*profile); err == nil {
+		return fmt.Errorf("discover requires the name of a SAML profile, not a role ARN")
+	}
+
+	if cfg.SamlAuthUrl == nil || len(cfg.SamlAuthUrl.String()) < 1 {
+		return fmt.Errorf("profile %s is not configured for SAML, saml_auth_url is not set", *profile)
+	}
+
+	if err := awsUser(); err != nil {
+		return err
+	}
+
+	rd, err := samlClient.RoleDetails()
+	if err != nil {
+		return err
+	}
+
+	in := &discoverInput{
+		SourceProfile: *profile,
+		AuthUrl:       cfg.SamlAuthUrl.String(),
+		Provider:      samlClient.Client().Provider,
+		NameTemplate:  *discoverArgs.nameTmpl,
+		ConfigFile:    awsConfigFile(),
+		DryRun:        *discoverArgs.dryRun,
+	}
+
+	if *discoverArgs.aliases {
+		saml, err := samlClient.AwsSaml()
+		if err != nil {
+			return err
+		}
+		in.AliasLookup = samlAccountAlias(saml)
+	}
+
+	roles := make([]*discoveredRole, 0)
+	for _, r := range rd.Roles() {
+		roles = append(roles, &discoveredRole{RoleArn: r, Principal: rd.Principal(r)})
+	}
+
+	return writeDiscoveredProfiles(in, roles, w)
+}
+
+// writeDiscoveredProfiles adds a profile for each role to the config file.  Existing profiles are merged with the
+// discovered attributes, only adding the attributes which aren't set, so local changes to the profiles are kept.  A
+// profile using a different role is left alone.  New profiles are appended to the config file, and the missing
+// attributes of existing profiles are inserted at the end of the profile, the rest of the file is not changed.  If
+// DryRun is set, the new and changed profiles are written to w instead of the config file.
+func writeDiscoveredProfiles(in *discoverInput, roles []*discoveredRole, w io.Writer) error {
+	tmpl := in.NameTemplate
+	if len(tmpl) < 1 {
+		tmpl = DefaultProfileNameTemplate
+	}
+
+	t, err := template.New("profile name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("invalid profile name template '%s': %v", tmpl, err)
+	}
+
+	f, err := ini.LoadSources(ini.LoadOptions{Loose: true}, in.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(roles, func(i, j int) bool { return roles[i].RoleArn < roles[j].RoleArn })
+	resolveAliases(in, roles)
+
+	changed := ini.Empty()
+	added := ini.Empty()
+	merged := make(map[string][][2]string)
+	for _, r := range roles {
+		b := new(bytes.Buffer)
+		if err := t.Execute(b, r); err != nil {
+			return fmt.Errorf("invalid profile name template '%s': %v", tmpl, err)
+		}
+
+		name := strings.TrimSpace(b.String())
+		if len(name) < 1 || strings.ContainsAny(name, "[] \t") {
+			log.Warnf("skipping role %s, invalid profile name '%s'", r.RoleArn, name)
+			continue
+		}
+
+		if name == in.SourceProfile {
+			log.Warnf("skipping role %s, profile name '%s' is the SAML profile", r.RoleArn, name)
+			continue
+		}
+
+		sn := "profile " + name
+		if name == cfglib.DefaultProfileName {
+			sn = name
+		}
+
+		_, err := f.GetSection(sn)
+		exists := err == nil
+
+		s := f.Section(sn)
+		if s.HasKey("role_arn") && s.Key("role_arn").String() != r.RoleArn {
+			log.Warnf("skipping role %s, profile %s already uses role %s", r.RoleArn, name, s.Key("role_arn").String())
+			continue
+		}
+
+		attrs := [][2]string{
+			{"role_arn", r.RoleArn},
+			{"source_profile", in.SourceProfile},
+			{"saml_auth_url", in.AuthUrl},
+			{"saml_provider", in.Provider},
+		}
+
+		missing := make([][2]string, 0)
+		for _, a := range attrs {
+			if len(a[1]) > 0 && !s.HasKey(a[0]) {
+				s.Key(a[0]).SetValue(a[1])
+				missing = append(missing, a)
+			}
+		}
+
+		if len(missing) < 1 {
+			continue
+		}
+
+		log.Debugf("updating profile %s for role %s", name, r.RoleArn)
+		cs := changed.Section(sn)
+		for _, k := range s.Keys() {
+			cs.Key(k.Name()).SetValue(k.Value())
+		}
+
+		if exists {
+			merged[sn] = missing
+		} else {
+			as := added.Section(sn)
+			for _, k := range s.Keys() {
+				as.Key(k.Name()).SetValue(k.Value())
+			}
+		}
+	}
+
+	// the pretty print settings are package globals in go-ini, put them back for any other writers
+	defer func(f, e bool) {
+		ini.PrettyFormat = f
+		ini.PrettyEqual = e
+	}(ini.PrettyFormat, ini.PrettyEqual)
+
+	ini.PrettyFormat = false
+	ini.PrettyEqual = true
+
+	if in.DryRun {
+		_, err = changed.WriteTo(w)
+		return err
+	}
+
+	if len(changed.Sections()) < 2 {
+		log.Info("no new profiles found")
+		return nil
+	}
+
+	if len(merged) > 0 {
+		b, err := ioutil.ReadFile(in.ConfigFile)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(in.ConfigFile, mergeProfileAttributes(b, merged), 0600); err != nil {
+			return err
+		}
+	}
+
+	if len(added.Sections()) > 1 {
+		if err := appendProfiles(in.ConfigFile, added); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("wrote %d profiles to %s", len(changed.Sections())-1, in.ConfigFile)
+	return nil
+}
+
+// mergeProfileAttributes inserts the attributes for each section after the last attribute in the first section with the
+// same name in the config file data, leaving the rest of the data as it was
+func mergeProfileAttributes(b []byte, merged map[string][][2]string) []byte {
+	lines := strings.SplitAfter(string(b), "\n")
+	at := make(map[int][][2]string)
+	seen := make(map[string]bool)
+
+	var name string
+	last := -1
+	mark := func() {
+		if a, ok := merged[name]; ok && !seen[name] && last >= 0 {
+			at[last] = a
+		}
+		seen[name] = true
+	}
+
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(t, "[") {
+			mark()
+			name, last = "", i
+			if e := strings.Index(t, "]"); e > 0 {
+				name = strings.TrimSpace(t[1:e])
+			}
+			continue
+		}
+
+		if len(t) > 0 && !strings.HasPrefix(t, "#") && !strings.HasPrefix(t, ";") {
+			last = i
+		}
+	}
+	mark()
+
+	out := new(bytes.Buffer)
+	for i, l := range lines {
+		out.WriteString(l)
+		if a, ok := at[i]; ok {
+			if !strings.HasSuffix(l, "\n") {
+				out.WriteString("\n")
+			}
+
+			for _, kv := range a {
+				fmt.Fprintf(out, "%s = %s\n", kv[0], kv[1])
+			}
+		}
+	}
+
+	return out.Bytes()
+}
+
+// appendProfiles appends the sections of the ini file to the end of the config file, creating the file if it does not
+// exist
+func appendProfiles(file string, profiles *ini.File) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+
+	cf, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer cf.Close()
+
+	buf := new(bytes.Buffer)
+	if fi, err := cf.Stat(); err == nil && fi.Size() > 0 {
+		buf.WriteString("\n")
+	}
+
+	if _, err := profiles.WriteTo(buf); err != nil {
+		return err
+	}
+
+	if _, err := cf.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return cf.Close()
+}
+
+// resolveAliases sets the account ID, role name, and alias of the roles.  The alias is looked up once for each account,
+// using the first role in the account, and is the account ID if the lookup fails, or isn't configured.
+func resolveAliases(in *discoverInput, roles []*discoveredRole) {
+	aliases := make(map[string]string)
+
+	for _, r := range roles {
+		r.AccountId, r.Role = splitRoleArn(r.RoleArn)
+
+		a, ok := aliases[r.AccountId]
+		if !ok && in.AliasLookup != nil {
+			var err error
+			if a, err = in.AliasLookup(r); err != nil {
+				log.Warnf("unable to get account alias using role %s: %v", r.RoleArn, err)
+			}
+			aliases[r.AccountId] = a
+		}
+
+		r.Alias = a
+		if len(r.Alias) < 1 {
+			r.Alias = r.AccountId
+		}
+	}
+}
+
+// samlAccountAlias returns a function which assumes the role using the SAML assertion, and returns the first account
+// alias of the account
+func samlAccountAlias(saml string) func(r *discoveredRole) (string, error) {
+	return func(r *discoveredRole) (string, error) {
+		out, err := sts.New(samlSession()).AssumeRoleWithSAML(&sts.AssumeRoleWithSAMLInput{
+			RoleArn:         aws.String(r.RoleArn),
+			PrincipalArn:    aws.String(r.Principal),
+			SAMLAssertion:   aws.String(saml),
+			DurationSeconds: aws.Int64(900),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		c := out.Credentials
+		ic := credentials.NewStaticCredentials(*c.AccessKeyId, *c.SecretAccessKey, *c.SessionToken)
+
+		res, err := iam.New(ses.Copy(new(aws.Config).WithCredentials(ic))).ListAccountAliases(new(iam.ListAccountAliasesInput))
+		if err != nil {
+			return "", err
+		}
+
+		if len(res.AccountAliases) < 1 {
+			return "", nil
+		}
+		return *res.AccountAliases[0], nil
+	}
+}
+
+// awsConfigFile returns the path of the AWS config file, which may be set in the AWS_CONFIG_FILE environment variable
+func awsConfigFile() string {
+	if v, ok := os.LookupEnv(cfglib.ConfigFileEnvVar); ok && len(v) > 0 {
+		return v
+	}
+	return defaults.SharedConfigFilename()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/go-ini/ini"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteDiscoveredProfiles(t *testing.T) {
+	d, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	newInput := func(dryRun bool) *discoverInput {
+		f := filepath.Join(d, "config")
+		_ = ioutil.WriteFile(f, []byte(`# my config
+[profile saml]
+saml_auth_url = https://idp.example.com/saml
+output=json
+
+[profile 1111-Admin]
+region = eu-west-1
+source_profile = other
+# keep me
+
+[profile 2222-Admin]
+role_arn = arn:aws:iam::2222:role/SomethingElse
+`), 0600)
+
+		return &discoverInput{
+			SourceProfile: "saml",
+			AuthUrl:       "https://idp.example.com/saml",
+			Provider:      "okta",
+			ConfigFile:    f,
+			DryRun:        dryRun,
+		}
+	}
+
+	roles := func() []*discoveredRole {
+		return []*discoveredRole{
+			{RoleArn: "arn:aws:iam::3333:role/path/ReadOnly"},
+			{RoleArn: "arn:aws:iam::1111:role/Admin"},
+			{RoleArn: "arn:aws:iam::2222:role/Admin"},
+		}
+	}
+
+	t.Run("write", func(t *testing.T) {
+		defer func(f, e bool) {
+			ini.PrettyFormat = f
+			ini.PrettyEqual = e
+		}(ini.PrettyFormat, ini.PrettyEqual)
+
+		ini.PrettyFormat = true
+		ini.PrettyEqual = false
+
+		in := newInput(false)
+		if err := writeDiscoveredProfiles(in, roles(), ioutil.Discard); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !ini.PrettyFormat || ini.PrettyEqual {
+			t.Error("ini format settings not restored")
+		}
+
+		b, err := ioutil.ReadFile(in.ConfigFile)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s := string(b)
+
+		// existing attributes are kept, missing ones are added, and the rest of the file is unchanged
+		if !strings.HasPrefix(s, `# my config
+[profile saml]
+saml_auth_url = https://idp.example.com/saml
+output=json
+
+[profile 1111-Admin]
+region = eu-west-1
+source_profile = other
+role_arn = arn:aws:iam::1111:role/Admin
+saml_auth_url = https://idp.example.com/saml
+saml_provider = okta
+# keep me
+
+[profile 2222-Admin]
+role_arn = arn:aws:iam::2222:role/SomethingElse
+
+[profile 3333-ReadOnly]
+`) {
+			t.Errorf("profile not merged:\n%s", s)
+		}
+
+		if !strings.Contains(s, `[profile 3333-ReadOnly]
+role_arn = arn:aws:iam::3333:role/path/ReadOnly
+source_profile = saml
+`) {
+			t.Errorf("profile not added:\n%s", s)
+		}
+
+		// the profile for a different role is untouched
+		if strings.Contains(s, "role_arn = arn:aws:iam::2222:role/Admin") {
+			t.Errorf("profile overwritten:\n%s", s)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		in := newInput(true)
+		in.NameTemplate = "{{.AccountId}}.{{.Role}}"
+
+		out := new(bytes.Buffer)
+		if err := writeDiscoveredProfiles(in, roles(), out); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if s := out.String(); !strings.HasPrefix(s, "[profile 1111.Admin]\nrole_arn") || strings.Contains(s, "my config") ||
+			!strings.Contains(s, "[profile 2222.Admin]") || !strings.Contains(s, "[profile 3333.ReadOnly]") {
+			t.Errorf("unexpected output:\n%s", s)
+		}
+
+		if b, _ := ioutil.ReadFile(in.ConfigFile); strings.Contains(string(b), "ReadOnly") {
+			t.Error("config file written with dry run")
+		}
+	})
+
+	t.Run("aliases", func(t *testing.T) {
+		var lookups int
+		in := newInput(true)
+		in.AliasLookup = func(r *discoveredRole) (string, error) {
+			lookups++
+			if r.AccountId == "1111" {
+				return "", errors.New("access denied")
+			}
+			return "acct-" + r.AccountId, nil
+		}
+
+		rl := append(roles(), &discoveredRole{RoleArn: "arn:aws:iam::3333:role/Admin"})
+		out := new(bytes.Buffer)
+		if err := writeDiscoveredProfiles(in, rl, out); err != nil {
+			t.Error(err)
+			return
+		}
+
+		s := out.String()
+		if lookups != 3 || !strings.Contains(s, "[profile acct-3333-Admin]") ||
+			!strings.Contains(s, "[profile acct-3333-ReadOnly]") || !strings.Contains(s, "[profile 1111-Admin]") {
+			t.Errorf("unexpected output (%d lookups):\n%s", lookups, s)
+		}
+	})
+
+	t.Run("bad template", func(t *testing.T) {
+		in := newInput(true)
+		in.NameTemplate = "{{.Bogus}}"
+
+		if err := writeDiscoveredProfiles(in, roles(), ioutil.Discard); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	credlib "aws-runas/lib/credentials"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/dustin/go-humanize"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// expiryCheckInterval is how often the expiry watcher checks the expiration of the credentials
+const expiryCheckInterval = 15 * time.Second
+
+// interactiveCreds are the credentials which need the user (to enter an MFA code, or authenticate with the identity
+// provider) to refresh them, found while getting the credentials for the profile
+var interactiveCreds []*watchedCredentials
+
+// watchedCredentials are credentials the expiry watcher warns about before they expire.  If renew is set, the
+// credentials are renewed before they expire.
+type watchedCredentials struct {
+	name    string
+	creds   *credentials.Credentials
+	renew   func() error
+	exp     time.Time
+	warned  map[time.Duration]bool
+	renewed bool
+}
+
+// watchCredentials adds the credentials to the list of credentials which need the user to refresh them
+func watchCredentials(name string, c *credentials.Credentials, renew func() error) {
+	interactiveCreds = append(interactiveCreds, &watchedCredentials{name: name, creds: c, renew: renew})
+}
+
+// expiryWatcher warns about credentials which will expire while a wrapped command is running, by logging the warning,
+// and running the notification command.  Credentials which can be renewed are renewed through the terminal before
+// they expire, so the command doesn't fail when it needs to refresh its credentials.
+type expiryWatcher struct {
+	profile   string
+	creds     []*watchedCredentials
+	warnings  []time.Duration
+	reauth    time.Duration
+	notifyCmd string
+	now       func() time.Time
+}
+
+// newExpiryWatcher creates the expiry watcher for the credentials c, provided to a wrapped command.  If the command is
+// given the credentials as environment variables, it can't refresh them, so the expiration of c is watched.  Otherwise,
+// c is refreshed by the credential endpoint, and the credentials which need the user to refresh them are watched.
+func newExpiryWatcher(c *credentials.Credentials) *expiryWatcher {
+	w := &expiryWatcher{
+		profile:   *profile,
+		warnings:  cfg.ExpiryWarnings,
+		reauth:    cfg.ExpiryReauth,
+		notifyCmd: cfg.ExpiryNotifyCommand,
+		now:       time.Now,
+	}
+
+	if *envFlag {
+		w.creds = []*watchedCredentials{{name: "credentials", creds: c}}
+	} else {
+		w.creds = interactiveCreds
+	}
+
+	return w
+}
+
+// run checks the expiration of the credentials until the context is done
+func (w *expiryWatcher) run(ctx context.Context) {
+	if len(w.creds) < 1 || (len(w.warnings) < 1 && w.reauth <= 0) {
+		return
+	}
+
+	t := time.NewTicker(expiryCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			w.check()
+		}
+	}
+}
+
+// check renews, or warns about, credentials which are about to expire.  Each warning is only given once for each
+// expiration time of the credentials.  Credentials which haven't been retrieved are skipped.
+func (w *expiryWatcher) check() {
+	now := w.now()
+
+	for _, c := range w.creds {
+		e, err := c.creds.ExpiresAt()
+		if err != nil || e.IsZero() {
+			continue
+		}
+
+		if !e.Equal(c.exp) {
+			c.exp = e
+			c.warned = make(map[time.Duration]bool)
+			c.renewed = false
+		}
+
+		left := e.Sub(now)
+		if c.renew != nil && w.reauth > 0 && left <= w.reauth && !c.renewed {
+			c.renewed = true
+
+			log.Infof("renewing %s for profile %s", c.name, w.profile)
+			if err := c.renew(); err == nil {
+				continue
+			}
+			log.Warnf("unable to renew %s for profile %s: %v", c.name, w.profile, err)
+		}
+
+		if left <= 0 {
+			if !c.warned[0] {
+				c.warned[0] = true
+				w.notify(fmt.Sprintf("%s for profile %s expired %s", c.name, w.profile, humanize.Time(e)), e)
+			}
+			continue
+		}
+
+		// warnings are sorted longest first, find the shortest warning for the remaining time
+		var warn time.Duration
+		for _, t := range w.warnings {
+			if left <= t {
+				warn = t
+			}
+		}
+
+		if warn > 0 && !c.warned[warn] {
+			for _, t := range w.warnings {
+				if t >= warn {
+					c.warned[t] = true
+				}
+			}
+			w.notify(fmt.Sprintf("%s for profile %s expire %s (%s)", c.name, w.profile, humanize.Time(e),
+				e.Format("15:04:05")), e)
+		}
+	}
+}
+
+// notify logs the message, and runs the notification command with the message, profile, and expiration time in the
+// RUNAS_EXPIRY_MESSAGE, RUNAS_EXPIRY_PROFILE, and RUNAS_EXPIRATION environment variables
+func (w *expiryWatcher) notify(msg string, exp time.Time) {
+	log.Warn(msg)
+
+	if len(w.notifyCmd) < 1 {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", w.notifyCmd)
+	} else {
+		cmd = exec.Command("sh", "-c", w.notifyCmd)
+	}
+
+	cmd.Env = append(os.Environ(), "RUNAS_EXPIRY_MESSAGE="+msg, "RUNAS_EXPIRY_PROFILE="+w.profile,
+		"RUNAS_EXPIRATION="+exp.Format(time.RFC3339))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		log.Debugf("error running expiry notification command: %v", err)
+	}
+}
+
+// ttyRenewal returns a function which renews the credentials, after calling the renew function of their provider with
+// an MFA token provider reading from the terminal
+func ttyRenewal(c *credentials.Credentials, renew func(func() (string, error))) func() error {
+	return func() error {
+		return withTty(func(tty *os.File) error {
+			renew(credlib.ReaderMfaTokenProvider(tty))
+			c.Expire()
+			_, err := c.Get()
+			return err
+		})
+	}
+}
+
+// withTty runs f with the terminal opened for reading, so prompts for input (like an MFA code) can be answered while a
+// wrapped command is using the standard input of the program
+func withTty(f func(tty *os.File) error) error {
+	dev := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		dev = "CONIN$"
+	}
+
+	tty, err := os.Open(dev)
+	if err != nil {
+		return fmt.Errorf("no terminal available: %v", err)
+	}
+	defer tty.Close()
+
+	return f(tty)
+}
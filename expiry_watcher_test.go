@@ -0,0 +1,211 @@
+package main
+
+import (
+	"aws-runas/lib/config"
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	cfglib "github.com/mmmorris1975/aws-config/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewExpiryWatcher(t *testing.T) {
+	defer func() { interactiveCreds = nil }()
+
+	profile = aws.String("watched")
+	cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig), ExpiryWarnings: []time.Duration{10 * time.Minute},
+		ExpiryReauth: 5 * time.Minute}
+
+	c := credentials.NewCredentials(new(mockCredProvider))
+	sc := credentials.NewCredentials(new(mockCredProvider))
+	watchCredentials("session token credentials", sc, func() error { return nil })
+
+	t.Run("endpoint", func(t *testing.T) {
+		envFlag = aws.Bool(false)
+
+		w := newExpiryWatcher(c)
+		if len(w.creds) != 1 || w.creds[0].creds != sc || w.profile != "watched" || w.reauth != 5*time.Minute {
+			t.Errorf("unexpected watcher: %+v", w)
+		}
+	})
+
+	t.Run("env", func(t *testing.T) {
+		envFlag = aws.Bool(true)
+		defer func() { envFlag = aws.Bool(false) }()
+
+		// the command can't refresh credentials in its environment, so only the credentials it was given matter
+		w := newExpiryWatcher(c)
+		if len(w.creds) != 1 || w.creds[0].creds != c || w.creds[0].renew != nil {
+			t.Errorf("unexpected watcher: %+v", w)
+		}
+	})
+
+	t.Run("nothing to watch", func(t *testing.T) {
+		w := &expiryWatcher{warnings: []time.Duration{time.Minute}}
+
+		done := make(chan bool)
+		go func() {
+			w.run(context.Background())
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(1 * time.Second):
+			t.Error("watcher with no credentials did not return")
+		}
+	})
+}
+
+func TestExpiryWatcher_Check(t *testing.T) {
+	c := credentials.NewCredentials(new(expiringCredProvider))
+	if _, err := c.Get(); err != nil {
+		t.Error(err)
+		return
+	}
+	exp, _ := c.ExpiresAt()
+
+	var notified []string
+	newWatcher := func(renew func() error) *expiryWatcher {
+		notified = nil
+		return &expiryWatcher{
+			profile:  "p",
+			creds:    []*watchedCredentials{{name: "role credentials", creds: c, renew: renew}},
+			warnings: []time.Duration{10 * time.Minute, 2 * time.Minute},
+			reauth:   5 * time.Minute,
+		}
+	}
+
+	check := func(w *expiryWatcher, left time.Duration) {
+		w.now = func() time.Time { return exp.Add(-left) }
+		w.check()
+
+		if l := len(w.creds[0].warned); l > len(notified) {
+			notified = append(notified, left.String())
+		}
+	}
+
+	t.Run("warnings", func(t *testing.T) {
+		w := newWatcher(nil)
+
+		check(w, 30*time.Minute)
+		if len(notified) > 0 {
+			t.Errorf("unexpected warning: %v", notified)
+		}
+
+		// each warning is only given once
+		check(w, 9*time.Minute)
+		check(w, 8*time.Minute)
+		if len(notified) != 1 || !w.creds[0].warned[10*time.Minute] {
+			t.Errorf("unexpected warnings: %v", notified)
+		}
+
+		check(w, 1*time.Minute)
+		check(w, -1*time.Minute)
+		if !w.creds[0].warned[2*time.Minute] || !w.creds[0].warned[0] {
+			t.Errorf("unexpected warnings: %v", w.creds[0].warned)
+		}
+	})
+
+	t.Run("skip to last warning", func(t *testing.T) {
+		w := newWatcher(nil)
+
+		check(w, 1*time.Minute)
+		if !w.creds[0].warned[10*time.Minute] || !w.creds[0].warned[2*time.Minute] {
+			t.Errorf("unexpected warnings: %v", w.creds[0].warned)
+		}
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		var renewed int
+		w := newWatcher(func() error {
+			renewed++
+			return nil
+		})
+
+		check(w, 6*time.Minute)
+		check(w, 4*time.Minute)
+		check(w, 3*time.Minute)
+		if renewed != 1 {
+			t.Errorf("credentials renewed %d times", renewed)
+		}
+	})
+
+	t.Run("renew error", func(t *testing.T) {
+		w := newWatcher(func() error { return errors.New("renew failed") })
+
+		check(w, 1*time.Minute)
+		if !w.creds[0].renewed || !w.creds[0].warned[2*time.Minute] {
+			t.Error("did not warn after failed renewal")
+		}
+	})
+
+	t.Run("new expiration", func(t *testing.T) {
+		w := newWatcher(nil)
+
+		check(w, 1*time.Minute)
+		w.creds[0].exp = exp.Add(-1 * time.Hour)
+
+		// the credentials were refreshed since the last check (from the point of view of the watcher)
+		check(w, 1*time.Minute)
+		if len(w.creds[0].warned) != 2 {
+			t.Errorf("unexpected warnings: %v", w.creds[0].warned)
+		}
+	})
+
+	t.Run("not retrieved", func(t *testing.T) {
+		w := newWatcher(nil)
+		w.creds[0].creds = credentials.NewCredentials(new(expiringCredProvider))
+
+		check(w, -1*time.Hour)
+		if len(w.creds[0].warned) > 0 {
+			t.Errorf("unexpected warnings: %v", w.creds[0].warned)
+		}
+	})
+}
+
+func TestExpiryWatcher_Notify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("notification command test uses sh")
+	}
+
+	d, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	f := filepath.Join(d, "out")
+	w := &expiryWatcher{profile: "p", notifyCmd: `echo "$RUNAS_EXPIRY_PROFILE $RUNAS_EXPIRY_MESSAGE" > ` + f}
+	w.notify("credentials expire soon", time.Now())
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if strings.TrimSpace(string(b)) != "p credentials expire soon" {
+		t.Errorf("unexpected notification: %s", b)
+	}
+}
+
+// expiringCredProvider returns non-empty credentials, since credentials.Credentials ExpiresAt() returns the zero time
+// for empty credentials
+type expiringCredProvider struct {
+	mockCredProvider
+}
+
+func (p *expiringCredProvider) Retrieve() (credentials.Value, error) {
+	v, err := p.mockCredProvider.Retrieve()
+	v.ProviderName = "mock"
+	return v, err
+}
@@ -0,0 +1,395 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/mmmorris1975/simple-logger/logger"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is how often the agent checks for credentials which need to be refreshed
+	DefaultRefreshInterval = 30 * time.Second
+
+	credentialsPath = "/credentials"
+	profilesPath    = "/profiles"
+	shutdownPath    = "/shutdown"
+)
+
+// Loader returns the credentials for a profile.  The agent calls the Loader when a profile is first requested, and
+// again when the credentials can no longer be refreshed (like when the SAML assertion used to get them is expired).
+// Calls to the Loader are serialized by the agent.
+type Loader func(profile string) (*credentials.Credentials, error)
+
+// AgentInput contains the options available for customizing the behavior of the credential agent
+type AgentInput struct {
+	// Socket is the path of the Unix socket the agent listens on
+	Socket string
+	// Loader returns the credentials for a profile
+	Loader Loader
+	// Logger is the logging object to configure for the agent.  If not provided, a standard logger is configured.
+	Logger *logger.Logger
+	// RefreshInterval is how often the agent checks for credentials to refresh.  If not provided, the
+	// DefaultRefreshInterval is used.
+	RefreshInterval time.Duration
+}
+
+// ProfileStatus is the state of the credentials the agent holds for a profile
+type ProfileStatus struct {
+	Profile    string
+	Expiration time.Time
+}
+
+// Agent holds the credentials of each requested profile in memory, and serves them to clients connecting to its Unix
+// socket.  Credentials are refreshed in the background once they enter the expiry window of their provider, so clients
+// are served unexpired credentials without waiting on a refresh.
+type Agent struct {
+	// Socket is the path of the Unix socket the agent listens on
+	Socket   string
+	log      *logger.Logger
+	loader   Loader
+	interval time.Duration
+	mu       sync.Mutex
+	loadMu   sync.Mutex
+	creds    map[string]*credentials.Credentials
+	srv      *http.Server
+	lsnr     net.Listener
+	done     chan struct{}
+	err      error
+}
+
+// NewAgent creates a new Agent using the provided AgentInput options, listening on the Unix socket.  The socket is
+// only accessible by the user running the agent.  An error is returned if another agent is using the socket.
+func NewAgent(opts *AgentInput) (*Agent, error) {
+	if opts.Loader == nil {
+		return nil, errors.New("credential loader is required")
+	}
+
+	if len(opts.Socket) < 1 {
+		return nil, errors.New("socket path is required")
+	}
+
+	a := &Agent{
+		Socket:   opts.Socket,
+		log:      opts.Logger,
+		loader:   opts.Loader,
+		interval: opts.RefreshInterval,
+		creds:    make(map[string]*credentials.Credentials),
+	}
+
+	if a.log == nil {
+		a.log = logger.StdLogger
+	}
+
+	if a.interval <= 0 {
+		a.interval = DefaultRefreshInterval
+	}
+
+	l, err := listen(a.Socket)
+	if err != nil {
+		return nil, err
+	}
+	a.lsnr = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(credentialsPath, a.credentialsHandler)
+	mux.HandleFunc(profilesPath, a.profilesHandler)
+	mux.HandleFunc(shutdownPath, a.shutdownHandler)
+	a.srv = &http.Server{Handler: mux}
+
+	return a, nil
+}
+
+// Load returns the credentials for the profile, calling the Loader if the agent does not hold credentials for the
+// profile.  Credentials are retrieved before they are stored, so profiles needing input from the user (like an MFA code)
+// can be loaded before the agent starts serving requests.
+func (a *Agent) Load(profile string) (*credentials.Credentials, error) {
+	a.mu.Lock()
+	c, ok := a.creds[profile]
+	a.mu.Unlock()
+
+	if ok {
+		return c, nil
+	}
+	return a.reload(profile, nil)
+}
+
+// Profiles returns the status of the credentials held by the agent, sorted by profile name
+func (a *Agent) Profiles() []*ProfileStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	p := make([]*ProfileStatus, 0, len(a.creds))
+	for k, c := range a.creds {
+		s := &ProfileStatus{Profile: k}
+		if e, err := c.ExpiresAt(); err == nil {
+			s.Expiration = e
+		}
+		p = append(p, s)
+	}
+
+	sort.Slice(p, func(i, j int) bool { return p[i].Profile < p[j].Profile })
+	return p
+}
+
+// ServeHTTP dispatches the request to the handler registered for the request path, allowing the agent to be tested
+// using the httptest package
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.srv.Handler.ServeHTTP(w, r)
+}
+
+// Start begins serving requests, and refreshing credentials, in the background.  The agent will shut down when the
+// provided context is done, or when Shutdown() is called.
+func (a *Agent) Start(ctx context.Context) error {
+	if a.done != nil {
+		return errors.New("agent already started")
+	}
+
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		if err := a.srv.Serve(a.lsnr); err != nil && err != http.ErrServerClosed {
+			a.err = err
+		}
+	}()
+
+	go func() {
+		t := time.NewTicker(a.interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				if err := a.Shutdown(context.Background()); err != nil {
+					a.log.Debugf("error shutting down agent: %v", err)
+				}
+				return
+			case <-a.done:
+				return
+			case <-t.C:
+				a.refresh()
+			}
+		}
+	}()
+
+	a.log.Infof("credential agent listening on %s", a.Socket)
+	return nil
+}
+
+// Wait blocks until the agent stops, and returns any error encountered while serving requests
+func (a *Agent) Wait() error {
+	if a.done == nil {
+		return errors.New("agent not started")
+	}
+
+	<-a.done
+	return a.err
+}
+
+// Shutdown gracefully stops the agent, and removes the socket
+func (a *Agent) Shutdown(ctx context.Context) error {
+	if a.done == nil {
+		// listener was created, but never served
+		defer a.lsnr.Close()
+	}
+	return a.srv.Shutdown(ctx)
+}
+
+// refresh retrieves new credentials for any profile whose credentials are in the expiry window
+func (a *Agent) refresh() {
+	a.mu.Lock()
+	creds := make(map[string]*credentials.Credentials, len(a.creds))
+	for k, v := range a.creds {
+		creds[k] = v
+	}
+	a.mu.Unlock()
+
+	for p, c := range creds {
+		if !c.IsExpired() {
+			continue
+		}
+
+		a.log.Debugf("refreshing credentials for profile %s", p)
+		if _, _, err := a.get(p, c); err != nil {
+			a.log.Warnf("unable to refresh credentials for profile %s: %v", p, err)
+		}
+	}
+}
+
+// get retrieves the credentials for the profile, reloading them if the credentials can not be refreshed.  The
+// credentials the value was retrieved from are returned with the value.
+func (a *Agent) get(profile string, c *credentials.Credentials) (*credentials.Credentials, credentials.Value, error) {
+	v, err := c.Get()
+	if err == nil {
+		return c, v, nil
+	}
+	a.log.Debugf("error retrieving credentials for profile %s, reloading: %v", profile, err)
+
+	if c, err = a.reload(profile, c); err != nil {
+		return nil, credentials.Value{}, err
+	}
+
+	v, err = c.Get()
+	return c, v, err
+}
+
+// reload calls the Loader for the profile, unless another request has replaced the old credentials while waiting
+func (a *Agent) reload(profile string, old *credentials.Credentials) (*credentials.Credentials, error) {
+	a.loadMu.Lock()
+	defer a.loadMu.Unlock()
+
+	a.mu.Lock()
+	c, ok := a.creds[profile]
+	a.mu.Unlock()
+
+	if ok && c != old {
+		return c, nil
+	}
+
+	c, err := a.loader(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.Get(); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.creds[profile] = c
+	a.mu.Unlock()
+
+	a.log.Debugf("loaded credentials for profile %s", profile)
+	return c, nil
+}
+
+func (a *Agent) credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("profile")
+	if len(p) < 1 {
+		writeError(w, http.StatusBadRequest, errors.New("profile is required"))
+		return
+	}
+
+	c, err := a.Load(p)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	c, v, err := a.get(p, c)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	e, err := c.ExpiresAt()
+	if err != nil {
+		e = time.Now()
+	}
+
+	writeJson(w, &credentialResponse{
+		AccessKeyId:     v.AccessKeyID,
+		SecretAccessKey: v.SecretAccessKey,
+		Token:           v.SessionToken,
+		Expiration:      e.UTC().Format(time.RFC3339),
+	})
+}
+
+func (a *Agent) profilesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, a.Profiles())
+}
+
+func (a *Agent) shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	a.log.Info("credential agent shutting down")
+
+	go func() {
+		if err := a.Shutdown(context.Background()); err != nil {
+			a.log.Debugf("error shutting down agent: %v", err)
+		}
+	}()
+}
+
+// listen creates the Unix socket, removing the socket of an agent which did not shut down cleanly.  The socket is
+// created with a umask only allowing access by the user, and the agent refuses to start if other users could replace
+// the socket in its directory.
+func listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := checkSocketDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("credential agent already running at %s", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var l net.Listener
+	err := withUmask(0177, func() error {
+		var err error
+		l, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(j)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	j, _ := json.Marshal(&errorResponse{Code: code, Message: err.Error()})
+	http.Error(w, string(j), code)
+}
+
+type errorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type credentialResponse struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+}
@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAgent(t *testing.T) {
+	t.Run("no loader", func(t *testing.T) {
+		if _, err := NewAgent(&AgentInput{Socket: testSocket(t)}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("no socket", func(t *testing.T) {
+		if _, err := NewAgent(&AgentInput{Loader: staticLoader}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("good", func(t *testing.T) {
+		s := testSocket(t)
+		a, err := NewAgent(&AgentInput{Socket: s, Loader: staticLoader})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer a.Shutdown(context.Background())
+
+		if a.interval != DefaultRefreshInterval {
+			t.Errorf("unexpected refresh interval: %s", a.interval)
+		}
+
+		fi, err := os.Stat(s)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+			t.Errorf("unexpected socket mode: %s", fi.Mode())
+		}
+	})
+
+	t.Run("already running", func(t *testing.T) {
+		s := testSocket(t)
+		a, err := NewAgent(&AgentInput{Socket: s, Loader: staticLoader})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer a.Shutdown(context.Background())
+
+		if _, err := NewAgent(&AgentInput{Socket: s, Loader: staticLoader}); err == nil || !strings.Contains(err.Error(), "already running") {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		s := testSocket(t)
+		l, err := net.Listen("unix", s)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// leave the socket file behind, like an agent which was killed
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+
+		a, err := NewAgent(&AgentInput{Socket: s, Loader: staticLoader})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		a.Shutdown(context.Background())
+	})
+}
+
+func TestAgent_Load(t *testing.T) {
+	l := new(countingLoader)
+	a, err := NewAgent(&AgentInput{Socket: testSocket(t), Loader: l.load})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	t.Run("good", func(t *testing.T) {
+		c, err := a.Load("p1")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		c2, err := a.Load("p1")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c != c2 || l.calls != 1 {
+			t.Errorf("profile loaded %d times", l.calls)
+		}
+
+		if p := a.Profiles(); len(p) != 1 || p[0].Profile != "p1" {
+			t.Errorf("unexpected profiles: %+v", p)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		if _, err := a.Load("bad"); err == nil {
+			t.Error("did not receive expected error")
+		}
+
+		if len(a.Profiles()) != 1 {
+			t.Error("failed profile was stored")
+		}
+	})
+}
+
+func TestAgent_Refresh(t *testing.T) {
+	l := new(countingLoader)
+	a, err := NewAgent(&AgentInput{Socket: testSocket(t), Loader: l.load})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	t.Run("expired", func(t *testing.T) {
+		if _, err := a.Load("expired"); err != nil {
+			t.Error(err)
+			return
+		}
+		p := l.providers["expired"]
+
+		a.refresh()
+		if p.calls != 2 {
+			t.Errorf("expired credentials were not refreshed, %d calls", p.calls)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		if _, err := a.Load("valid"); err != nil {
+			t.Error(err)
+			return
+		}
+		p := l.providers["valid"]
+
+		a.refresh()
+		if p.calls != 1 {
+			t.Errorf("valid credentials were refreshed, %d calls", p.calls)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		c, err := a.Load("fail-refresh")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		a.refresh()
+		if c2, _ := a.Load("fail-refresh"); c2 == c {
+			t.Error("credentials were not reloaded")
+		}
+	})
+}
+
+func TestAgent_Handlers(t *testing.T) {
+	a, err := NewAgent(&AgentInput{Socket: testSocket(t), Loader: staticLoader})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	t.Run("credentials", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, credentialsPath+"?profile=p1", nil)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+
+		b, _ := ioutil.ReadAll(w.Result().Body)
+		if w.Code != http.StatusOK || !strings.Contains(string(b), `"AccessKeyId":"AKIAMOCK"`) {
+			t.Errorf("unexpected response %d: %s", w.Code, b)
+		}
+	})
+
+	t.Run("no profile", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, credentialsPath, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status: %d", w.Code)
+		}
+	})
+
+	t.Run("load error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, credentialsPath+"?profile=bad", nil))
+
+		b, _ := ioutil.ReadAll(w.Result().Body)
+		if w.Code != http.StatusInternalServerError || !strings.Contains(string(b), "unknown profile") {
+			t.Errorf("unexpected response %d: %s", w.Code, b)
+		}
+	})
+
+	t.Run("profiles", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, profilesPath, nil))
+
+		b, _ := ioutil.ReadAll(w.Result().Body)
+		if w.Code != http.StatusOK || !strings.Contains(string(b), `"Profile":"p1"`) {
+			t.Errorf("unexpected response %d: %s", w.Code, b)
+		}
+	})
+
+	t.Run("shutdown get", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, shutdownPath, nil))
+
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("unexpected status: %d", w.Code)
+		}
+	})
+}
+
+var sockDir string
+
+func TestMain(m *testing.M) {
+	// keep socket paths short, since they are limited to about 100 characters
+	d, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		panic(err)
+	}
+	sockDir = d
+
+	rc := m.Run()
+	os.RemoveAll(d)
+	os.Exit(rc)
+}
+
+// testSocket returns a unique socket path for the test
+func testSocket(t *testing.T) string {
+	return filepath.Join(sockDir, fmt.Sprintf("%x", sha1.Sum([]byte(t.Name()))))
+}
+
+func staticLoader(profile string) (*credentials.Credentials, error) {
+	if profile == "bad" {
+		return nil, errors.New("unknown profile")
+	}
+	return credentials.NewStaticCredentials("AKIAMOCK", "MockSecret", "MockToken"), nil
+}
+
+// countingLoader returns credentials from a mockProvider, whose behavior depends on the profile name
+type countingLoader struct {
+	calls     int
+	providers map[string]*mockProvider
+}
+
+func (l *countingLoader) load(profile string) (*credentials.Credentials, error) {
+	if profile == "bad" {
+		return nil, errors.New("unknown profile")
+	}
+
+	if l.providers == nil {
+		l.providers = make(map[string]*mockProvider)
+	}
+
+	l.calls++
+	p := &mockProvider{profile: profile}
+	l.providers[profile] = p
+	return credentials.NewCredentials(p), nil
+}
+
+type mockProvider struct {
+	credentials.Expiry
+	profile string
+	calls   int
+}
+
+func (p *mockProvider) Retrieve() (credentials.Value, error) {
+	p.calls++
+
+	switch p.profile {
+	case "expired":
+		p.SetExpiration(time.Now().Add(-1*time.Minute), 0)
+	case "fail-refresh":
+		if p.calls > 1 {
+			return credentials.Value{}, errors.New("refresh failed")
+		}
+		p.SetExpiration(time.Now().Add(-1*time.Minute), 0)
+	default:
+		p.SetExpiration(time.Now().Add(1*time.Hour), 0)
+	}
+
+	return credentials.Value{AccessKeyID: "AKIAMOCK", SecretAccessKey: "MockSecret", ProviderName: "mock"}, nil
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// ProviderName is the name given to this AWS credential provider
+	ProviderName = "AgentProvider"
+
+	// the host part of the request URLs is ignored, since requests are sent to the Unix socket
+	agentUrl = "http://agent"
+)
+
+// Client makes requests to a credential agent listening on a Unix socket
+type Client struct {
+	// Socket is the path of the Unix socket the agent listens on
+	Socket     string
+	httpClient *http.Client
+}
+
+// NewClient creates a Client for the agent listening on the Unix socket.  Since the agent may need to load the
+// credentials of a profile before responding, requests time out after 1 minute.  The client only connects to a socket
+// owned by, and only accessible by, the current user.
+func NewClient(socket string) *Client {
+	t := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if err := checkSocketOwner(socket); err != nil {
+				return nil, err
+			}
+
+			d := net.Dialer{Timeout: time.Second}
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	return &Client{Socket: socket, httpClient: &http.Client{Transport: t, Timeout: 1 * time.Minute}}
+}
+
+// Running returns true if an agent is accepting connections on the socket, and the socket is owned by the current user
+func (c *Client) Running() bool {
+	if err := checkSocketOwner(c.Socket); err != nil {
+		return false
+	}
+
+	conn, err := net.DialTimeout("unix", c.Socket, time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// Credentials returns the credentials held by the agent for the profile, and their expiration time
+func (c *Client) Credentials(profile string) (credentials.Value, time.Time, error) {
+	r := new(credentialResponse)
+	if err := c.do(http.MethodGet, fmt.Sprintf("%s?profile=%s", credentialsPath, url.QueryEscape(profile)), r); err != nil {
+		return credentials.Value{}, time.Time{}, err
+	}
+
+	e, err := time.Parse(time.RFC3339, r.Expiration)
+	if err != nil {
+		return credentials.Value{}, time.Time{}, fmt.Errorf("invalid credential expiration: %v", err)
+	}
+
+	v := credentials.Value{
+		AccessKeyID:     r.AccessKeyId,
+		SecretAccessKey: r.SecretAccessKey,
+		SessionToken:    r.Token,
+		ProviderName:    ProviderName,
+	}
+	return v, e, nil
+}
+
+// Profiles returns the status of the credentials held by the agent
+func (c *Client) Profiles() ([]*ProfileStatus, error) {
+	p := make([]*ProfileStatus, 0)
+	if err := c.do(http.MethodGet, profilesPath, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Shutdown stops the agent
+func (c *Client) Shutdown() error {
+	return c.do(http.MethodPost, shutdownPath, nil)
+}
+
+func (c *Client) do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, agentUrl+path, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		e := new(errorResponse)
+		if err := json.Unmarshal(b, e); err != nil || len(e.Message) < 1 {
+			return fmt.Errorf("agent returned http status %d", res.StatusCode)
+		}
+		return fmt.Errorf("agent error: %s", e.Message)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Provider is an AWS credentials.Provider which retrieves the credentials for a profile from a credential agent
+type Provider struct {
+	credentials.Expiry
+	Client  *Client
+	Profile string
+}
+
+// NewCredentials wraps a Provider for the profile in an AWS credentials.Credentials object
+func NewCredentials(c *Client, profile string) *credentials.Credentials {
+	return credentials.NewCredentials(&Provider{Client: c, Profile: profile})
+}
+
+// Retrieve implements the AWS credentials.Provider interface to return the credentials held by the agent.  The
+// credentials expire when the agent will refresh them.
+func (p *Provider) Retrieve() (credentials.Value, error) {
+	v, e, err := p.Client.Credentials(p.Profile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	p.SetExpiration(e, 0)
+	return v, nil
+}
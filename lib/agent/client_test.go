@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	s := testSocket(t)
+	a, err := NewAgent(&AgentInput{Socket: s, Loader: staticLoader})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := a.Start(context.Background()); err != nil {
+		t.Error(err)
+		return
+	}
+	defer a.Shutdown(context.Background())
+
+	c := NewClient(s)
+
+	t.Run("running", func(t *testing.T) {
+		if !c.Running() {
+			t.Error("agent not running")
+		}
+	})
+
+	t.Run("credentials", func(t *testing.T) {
+		v, e, err := c.Credentials("p1")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if v.AccessKeyID != "AKIAMOCK" || v.SessionToken != "MockToken" || v.ProviderName != ProviderName || e.IsZero() {
+			t.Errorf("unexpected credentials: %+v %s", v, e)
+		}
+	})
+
+	t.Run("bad profile", func(t *testing.T) {
+		if _, _, err := c.Credentials("bad"); err == nil || !strings.Contains(err.Error(), "unknown profile") {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+
+	t.Run("provider", func(t *testing.T) {
+		cr := NewCredentials(c, "p2")
+		v, err := cr.Get()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if v.SecretAccessKey != "MockSecret" {
+			t.Errorf("unexpected credentials: %+v", v)
+		}
+
+		if e, err := cr.ExpiresAt(); err != nil || time.Since(e) > time.Minute {
+			t.Errorf("unexpected expiration: %s %v", e, err)
+		}
+	})
+
+	t.Run("profiles", func(t *testing.T) {
+		p, err := c.Profiles()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(p) != 2 || p[0].Profile != "p1" || p[1].Profile != "p2" {
+			t.Errorf("unexpected profiles: %+v", p)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		if err := c.Shutdown(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := a.Wait(); err != nil {
+			t.Error(err)
+		}
+
+		if c.Running() {
+			t.Error("agent still running")
+		}
+	})
+}
+
+func TestClient_NotRunning(t *testing.T) {
+	c := NewClient(testSocket(t))
+
+	if c.Running() {
+		t.Error("agent running")
+	}
+
+	if _, _, err := c.Credentials("p1"); err == nil {
+		t.Error("did not receive expected error")
+	}
+}
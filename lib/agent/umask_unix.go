@@ -0,0 +1,53 @@
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// withUmask runs f with the process umask set to mask, so the files f creates (like the agent socket) are never created
+// with looser permissions, even briefly
+func withUmask(mask int, f func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
+
+// checkSocketDir returns an error if the directory of the socket is writable by the group or other users, since they
+// would be able to replace the socket with their own
+func checkSocketDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("socket directory %s is writable by other users (mode %s)", dir, fi.Mode().Perm())
+	}
+	return nil
+}
+
+// checkSocketOwner returns an error if the socket is not a socket owned by the current user, and only accessible by the
+// user, so the client never trusts credentials from an agent run by another user
+func checkSocketOwner(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("socket %s is owned by another user (uid %d)", path, st.Uid)
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("socket %s is accessible by other users (mode %s)", path, fi.Mode().Perm())
+	}
+	return nil
+}
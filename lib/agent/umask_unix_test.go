@@ -0,0 +1,123 @@
+// +build !windows
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenPermissions(t *testing.T) {
+	d, err := ioutil.TempDir("", "agent-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	t.Run("socket mode", func(t *testing.T) {
+		l, err := listen(filepath.Join(d, "good", "agent.sock"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer l.Close()
+
+		fi, err := os.Stat(filepath.Join(d, "good", "agent.sock"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("unexpected socket mode: %s", fi.Mode().Perm())
+		}
+	})
+
+	t.Run("writable dir", func(t *testing.T) {
+		bad := filepath.Join(d, "bad")
+		if err := os.Mkdir(bad, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chmod(bad, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := listen(filepath.Join(bad, "agent.sock")); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("group writable parent", func(t *testing.T) {
+		// like ~/.aws with a umask of 002, the socket directory created in it is private
+		aws := filepath.Join(d, "aws")
+		if err := os.Mkdir(aws, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chmod(aws, 0775); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := listen(filepath.Join(aws, "runas-agent", "agent.sock"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer l.Close()
+
+		fi, err := os.Stat(filepath.Join(aws, "runas-agent"))
+		if err != nil || fi.Mode().Perm() != 0700 {
+			t.Errorf("unexpected socket directory mode: %v %v", fi, err)
+		}
+	})
+}
+
+func TestCheckSocketOwner(t *testing.T) {
+	d, err := ioutil.TempDir("", "agent-owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+
+	s := filepath.Join(d, "agent.sock")
+	l, err := listen(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	t.Run("good", func(t *testing.T) {
+		if err := checkSocketOwner(s); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		f := filepath.Join(d, "file")
+		if err := ioutil.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := checkSocketOwner(f); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("accessible by others", func(t *testing.T) {
+		if err := os.Chmod(s, 0666); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(s, 0600)
+
+		if err := checkSocketOwner(s); err == nil {
+			t.Error("did not receive expected error")
+		}
+
+		if NewClient(s).Running() {
+			t.Error("client trusted a socket accessible by other users")
+		}
+	})
+}
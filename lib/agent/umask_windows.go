@@ -0,0 +1,18 @@
+// +build windows
+
+package agent
+
+// withUmask runs f, since Windows has no umask
+func withUmask(mask int, f func() error) error {
+	return f()
+}
+
+// checkSocketDir does nothing on Windows, where access to the socket is controlled by the ACL of the directory
+func checkSocketDir(dir string) error {
+	return nil
+}
+
+// checkSocketOwner does nothing on Windows, where access to the socket is controlled by the ACL of the directory
+func checkSocketOwner(path string) error {
+	return nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"github.com/mmmorris1975/aws-config/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RoleHop is the configuration for assuming a single role in a role chain, using only the attributes set directly in
+// the profile for the role
+type RoleHop struct {
+	Profile           string
+	RoleArn           string
+	ExternalId        string
+	MfaSerial         string
+	Duration          time.Duration
+	RoleSessionName   string
+	SourceIdentity    string
+	SessionTags       map[string]string
+	TransitiveTagKeys []string
+	SessionPolicy     string
+	SessionPolicyArns []string
+}
+
+// RoleChain is the list of roles to assume, in order, to get credentials for a profile.  The credentials for
+// SourceProfile are used to assume the first role, and the credentials for each role are used to assume the next.
+type RoleChain struct {
+	SourceProfile string
+	Hops          []*RoleHop
+	// the configuration of each profile in the chain, starting with the source profile
+	Profiles []*config.AwsConfig
+}
+
+// ResolveRoleChain follows the source_profile attribute, starting at the given profile, until a profile without a
+// role_arn, or without a source_profile, is found.  A profile which sets source_profile to itself uses its own
+// credentials to assume its role.  An error is returned if the source_profile attributes form a loop.
+func ResolveRoleChain(p config.AwsConfigProvider, profile string) (*RoleChain, error) {
+	chain := new(RoleChain)
+	seen := make(map[string]bool)
+	path := make([]string, 0)
+
+	for name := profile; len(name) > 0; {
+		path = append(path, name)
+		if seen[name] {
+			return nil, fmt.Errorf("source_profile loop detected: %s", strings.Join(path, " -> "))
+		}
+		seen[name] = true
+
+		c, err := p.Config(name)
+		if err != nil {
+			return nil, err
+		}
+		chain.Profiles = append([]*config.AwsConfig{c}, chain.Profiles...)
+		chain.SourceProfile = name
+
+		if len(c.RoleArn) < 1 {
+			break
+		}
+
+		h, err := newRoleHop(c)
+		if err != nil {
+			return nil, err
+		}
+		chain.Hops = append([]*RoleHop{h}, chain.Hops...)
+
+		if c.SourceProfile == name {
+			break
+		}
+		name = c.SourceProfile
+	}
+
+	return chain, nil
+}
+
+func newRoleHop(c *config.AwsConfig) (*RoleHop, error) {
+	h := &RoleHop{
+		Profile:           c.Profile,
+		RoleArn:           c.RoleArn,
+		ExternalId:        c.ExternalId,
+		MfaSerial:         c.MfaSerial,
+		RoleSessionName:   c.RoleSessionName,
+		TransitiveTagKeys: splitList(c.Get("transitive_tag_keys")),
+		SessionPolicyArns: splitList(c.Get("session_policy_arns")),
+	}
+
+	tags, err := parseSessionTags(c.Get("session_tags"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid session_tags in profile %s: %v", c.Profile, err)
+	}
+	h.SessionTags = tags
+
+	if h.SessionPolicy, err = ReadSessionPolicy(c.Get("session_policy")); err != nil {
+		return nil, fmt.Errorf("invalid session_policy in profile %s: %v", c.Profile, err)
+	}
+
+	if v := c.Get("duration_seconds"); len(v) > 0 {
+		s, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration_seconds in profile %s: %v", c.Profile, err)
+		}
+		h.Duration = time.Duration(s) * time.Second
+	} else if v := c.Get("credentials_duration"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials_duration in profile %s: %v", c.Profile, err)
+		}
+		h.Duration = d
+	}
+
+	return h, nil
+}
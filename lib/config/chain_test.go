@@ -0,0 +1,80 @@
+package config
+
+import (
+	"github.com/mmmorris1975/aws-config/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveRoleChain(t *testing.T) {
+	p, err := config.NewIniConfigProvider("test/config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	t.Run("chain", func(t *testing.T) {
+		c, err := ResolveRoleChain(p, "workload")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c.SourceProfile != "simple" || len(c.Hops) != 3 || len(c.Profiles) != 4 || c.Profiles[0].Profile != "simple" {
+			t.Errorf("unexpected chain: %+v", c)
+			return
+		}
+
+		h := c.Hops
+		if h[0].Profile != "org_admin" || h[0].MfaSerial != "arn:aws:iam::1234567890:mfa/123456" || h[0].Duration != 4*time.Hour {
+			t.Errorf("unexpected first hop: %+v", h[0])
+		}
+
+		if h[1].RoleArn != "arn:aws:iam::2222222222:role/AccountAdmin" || h[1].ExternalId != "acct" || len(h[1].MfaSerial) > 0 ||
+			h[1].SessionTags["Account"] != "shared" || !strings.Contains(h[1].SessionPolicy, "ec2:Describe*") {
+			t.Errorf("unexpected second hop: %+v", h[1])
+		}
+
+		if h[2].Duration != 15*time.Minute || h[2].RoleSessionName != "deployer" {
+			t.Errorf("unexpected last hop: %+v", h[2])
+		}
+	})
+
+	t.Run("no role", func(t *testing.T) {
+		c, err := ResolveRoleChain(p, "simple")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c.SourceProfile != "simple" || len(c.Hops) != 0 {
+			t.Errorf("unexpected chain: %+v", c)
+		}
+	})
+
+	t.Run("self source profile", func(t *testing.T) {
+		c, err := ResolveRoleChain(p, "self")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c.SourceProfile != "self" || len(c.Hops) != 1 || len(c.Profiles) != 1 {
+			t.Errorf("unexpected chain: %+v", c)
+		}
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		_, err := ResolveRoleChain(p, "loop_a")
+		if err == nil || !strings.Contains(err.Error(), "loop_a -> loop_b -> loop_a") {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+
+	t.Run("missing profile", func(t *testing.T) {
+		if _, err := ResolveRoleChain(p, "nope"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
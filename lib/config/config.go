@@ -1,11 +1,29 @@
 package config
 
 import (
+	"aws-runas/lib/httpclient"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/mmmorris1975/aws-config/config"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+)
+
+const (
+	// DefaultExpiryWarnings is the list of times before expiration to warn about expiring credentials, if the
+	// expiry_warnings attribute is not set
+	DefaultExpiryWarnings = "10m,2m"
+	// DefaultExpiryReauth is the time before expiration to renew credentials which need user interaction, if the
+	// expiry_reauth attribute is not set
+	DefaultExpiryReauth = 5 * time.Minute
 )
 
 // AwsConfig extends aws-config/config.AwsConfig and adds attributes "non-standard" config items
@@ -17,14 +35,101 @@ type AwsConfig struct {
 	SamlAuthUrl          *url.URL
 	SamlUsername         string
 	SamlProvider         string
+	SsmPortForwards      []string
+	SsmRecordDir         string
+	SsmRecordInput       bool
+	SessionTags          map[string]string
+	TransitiveTagKeys    []string
+	SourceIdentity       string
+	SessionPolicy        string
+	SessionPolicyArns    []string
+	StsRegionalEndpoints endpoints.STSRegionalEndpoint
+	StsEndpointUrl       string
+	SamlStsEndpoint      string
+	SamlClientCert       string
+	SamlClientKey        string
+	HttpTimeout          time.Duration
+	HttpConnectTimeout   time.Duration
+	ExpiryWarnings       []time.Duration
+	ExpiryReauth         time.Duration
+	ExpiryNotifyCommand  string
+	Ec2InstanceId        string
+	Ec2Region            string
+	Ec2AvailabilityZone  string
 }
 
 // Wrap converts an aws-config/config.AwsConfig type to our local AwsConfig type
 func Wrap(c *config.AwsConfig) (*AwsConfig, error) {
 	t := AwsConfig{
-		AwsConfig:    c,
-		SamlUsername: c.Get("saml_username"),
-		SamlProvider: strings.ToLower(c.Get("saml_provider")),
+		AwsConfig:       c,
+		SamlUsername:    c.Get("saml_username"),
+		SamlProvider:    strings.ToLower(c.Get("saml_provider")),
+		SsmRecordDir:    c.Get("ssm_record_dir"),
+		SourceIdentity:  c.Get("source_identity"),
+		StsEndpointUrl:  c.Get("sts_endpoint_url"),
+		SamlStsEndpoint: c.Get("saml_sts_endpoint"),
+		SamlClientCert:  c.Get("saml_client_cert"),
+		SamlClientKey:   c.Get("saml_client_key"),
+		ExpiryReauth:    DefaultExpiryReauth,
+
+		Ec2InstanceId:       c.Get("ec2_instance_id"),
+		Ec2Region:           c.Get("ec2_region"),
+		Ec2AvailabilityZone: c.Get("ec2_availability_zone"),
+	}
+
+	t.ExpiryNotifyCommand = strings.TrimSpace(c.Get("expiry_notify_command"))
+
+	durations := map[string]*time.Duration{
+		"http_timeout":         &t.HttpTimeout,
+		"http_connect_timeout": &t.HttpConnectTimeout,
+		"expiry_reauth":        &t.ExpiryReauth,
+	}
+
+	for k, d := range durations {
+		if v := c.Get(k); len(v) > 0 {
+			td, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value '%s': %v", k, v, err)
+			}
+			*d = td
+		}
+	}
+
+	if v := c.Get("ssm_record_input"); len(v) > 0 {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssm_record_input value '%s': %v", v, err)
+		}
+		t.SsmRecordInput = b
+	}
+
+	if v := c.Get("sts_regional_endpoints"); len(v) > 0 {
+		e, err := endpoints.GetSTSRegionalEndpoint(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sts_regional_endpoints value '%s', must be legacy or regional", v)
+		}
+		t.StsRegionalEndpoints = e
+	}
+
+	w, err := parseExpiryWarnings(c.Get("expiry_warnings"))
+	if err != nil {
+		return nil, err
+	}
+	t.ExpiryWarnings = w
+
+	// list of local:target:remote port mappings, separated by commas or whitespace
+	t.SsmPortForwards = splitList(c.Get("ssm_port_forwards"))
+	t.TransitiveTagKeys = splitList(c.Get("transitive_tag_keys"))
+
+	tags, err := parseSessionTags(c.Get("session_tags"))
+	if err != nil {
+		return nil, err
+	}
+	t.SessionTags = tags
+
+	t.SessionPolicyArns = splitList(c.Get("session_policy_arns"))
+	if t.SessionPolicy, err = ReadSessionPolicy(c.Get("session_policy")); err != nil {
+		return nil, err
 	}
 
 	if c.DurationSeconds < 1 {
@@ -62,3 +167,115 @@ func Wrap(c *config.AwsConfig) (*AwsConfig, error) {
 
 	return &t, nil
 }
+
+// parseExpiryWarnings parses the list of durations in the expiry_warnings attribute, sorted from longest to shortest.
+// Durations less than or equal to 0 are dropped, so setting the attribute to 0s disables the warnings.
+func parseExpiryWarnings(s string) ([]time.Duration, error) {
+	if len(strings.TrimSpace(s)) < 1 {
+		s = DefaultExpiryWarnings
+	}
+
+	w := make([]time.Duration, 0)
+	for _, v := range splitList(s) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry_warnings value '%s': %v", v, err)
+		}
+
+		if d > 0 {
+			w = append(w, d)
+		}
+	}
+
+	sort.Slice(w, func(i, j int) bool { return w[i] > w[j] })
+	return w, nil
+}
+
+// splitList splits a config attribute value containing a list of items separated by commas or whitespace
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// HttpClientOptions returns the settings for the HTTP clients used to communicate with the SAML identity provider.  The
+// AWS_CA_BUNDLE environment variable takes precedence over the ca_bundle attribute, like the AWS SDK.
+func (c *AwsConfig) HttpClientOptions() *httpclient.Options {
+	o := &httpclient.Options{
+		ClientCert:     c.SamlClientCert,
+		ClientKey:      c.SamlClientKey,
+		ConnectTimeout: c.HttpConnectTimeout,
+		Timeout:        c.HttpTimeout,
+	}
+
+	if c.AwsConfig != nil {
+		o.CaBundle = c.CaBundle
+	}
+
+	if v, ok := os.LookupEnv(httpclient.CaBundleEnvVar); ok {
+		o.CaBundle = v
+	}
+
+	// paths which can not be expanded are left as-is, and are reported when the files are loaded
+	for _, p := range []*string{&o.CaBundle, &o.ClientCert, &o.ClientKey} {
+		if v, err := ExpandHome(*p); err == nil {
+			*p = v
+		}
+	}
+
+	return o
+}
+
+// ReadSessionPolicy returns the inline session policy for a session_policy config attribute value, which is either the
+// JSON policy document, or the path to a file containing the policy document
+func ReadSessionPolicy(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 1 || strings.HasPrefix(s, "{") {
+		return s, nil
+	}
+
+	s, err := ExpandHome(s)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadFile(s)
+	if err != nil {
+		return "", fmt.Errorf("unable to read session policy: %v", err)
+	}
+	return string(b), nil
+}
+
+// ExpandHome returns the path p with a leading ~/ replaced by the user's home directory
+func ExpandHome(p string) (string, error) {
+	if !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+
+	h, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(h, p[2:]), nil
+}
+
+// parseSessionTags parses a list of key=value session tags separated by commas.  Whitespace around the keys and values
+// is ignored, since tag values may contain spaces.
+func parseSessionTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for _, t := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(t)) < 1 {
+			continue
+		}
+
+		kv := strings.SplitN(t, "=", 2)
+		k := strings.TrimSpace(kv[0])
+		if len(kv) < 2 || len(k) < 1 {
+			return nil, fmt.Errorf("invalid session tag '%s', must be key=value", strings.TrimSpace(t))
+		}
+		tags[k] = strings.TrimSpace(kv[1])
+	}
+
+	return tags, nil
+}
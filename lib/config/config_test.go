@@ -1,7 +1,11 @@
 package config
 
 import (
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/mmmorris1975/aws-config/config"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,6 +36,28 @@ func TestWrap(t *testing.T) {
 		}
 	})
 
+	t.Run("ssm", func(t *testing.T) {
+		c, err := r.Resolve("simple")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(w.SsmPortForwards) != 2 || w.SsmPortForwards[1] != "2222:tag:Role=bastion:22" {
+			t.Errorf("unexpected port forwards: %v", w.SsmPortForwards)
+		}
+
+		if w.SsmRecordDir != "/var/log/aws-runas" || !w.SsmRecordInput {
+			t.Errorf("unexpected recording settings: %s %t", w.SsmRecordDir, w.SsmRecordInput)
+		}
+	})
+
 	t.Run("iam", func(t *testing.T) {
 		c, err := r.Resolve("iam")
 		if err != nil {
@@ -51,6 +77,168 @@ func TestWrap(t *testing.T) {
 		}
 	})
 
+	t.Run("session tags", func(t *testing.T) {
+		c, err := r.Resolve("iam")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(w.SessionTags) != 2 || w.SessionTags["Project"] != "aws runas" || w.SessionTags["CostCenter"] != "1234" {
+			t.Errorf("unexpected session tags: %v", w.SessionTags)
+		}
+
+		if len(w.TransitiveTagKeys) != 1 || w.TransitiveTagKeys[0] != "Project" {
+			t.Errorf("unexpected transitive tag keys: %v", w.TransitiveTagKeys)
+		}
+	})
+
+	t.Run("sts endpoints", func(t *testing.T) {
+		c, err := r.Resolve("vpce")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if w.StsRegionalEndpoints != endpoints.RegionalSTSEndpoint ||
+			w.StsEndpointUrl != "https://vpce-0123-abcd.sts.us-west-1.vpce.amazonaws.com" ||
+			w.SamlStsEndpoint != "https://vpce-4567-efgh.sts.us-west-1.vpce.amazonaws.com" {
+			t.Errorf("unexpected sts endpoints: %v %s %s", w.StsRegionalEndpoints, w.StsEndpointUrl, w.SamlStsEndpoint)
+		}
+	})
+
+	t.Run("bad sts regional endpoints", func(t *testing.T) {
+		c, err := r.Resolve("bad_sts")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, err := Wrap(c); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("http options", func(t *testing.T) {
+		c, err := r.Resolve("http")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if v, ok := os.LookupEnv("AWS_CA_BUNDLE"); ok {
+			defer os.Setenv("AWS_CA_BUNDLE", v)
+		} else {
+			defer os.Unsetenv("AWS_CA_BUNDLE")
+		}
+		os.Unsetenv("AWS_CA_BUNDLE")
+
+		h, _ := os.UserHomeDir()
+		o := w.HttpClientOptions()
+		if o.CaBundle != "/etc/pki/corp-ca.pem" || o.ClientCert != filepath.Join(h, ".aws", "idp-client.pem") ||
+			o.ClientKey != filepath.Join(h, ".aws", "idp-client.key") || o.Timeout != 45*time.Second || o.ConnectTimeout != 5*time.Second {
+			t.Errorf("unexpected http options: %+v", o)
+		}
+
+		os.Setenv("AWS_CA_BUNDLE", "/tmp/ca.pem")
+
+		if o := w.HttpClientOptions(); o.CaBundle != "/tmp/ca.pem" {
+			t.Errorf("environment did not override ca bundle: %s", o.CaBundle)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		c, err := r.Resolve("expiry")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(w.ExpiryWarnings) != 2 || w.ExpiryWarnings[0] != 15*time.Minute || w.ExpiryWarnings[1] != 1*time.Minute {
+			t.Errorf("unexpected expiry warnings: %v", w.ExpiryWarnings)
+		}
+
+		if w.ExpiryReauth != 0 || w.ExpiryNotifyCommand != "notify-send aws-runas" {
+			t.Errorf("unexpected expiry settings: %s '%s'", w.ExpiryReauth, w.ExpiryNotifyCommand)
+		}
+	})
+
+	t.Run("ec2 identity", func(t *testing.T) {
+		c, err := r.Resolve("ec2")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if w.Ec2InstanceId != "i-0123456789abcdef0" || w.Ec2AvailabilityZone != "us-west-2c" || len(w.Ec2Region) > 0 {
+			t.Errorf("unexpected ec2 identity: '%s' '%s' '%s'", w.Ec2InstanceId, w.Ec2Region, w.Ec2AvailabilityZone)
+		}
+	})
+
+	t.Run("bad http timeout", func(t *testing.T) {
+		c, err := r.Resolve("bad_http")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, err := Wrap(c); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("session policy", func(t *testing.T) {
+		c, err := r.Resolve("iam")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w, err := Wrap(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !strings.HasPrefix(w.SessionPolicy, `{"Version": "2012-10-17"`) {
+			t.Errorf("unexpected session policy: %s", w.SessionPolicy)
+		}
+
+		if len(w.SessionPolicyArns) != 2 || w.SessionPolicyArns[1] != "arn:aws:iam::1234567890:policy/Extra" {
+			t.Errorf("unexpected session policy arns: %v", w.SessionPolicyArns)
+		}
+	})
+
 	t.Run("override", func(t *testing.T) {
 		c, err := r.Resolve("duration_override")
 		if err != nil {
@@ -90,3 +278,99 @@ func TestWrap(t *testing.T) {
 		}
 	})
 }
+
+func TestParseExpiryWarnings(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		w, err := parseExpiryWarnings("")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(w) != 2 || w[0] != 10*time.Minute || w[1] != 2*time.Minute {
+			t.Errorf("unexpected expiry warnings: %v", w)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		if w, err := parseExpiryWarnings("0s"); err != nil || len(w) > 0 {
+			t.Errorf("unexpected expiry warnings: %v %v", w, err)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		if _, err := parseExpiryWarnings("10m,soon"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestReadSessionPolicy(t *testing.T) {
+	t.Run("inline", func(t *testing.T) {
+		p, err := ReadSessionPolicy(` {"Version": "2012-10-17"} `)
+		if err != nil || p != `{"Version": "2012-10-17"}` {
+			t.Errorf("unexpected policy: %s %v", p, err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		p, err := ReadSessionPolicy("test/policy.json")
+		if err != nil || !strings.Contains(p, "ec2:Describe*") {
+			t.Errorf("unexpected policy: %s %v", p, err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := ReadSessionPolicy("test/nope.json"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestExpandHome(t *testing.T) {
+	h, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	m := map[string]string{
+		"~/.aws/idp-client.pem": filepath.Join(h, ".aws", "idp-client.pem"),
+		"/etc/pki/corp-ca.pem":  "/etc/pki/corp-ca.pem",
+		"certs/~/client.pem":    "certs/~/client.pem",
+		"":                      "",
+	}
+
+	for k, v := range m {
+		if p, err := ExpandHome(k); err != nil || p != v {
+			t.Errorf("%s: expected %s, got %s %v", k, v, p, err)
+		}
+	}
+}
+
+func TestParseSessionTags(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		tags, err := parseSessionTags(" a=1,b = x y ,, c=")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(tags) != 3 || tags["a"] != "1" || tags["b"] != "x y" || tags["c"] != "" {
+			t.Errorf("unexpected tags: %v", tags)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if tags, err := parseSessionTags(""); err != nil || len(tags) > 0 {
+			t.Errorf("unexpected tags: %v %v", tags, err)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		for _, s := range []string{"a", "a=1,b", "=1"} {
+			if _, err := parseSessionTags(s); err == nil {
+				t.Errorf("did not receive expected error for %s", s)
+			}
+		}
+	})
+}
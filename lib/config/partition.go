@@ -0,0 +1,43 @@
+package config
+
+import (
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// the region used for API calls in each partition, if the configured region is not in the partition
+var partitionRegions = map[string]string{
+	endpoints.AwsPartitionID:      endpoints.UsEast1RegionID,
+	endpoints.AwsCnPartitionID:    endpoints.CnNorth1RegionID,
+	endpoints.AwsUsGovPartitionID: endpoints.UsGovWest1RegionID,
+	endpoints.AwsIsoPartitionID:   endpoints.UsIsoEast1RegionID,
+	endpoints.AwsIsoBPartitionID:  endpoints.UsIsobEast1RegionID,
+}
+
+// ArnPartition returns the partition of the ARN (like aws, aws-us-gov, or aws-cn), or an empty string if the value is
+// not a valid ARN
+func ArnPartition(s string) string {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return a.Partition
+}
+
+// RegionPartition returns the partition containing the region, or an empty string if the region is not known
+func RegionPartition(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	return ""
+}
+
+// PartitionRegion returns the region to use for API calls in the partition.  The region is returned as-is if it is in the
+// partition, or if the partition is empty or unknown, otherwise the default region of the partition is returned.
+func PartitionRegion(partition, region string) string {
+	r, ok := partitionRegions[partition]
+	if !ok || (len(region) > 0 && RegionPartition(region) == partition) {
+		return region
+	}
+	return r
+}
@@ -0,0 +1,59 @@
+package config
+
+import "testing"
+
+func TestArnPartition(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:iam::1234567890:role/Admin":        "aws",
+		"arn:aws-us-gov:iam::1234567890:role/Admin": "aws-us-gov",
+		"arn:aws-cn:iam::1234567890:role/Admin":     "aws-cn",
+		"Admin":                                     "",
+	}
+
+	for a, p := range tests {
+		if v := ArnPartition(a); v != p {
+			t.Errorf("unexpected partition for %s: %s", a, v)
+		}
+	}
+}
+
+func TestRegionPartition(t *testing.T) {
+	tests := map[string]string{
+		"us-east-2":      "aws",
+		"eu-west-1":      "aws",
+		"us-gov-west-1":  "aws-us-gov",
+		"us-gov-east-1":  "aws-us-gov",
+		"cn-north-1":     "aws-cn",
+		"cn-northwest-1": "aws-cn",
+		"":               "",
+	}
+
+	for r, p := range tests {
+		if v := RegionPartition(r); v != p {
+			t.Errorf("unexpected partition for %s: %s", r, v)
+		}
+	}
+}
+
+func TestPartitionRegion(t *testing.T) {
+	tests := []struct {
+		partition, region, want string
+	}{
+		{"aws", "us-west-2", "us-west-2"},
+		{"aws", "", "us-east-1"},
+		{"aws", "us-gov-west-1", "us-east-1"},
+		{"aws-us-gov", "us-gov-east-1", "us-gov-east-1"},
+		{"aws-us-gov", "us-east-1", "us-gov-west-1"},
+		{"aws-us-gov", "", "us-gov-west-1"},
+		{"aws-cn", "cn-northwest-1", "cn-northwest-1"},
+		{"aws-cn", "eu-west-1", "cn-north-1"},
+		{"", "eu-west-1", "eu-west-1"},
+		{"unknown", "eu-west-1", "eu-west-1"},
+	}
+
+	for _, tc := range tests {
+		if v := PartitionRegion(tc.partition, tc.region); v != tc.want {
+			t.Errorf("unexpected region for %s %s: %s", tc.partition, tc.region, v)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package credentials
 
 import (
 	"aws-runas/lib/cache"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"sort"
 	"time"
 )
 
@@ -18,15 +20,26 @@ const (
 	AssumeRoleMaxDuration = 12 * time.Hour
 	// AssumeRoleDefaultDuration is a sensible default value for Assume Role credential duration
 	AssumeRoleDefaultDuration = 1 * time.Hour
+	// SessionTagsMax is the maximum number of session tags allowed by the AWS API
+	SessionTagsMax = 50
 )
 
 // AssumeRoleProvider provides the settings to perform the AssumeRole operation in the AWS API.
 // An optional Cache provides the ability to cache the credentials in order to limit API calls.
+// Tags are passed as session tags, and TransitiveTagKeys are the keys of the session tags which
+// are passed on to roles assumed using these credentials.  If set, SourceIdentity is recorded in
+// CloudTrail for this session, and any role sessions created using these credentials.  The inline
+// Policy and managed PolicyArns session policies limit the permissions of the role session.
 type AssumeRoleProvider struct {
 	*stsCredentialProvider
-	RoleARN         string
-	RoleSessionName string
-	ExternalID      string
+	RoleARN           string
+	RoleSessionName   string
+	ExternalID        string
+	Tags              map[string]string
+	TransitiveTagKeys []string
+	SourceIdentity    string
+	Policy            string
+	PolicyArns        []string
 }
 
 // NewAssumeRoleCredentials configures a default AssumeRoleProvider, and wraps it in an AWS credentials.Credentials object
@@ -85,6 +98,18 @@ func (p *AssumeRoleProvider) retrieve() (*cache.CacheableCredentials, error) {
 		p.Duration = AssumeRoleDefaultDuration
 	}
 
+	if len(p.RoleSessionName) > 0 {
+		if err := ValidateSessionName(p.RoleSessionName); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p.SourceIdentity) > 0 {
+		if err := ValidateSessionName(p.SourceIdentity); err != nil {
+			return nil, fmt.Errorf("invalid source identity: %v", err)
+		}
+	}
+
 	i := new(sts.AssumeRoleInput).SetDurationSeconds(p.validateDuration(p.Duration)).SetRoleArn(p.RoleARN).
 		SetRoleSessionName(p.RoleSessionName)
 
@@ -92,6 +117,20 @@ func (p *AssumeRoleProvider) retrieve() (*cache.CacheableCredentials, error) {
 		i.ExternalId = aws.String(p.ExternalID)
 	}
 
+	if len(p.Tags) > 0 || len(p.TransitiveTagKeys) > 0 {
+		tags, err := sessionTags(p.Tags, p.TransitiveTagKeys)
+		if err != nil {
+			return nil, err
+		}
+		i.SetTags(tags).SetTransitiveTagKeys(aws.StringSlice(p.TransitiveTagKeys))
+	}
+
+	var err error
+	i.Policy, i.PolicyArns, err = sessionPolicy(p.Policy, p.PolicyArns)
+	if err != nil {
+		return nil, err
+	}
+
 	t, err := p.handleMfa()
 	if err != nil {
 		return nil, err
@@ -113,8 +152,13 @@ func (p *AssumeRoleProvider) retrieve() (*cache.CacheableCredentials, error) {
 }
 
 // AssumeRole implements the AssumeRoler interface, calling the AssumeRole method on the underlying client
-// using the provided AssumeRoleInput
+// using the provided AssumeRoleInput, and adding the SourceIdentity to the request, if set
 func (p *AssumeRoleProvider) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	if len(p.SourceIdentity) > 0 {
+		req, out := p.client.AssumeRoleRequest(input)
+		req.Handlers.Build.PushBackNamed(sourceIdentityHandler(p.SourceIdentity))
+		return out, req.Send()
+	}
 	return p.client.AssumeRole(input)
 }
 
@@ -135,3 +179,36 @@ func (p *AssumeRoleProvider) validateDuration(d time.Duration) int64 {
 
 	return s
 }
+
+// sessionTags converts the tags to the AssumeRole API type, sorted by key, and checks the tags against the limits of the
+// AWS API.  Every transitive tag key must be one of the session tags.
+func sessionTags(tags map[string]string, transitive []string) ([]*sts.Tag, error) {
+	if len(tags) > SessionTagsMax {
+		return nil, fmt.Errorf("too many session tags, the maximum is %d", SessionTagsMax)
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if len(k) < 1 || len(k) > 128 {
+			return nil, fmt.Errorf("invalid session tag key '%s', must be 1 to 128 characters", k)
+		}
+
+		if len(v) > 256 {
+			return nil, fmt.Errorf("invalid value for session tag '%s', must be at most 256 characters", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range transitive {
+		if _, ok := tags[k]; !ok {
+			return nil, fmt.Errorf("transitive tag key '%s' is not a session tag", k)
+		}
+	}
+
+	t := make([]*sts.Tag, len(keys))
+	for i, k := range keys {
+		t[i] = new(sts.Tag).SetKey(k).SetValue(tags[k])
+	}
+	return t, nil
+}
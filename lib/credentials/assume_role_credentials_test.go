@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/awstesting/mock"
+	"strings"
 	"testing"
 	"time"
 )
@@ -240,6 +241,146 @@ func TestAssumeRoleProvider_RetrieveMfa(t *testing.T) {
 	})
 }
 
+func TestAssumeRoleProvider_RetrieveTags(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.Tags = map[string]string{"Project": "runas", "CostCenter": "1234"}
+		p.TransitiveTagKeys = []string{"Project"}
+
+		c, err := p.Retrieve()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !c.HasKeys() {
+			t.Error("bad keys")
+		}
+	})
+
+	t.Run("bad transitive key", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.Tags = map[string]string{"Project": "runas"}
+		p.TransitiveTagKeys = []string{"Team"}
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestAssumeRoleProvider_RetrieveSourceIdentity(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.RoleSessionName = "bob@example.org"
+		p.SourceIdentity = "ItsAllGood"
+
+		c, err := p.Retrieve()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !c.HasKeys() {
+			t.Error("bad keys")
+		}
+	})
+
+	t.Run("wrong", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.SourceIdentity = "ItsNotGood"
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.SourceIdentity = "bob smith"
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("invalid session name", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.RoleSessionName = strings.Repeat("a", 65)
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestAssumeRoleProvider_RetrievePolicy(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.Policy = `{"Version": "2012-10-17", "Statement": []}`
+		p.PolicyArns = []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}
+
+		if _, err := p.Retrieve(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("bad policy", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.Policy = `{"Version": "2012-10-17"`
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad arn", func(t *testing.T) {
+		p := newAssumeRoleProvider()
+		p.PolicyArns = []string{"ReadOnlyAccess"}
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestSessionTags(t *testing.T) {
+	t.Run("sorted", func(t *testing.T) {
+		tags, err := sessionTags(map[string]string{"b": "2", "a": "1", "c": ""}, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(tags) != 3 || *tags[0].Key != "a" || *tags[0].Value != "1" || *tags[2].Key != "c" {
+			t.Errorf("unexpected tags: %v", tags)
+		}
+	})
+
+	t.Run("too many", func(t *testing.T) {
+		m := make(map[string]string)
+		for i := 0; i <= SessionTagsMax; i++ {
+			m[fmt.Sprintf("k%d", i)] = "v"
+		}
+
+		if _, err := sessionTags(m, nil); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("long key", func(t *testing.T) {
+		if _, err := sessionTags(map[string]string{strings.Repeat("k", 129): "v"}, nil); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("long value", func(t *testing.T) {
+		if _, err := sessionTags(map[string]string{"k": strings.Repeat("v", 257)}, nil); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
 func newAssumeRoleProvider() *AssumeRoleProvider {
 	p := &AssumeRoleProvider{
 		stsCredentialProvider: newStsCredentialProvider(mock.Session),
@@ -6,8 +6,12 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/mock"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"io/ioutil"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -49,10 +53,50 @@ func (m *stsMock) AssumeRole(in *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, er
 		}
 	}
 
+	for _, t := range in.Tags {
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	out := new(sts.AssumeRoleOutput).SetCredentials(m.buildCreds(in.DurationSeconds))
 	return out, nil
 }
 
+// AssumeRoleRequest builds the request using an STS client, but checks the SourceIdentity parameter added to the request
+// body, and returns the credentials, instead of sending the request
+func (m *stsMock) AssumeRoleRequest(in *sts.AssumeRoleInput) (*request.Request, *sts.AssumeRoleOutput) {
+	req, out := sts.New(mock.Session, aws.NewConfig().WithRegion("us-east-1")).AssumeRoleRequest(in)
+	req.Handlers.Sign.Clear()
+	req.Handlers.Send.Clear()
+	req.Handlers.ValidateResponse.Clear()
+	req.Handlers.UnmarshalMeta.Clear()
+	req.Handlers.Unmarshal.Clear()
+	req.Handlers.UnmarshalError.Clear()
+
+	req.Handlers.Send.PushBack(func(r *request.Request) {
+		b, err := ioutil.ReadAll(r.GetBody())
+		if err != nil {
+			r.Error = err
+			return
+		}
+
+		v, err := url.ParseQuery(string(b))
+		if err != nil {
+			r.Error = err
+			return
+		}
+
+		if v.Get("SourceIdentity") != "ItsAllGood" || v.Get("RoleArn") != *in.RoleArn {
+			r.Error = fmt.Errorf("invalid SourceIdentity")
+			return
+		}
+		out.SetCredentials(m.buildCreds(in.DurationSeconds))
+	})
+
+	return req, out
+}
+
 func (m *stsMock) AssumeRoleWithSAML(in *sts.AssumeRoleWithSAMLInput) (*sts.AssumeRoleWithSAMLOutput, error) {
 	if err := m.validateDuration(in.DurationSeconds, AssumeRoleMaxDuration); err != nil {
 		return nil, err
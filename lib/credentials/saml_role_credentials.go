@@ -22,6 +22,7 @@ type SamlRoleProvider struct {
 	*AssumeRoleProvider
 	principalArn  string
 	SAMLAssertion string
+	assertion     string // replaces SAMLAssertion, see RenewWithAssertion()
 }
 
 // NewSamlRoleCredentials configures a default SamlRoleProvider, and wraps it in an AWS credentials.Credentials object
@@ -51,6 +52,14 @@ func NewSamlRoleCredentials(cfg client.ConfigProvider, roleArn string, saml stri
 // are expired, the credentials will be refreshed, and stored back in the cache.
 func (p *SamlRoleProvider) Retrieve() (credentials.Value, error) {
 	var err error
+
+	p.renewMu.Lock()
+	if len(p.assertion) > 0 {
+		p.SAMLAssertion = p.assertion
+		p.assertion = ""
+	}
+	p.renewMu.Unlock()
+
 	creds := p.checkCache()
 
 	if p.IsExpired() {
@@ -79,6 +88,17 @@ func (p *SamlRoleProvider) Retrieve() (credentials.Value, error) {
 	return v, nil
 }
 
+// RenewWithAssertion makes the next Retrieve() get new credentials from AWS using the SAML assertion, like Renew().
+// Since a SAML assertion is only valid for a few minutes after it's issued, this allows credentials to be renewed after
+// the assertion used to create the provider has expired.
+func (p *SamlRoleProvider) RenewWithAssertion(saml string) {
+	p.renewMu.Lock()
+	defer p.renewMu.Unlock()
+
+	p.assertion = saml
+	p.renew = true
+}
+
 func (p *SamlRoleProvider) retrieve() (*cache.CacheableCredentials, error) {
 	if p.Duration < 1 {
 		p.Duration = AssumeRoleDefaultDuration
@@ -87,7 +107,23 @@ func (p *SamlRoleProvider) retrieve() (*cache.CacheableCredentials, error) {
 	i := new(sts.AssumeRoleWithSAMLInput).SetDurationSeconds(p.validateDuration(p.Duration)).SetRoleArn(p.RoleARN).
 		SetPrincipalArn(p.principalArn).SetSAMLAssertion(p.SAMLAssertion)
 
-	// unlike plain AssumeRole, we don't (can't!) check MFA with the SAML request
+	var err error
+	i.Policy, i.PolicyArns, err = sessionPolicy(p.Policy, p.PolicyArns)
+	if err != nil {
+		return nil, err
+	}
+
+	// unlike plain AssumeRole, we don't (can't!) check MFA with the SAML request.  Session tags and source identity can't
+	// be sent with the SAML request either, they must be provided by the identity provider as attributes in the SAML
+	// assertion
+	if len(p.Tags) > 0 {
+		p.debug("session tags are not supported by AssumeRoleWithSAML, ignoring")
+	}
+
+	if len(p.SourceIdentity) > 0 {
+		p.debug("source identity is not supported by AssumeRoleWithSAML, ignoring")
+	}
+
 	o, err := p.client.AssumeRoleWithSAML(i)
 	if err != nil {
 		return nil, err
@@ -99,7 +135,7 @@ func (p *SamlRoleProvider) retrieve() (*cache.CacheableCredentials, error) {
 }
 
 func (p *SamlRoleProvider) setPrincipalArn() {
-	re, err := regexp.Compile(`>(arn:aws:iam::\d+:role/.*?),(arn:aws:iam::\d+:saml-provider/.*?)<`)
+	re, err := regexp.Compile(`>(arn:aws[\w-]*:iam::\d+:role/.*?),(arn:aws[\w-]*:iam::\d+:saml-provider/.*?)<`)
 	if err != nil {
 		return
 	}
@@ -80,6 +80,44 @@ func TestSamlRoleProvider_RetrieveNoCache(t *testing.T) {
 		}
 	})
 
+	t.Run("session policy", func(t *testing.T) {
+		p := newSamlRoleProvider()
+		p.Policy = `{"Version": "2012-10-17", "Statement": []}`
+		p.PolicyArns = []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}
+
+		if _, err := p.Retrieve(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid session policy", func(t *testing.T) {
+		p := newSamlRoleProvider()
+		p.Policy = "Allow everything"
+
+		if _, err := p.Retrieve(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	for _, part := range []string{"aws-us-gov", "aws-cn"} {
+		t.Run(part, func(t *testing.T) {
+			p := newSamlRoleProvider()
+			p.RoleARN = fmt.Sprintf("arn:%s:iam::1234567890:role/Admin", part)
+			princ := fmt.Sprintf("arn:%s:iam::1234567890:saml-provider/mySAML", part)
+			p.SAMLAssertion = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(">%s,%s<", p.RoleARN, princ)))
+			p.setPrincipalArn()
+
+			if p.principalArn != princ {
+				t.Errorf("unexpected principal: %s", p.principalArn)
+				return
+			}
+
+			if _, err := p.Retrieve(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
 	t.Run("invalid principal", func(t *testing.T) {
 		p := newSamlRoleProvider()
 		p.principalArn = "arn:aws:iam::1234567890:role/PowerUser"
@@ -195,6 +233,32 @@ func TestSamlRoleProvider_RetrieveCache(t *testing.T) {
 	})
 }
 
+func TestSamlRoleProvider_RenewWithAssertion(t *testing.T) {
+	p := newSamlRoleProvider()
+	if _, err := p.Retrieve(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	data := fmt.Sprintf(">%s,%s<renewed", p.RoleARN, p.principalArn)
+	saml := base64.StdEncoding.EncodeToString([]byte(data))
+	p.RenewWithAssertion(saml)
+
+	// the assertion is only used by the next call to Retrieve()
+	if p.SAMLAssertion == saml {
+		t.Error("assertion replaced before retrieve")
+	}
+
+	if _, err := p.Retrieve(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if p.SAMLAssertion != saml || len(p.assertion) > 0 || p.IsExpired() {
+		t.Error("credentials not renewed with the new assertion")
+	}
+}
+
 func newSamlRoleProvider() *SamlRoleProvider {
 	princArn := "arn:aws:iam::1234567890:saml-provider/mySAML"
 
@@ -0,0 +1,87 @@
+package credentials
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// the character set and length allowed by the AWS API for role session names and source identities
+var sessionNameRe = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// SessionNameData is the data available to the role_session_name and source_identity templates
+type SessionNameData struct {
+	Username string
+	Hostname string
+	Profile  string
+}
+
+// NewSessionNameData returns the template data for the username and profile, using the short name of the local host
+func NewSessionNameData(username, profile string) *SessionNameData {
+	h, _ := os.Hostname()
+	if i := strings.Index(h, "."); i > 0 {
+		h = h[:i]
+	}
+	return &SessionNameData{Username: username, Hostname: h, Profile: profile}
+}
+
+// ExpandSessionName executes the template, using placeholders like {{.Username}}, {{.Hostname}}, and {{.Profile}}, and
+// validates the result against the AWS API rules for role session names and source identities.  A value without any
+// placeholders is returned as-is, after validation.
+func ExpandSessionName(tmpl string, data *SessionNameData) (string, error) {
+	t, err := template.New("session name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid session name template '%s': %v", tmpl, err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := t.Execute(b, data); err != nil {
+		return "", fmt.Errorf("invalid session name template '%s': %v", tmpl, err)
+	}
+
+	s := b.String()
+	if err := ValidateSessionName(s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// ValidateSessionName checks the value against the AWS API rules for role session names and source identities, which
+// must be 2 to 64 characters, using only letters, numbers, and the characters +=,.@_-
+func ValidateSessionName(s string) error {
+	if !sessionNameRe.MatchString(s) {
+		return fmt.Errorf("invalid session name '%s', must be 2 to 64 letters, numbers, or the characters +=,.@_-", s)
+	}
+	return nil
+}
+
+// sourceIdentityHandler returns a request handler which adds the SourceIdentity parameter to an AssumeRole request.
+// This version of the AWS SDK doesn't support the parameter, so it's added to the query string body built by the SDK.
+func sourceIdentityHandler(id string) request.NamedHandler {
+	return request.NamedHandler{Name: "awsrunas.SourceIdentityHandler", Fn: func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+
+		b, err := ioutil.ReadAll(r.GetBody())
+		if err != nil {
+			r.Error = err
+			return
+		}
+
+		v, err := url.ParseQuery(string(b))
+		if err != nil {
+			r.Error = err
+			return
+		}
+
+		v.Set("SourceIdentity", id)
+		r.SetBufferBody([]byte(v.Encode()))
+	}}
+}
@@ -0,0 +1,67 @@
+package credentials
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandSessionName(t *testing.T) {
+	d := &SessionNameData{Username: "bob@example.org", Hostname: "laptop", Profile: "admin"}
+
+	t.Run("template", func(t *testing.T) {
+		s, err := ExpandSessionName("{{.Username}}-{{.Hostname}}", d)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if s != "bob@example.org-laptop" {
+			t.Errorf("unexpected session name: %s", s)
+		}
+	})
+
+	t.Run("literal", func(t *testing.T) {
+		if s, err := ExpandSessionName("deployer", d); err != nil || s != "deployer" {
+			t.Errorf("unexpected session name: %s %v", s, err)
+		}
+	})
+
+	t.Run("bad template", func(t *testing.T) {
+		if _, err := ExpandSessionName("{{.Username", d); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		if _, err := ExpandSessionName("{{.Account}}", d); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("invalid result", func(t *testing.T) {
+		if _, err := ExpandSessionName("{{.Profile}} {{.Username}}", d); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestValidateSessionName(t *testing.T) {
+	for _, s := range []string{"ab", "bob@example.org", "a+b=c,d.e_f-g", strings.Repeat("x", 64)} {
+		if err := ValidateSessionName(s); err != nil {
+			t.Errorf("unexpected error for %s: %v", s, err)
+		}
+	}
+
+	for _, s := range []string{"", "a", "bob smith", "bob/smith", strings.Repeat("x", 65)} {
+		if err := ValidateSessionName(s); err == nil {
+			t.Errorf("did not receive expected error for %s", s)
+		}
+	}
+}
+
+func TestNewSessionNameData(t *testing.T) {
+	d := NewSessionNameData("bob", "admin")
+	if d.Username != "bob" || d.Profile != "admin" || strings.Contains(d.Hostname, ".") {
+		t.Errorf("unexpected data: %+v", d)
+	}
+}
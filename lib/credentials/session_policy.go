@@ -0,0 +1,79 @@
+package credentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"strings"
+)
+
+const (
+	// SessionPolicyMaxLength is the maximum length allowed by the AWS API for an inline session policy, after removing
+	// insignificant whitespace
+	SessionPolicyMaxLength = 2048
+	// SessionPolicyArnsMax is the maximum number of managed session policies allowed by the AWS API
+	SessionPolicyArnsMax = 10
+)
+
+// CompactSessionPolicy checks that the inline session policy is a JSON object within the size limit of the AWS API, and
+// returns the policy with insignificant whitespace removed, since whitespace counts against the size limit
+func CompactSessionPolicy(policy string) (string, error) {
+	b := new(bytes.Buffer)
+	if err := json.Compact(b, []byte(policy)); err != nil {
+		return "", fmt.Errorf("invalid session policy: %v", err)
+	}
+
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		return "", fmt.Errorf("invalid session policy, must be a JSON object: %v", err)
+	}
+
+	if b.Len() > SessionPolicyMaxLength {
+		return "", fmt.Errorf("session policy is %d characters, the maximum is %d", b.Len(), SessionPolicyMaxLength)
+	}
+
+	return b.String(), nil
+}
+
+// ValidatePolicyArns checks that the managed session policy ARNs are IAM policy ARNs, and within the limit of the
+// AWS API
+func ValidatePolicyArns(arns []string) error {
+	if len(arns) > SessionPolicyArnsMax {
+		return fmt.Errorf("too many session policy ARNs, the maximum is %d", SessionPolicyArnsMax)
+	}
+
+	for _, a := range arns {
+		p, err := arn.Parse(a)
+		if err != nil || p.Service != "iam" || !strings.HasPrefix(p.Resource, "policy/") {
+			return fmt.Errorf("invalid session policy ARN '%s'", a)
+		}
+	}
+	return nil
+}
+
+// sessionPolicy validates the inline and managed session policies, and returns them in the form used by the
+// AssumeRole and AssumeRoleWithSAML APIs
+func sessionPolicy(policy string, arns []string) (*string, []*sts.PolicyDescriptorType, error) {
+	var p *string
+	if len(policy) > 0 {
+		c, err := CompactSessionPolicy(policy)
+		if err != nil {
+			return nil, nil, err
+		}
+		p = aws.String(c)
+	}
+
+	if err := ValidatePolicyArns(arns); err != nil {
+		return nil, nil, err
+	}
+
+	var d []*sts.PolicyDescriptorType
+	for _, a := range arns {
+		d = append(d, new(sts.PolicyDescriptorType).SetArn(a))
+	}
+
+	return p, d, nil
+}
@@ -0,0 +1,79 @@
+package credentials
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompactSessionPolicy(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		p := `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::my-bucket/*"}
+  ]
+}`
+		c, err := CompactSessionPolicy(p)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if strings.ContainsAny(c, " \n") || !strings.HasPrefix(c, `{"Version":"2012-10-17"`) {
+			t.Errorf("unexpected policy: %s", c)
+		}
+	})
+
+	t.Run("bad json", func(t *testing.T) {
+		if _, err := CompactSessionPolicy(`{"Version": "2012-10-17",`); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("not object", func(t *testing.T) {
+		if _, err := CompactSessionPolicy(`["s3:GetObject"]`); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		p := `{"Sid": "` + strings.Repeat("x", SessionPolicyMaxLength) + `"}`
+		if _, err := CompactSessionPolicy(p); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestValidatePolicyArns(t *testing.T) {
+	good := []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::1234567890:policy/path/MyPolicy"}
+	if err := ValidatePolicyArns(good); err != nil {
+		t.Error(err)
+	}
+
+	for _, a := range []string{"ReadOnlyAccess", "arn:aws:iam::1234567890:role/Admin", "arn:aws:s3:::policy/x"} {
+		if err := ValidatePolicyArns([]string{a}); err == nil {
+			t.Errorf("did not receive expected error for %s", a)
+		}
+	}
+
+	many := make([]string, SessionPolicyArnsMax+1)
+	for i := range many {
+		many[i] = good[0]
+	}
+
+	if err := ValidatePolicyArns(many); err == nil {
+		t.Error("did not receive expected error")
+	}
+}
+
+func TestSessionPolicy(t *testing.T) {
+	p, d, err := sessionPolicy("", nil)
+	if err != nil || p != nil || d != nil {
+		t.Errorf("unexpected policy: %v %v %v", p, d, err)
+	}
+
+	p, d, err = sessionPolicy(`{ "Version": "2012-10-17" }`, []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"})
+	if err != nil || *p != `{"Version":"2012-10-17"}` || len(d) != 1 || *d[0].Arn != "arn:aws:iam::aws:policy/ReadOnlyAccess" {
+		t.Errorf("unexpected policy: %v %v %v", p, d, err)
+	}
+}
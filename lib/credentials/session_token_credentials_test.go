@@ -170,6 +170,84 @@ func TestSessionTokenProvider_RetrieveCache(t *testing.T) {
 	})
 }
 
+func TestSessionTokenProvider_Renew(t *testing.T) {
+	exp := cache.CacheableCredentials{
+		AccessKeyId:     aws.String("AKIAvalid"),
+		SecretAccessKey: aws.String("valid"),
+		SessionToken:    aws.String("valid"),
+		Expiration:      aws.Time(time.Now().Add(1 * time.Hour)),
+	}
+
+	cc := new(credentialCacheMock)
+	cc.CacheableCredentials = &exp
+
+	var prompts int
+	p := newSessionTokenProvider()
+	p.Cache = cc
+	p.SerialNumber = "MFAtime"
+	p.TokenCode = "654321"
+	p.TokenProvider = func() (string, error) {
+		prompts++
+		return "123456", nil
+	}
+
+	p.Renew()
+	c, err := p.Retrieve()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if c.AccessKeyID == "AKIAvalid" || prompts != 1 {
+		t.Errorf("credentials were not renewed: %s, %d prompts", c.AccessKeyID, prompts)
+	}
+
+	// the renewed credentials are cached, and used by the next call
+	if c2, err := p.Retrieve(); err != nil || c2.AccessKeyID != c.AccessKeyID || prompts != 1 {
+		t.Errorf("renewed credentials not cached: %s %v", c2.AccessKeyID, err)
+	}
+}
+
+func TestSessionTokenProvider_RenewWithTokenProvider(t *testing.T) {
+	cc := new(credentialCacheMock)
+	cc.CacheableCredentials = &cache.CacheableCredentials{
+		AccessKeyId:     aws.String("AKIAvalid"),
+		SecretAccessKey: aws.String("valid"),
+		SessionToken:    aws.String("valid"),
+		Expiration:      aws.Time(time.Now().Add(1 * time.Hour)),
+	}
+
+	var prompts, ttyPrompts int
+	p := newSessionTokenProvider()
+	p.Cache = cc
+	p.SerialNumber = "MFAtime"
+	p.TokenProvider = func() (string, error) {
+		prompts++
+		return "123456", nil
+	}
+
+	p.RenewWithTokenProvider(func() (string, error) {
+		ttyPrompts++
+		return "123456", nil
+	})
+
+	c, err := p.Retrieve()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if c.AccessKeyID == "AKIAvalid" || prompts != 0 || ttyPrompts != 1 {
+		t.Errorf("credentials were not renewed: %s, %d prompts, %d tty prompts", c.AccessKeyID, prompts, ttyPrompts)
+	}
+
+	// the token provider for the renewal isn't used again
+	p.Renew()
+	if _, err := p.Retrieve(); err != nil || prompts != 1 || ttyPrompts != 1 {
+		t.Errorf("unexpected prompts: %d prompts, %d tty prompts, %v", prompts, ttyPrompts, err)
+	}
+}
+
 func TestSessionTokenProvider_RetrieveMfa(t *testing.T) {
 	t.Run("no token", func(t *testing.T) {
 		p := newSessionTokenProvider()
@@ -8,6 +8,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"sync"
 	"time"
 )
 
@@ -29,8 +30,15 @@ type stsCredentialProvider struct {
 	SerialNumber  string
 	TokenCode     string
 	TokenProvider func() (string, error)
+	renewMu       sync.Mutex
+	renew         bool
+	renewTp       func() (string, error)
+	// tokenOverride replaces the TokenProvider for the credentials being renewed, see RenewWithTokenProvider()
+	tokenOverride func() (string, error)
 }
 
+// newStsCredentialProvider creates the STS client using the configuration of c, which selects the STS endpoint (see
+// StsEndpointConfig)
 func newStsCredentialProvider(c client.ConfigProvider) *stsCredentialProvider {
 	return &stsCredentialProvider{
 		client:        sts.New(c),
@@ -40,9 +48,45 @@ func newStsCredentialProvider(c client.ConfigProvider) *stsCredentialProvider {
 	}
 }
 
+// Renew makes the next Retrieve() get new credentials from AWS, instead of using cached credentials.  Any MFA token
+// code already used is discarded, so a new code is requested from the TokenProvider.  It is safe to call Renew while
+// credentials are being retrieved.  The caller must expire the credentials.Credentials object wrapping the provider, so
+// Retrieve() is called by the next Get().
+func (p *stsCredentialProvider) Renew() {
+	p.RenewWithTokenProvider(nil)
+}
+
+// RenewWithTokenProvider is like Renew(), using tp instead of the TokenProvider to get the MFA token code for the
+// renewed credentials (if tp isn't nil), like when the prompt must read from a different terminal than the TokenProvider
+func (p *stsCredentialProvider) RenewWithTokenProvider(tp func() (string, error)) {
+	p.renewMu.Lock()
+	defer p.renewMu.Unlock()
+	p.renew = true
+	p.renewTp = tp
+}
+
+// renewing returns true, once, after Renew() is called, along with the token provider for the renewal
+func (p *stsCredentialProvider) renewing() (bool, func() (string, error)) {
+	p.renewMu.Lock()
+	defer p.renewMu.Unlock()
+
+	r, tp := p.renew, p.renewTp
+	p.renew = false
+	p.renewTp = nil
+	return r, tp
+}
+
 func (p *stsCredentialProvider) checkCache() *cache.CacheableCredentials {
 	var creds *cache.CacheableCredentials
 
+	if r, tp := p.renewing(); r {
+		p.debug("renewing credentials, ignoring cache")
+		p.TokenCode = ""
+		p.tokenOverride = tp
+		p.SetExpiration(time.Now(), SessionTokenMaxDuration)
+		return nil
+	}
+
 	if p.Cache != nil {
 		var err error
 		creds, err = p.Cache.Load()
@@ -58,9 +102,15 @@ func (p *stsCredentialProvider) checkCache() *cache.CacheableCredentials {
 }
 
 func (p *stsCredentialProvider) handleMfa() (*string, error) {
+	tp := p.TokenProvider
+	if p.tokenOverride != nil {
+		tp = p.tokenOverride
+		p.tokenOverride = nil
+	}
+
 	if len(p.SerialNumber) > 0 && len(p.TokenCode) < 1 {
-		if p.TokenProvider != nil {
-			t, err := p.TokenProvider()
+		if tp != nil {
+			t, err := tp()
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,40 @@
+package credentials
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// StsEndpointConfig returns the AWS configuration which selects the endpoint used by STS clients, like the ones created
+// by the credential providers in this package.  The regional parameter selects the regional, or legacy global, STS
+// endpoints, and is not changed if unset.  A non-empty url overrides the STS endpoint for every region, for example to
+// use a VPC interface endpoint.  The endpoints for all other services are resolved normally.
+func StsEndpointConfig(regional endpoints.STSRegionalEndpoint, url string) *aws.Config {
+	c := new(aws.Config)
+
+	if regional != endpoints.UnsetSTSEndpoint {
+		c.STSRegionalEndpoint = regional
+	}
+
+	if len(url) > 0 {
+		c.EndpointResolver = StsEndpointResolver(url)
+	}
+
+	return c
+}
+
+// StsEndpointResolver returns an endpoints.Resolver which resolves the STS endpoint to the url, signed for the requested
+// region, and uses the default resolver for all other services
+func StsEndpointResolver(url string) endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if service == sts.EndpointsID {
+			return endpoints.ResolvedEndpoint{
+				URL:           endpoints.AddScheme(url, false),
+				SigningRegion: region,
+				SigningName:   service,
+			}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+}
@@ -0,0 +1,51 @@
+package credentials
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"testing"
+)
+
+func TestStsEndpointConfig(t *testing.T) {
+	newSession := func(c *aws.Config) *session.Session {
+		return session.Must(session.NewSession(new(aws.Config).WithRegion("us-east-1"), c))
+	}
+
+	t.Run("default", func(t *testing.T) {
+		s := newSession(StsEndpointConfig(endpoints.UnsetSTSEndpoint, ""))
+		if e := s.ClientConfig(sts.EndpointsID).Endpoint; e != "https://sts.amazonaws.com" {
+			t.Errorf("unexpected endpoint: %s", e)
+		}
+	})
+
+	t.Run("regional", func(t *testing.T) {
+		s := newSession(StsEndpointConfig(endpoints.RegionalSTSEndpoint, ""))
+		if e := s.ClientConfig(sts.EndpointsID).Endpoint; e != "https://sts.us-east-1.amazonaws.com" {
+			t.Errorf("unexpected endpoint: %s", e)
+		}
+	})
+
+	t.Run("url", func(t *testing.T) {
+		u := "vpce-0123-abcd.sts.us-east-1.vpce.amazonaws.com"
+		s := newSession(StsEndpointConfig(endpoints.RegionalSTSEndpoint, u))
+
+		c := s.ClientConfig(sts.EndpointsID)
+		if c.Endpoint != "https://"+u || c.SigningRegion != "us-east-1" {
+			t.Errorf("unexpected endpoint: %s %s", c.Endpoint, c.SigningRegion)
+		}
+
+		// other services are unaffected
+		if e := s.ClientConfig(iam.EndpointsID).Endpoint; e != "https://iam.amazonaws.com" {
+			t.Errorf("unexpected iam endpoint: %s", e)
+		}
+
+		// copies of the session keep the endpoint
+		if e := s.Copy(new(aws.Config).WithRegion("us-west-2")).ClientConfig(sts.EndpointsID); e.Endpoint != "https://"+u ||
+			e.SigningRegion != "us-west-2" {
+			t.Errorf("unexpected endpoint in session copy: %s", e.Endpoint)
+		}
+	})
+}
@@ -9,38 +9,54 @@ import (
 
 // StdinCredProvider prompts for username and password information via prompts printed on os.Stderr
 func StdinCredProvider(u, p string) (string, string, error) {
-	var err error
+	return TtyCredProvider(os.Stdin)(u, p)
+}
 
-	for len(u) < 1 {
-		fmt.Fprint(os.Stderr, "Username: ")
-		_, err = fmt.Scanln(&u)
-		if err != nil && err != io.EOF {
-			return "", "", err
+// TtyCredProvider returns a function which prompts for username and password information via prompts printed on
+// os.Stderr, reading the answers from the terminal tty
+func TtyCredProvider(tty *os.File) func(string, string) (string, string, error) {
+	return func(u, p string) (string, string, error) {
+		var err error
+
+		for len(u) < 1 {
+			fmt.Fprint(os.Stderr, "Username: ")
+			_, err = fmt.Fscanln(tty, &u)
+			if err != nil && err != io.EOF {
+				return "", "", err
+			}
 		}
-	}
 
-	for len(p) < 1 {
-		fmt.Fprint(os.Stderr, "Password: ")
-		b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-		if err != nil && err != io.EOF {
-			return "", "", err
+		for len(p) < 1 {
+			fmt.Fprint(os.Stderr, "Password: ")
+			b, err := terminal.ReadPassword(int(tty.Fd()))
+			if err != nil && err != io.EOF {
+				return "", "", err
+			}
+			fmt.Fprintln(os.Stderr)
+			p = string(b)
 		}
-		fmt.Println()
-		p = string(b)
-	}
 
-	return u, p, nil
+		return u, p, nil
+	}
 }
 
 // StdinMfaTokenProvider prompts for multi-factor tokens via prompts printed on os.Stderr
 func StdinMfaTokenProvider() (string, error) {
-	var v string
+	return ReaderMfaTokenProvider(os.Stdin)()
+}
 
-	fmt.Fprint(os.Stderr, "MFA token code: ")
-	_, err := fmt.Scanln(&v)
-	if err != nil && err != io.EOF {
-		return "", err
-	}
+// ReaderMfaTokenProvider returns a function which prompts for multi-factor tokens via prompts printed on os.Stderr,
+// reading the token from r
+func ReaderMfaTokenProvider(r io.Reader) func() (string, error) {
+	return func() (string, error) {
+		var v string
+
+		fmt.Fprint(os.Stderr, "MFA token code: ")
+		_, err := fmt.Fscanln(r, &v)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
 
-	return v, nil
+		return v, nil
+	}
 }
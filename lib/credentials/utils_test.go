@@ -3,6 +3,7 @@ package credentials
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -64,3 +65,15 @@ func TestStdinMfaTokenProvider(t *testing.T) {
 	//	}
 	//}
 }
+
+func TestReaderMfaTokenProvider(t *testing.T) {
+	v, err := ReaderMfaTokenProvider(strings.NewReader("123456\n"))()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v != "123456" {
+		t.Errorf("unexpected token code: %s", v)
+	}
+}
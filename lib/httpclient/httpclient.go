@@ -0,0 +1,116 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultConnectTimeout is the default time allowed to establish the network and TLS connection to the server
+	DefaultConnectTimeout = 30 * time.Second
+	// CaBundleEnvVar is the environment variable for the CA bundle file, which takes precedence over the ca_bundle
+	// config file attribute
+	CaBundleEnvVar = "AWS_CA_BUNDLE"
+)
+
+// Options is the configuration for the HTTP clients created by New()
+type Options struct {
+	// CaBundle is the path to a file of PEM encoded CA certificates to trust, in addition to the system CA certificates
+	CaBundle string
+	// ClientCert is the path to a PEM encoded certificate file used to authenticate to the server (mutual TLS)
+	ClientCert string
+	// ClientKey is the path to the PEM encoded private key for ClientCert.  If not set, the key is loaded from the
+	// ClientCert file
+	ClientKey string
+	// ConnectTimeout is the time allowed to establish the network and TLS connection, default is DefaultConnectTimeout
+	ConnectTimeout time.Duration
+	// Timeout is the time allowed for the whole request, including reading the response body.  There is no limit if
+	// not set.
+	Timeout time.Duration
+}
+
+// New returns an http.Client using a transport created by NewTransport().  The client follows redirects, like the
+// default Go http.Client.
+func New(o *Options) (*http.Client, error) {
+	if o == nil {
+		o = new(Options)
+	}
+
+	t, err := NewTransport(o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: t, Timeout: o.Timeout}, nil
+}
+
+// NewTransport returns an http.Transport which uses the proxy configured in the HTTPS_PROXY, HTTP_PROXY, and NO_PROXY
+// environment variables, trusts the system CA certificates and the certificates in the CA bundle file, and presents the
+// client certificate, if configured.
+func NewTransport(o *Options) (*http.Transport, error) {
+	if o == nil {
+		o = new(Options)
+	}
+
+	ct := o.ConnectTimeout
+	if ct <= 0 {
+		ct = DefaultConnectTimeout
+	}
+
+	tc := new(tls.Config)
+
+	if len(o.CaBundle) > 0 {
+		p, err := caCertPool(o.CaBundle)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = p
+	}
+
+	if len(o.ClientCert) > 0 {
+		k := o.ClientKey
+		if len(k) < 1 {
+			k = o.ClientCert
+		}
+
+		c, err := tls.LoadX509KeyPair(o.ClientCert, k)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{c}
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: ct, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tc,
+		TLSHandshakeTimeout:   ct,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
+
+// caCertPool returns the system CA certificates, with the certificates in the CA bundle file added
+func caCertPool(f string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %v", err)
+	}
+
+	p, err := x509.SystemCertPool()
+	if err != nil || p == nil {
+		p = x509.NewCertPool()
+	}
+
+	if !p.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", f)
+	}
+	return p, nil
+}
@@ -0,0 +1,157 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "httpclient")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ca := writePem(t, dir, "ca.pem", "CERTIFICATE", s.Certificate().Raw)
+
+	t.Run("defaults", func(t *testing.T) {
+		c, err := New(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		tr := c.Transport.(*http.Transport)
+		if tr.Proxy == nil || tr.TLSHandshakeTimeout != DefaultConnectTimeout || c.Timeout != 0 {
+			t.Errorf("unexpected client settings: %+v", c)
+		}
+
+		// the test server certificate is not trusted without the CA bundle
+		if _, err := c.Get(s.URL); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("ca bundle", func(t *testing.T) {
+		c, err := New(&Options{CaBundle: ca, Timeout: 5 * time.Second, ConnectTimeout: 2 * time.Second})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		res, err := c.Get(s.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res.Body.Close()
+
+		if c.Timeout != 5*time.Second || c.Transport.(*http.Transport).TLSHandshakeTimeout != 2*time.Second {
+			t.Errorf("unexpected timeouts: %+v", c)
+		}
+	})
+
+	t.Run("bad ca bundle", func(t *testing.T) {
+		if _, err := New(&Options{CaBundle: filepath.Join(dir, "missing.pem")}); err == nil {
+			t.Error("did not receive expected error")
+		}
+
+		f := filepath.Join(dir, "empty.pem")
+		ioutil.WriteFile(f, []byte("not a cert"), 0600)
+		if _, err := New(&Options{CaBundle: f}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("client cert", func(t *testing.T) {
+		cert, key := clientCert(t, dir)
+
+		ms := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.PeerCertificates) < 1 || r.TLS.PeerCertificates[0].Subject.CommonName != "aws-runas" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		ms.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		ms.StartTLS()
+		defer ms.Close()
+
+		mca := writePem(t, dir, "mtls-ca.pem", "CERTIFICATE", ms.Certificate().Raw)
+
+		c, err := New(&Options{CaBundle: mca, ClientCert: cert, ClientKey: key})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		res, err := c.Get(ms.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status: %d", res.StatusCode)
+		}
+
+		if _, err := New(&Options{ClientCert: filepath.Join(dir, "missing.pem")}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func writePem(t *testing.T, dir, name, typ string, b []byte) string {
+	f := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func clientCert(t *testing.T, dir string) (string, string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "aws-runas"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	c, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kb, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writePem(t, dir, "client.pem", "CERTIFICATE", c), writePem(t, dir, "client.key", "EC PRIVATE KEY", kb)
+}
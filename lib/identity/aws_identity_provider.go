@@ -1,7 +1,6 @@
 package identity
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
@@ -10,7 +9,6 @@ import (
 	"github.com/aws/aws-sdk-go/service/iam/iamiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
-	"net/url"
 	"sort"
 	"strings"
 	"sync"
@@ -26,9 +24,12 @@ type AwsIdentityProvider struct {
 	log       aws.Logger
 	logDebug  bool
 	wg        *sync.WaitGroup
+	expand    bool
 }
 
-// NewAwsIdentityProvider creates a valid, default AwsIdentityProvider using the specified client.ConfigProvider
+// NewAwsIdentityProvider creates a valid, default AwsIdentityProvider using the specified client.ConfigProvider.  The STS
+// and IAM endpoints are resolved using the configuration of the client.ConfigProvider, so a custom STS endpoint set on
+// the session is also used for identity lookups.
 func NewAwsIdentityProvider(c client.ConfigProvider) *AwsIdentityProvider {
 	return &AwsIdentityProvider{
 		stsClient: sts.New(c),
@@ -45,6 +46,13 @@ func (p *AwsIdentityProvider) WithLogger(l aws.Logger) *AwsIdentityProvider {
 	return p
 }
 
+// WithWildcardExpansion is a fluent method to expand wildcard role ARNs found by PolicyRoles() using the roles in the
+// account of the user
+func (p *AwsIdentityProvider) WithWildcardExpansion(e bool) *AwsIdentityProvider {
+	p.expand = e
+	return p
+}
+
 // GetIdentity retrieves the Identity information for the IAM user
 func (p *AwsIdentityProvider) GetIdentity() (*Identity, error) {
 	o, err := p.stsClient.GetCallerIdentity(new(sts.GetCallerIdentityInput))
@@ -59,7 +67,7 @@ func (p *AwsIdentityProvider) GetIdentity() (*Identity, error) {
 		return nil, err
 	}
 
-	id := &Identity{Provider: ProviderAws}
+	id := &Identity{Provider: ProviderAws, Partition: a.Partition}
 
 	r := strings.Split(a.Resource, "/")
 	id.IdentityType = r[0]
@@ -73,8 +81,40 @@ func (p *AwsIdentityProvider) GetIdentity() (*Identity, error) {
 // GetIdentity().
 //
 // This method will check the inline and attached IAM policies for the user, and any groups the user is a member of.  It
-// will return all roles the user is allowed to assume, even those specifying wildcards in the ARN fields.
+// will return all roles the user is allowed to assume, even those specifying wildcards in the ARN fields, except roles
+// denied by a Deny statement, or the permissions boundary of the user.
 func (p *AwsIdentityProvider) Roles(user ...string) (Roles, error) {
+	pr, err := p.PolicyRoles(user...)
+	if err != nil {
+		return nil, err
+	}
+
+	// a role is returned if any policy allows it, even if it's denied in the context of another policy
+	m := make(map[string]bool)
+	for _, r := range pr {
+		m[r.Arn] = m[r.Arn] || r.Status != RoleDenied
+	}
+
+	r := make([]string, 0)
+	for k, v := range m {
+		if !v {
+			continue
+		}
+		r = append(r, k)
+	}
+
+	sort.Strings(r)
+	return r, nil
+}
+
+// PolicyRoles retrieves the roles which the user is able to assume, like Roles(), along with the policy allowing each
+// role, and the user or group the policy applies to.  A role allowed by more than one policy is returned for each
+// policy.  If wildcard expansion is enabled, wildcard role ARNs are expanded using the roles in the account of the user.
+//
+// The Status of each role is set using the Deny statements of the IAM policies, and the permissions boundary of the user
+// (if set), so roles which the user can't assume are returned as RoleDenied, and roles depending on conditions, like
+// requiring MFA, are returned as RoleConditional.
+func (p *AwsIdentityProvider) PolicyRoles(user ...string) ([]*PolicyRole, error) {
 	if user == nil || len(user) < 1 || len(user[0]) < 1 {
 		id, err := p.GetIdentity()
 		if err != nil {
@@ -83,41 +123,146 @@ func (p *AwsIdentityProvider) Roles(user ...string) (Roles, error) {
 		user = []string{id.Username}
 	}
 
-	m := make(map[string]bool)
-	ch := make(chan string, 8)
-
-	go p.roles(user[0], ch)
-	for i := range ch {
-		tr := strings.TrimSpace(i)
-		if len(tr) > 0 {
-			m[tr] = true
-			p.debug("found role ARN: %s", tr)
+	ch := make(chan *policyDocument, 8)
+	go p.policies(user[0], ch)
+
+	stmts := make([]*policyStatement, 0)
+	for d := range ch {
+		s, err := parsePolicy(d)
+		if err != nil {
+			p.error("error reading policy %s for %s: %v", d.Policy, d.Source, err)
+			continue
 		}
+		stmts = append(stmts, s...)
 	}
 
-	r := make([]string, 0)
-	for k := range m {
-		r = append(r, k)
+	roles := allowedRoles(stmts, p.isRoleArn)
+	if p.expand {
+		roles = p.expandRoles(roles)
 	}
+	evaluateRoles(roles, stmts, p.permissionsBoundary(user[0]))
 
-	sort.Strings(r)
-	return r, nil
+	for _, r := range roles {
+		p.debug("found role ARN: %s (%s %s) %s", r.Arn, r.Source, r.Policy, r.Status)
+	}
+
+	sort.SliceStable(roles, func(i, j int) bool { return roles[i].Arn < roles[j].Arn })
+	return roles, nil
+}
+
+// expandRoles replaces the wildcard roles which can only match roles in the account of the user with the matching roles
+// in the account.  Wildcard roles which may match roles in other accounts are kept, since those roles can't be listed.
+func (p *AwsIdentityProvider) expandRoles(roles []*PolicyRole) []*PolicyRole {
+	id, err := p.stsClient.GetCallerIdentity(new(sts.GetCallerIdentityInput))
+	if err != nil {
+		p.error("error getting account for role expansion: %v", err)
+		return roles
+	}
+	acct := *id.Account
+
+	var acctRoles []string
+	res := make([]*PolicyRole, 0, len(roles))
+
+	for _, r := range roles {
+		if !r.Wildcard() {
+			res = append(res, r)
+			continue
+		}
+
+		// a wildcard which may also match roles in other accounts is kept, since those roles can't be listed
+		keep := true
+		if a, err := arn.Parse(r.Arn); err == nil {
+			if !wildcardMatch(a.AccountID, acct) {
+				res = append(res, r)
+				continue
+			}
+			keep = a.AccountID != acct
+		}
+
+		if acctRoles == nil {
+			if acctRoles, err = p.listRoles(); err != nil {
+				p.error("error listing roles in account %s: %v", acct, err)
+				return roles
+			}
+		}
+
+		if keep {
+			res = append(res, r)
+		}
+
+		for _, a := range acctRoles {
+			if !r.matches(a) {
+				continue
+			}
+
+			x := *r
+			x.Arn = a
+			x.NotResource = nil
+			x.Pattern = r.Arn
+			res = append(res, &x)
+		}
+	}
+
+	return res
 }
 
-func (p *AwsIdentityProvider) roles(user string, ch chan<- string) {
+func (p *AwsIdentityProvider) listRoles() ([]string, error) {
+	roles := make([]string, 0)
+
+	err := p.iamClient.ListRolesPages(new(iam.ListRolesInput), func(out *iam.ListRolesOutput, last bool) bool {
+		for _, r := range out.Roles {
+			roles = append(roles, *r.Arn)
+		}
+		return !last
+	})
+
+	return roles, err
+}
+
+// permissionsBoundary returns the statements of the permissions boundary policy of the user, or nil if the user has no
+// permissions boundary.  If the boundary can't be read, it's logged, and not used to evaluate the roles.
+func (p *AwsIdentityProvider) permissionsBoundary(user string) []*policyStatement {
+	u, err := p.iamClient.GetUser(new(iam.GetUserInput).SetUserName(user))
+	if err != nil {
+		p.error("error getting permissions boundary for user %s: %v", user, err)
+		return nil
+	}
+
+	if u.User == nil || u.User.PermissionsBoundary == nil || u.User.PermissionsBoundary.PermissionsBoundaryArn == nil {
+		return nil
+	}
+
+	d, err := p.managedPolicy("user/"+user, u.User.PermissionsBoundary.PermissionsBoundaryArn)
+	if err != nil {
+		p.error("error getting permissions boundary for user %s: %v", user, err)
+		return nil
+	}
+	d.PolicyType = "boundary"
+
+	stmts, err := parsePolicy(d)
+	if err != nil {
+		p.error("error reading permissions boundary %s for user %s: %v", d.Policy, user, err)
+		return nil
+	}
+
+	p.debug("PERMISSIONS BOUNDARY: %s", d.Policy)
+	return stmts
+}
+
+func (p *AwsIdentityProvider) policies(user string, ch chan<- *policyDocument) {
 	defer close(ch)
 
 	p.wg.Add(2)
-	go p.getInlineUserRoles(user, ch)
-	go p.getAttachedUserRoles(user, ch)
+	go p.getInlineUserPolicies(user, ch)
+	go p.getAttachedUserPolicies(user, ch)
 
 	in := new(iam.ListGroupsForUserInput).SetUserName(user)
 	err := p.iamClient.ListGroupsForUserPages(in, func(out *iam.ListGroupsForUserOutput, last bool) bool {
 		for _, g := range out.Groups {
 			p.debug("GROUP: %s", *g.GroupName)
 			p.wg.Add(2)
-			go p.getInlineGroupRoles(*g.GroupName, ch)
-			go p.getAttachedGroupRoles(*g.GroupName, ch)
+			go p.getInlineGroupPolicies(*g.GroupName, ch)
+			go p.getAttachedGroupPolicies(*g.GroupName, ch)
 		}
 
 		return !last
@@ -130,7 +275,7 @@ func (p *AwsIdentityProvider) roles(user string, ch chan<- string) {
 	p.wg.Wait()
 }
 
-func (p *AwsIdentityProvider) getInlineUserRoles(user string, ch chan<- string) {
+func (p *AwsIdentityProvider) getInlineUserPolicies(user string, ch chan<- *policyDocument) {
 	defer p.wg.Done()
 
 	in := new(iam.ListUserPoliciesInput).SetUserName(user)
@@ -146,7 +291,7 @@ func (p *AwsIdentityProvider) getInlineUserRoles(user string, ch chan<- string)
 				continue
 			}
 
-			p.findPolicyRoles(r.PolicyDocument, ch)
+			ch <- &policyDocument{Source: "user/" + user, Policy: *pol, PolicyType: "inline", Document: aws.StringValue(r.PolicyDocument)}
 		}
 
 		return !last
@@ -157,14 +302,14 @@ func (p *AwsIdentityProvider) getInlineUserRoles(user string, ch chan<- string)
 	}
 }
 
-func (p *AwsIdentityProvider) getAttachedUserRoles(user string, ch chan<- string) {
+func (p *AwsIdentityProvider) getAttachedUserPolicies(user string, ch chan<- *policyDocument) {
 	defer p.wg.Done()
 
 	in := new(iam.ListAttachedUserPoliciesInput).SetUserName(user)
 
 	err := p.iamClient.ListAttachedUserPoliciesPages(in, func(out *iam.ListAttachedUserPoliciesOutput, last bool) bool {
 		for _, pol := range out.AttachedPolicies {
-			p.getAttachedPolicyRoles(pol.PolicyArn, ch)
+			p.getAttachedPolicy("user/"+user, pol.PolicyArn, ch)
 		}
 
 		return !last
@@ -175,7 +320,7 @@ func (p *AwsIdentityProvider) getAttachedUserRoles(user string, ch chan<- string
 	}
 }
 
-func (p *AwsIdentityProvider) getInlineGroupRoles(group string, ch chan<- string) {
+func (p *AwsIdentityProvider) getInlineGroupPolicies(group string, ch chan<- *policyDocument) {
 	defer p.wg.Done()
 
 	in := new(iam.ListGroupPoliciesInput).SetGroupName(group)
@@ -191,7 +336,7 @@ func (p *AwsIdentityProvider) getInlineGroupRoles(group string, ch chan<- string
 				continue
 			}
 
-			p.findPolicyRoles(r.PolicyDocument, ch)
+			ch <- &policyDocument{Source: "group/" + group, Policy: *pol, PolicyType: "inline", Document: aws.StringValue(r.PolicyDocument)}
 		}
 
 		return !last
@@ -202,13 +347,13 @@ func (p *AwsIdentityProvider) getInlineGroupRoles(group string, ch chan<- string
 	}
 }
 
-func (p *AwsIdentityProvider) getAttachedGroupRoles(group string, ch chan<- string) {
+func (p *AwsIdentityProvider) getAttachedGroupPolicies(group string, ch chan<- *policyDocument) {
 	defer p.wg.Done()
 
 	in := new(iam.ListAttachedGroupPoliciesInput).SetGroupName(group)
 	err := p.iamClient.ListAttachedGroupPoliciesPages(in, func(out *iam.ListAttachedGroupPoliciesOutput, last bool) bool {
 		for _, pol := range out.AttachedPolicies {
-			p.getAttachedPolicyRoles(pol.PolicyArn, ch)
+			p.getAttachedPolicy("group/"+group, pol.PolicyArn, ch)
 		}
 
 		return !last
@@ -219,94 +364,31 @@ func (p *AwsIdentityProvider) getAttachedGroupRoles(group string, ch chan<- stri
 	}
 }
 
-func (p *AwsIdentityProvider) getAttachedPolicyRoles(arn *string, ch chan<- string) {
-	getPol := new(iam.GetPolicyInput).SetPolicyArn(*arn)
-	pol, err := p.iamClient.GetPolicy(getPol)
-	if err != nil {
-		p.error("error getting IAM policy %s: %v", *arn, err)
-		return
-	}
-
-	getVer := new(iam.GetPolicyVersionInput).SetPolicyArn(*pol.Policy.Arn).SetVersionId(*pol.Policy.DefaultVersionId)
-	ver, err := p.iamClient.GetPolicyVersion(getVer)
+func (p *AwsIdentityProvider) getAttachedPolicy(source string, arn *string, ch chan<- *policyDocument) {
+	d, err := p.managedPolicy(source, arn)
 	if err != nil {
-		p.error("error getting IAM policy version for policy %s: %v", *pol.Policy.PolicyName, err)
+		p.error("%v", err)
 		return
 	}
-
-	p.findPolicyRoles(ver.PolicyVersion.Document, ch)
+	ch <- d
 }
 
-func (p *AwsIdentityProvider) findPolicyRoles(doc *string, ch chan<- string) {
-	if doc == nil || len(*doc) < 1 {
-		p.error("empty policy document")
-		return
-	}
-
-	escDoc, err := url.QueryUnescape(*doc)
+// managedPolicy returns the default version of the managed policy
+func (p *AwsIdentityProvider) managedPolicy(source string, arn *string) (*policyDocument, error) {
+	getPol := new(iam.GetPolicyInput).SetPolicyArn(*arn)
+	pol, err := p.iamClient.GetPolicy(getPol)
 	if err != nil {
-		p.error("error unescaping policy document: %v", err)
-		return
-	}
-
-	polJson := make(map[string]interface{})
-	if err := json.Unmarshal([]byte(escDoc), &polJson); err != nil {
-		p.error("error unmarshalling policy document json: %v", err)
-		return
+		return nil, fmt.Errorf("error getting IAM policy %s: %v", *arn, err)
 	}
 
-	for _, r := range p.findRoles(polJson["Statement"]) {
-		ch <- r
-	}
-}
-
-func (p *AwsIdentityProvider) findRoles(data interface{}) []string {
-	roles := make([]string, 0)
-
-	switch t := data.(type) {
-	case []interface{}:
-		for _, v := range t {
-			roles = append(roles, p.findRoles(v)...)
-		}
-	case map[string]interface{}:
-		assumeRoleAction := "sts:AssumeRole"
-
-		if t["Effect"] == "Allow" {
-			switch v := t["Action"].(type) {
-			case string:
-				if v == assumeRoleAction {
-					roles = append(roles, p.parseRoles(t["Resource"])...)
-				}
-			case []interface{}:
-				for _, val := range v {
-					if val == assumeRoleAction {
-						roles = append(roles, p.parseRoles(t["Resource"])...)
-					}
-				}
-			}
-		}
-	}
-
-	return roles
-}
-
-func (p *AwsIdentityProvider) parseRoles(data interface{}) []string {
-	roles := make([]string, 0)
-
-	switch r := data.(type) {
-	case string:
-		if p.isRoleArn(r) {
-			roles = append(roles, r)
-		}
-	case []interface{}:
-		for _, i := range r {
-			if p.isRoleArn(i.(string)) {
-				roles = append(roles, i.(string))
-			}
-		}
+	getVer := new(iam.GetPolicyVersionInput).SetPolicyArn(*pol.Policy.Arn).SetVersionId(*pol.Policy.DefaultVersionId)
+	ver, err := p.iamClient.GetPolicyVersion(getVer)
+	if err != nil {
+		return nil, fmt.Errorf("error getting IAM policy version for policy %s: %v", *pol.Policy.PolicyName, err)
 	}
 
-	return roles
+	return &policyDocument{Source: source, Policy: *pol.Policy.PolicyName, PolicyType: "managed",
+		Document: aws.StringValue(ver.PolicyVersion.Document)}, nil
 }
 
 func (p *AwsIdentityProvider) isRoleArn(s string) bool {
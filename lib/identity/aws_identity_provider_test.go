@@ -29,9 +29,26 @@ func TestAwsIdentityProvider_GetIdentity(t *testing.T) {
 		return
 	}
 
-	if id.Username != "bob" || id.IdentityType != "user" || id.Provider != "AwsIdentityProvider" {
+	if id.Username != "bob" || id.IdentityType != "user" || id.Provider != "AwsIdentityProvider" || id.Partition != "aws" {
 		t.Error("data mismatch")
 	}
+
+	for _, part := range []string{"aws-us-gov", "aws-cn"} {
+		t.Run(part, func(t *testing.T) {
+			a := fmt.Sprintf("arn:%s:iam::123456789012:user/bob", part)
+			p := AwsIdentityProvider{stsClient: &mockStsClient{arn: a}}
+
+			id, err := p.GetIdentity()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if id.Username != "bob" || id.IdentityType != "user" || id.Partition != part {
+				t.Errorf("data mismatch: %+v", id)
+			}
+		})
+	}
 }
 
 func TestAwsIdentityProvider_Roles(t *testing.T) {
@@ -63,6 +80,182 @@ func TestAwsIdentityProvider_Roles(t *testing.T) {
 	})
 }
 
+func TestAwsIdentityProvider_PolicyRoles(t *testing.T) {
+	newClient := func(docs ...*mockIamPolicy) *mockIamClient {
+		return &mockIamClient{docs: docs, roles: []string{
+			"arn:aws:iam::123456789012:role/dev-admin",
+			"arn:aws:iam::123456789012:role/dev-readonly",
+			"arn:aws:iam::123456789012:role/prod-admin",
+		}}
+	}
+
+	newProvider := func(docs ...*mockIamPolicy) *AwsIdentityProvider {
+		return &AwsIdentityProvider{stsClient: new(mockStsClient), iamClient: newClient(docs...), wg: new(sync.WaitGroup)}
+	}
+
+	t.Run("provenance", func(t *testing.T) {
+		r, err := newProvider(p1).PolicyRoles()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// the policy is attached to the user and the groups (inline group policies aren't found by the mock)
+		src := make(map[string]bool)
+		for _, i := range r {
+			src[i.Source+" "+i.PolicyType] = true
+			if i.Arn != "arn:aws:iam::111111111:role/p1" || i.Policy != "stringAction-stringRole" {
+				t.Errorf("unexpected role: %+v", i)
+			}
+		}
+
+		if len(r) != 5 || !src["user/bob inline"] || !src["user/bob managed"] || !src["group/group2 managed"] {
+			t.Errorf("unexpected roles: %v", src)
+		}
+
+		if r[0].Status != RoleAllowed || len(r[0].DeniedBy) > 0 {
+			t.Errorf("unexpected status: %+v", r[0])
+		}
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		r, err := newProvider(pDeny).PolicyRoles()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// only the wildcard (which isn't denied as a whole) and the conditionally denied role aren't denied
+		m := make(map[string]*PolicyRole)
+		for _, i := range userInline(r) {
+			m[i.Arn] = i
+		}
+
+		if len(m) != 3 || m["arn:aws:iam::123456789012:role/*"].Status != RoleAllowed {
+			t.Errorf("unexpected roles: %v", m)
+			return
+		}
+
+		if d := m["arn:aws:iam::210987654321:role/Other"]; d == nil || d.Status != RoleDenied || d.DeniedBy != "deny-prod" {
+			t.Errorf("unexpected denied role: %+v", d)
+		}
+
+		c := m["arn:aws:iam::210987654321:role/Admin"]
+		if c == nil || c.Status != RoleConditional || !c.MfaRequired || len(c.Conditions) != 1 {
+			t.Errorf("unexpected conditional role: %+v", c)
+		}
+
+		// Roles() only returns the roles which aren't denied
+		a, err := newProvider(pDeny).Roles()
+		if err != nil || len(a) != 2 {
+			t.Errorf("unexpected roles: %v %v", a, err)
+		}
+	})
+
+	t.Run("boundary", func(t *testing.T) {
+		c := newClient(pDeny, pNotResource)
+		c.boundary = pBoundary
+		p := &AwsIdentityProvider{stsClient: new(mockStsClient), iamClient: c, wg: new(sync.WaitGroup)}
+
+		r, err := p.WithWildcardExpansion(true).PolicyRoles()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		m := make(map[string]*PolicyRole)
+		for _, i := range userInline(r) {
+			if i.Policy == "deny-prod" {
+				m[i.Arn] = i
+			}
+		}
+
+		// the boundary doesn't allow roles in other accounts, or the dev-admin role without MFA
+		tests := map[string]string{
+			"arn:aws:iam::123456789012:role/dev-readonly": RoleConditional,
+			"arn:aws:iam::123456789012:role/dev-admin":    RoleConditional,
+			"arn:aws:iam::123456789012:role/prod-admin":   RoleDenied,
+			"arn:aws:iam::210987654321:role/Admin":        RoleDenied,
+			"arn:aws:iam::210987654321:role/Other":        RoleDenied,
+		}
+
+		for k, v := range tests {
+			if m[k] == nil || m[k].Status != v {
+				t.Errorf("unexpected status for %s: %+v", k, m[k])
+			}
+		}
+
+		if a := m["arn:aws:iam::123456789012:role/dev-admin"]; !a.MfaRequired || a.Conditions[0] != "aws:MultiFactorAuthAge" {
+			t.Errorf("unexpected conditions: %+v", a)
+		}
+
+		if a := m["arn:aws:iam::123456789012:role/dev-readonly"]; a.MfaRequired || a.Conditions[0] != "aws:RequestedRegion" {
+			t.Errorf("unexpected conditions: %+v", a)
+		}
+
+		if d := m["arn:aws:iam::210987654321:role/Admin"]; d.DeniedBy != "permissions boundary" {
+			t.Errorf("unexpected denied role: %+v", d)
+		}
+
+		if d := m["arn:aws:iam::123456789012:role/prod-admin"]; d.DeniedBy != "deny-prod" {
+			t.Errorf("unexpected denied role: %+v", d)
+		}
+
+		// the NotResource wildcard is allowed, since the boundary allows some of the roles it matches
+		for _, i := range userInline(r) {
+			if i.Arn == "*" && i.Status != RoleAllowed {
+				t.Errorf("unexpected wildcard status: %+v", i)
+			}
+		}
+	})
+
+	t.Run("expand", func(t *testing.T) {
+		r, err := newProvider(pDeny, pNotResource).WithWildcardExpansion(true).PolicyRoles()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		m := make(map[string][]*PolicyRole)
+		for _, i := range userInline(r) {
+			m[i.Arn] = append(m[i.Arn], i)
+		}
+
+		// the wildcard in the account of the user is replaced by the roles it matches, and the NotResource wildcard is
+		// kept, since it matches roles in other accounts
+		if len(m["arn:aws:iam::123456789012:role/*"]) > 0 || len(m["*"]) != 1 {
+			t.Errorf("unexpected roles: %v", m)
+		}
+
+		if d := m["arn:aws:iam::123456789012:role/prod-admin"]; len(d) != 1 || d[0].Status != RoleDenied {
+			t.Errorf("unexpected denied roles: %v", d)
+		}
+
+		// dev-readonly is allowed by both policies
+		ro := m["arn:aws:iam::123456789012:role/dev-readonly"]
+		if len(ro) != 2 || ro[0].Pattern != "arn:aws:iam::123456789012:role/*" || ro[1].Pattern != "*" {
+			t.Errorf("unexpected expanded roles: %+v %+v", ro[0], ro[1])
+		}
+
+		// the NotResource statement excludes admin roles
+		if len(m["arn:aws:iam::123456789012:role/dev-admin"]) != 1 {
+			t.Errorf("unexpected expanded roles: %v", m["arn:aws:iam::123456789012:role/dev-admin"])
+		}
+	})
+}
+
+// userInline returns the roles found in the inline policies of the user, since the mock IAM client returns the same
+// policies for each user and group
+func userInline(roles []*PolicyRole) []*PolicyRole {
+	res := make([]*PolicyRole, 0)
+	for _, r := range roles {
+		if r.Source == "user/bob" && r.PolicyType == "inline" {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
 func ExampleAwsIdentityProvider_Roles() {
 	p := AwsIdentityProvider{stsClient: new(mockStsClient), iamClient: new(mockIamClient),
 		wg: new(sync.WaitGroup), logDebug: false}
@@ -88,12 +281,18 @@ func ExampleAwsIdentityProvider_Roles() {
 // An STS client we can use for testing to avoid calls out to AWS
 type mockStsClient struct {
 	stsiface.STSAPI
+	arn string
 }
 
 func (c *mockStsClient) GetCallerIdentity(in *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	a := c.arn
+	if len(a) < 1 {
+		a = "arn:aws:iam::123456789012:user/bob"
+	}
+
 	return new(sts.GetCallerIdentityOutput).
 		SetAccount("123456789012").
-		SetArn("arn:aws:iam::123456789012:user/bob").
+		SetArn(a).
 		SetUserId("AIDAB0B"), nil
 }
 
@@ -102,6 +301,12 @@ func (c *mockStsClient) GetCallerIdentity(in *sts.GetCallerIdentityInput) (*sts.
 // by the various IAM API calls
 type mockIamClient struct {
 	iamiface.IAMAPI
+	// docs replaces the default policies, if set
+	docs []*mockIamPolicy
+	// roles are the role ARNs returned by ListRoles
+	roles []string
+	// boundary is the permissions boundary of the user, if set
+	boundary *mockIamPolicy
 }
 
 func (c *mockIamClient) groups() []*iam.Group {
@@ -113,6 +318,9 @@ func (c *mockIamClient) groups() []*iam.Group {
 }
 
 func (c *mockIamClient) policies() []*mockIamPolicy {
+	if c.docs != nil {
+		return c.docs
+	}
 	return []*mockIamPolicy{p1, p2, p3, p4, p5, p6, p7, p8, p9}
 }
 
@@ -140,6 +348,10 @@ func (c *mockIamClient) attachedPolicies() []*iam.AttachedPolicy {
 }
 
 func (c *mockIamClient) lookupPolicy(f *string) *mockIamPolicy {
+	if c.boundary != nil && *c.boundary.Arn == *f {
+		return c.boundary
+	}
+
 	for _, p := range c.policies() {
 		if *p.Arn == *f || *p.Policy.PolicyName == *f {
 			return p
@@ -149,6 +361,15 @@ func (c *mockIamClient) lookupPolicy(f *string) *mockIamPolicy {
 	return nil
 }
 
+func (c *mockIamClient) GetUser(in *iam.GetUserInput) (*iam.GetUserOutput, error) {
+	u := new(iam.User).SetUserName(*in.UserName).SetArn("arn:aws:iam::123456789012:user/" + *in.UserName)
+	if c.boundary != nil {
+		u.SetPermissionsBoundary(new(iam.AttachedPermissionsBoundary).SetPermissionsBoundaryArn(*c.boundary.Arn).
+			SetPermissionsBoundaryType(iam.PermissionsBoundaryAttachmentTypePermissionsBoundaryPolicy))
+	}
+	return new(iam.GetUserOutput).SetUser(u), nil
+}
+
 func (c *mockIamClient) ListGroupsForUserPages(in *iam.ListGroupsForUserInput, fn func(*iam.ListGroupsForUserOutput, bool) bool) error {
 	out := new(iam.ListGroupsForUserOutput).SetGroups(c.groups())
 	fn(out, true)
@@ -220,6 +441,15 @@ func (c *mockIamClient) GetPolicyVersion(in *iam.GetPolicyVersionInput) (*iam.Ge
 	return out, nil
 }
 
+func (c *mockIamClient) ListRolesPages(in *iam.ListRolesInput, fn func(*iam.ListRolesOutput, bool) bool) error {
+	out := new(iam.ListRolesOutput)
+	for _, r := range c.roles {
+		out.Roles = append(out.Roles, new(iam.Role).SetArn(r))
+	}
+	fn(out, true)
+	return nil
+}
+
 // A type combining the capabilities of the iam.Policy and iam.PolicyDetail types so that we can manage
 // the identity and policy document information in a single place
 type mockIamPolicy struct {
@@ -314,3 +544,54 @@ var p7 = NewMockIamPolicy("empty-statement").WithPolicyDocument(`
 
 var p8 = NewMockIamPolicy("empty-doc").WithPolicyDocument(``)
 var p9 = NewMockIamPolicy("bad-json").WithPolicyDocument(`{Statement: []}`)
+
+var pDeny = NewMockIamPolicy("deny-prod").WithPolicyDocument(`
+{"Statement": [
+  {
+    "Effect": "Allow",
+    "Action": "sts:*",
+    "Resource": ["arn:aws:iam::123456789012:role/*", "arn:aws:iam::210987654321:role/Admin", "arn:aws:iam::210987654321:role/Other"]
+  },
+  {
+    "Effect": "Deny",
+    "Action": "sts:AssumeRole",
+    "Resource": ["arn:aws:iam::*:role/prod-*", "arn:aws:iam::210987654321:role/Other"]
+  },
+  {
+    "Effect": "Deny",
+    "NotAction": "iam:*",
+    "Resource": "arn:aws:iam::210987654321:role/Admin",
+    "Condition": {"BoolIfExists": {"aws:MultiFactorAuthPresent": false}}
+  }
+]}
+`)
+
+var pNotResource = NewMockIamPolicy("not-resource").WithPolicyDocument(`
+{"Statement": {
+  "Effect": "Allow",
+  "Action": "sts:AssumeRole",
+  "NotResource": "arn:aws:iam::*:role/*admin*"
+}}
+`)
+
+var pBoundary = NewMockIamPolicy("boundary").WithPolicyDocument(`
+{"Statement": [
+  {
+    "Effect": "Allow",
+    "Action": "sts:AssumeRole",
+    "Resource": "arn:aws:iam::123456789012:role/dev-*",
+    "Condition": {"NumericLessThan": {"aws:MultiFactorAuthAge": 3600}}
+  },
+  {
+    "Effect": "Allow",
+    "Action": "sts:AssumeRole",
+    "Resource": ["arn:aws:iam::123456789012:role/*readonly", "arn:aws:iam::123456789012:role/prod-*"]
+  },
+  {
+    "Effect": "Deny",
+    "Action": "sts:AssumeRole",
+    "Resource": "arn:aws:iam::123456789012:role/dev-readonly",
+    "Condition": {"StringNotEquals": {"aws:RequestedRegion": "us-east-1"}}
+  }
+]}
+`)
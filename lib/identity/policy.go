@@ -0,0 +1,465 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const assumeRoleAction = "sts:assumerole"
+
+const (
+	// RoleAllowed is the status of a role the user is allowed to assume
+	RoleAllowed = "allowed"
+	// RoleDenied is the status of a role denied by a Deny statement, or not allowed by the permissions boundary
+	RoleDenied = "denied"
+	// RoleConditional is the status of a role which is allowed, or denied, depending on the condition keys of the role
+	RoleConditional = "conditional"
+)
+
+// PolicyRole is a role (or wildcard role ARN) the user is allowed to assume, and the policy which allows it
+type PolicyRole struct {
+	// Arn is the role ARN, which may contain wildcards
+	Arn string `json:"role_arn"`
+	// Source is the IAM user or group the policy applies to, like user/bob or group/admins
+	Source string `json:"source"`
+	// Policy is the name of the policy
+	Policy string `json:"policy"`
+	// PolicyType is inline, or managed for an attached policy
+	PolicyType string `json:"policy_type"`
+	// NotResource is set for statements allowing every role except the ones listed
+	NotResource []string `json:"not_resource,omitempty"`
+	// Conditions are the condition keys of the statement allowing the role, and any Deny statement with conditions
+	// which applies to the role
+	Conditions []string `json:"conditions,omitempty"`
+	// MfaRequired is true if the conditions require the user to authenticate with MFA
+	MfaRequired bool `json:"mfa_required"`
+	// Pattern is the wildcard ARN in the policy, for roles found by expanding wildcards
+	Pattern string `json:"pattern,omitempty"`
+	// Status is RoleAllowed, RoleDenied, or RoleConditional
+	Status string `json:"status"`
+	// DeniedBy is the policy denying the role, if the Status is RoleDenied
+	DeniedBy string `json:"denied_by,omitempty"`
+}
+
+// Wildcard returns true if the role ARN contains wildcards, or the role was allowed using NotResource
+func (r *PolicyRole) Wildcard() bool {
+	return strings.ContainsAny(r.Arn, "*?") || len(r.NotResource) > 0
+}
+
+// matches returns true if the (possibly wildcard) role allows the role ARN
+func (r *PolicyRole) matches(a string) bool {
+	if len(r.NotResource) > 0 {
+		return !matchAny(r.NotResource, a, false)
+	}
+	return wildcardMatch(r.Arn, a)
+}
+
+// policyDocument is an IAM policy document, and where it was found
+type policyDocument struct {
+	Source     string
+	Policy     string
+	PolicyType string
+	Document   string
+}
+
+// policyStatement is a statement in an IAM policy document.  The Action, NotAction, Resource, and NotResource elements
+// may be a string, or a list of strings.
+type policyStatement struct {
+	Effect      string
+	Action      stringList
+	NotAction   stringList
+	Resource    stringList
+	NotResource stringList
+	// Condition is a map of condition operator to condition key to values
+	Condition map[string]map[string]stringList
+	doc       *policyDocument
+}
+
+// stringList is a JSON value which may be a single value, or a list of values.  Condition values may be strings,
+// numbers, or booleans, which are kept as strings.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	a, ok := v.([]interface{})
+	if !ok {
+		a = []interface{}{v}
+	}
+
+	*l = make([]string, len(a))
+	for i, v := range a {
+		(*l)[i] = fmt.Sprintf("%v", v)
+	}
+	return nil
+}
+
+// parsePolicy returns the statements in the URL encoded policy document, which may be a single statement, or a list
+func parsePolicy(doc *policyDocument) ([]*policyStatement, error) {
+	if len(doc.Document) < 1 {
+		return nil, fmt.Errorf("empty policy document")
+	}
+
+	d, err := url.QueryUnescape(doc.Document)
+	if err != nil {
+		return nil, fmt.Errorf("error unescaping policy document: %v", err)
+	}
+
+	pol := new(struct {
+		Statement json.RawMessage
+	})
+	if err := json.Unmarshal([]byte(d), pol); err != nil {
+		return nil, fmt.Errorf("error unmarshalling policy document json: %v", err)
+	}
+
+	stmts := make([]*policyStatement, 0)
+	if len(pol.Statement) < 1 {
+		return stmts, nil
+	}
+
+	if err := json.Unmarshal(pol.Statement, &stmts); err != nil {
+		s := new(policyStatement)
+		if err := json.Unmarshal(pol.Statement, s); err != nil {
+			return nil, fmt.Errorf("error unmarshalling policy statement json: %v", err)
+		}
+		stmts = append(stmts, s)
+	}
+
+	for _, s := range stmts {
+		s.doc = doc
+	}
+	return stmts, nil
+}
+
+// assumeRole returns true if the statement applies to the sts:AssumeRole action
+func (s *policyStatement) assumeRole() bool {
+	if len(s.NotAction) > 0 {
+		return !matchAny(s.NotAction, assumeRoleAction, true)
+	}
+	return matchAny(s.Action, assumeRoleAction, true)
+}
+
+// matchesResource returns true if the statement applies to the role ARN
+func (s *policyStatement) matchesResource(r string) bool {
+	if len(s.NotResource) > 0 {
+		return !matchAny(s.NotResource, r, false)
+	}
+	return matchAny(s.Resource, r, false)
+}
+
+// overlapsRole returns true if the statement applies to the role, or to some of the roles matching a wildcard role.
+// The roles matching both wildcards aren't known without listing them, so a wildcard role is treated as allowed by
+// any resource wildcard which could match some of the same roles.
+func (s *policyStatement) overlapsRole(r *PolicyRole) bool {
+	if s.matchesResource(r.Arn) {
+		return true
+	}
+
+	if !r.Wildcard() {
+		return false
+	}
+
+	if len(s.NotResource) > 0 {
+		return true
+	}
+
+	for _, res := range s.Resource {
+		if arnOverlap(r.Arn, res) {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionKeys returns the sorted condition keys of the statement
+func (s *policyStatement) conditionKeys() []string {
+	keys := make([]string, 0)
+	for _, c := range s.Condition {
+		for k := range c {
+			keys = append(keys, k)
+		}
+	}
+	return mergeKeys(nil, keys)
+}
+
+// mfaCondition returns true if the statement applies only when the user has authenticated with MFA (for Allow
+// statements), or only when the user has not authenticated with MFA (for Deny statements)
+func (s *policyStatement) mfaCondition() bool {
+	mfaValue := "true"
+	if s.Effect == "Deny" {
+		mfaValue = "false"
+	}
+
+	for op, c := range s.Condition {
+		op = strings.ToLower(op)
+		for k, v := range c {
+			switch strings.ToLower(k) {
+			case "aws:multifactorauthpresent":
+				if strings.HasPrefix(op, "bool") && matchAny(v, mfaValue, true) {
+					return true
+				}
+			case "aws:multifactorauthage":
+				if strings.HasPrefix(op, "numeric") && s.Effect == "Allow" {
+					return true
+				}
+
+				// a Null check for the key being set is true when MFA wasn't used
+				if op == "null" && matchAny(v, "true", true) == (s.Effect == "Deny") {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// allowedRoles returns the roles allowed by the Allow statements
+func allowedRoles(stmts []*policyStatement, isRole func(string) bool) []*PolicyRole {
+	roles := make([]*PolicyRole, 0)
+
+	for _, s := range stmts {
+		if s.Effect != "Allow" || !s.assumeRole() {
+			continue
+		}
+
+		newRole := func(arn string) *PolicyRole {
+			r := &PolicyRole{
+				Arn:         arn,
+				Source:      s.doc.Source,
+				Policy:      s.doc.Policy,
+				PolicyType:  s.doc.PolicyType,
+				Conditions:  s.conditionKeys(),
+				MfaRequired: s.mfaCondition(),
+				Status:      RoleAllowed,
+			}
+
+			if len(r.Conditions) > 0 {
+				r.Status = RoleConditional
+			}
+			return r
+		}
+
+		if len(s.NotResource) > 0 {
+			r := newRole("*")
+			r.NotResource = s.NotResource
+			roles = append(roles, r)
+			continue
+		}
+
+		for _, res := range s.Resource {
+			if isRole(res) {
+				roles = append(roles, newRole(res))
+			}
+		}
+	}
+
+	return roles
+}
+
+// evaluateRoles sets the status of the roles allowed by the identity policies, using the Deny statements of the
+// identity policies and the permissions boundary, and the Allow statements of the permissions boundary.  A nil boundary
+// means the user has no permissions boundary, so only the Deny statements of the identity policies are used.
+//
+// A role is denied by a Deny statement without conditions, or if no Allow statement in the permissions boundary applies
+// to it.  A Deny statement with conditions, or a permissions boundary only allowing the role with conditions, makes the
+// role conditional, adding the condition keys to the role.
+func evaluateRoles(roles []*PolicyRole, stmts []*policyStatement, boundary []*policyStatement) {
+	for _, r := range roles {
+		evaluateDenies(r, stmts)
+		evaluateDenies(r, boundary)
+
+		if boundary != nil && r.Status != RoleDenied {
+			evaluateBoundary(r, boundary)
+		}
+	}
+}
+
+// evaluateDenies applies the Deny statements which apply to the role
+func evaluateDenies(r *PolicyRole, stmts []*policyStatement) {
+	for _, s := range stmts {
+		if r.Status == RoleDenied {
+			return
+		}
+
+		if s.Effect != "Deny" || !s.assumeRole() || !s.matchesResource(r.Arn) {
+			continue
+		}
+
+		if len(s.Condition) < 1 {
+			r.Status = RoleDenied
+			r.DeniedBy = s.doc.Policy
+			continue
+		}
+
+		conditional(r, s)
+	}
+}
+
+// evaluateBoundary denies the role if no Allow statement in the permissions boundary applies to it.  If only Allow
+// statements with conditions apply to the role, it's conditional on the condition keys of those statements.
+func evaluateBoundary(r *PolicyRole, boundary []*policyStatement) {
+	allowed := make([]*policyStatement, 0)
+
+	for _, s := range boundary {
+		if s.Effect != "Allow" || !s.assumeRole() || !s.overlapsRole(r) {
+			continue
+		}
+
+		if len(s.Condition) < 1 {
+			return
+		}
+		allowed = append(allowed, s)
+	}
+
+	if len(allowed) < 1 {
+		r.Status = RoleDenied
+		r.DeniedBy = "permissions boundary"
+		return
+	}
+
+	for _, s := range allowed {
+		conditional(r, s)
+	}
+}
+
+// conditional adds the condition keys of the statement to the role, and marks it as conditional
+func conditional(r *PolicyRole, s *policyStatement) {
+	r.Status = RoleConditional
+	r.Conditions = mergeKeys(r.Conditions, s.conditionKeys())
+	if s.mfaCondition() {
+		r.MfaRequired = true
+	}
+}
+
+// mergeKeys returns the sorted, unique values of a and b
+func mergeKeys(a, b []string) []string {
+	m := make(map[string]bool)
+	for _, l := range [][]string{a, b} {
+		for _, k := range l {
+			m[k] = true
+		}
+	}
+
+	if len(m) < 1 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// matchAny returns true if s matches any of the patterns
+func matchAny(patterns []string, s string, ignoreCase bool) bool {
+	for _, p := range patterns {
+		if ignoreCase {
+			p = strings.ToLower(p)
+			s = strings.ToLower(s)
+		}
+
+		if wildcardMatch(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches s against the pattern, where * matches any sequence of characters, and ? matches any single
+// character, like the IAM policy wildcards
+func wildcardMatch(pattern, s string) bool {
+	p := []rune(pattern)
+	str := []rune(s)
+
+	// position of the last * in the pattern, and the position in s it matched up to
+	star, mark := -1, 0
+	i, j := 0, 0
+
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star = i
+			mark = j
+			i++
+		case star >= 0:
+			i = star + 1
+			mark++
+			j = mark
+		default:
+			return false
+		}
+	}
+
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// arnOverlap returns true if some ARN matches both wildcard ARNs.  The fields of the ARNs are compared separately, so a
+// wildcard in one field doesn't match across the following fields, as it would when matching the whole string.
+func arnOverlap(a, b string) bool {
+	x := strings.SplitN(a, ":", 6)
+	y := strings.SplitN(b, ":", 6)
+
+	if len(x) != 6 || len(y) != 6 {
+		return wildcardOverlap(a, b)
+	}
+
+	for i := range x {
+		if !wildcardOverlap(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardOverlap returns true if some string matches both wildcard patterns
+func wildcardOverlap(a, b string) bool {
+	x := []rune(a)
+	y := []rune(b)
+
+	// seen holds the positions already known not to overlap
+	seen := make(map[[2]int]bool)
+
+	var overlap func(i, j int) bool
+	overlap = func(i, j int) bool {
+		if i == len(x) && j == len(y) {
+			return true
+		}
+
+		k := [2]int{i, j}
+		if seen[k] {
+			return false
+		}
+
+		var res bool
+		switch {
+		case i < len(x) && x[i] == '*':
+			res = overlap(i+1, j) || (j < len(y) && overlap(i, j+1))
+		case j < len(y) && y[j] == '*':
+			res = overlap(i, j+1) || (i < len(x) && overlap(i+1, j))
+		case i < len(x) && j < len(y):
+			res = (x[i] == y[j] || x[i] == '?' || y[j] == '?') && overlap(i+1, j+1)
+		}
+
+		if !res {
+			seen[k] = true
+		}
+		return res
+	}
+
+	return overlap(0, 0)
+}
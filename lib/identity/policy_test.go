@@ -0,0 +1,163 @@
+package identity
+
+import "testing"
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"arn:aws:iam::*:role/*", "arn:aws:iam::123456789012:role/path/Admin", true},
+		{"arn:aws:iam::*:role/prod-*", "arn:aws:iam::123456789012:role/dev-admin", false},
+		{"arn:aws:iam::12345678901?:role/Admin", "arn:aws:iam::123456789012:role/Admin", true},
+		{"arn:aws:iam::12345678901?:role/Admin", "arn:aws:iam::12345678901:role/Admin", false},
+		{"*admin*", "dev-admin-role", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYc-", false},
+	}
+
+	for _, tc := range tests {
+		if m := wildcardMatch(tc.pattern, tc.s); m != tc.match {
+			t.Errorf("wildcardMatch(%s, %s) = %v", tc.pattern, tc.s, m)
+		}
+	}
+}
+
+func TestArnOverlap(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"*", "arn:aws:iam::123456789012:role/Admin", true},
+		{"arn:aws:iam::123456789012:role/dev-*", "arn:aws:iam::*:role/dev-admin", true},
+		{"arn:aws:iam::123456789012:role/dev-*", "arn:aws:iam::*:role/*-admin", true},
+		{"arn:aws:iam::123456789012:role/dev-*", "arn:aws:iam::*:role/prod-*", false},
+		{"arn:aws:iam::123456789012:role/dev-*", "arn:aws:iam::210987654321:role/*", false},
+		{"arn:aws:iam::12345678901?:role/Admin", "arn:aws:iam::123456789012:role/Admin", true},
+		{"a*", "b*", false},
+		{"*a", "*b", false},
+		{"a*c", "ab*", true},
+	}
+
+	for _, tc := range tests {
+		if o := arnOverlap(tc.a, tc.b); o != tc.overlap {
+			t.Errorf("arnOverlap(%s, %s) = %v", tc.a, tc.b, o)
+		}
+
+		if o := arnOverlap(tc.b, tc.a); o != tc.overlap {
+			t.Errorf("arnOverlap(%s, %s) = %v", tc.b, tc.a, o)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	doc := func(d string) *policyDocument {
+		return &policyDocument{Source: "user/bob", Policy: "p", PolicyType: "inline", Document: d}
+	}
+
+	t.Run("single statement", func(t *testing.T) {
+		s, err := parsePolicy(doc(`{"Statement": {"Effect": "Allow", "Action": "sts:AssumeRole", "Resource": "*"}}`))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(s) != 1 || s[0].Effect != "Allow" || len(s[0].Resource) != 1 || s[0].doc.Source != "user/bob" {
+			t.Errorf("unexpected statements: %+v", s)
+		}
+	})
+
+	t.Run("url encoded", func(t *testing.T) {
+		s, err := parsePolicy(doc(`%7B%22Statement%22%3A%5B%7B%22Effect%22%3A%22Deny%22%7D%5D%7D`))
+		if err != nil || len(s) != 1 || s[0].Effect != "Deny" {
+			t.Errorf("unexpected statements: %+v %v", s, err)
+		}
+	})
+
+	t.Run("condition values", func(t *testing.T) {
+		s, err := parsePolicy(doc(`{"Statement": [{"Effect": "Allow", "Condition": {"NumericLessThan": {"aws:MultiFactorAuthAge": 3600}, "Bool": {"aws:SecureTransport": [true]}}}]}`))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		k := s[0].conditionKeys()
+		if len(k) != 2 || k[0] != "aws:MultiFactorAuthAge" || s[0].Condition["NumericLessThan"]["aws:MultiFactorAuthAge"][0] != "3600" {
+			t.Errorf("unexpected conditions: %v", s[0].Condition)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		for _, d := range []string{"", "{Statement: []}", `{"Statement": "x"}`} {
+			if _, err := parsePolicy(doc(d)); err == nil {
+				t.Errorf("did not receive expected error for %s", d)
+			}
+		}
+	})
+}
+
+func TestPolicyStatement_MfaCondition(t *testing.T) {
+	tests := []struct {
+		effect, op, key, value string
+		mfa                    bool
+	}{
+		{"Allow", "Bool", "aws:MultiFactorAuthPresent", "true", true},
+		{"Allow", "BoolIfExists", "aws:MultiFactorAuthPresent", "false", false},
+		{"Deny", "BoolIfExists", "aws:MultiFactorAuthPresent", "false", true},
+		{"Allow", "NumericLessThan", "aws:MultiFactorAuthAge", "3600", true},
+		{"Deny", "Null", "aws:MultiFactorAuthAge", "true", true},
+		{"Allow", "Null", "aws:MultiFactorAuthAge", "false", true},
+		{"Allow", "StringEquals", "aws:RequestedRegion", "us-east-1", false},
+	}
+
+	for _, tc := range tests {
+		s := &policyStatement{Effect: tc.effect, Condition: map[string]map[string]stringList{tc.op: {tc.key: {tc.value}}}}
+		if m := s.mfaCondition(); m != tc.mfa {
+			t.Errorf("%s %s %s %s: mfa condition = %v", tc.effect, tc.op, tc.key, tc.value, m)
+		}
+	}
+}
+
+func TestEvaluateRoles(t *testing.T) {
+	doc := &policyDocument{Source: "user/bob", Policy: "p", PolicyType: "inline"}
+	newRoles := func() []*PolicyRole {
+		return []*PolicyRole{
+			{Arn: "arn:aws:iam::123456789012:role/Admin", Status: RoleAllowed},
+			{Arn: "arn:aws:iam::123456789012:role/dev-*", Status: RoleAllowed},
+		}
+	}
+
+	t.Run("no boundary", func(t *testing.T) {
+		r := newRoles()
+		evaluateRoles(r, nil, nil)
+
+		if r[0].Status != RoleAllowed || r[1].Status != RoleAllowed {
+			t.Errorf("unexpected status: %+v %+v", r[0], r[1])
+		}
+	})
+
+	t.Run("empty boundary", func(t *testing.T) {
+		r := newRoles()
+		evaluateRoles(r, nil, []*policyStatement{})
+
+		if r[0].Status != RoleDenied || r[1].DeniedBy != "permissions boundary" {
+			t.Errorf("unexpected status: %+v %+v", r[0], r[1])
+		}
+	})
+
+	t.Run("wildcard boundary", func(t *testing.T) {
+		b := []*policyStatement{
+			{Effect: "Allow", Action: stringList{"sts:*"}, Resource: stringList{"arn:aws:iam::*:role/dev-admin"}, doc: doc},
+		}
+
+		r := newRoles()
+		evaluateRoles(r, nil, b)
+
+		// the boundary allows one of the roles matching the wildcard role
+		if r[0].Status != RoleDenied || r[1].Status != RoleAllowed {
+			t.Errorf("unexpected status: %+v %+v", r[0], r[1])
+		}
+	})
+}
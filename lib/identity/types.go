@@ -5,6 +5,8 @@ type Identity struct {
 	IdentityType string
 	Provider     string
 	Username     string
+	// Partition is the AWS partition of the identity, like aws, aws-us-gov, or aws-cn
+	Partition string
 }
 
 // Roles is the list of roles the identity is allowed to assume
@@ -0,0 +1,159 @@
+// +build linux
+
+package metadata
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procRoot is the mount point of the proc filesystem, overridable for testing
+var procRoot = "/proc"
+
+// clientOwner finds the UID and PID of the local process which owns the client side of the connection between the
+// client address (ca) and server address (sa).  The PID is found by searching the open file descriptors of the
+// processes in /proc for the socket inode.  A PID of -1 is returned if the UID was found, but the process could not be
+// (typically because it's owned by another user).
+func clientOwner(ca, sa net.Addr) (int, int, error) {
+	uid, inode, err := clientSocket(ca, sa)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, findSocketPid(inode), nil
+}
+
+// clientSocket finds the UID of the owner, and the inode, of the client side of the connection between the client
+// address (ca) and server address (sa) in /proc/net/tcp (or tcp6)
+func clientSocket(ca, sa net.Addr) (int, uint64, error) {
+	cAddr, ok := ca.(*net.TCPAddr)
+	if !ok {
+		return -1, 0, fmt.Errorf("unsupported client address type %T", ca)
+	}
+
+	sAddr, ok := sa.(*net.TCPAddr)
+	if !ok {
+		return -1, 0, fmt.Errorf("unsupported server address type %T", sa)
+	}
+
+	for _, f := range []string{"tcp", "tcp6"} {
+		la := procAddr(cAddr, f == "tcp6")
+		ra := procAddr(sAddr, f == "tcp6")
+		if len(la) < 1 || len(ra) < 1 {
+			continue
+		}
+
+		uid, inode, err := findSocket(filepath.Join(procRoot, "net", f), la, ra)
+		if err != nil {
+			continue
+		}
+
+		return uid, inode, nil
+	}
+
+	return -1, 0, fmt.Errorf("socket not found for client %s", ca.String())
+}
+
+// tcpEstablished is the proc net socket state of an established TCP connection
+const tcpEstablished = "01"
+
+// findSocket searches the proc net file for the established connection from the local address la to the remote address
+// ra (in the format returned by procAddr), returning the UID and inode of the socket.  The fields of each line are:
+// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ...
+func findSocket(path string, la, ra string) (int, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return -1, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Scan() // skip header line
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		if !strings.EqualFold(fields[1], la) || !strings.EqualFold(fields[2], ra) || fields[3] != tcpEstablished {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return -1, 0, err
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return -1, 0, err
+		}
+
+		return uid, inode, nil
+	}
+
+	if err := s.Err(); err != nil {
+		return -1, 0, err
+	}
+	return -1, 0, fmt.Errorf("socket not found")
+}
+
+// procAddr formats the address like the proc net files, as the hex IP address and port, separated by a ':'.  The IP
+// address is written as 32-bit words in host (little endian) byte order, and IPv4 addresses in the tcp6 file use the
+// IPv4-mapped IPv6 form.  An empty string is returned for an IPv6 address in the tcp (IPv4) file.
+func procAddr(a *net.TCPAddr, v6 bool) string {
+	ip := a.IP.To4()
+	if v6 {
+		ip = a.IP.To16()
+	}
+
+	if ip == nil {
+		return ""
+	}
+
+	sb := new(strings.Builder)
+	for i := 0; i < len(ip); i += 4 {
+		fmt.Fprintf(sb, "%02X%02X%02X%02X", ip[i+3], ip[i+2], ip[i+1], ip[i])
+	}
+	fmt.Fprintf(sb, ":%04X", a.Port)
+
+	return sb.String()
+}
+
+// findSocketPid walks the file descriptors of the processes in /proc looking for the one holding the socket inode.
+// Processes we're not allowed to inspect are silently skipped.
+func findSocketPid(inode uint64) int {
+	target := fmt.Sprintf("socket:[%d]", inode)
+
+	procs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return -1
+	}
+
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join(procRoot, p.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			if l, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && l == target {
+				return pid
+			}
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,228 @@
+//go:build linux
+// +build linux
+
+package metadata
+
+import (
+	cfglib "aws-runas/lib/config"
+	"context"
+	"github.com/mmmorris1975/aws-config/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// client on 127.0.0.1:51234 (0xC822) connected to 169.254.169.254:80 (0x0050), owned by UID 1001 with inode 98765.  The
+// other rows use the same ports, but a different client address, or a connection which is not established.
+const mockProcNetTcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: FEA9FEA9:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 1 0000000000000000 100 0 0 10 0
+   1: 0200007F:C822 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000  1002        0 98764 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:C822 FEA9FEA9:0050 06 00000000:00000000 00:00000000 00000000  1003        0 98763 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:C822 FEA9FEA9:0050 01 00000000:00000000 00:00000000 00000000  1001        0 98765 1 0000000000000000 20 4 30 10 -1
+`
+
+func mockProcRoot(t *testing.T) string {
+	d, err := ioutil.TempDir("", "mock-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(d, "net"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(d, "net", "tcp"), []byte(mockProcNetTcp), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd := filepath.Join(d, "4242", "fd")
+	if err := os.MkdirAll(fd, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("socket:[98765]", filepath.Join(fd, "3")); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestClientOwner(t *testing.T) {
+	d := mockProcRoot(t)
+	defer os.RemoveAll(d)
+
+	procRoot = d
+	defer func() { procRoot = "/proc" }()
+
+	sa := &net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80}
+
+	t.Run("good", func(t *testing.T) {
+		uid, pid, err := clientOwner(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51234}, sa)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if uid != 1001 || pid != 4242 {
+			t.Errorf("unexpected owner, UID: %d, PID: %d", uid, pid)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, _, err := clientOwner(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4321}, sa); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad address", func(t *testing.T) {
+		if _, _, err := clientOwner(&net.UDPAddr{}, sa); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestRequestUid(t *testing.T) {
+	d := mockProcRoot(t)
+	defer os.RemoveAll(d)
+
+	procRoot = d
+	defer func() { procRoot = "/proc" }()
+
+	// the UID comes from the socket table, without searching the process file descriptors
+	if err := os.RemoveAll(filepath.Join(d, "4242")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	uid, err := requestUid(httptestRequest("127.0.0.1:51234", "169.254.169.254:80"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if uid != 1001 {
+		t.Errorf("unexpected UID: %d", uid)
+	}
+
+	if _, err := requestUid(httptestRequest("127.0.0.1:4321", "169.254.169.254:80")); err == nil {
+		t.Error("did not receive expected error")
+	}
+}
+
+func TestProcAddr(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51234}
+	if p := procAddr(a, false); p != "0100007F:C822" {
+		t.Errorf("unexpected address: %s", p)
+	}
+
+	if p := procAddr(a, true); p != "0000000000000000FFFF00000100007F:C822" {
+		t.Errorf("unexpected address: %s", p)
+	}
+
+	a6 := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 80}
+	if p := procAddr(a6, true); p != "00000000000000000000000001000000:0050" {
+		t.Errorf("unexpected address: %s", p)
+	}
+
+	if p := procAddr(a6, false); p != "" {
+		t.Errorf("unexpected address: %s", p)
+	}
+}
+
+func TestRouteProfile(t *testing.T) {
+	d := mockProcRoot(t)
+	defer os.RemoveAll(d)
+
+	procRoot = d
+	defer func() { procRoot = "/proc" }()
+
+	svc := &EC2MetadataServer{server: newServer(nil, ""), routes: map[string]string{"uid:1001": "uid-role"}}
+
+	r := httptestRequest("127.0.0.1:51234", "169.254.169.254:80")
+	if p := svc.routeProfile(r); p != "uid-role" {
+		t.Errorf("unexpected route profile: %s", p)
+	}
+
+	svc.routes["pid:4242"] = "pid-role"
+	if p := svc.routeProfile(r); p != "pid-role" {
+		t.Errorf("unexpected route profile: %s", p)
+	}
+}
+
+func TestSessionForRoute(t *testing.T) {
+	d := mockProcRoot(t)
+	defer os.RemoveAll(d)
+
+	procRoot = d
+	defer func() { procRoot = "/proc" }()
+
+	def := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{Profile: "default-role"}}}
+	routed := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{Profile: "uid-role"}}}
+
+	svc := &EC2MetadataServer{
+		server:   newServer(nil, ""),
+		active:   def,
+		routes:   map[string]string{"uid:1001": "uid-role"},
+		sessions: map[string]*roleSession{"default-role": def, "uid-role": routed},
+	}
+
+	t.Run("route", func(t *testing.T) {
+		r := httptestRequest("127.0.0.1:51234", "169.254.169.254:80")
+		if rs, err := svc.sessionFor(r, ""); err != nil || rs != routed {
+			t.Error("did not get routed session")
+		}
+	})
+
+	t.Run("header ignored", func(t *testing.T) {
+		r := httptestRequest("127.0.0.1:51234", "169.254.169.254:80")
+		r.Header.Set(ProfileHeader, "default-role")
+		if rs, err := svc.sessionFor(r, ""); err != nil || rs != routed {
+			t.Error("did not get routed session")
+		}
+	})
+
+	t.Run("other profile", func(t *testing.T) {
+		r := httptestRequest("127.0.0.1:51234", "169.254.169.254:80")
+		if _, err := svc.sessionFor(r, "default-role"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+// build a request as if it was received by a server listening on la from a client at ra
+func httptestRequest(ra, la string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath, nil)
+	r.RemoteAddr = ra
+
+	a, _ := net.ResolveTCPAddr("tcp", la)
+	return r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, a))
+}
+
+func TestEcsAuthorizeUid(t *testing.T) {
+	d := mockProcRoot(t)
+	defer os.RemoveAll(d)
+
+	procRoot = d
+	defer func() { procRoot = "/proc" }()
+
+	s := &EcsMetadataServer{server: newServer(nil, ""), AuthToken: "t0k3n", restrictUid: true}
+
+	r := httptestRequest("127.0.0.1:51234", "169.254.169.254:80")
+	r.Header.Set("Authorization", "t0k3n")
+
+	err := s.authorize(r)
+	if os.Getuid() == 1001 && err != nil {
+		t.Error(err)
+	} else if os.Getuid() != 1001 && err == nil {
+		t.Error("did not receive expected error")
+	}
+
+	s.restrictUid = false
+	if err := s.authorize(r); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func clientOwner(ca, sa net.Addr) (int, int, error) {
+	return -1, -1, fmt.Errorf("client owner lookup is not supported on %s", runtime.GOOS)
+}
+
+func clientSocket(ca, sa net.Addr) (int, uint64, error) {
+	return -1, 0, fmt.Errorf("client owner lookup is not supported on %s", runtime.GOOS)
+}
@@ -11,7 +11,7 @@ import (
 	"syscall"
 )
 
-func dropPrivileges() (err error) {
+func (svc *EC2MetadataServer) dropPrivileges() (err error) {
 	// precedence list (1st one wins)
 	// 1. SUDO_UID and SUDO_GID env vars
 	// 2. ownership of cacheDir
@@ -24,28 +24,28 @@ func dropPrivileges() (err error) {
 		uid, gid, err := checkSudoEnv()
 		if err != nil {
 			// fall through
-			log.Debugf("Error checking sudo env vars: %v", err)
+			svc.log.Debugf("Error checking sudo env vars: %v", err)
 		} else {
-			log.Debugf("Found UID/GID from sudo env vars: UID: %d, GID: %d", uid, gid)
+			svc.log.Debugf("Found UID/GID from sudo env vars: UID: %d, GID: %d", uid, gid)
 			return setPrivileges(uid, gid)
 		}
 
-		uid, gid, err = stat(cacheDir)
+		uid, gid, err = stat(svc.cacheDir)
 		if err != nil {
 			// fall through
-			log.Debugf("Error checking cache directory: %v", err)
+			svc.log.Debugf("Error checking cache directory: %v", err)
 		} else {
-			log.Debugf("Found UID/GID from cache directory ownership: UID: %d, GID: %d", uid, gid)
+			svc.log.Debugf("Found UID/GID from cache directory ownership: UID: %d, GID: %d", uid, gid)
 			return setPrivileges(uid, gid)
 		}
 
 		// Last option for getting pre-sudo uid/gid, fail if we see an error
 		uid, gid, err = statHomeDir()
 		if err != nil {
-			log.Debugf("Error checking home directory: %v", err)
+			svc.log.Debugf("Error checking home directory: %v", err)
 			return err
 		}
-		log.Debugf("Found UID/GID from home directory ownership: UID: %d, GID: %d", uid, gid)
+		svc.log.Debugf("Found UID/GID from home directory ownership: UID: %d, GID: %d", uid, gid)
 		return setPrivileges(uid, gid)
 	}
 	return nil
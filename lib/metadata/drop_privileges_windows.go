@@ -2,6 +2,6 @@
 
 package metadata
 
-func dropPrivileges() (err error) {
+func (svc *EC2MetadataServer) dropPrivileges() (err error) {
 	return nil
 }
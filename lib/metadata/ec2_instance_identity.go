@@ -0,0 +1,319 @@
+package metadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	instanceIdPath       = "/latest/meta-data/instance-id"
+	instanceTypePath     = "/latest/meta-data/instance-type"
+	amiIdPath            = "/latest/meta-data/ami-id"
+	localIpPath          = "/latest/meta-data/local-ipv4"
+	regionPath           = "/latest/meta-data/placement/region"
+	availabilityZonePath = "/latest/meta-data/placement/availability-zone"
+	iamInfoPath          = "/latest/meta-data/iam/info"
+	identityDocPath      = "/latest/dynamic/instance-identity/document"
+
+	defaultInstanceType = "t3.micro"
+	defaultImageId      = "ami-00000000000000000"
+)
+
+// InstanceIdentity holds the attributes used to build the fake EC2 instance identity served by the metadata service.
+// Any empty fields are populated with sensible values when the metadata service starts, or when the values are first
+// requested.
+type InstanceIdentity struct {
+	// InstanceId is the EC2 instance ID reported by the service, if empty a synthetic ID is derived from the local hostname
+	InstanceId string
+	// InstanceType is the EC2 instance type reported by the service, defaults to t3.micro
+	InstanceType string
+	// ImageId is the AMI ID reported by the service
+	ImageId string
+	// PrivateIp is the IP address reported as the instance's private IP, defaults to the loopback address
+	PrivateIp string
+	// Region overrides the region found in the active profile
+	Region string
+	// AvailabilityZone is the availability zone reported by the service, defaults to the 'a' zone of the region
+	AvailabilityZone string
+	// AccountId overrides the account ID discovered from the active role, or GetCallerIdentity
+	AccountId string
+
+	startTime time.Time
+}
+
+// instanceIdentityDocument is the json document returned by the instance-identity/document path
+type instanceIdentityDocument struct {
+	AccountId        string    `json:"accountId"`
+	Architecture     string    `json:"architecture"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	ImageId          string    `json:"imageId"`
+	InstanceId       string    `json:"instanceId"`
+	InstanceType     string    `json:"instanceType"`
+	PendingTime      time.Time `json:"pendingTime"`
+	PrivateIp        string    `json:"privateIp"`
+	Region           string    `json:"region"`
+	Version          string    `json:"version"`
+}
+
+// iamInfo is the json document returned by the iam/info path
+type iamInfo struct {
+	Code               string
+	LastUpdated        time.Time
+	InstanceProfileArn string
+	InstanceProfileId  string
+}
+
+// setDefaults fills in any fields which are not explicitly configured, and do not depend on the active profile
+func (i *InstanceIdentity) setDefaults() {
+	if len(i.InstanceId) < 1 {
+		i.InstanceId = syntheticInstanceId()
+	}
+
+	if len(i.InstanceType) < 1 {
+		i.InstanceType = defaultInstanceType
+	}
+
+	if len(i.ImageId) < 1 {
+		i.ImageId = defaultImageId
+	}
+
+	if len(i.PrivateIp) < 1 {
+		i.PrivateIp = "127.0.0.1"
+	}
+
+	if i.startTime.IsZero() {
+		i.startTime = time.Now().UTC().Truncate(time.Second)
+	}
+}
+
+// Build a stable instance ID in the form of a real EC2 instance ID (i- followed by 17 hex characters) using a hash of
+// the local hostname, so that the value does not change between runs on the same machine.
+func syntheticInstanceId() string {
+	h, err := os.Hostname()
+	if err != nil {
+		h = "localhost"
+	}
+
+	sum := sha256.Sum256([]byte(h))
+	return "i-" + hex.EncodeToString(sum[:])[:17]
+}
+
+// region returns the configured region, or the region of the client's profile if not configured
+func (i *InstanceIdentity) region(rs *roleSession) string {
+	if len(i.Region) > 0 {
+		return i.Region
+	}
+
+	if len(i.AvailabilityZone) > 1 {
+		return i.AvailabilityZone[:len(i.AvailabilityZone)-1]
+	}
+
+	if rs == nil {
+		return ""
+	}
+
+	if rs.profile != nil && len(rs.profile.Region) > 0 {
+		return rs.profile.Region
+	}
+
+	if rs.session != nil && rs.session.Config != nil && rs.session.Config.Region != nil {
+		return *rs.session.Config.Region
+	}
+
+	return ""
+}
+
+// availabilityZone returns the configured availability zone, or the first zone in the client's region if not configured
+func (i *InstanceIdentity) availabilityZone(rs *roleSession) string {
+	if len(i.AvailabilityZone) > 0 {
+		return i.AvailabilityZone
+	}
+
+	if r := i.region(rs); len(r) > 0 {
+		return r + "a"
+	}
+	return ""
+}
+
+// accountId returns the configured account ID, or the account ID of the client's role.  If the profile has no role,
+// the account is looked up using GetCallerIdentity with the provided STS client, and the result is cached with the
+// role session so the lookup happens once per session.
+func (i *InstanceIdentity) accountId(rs *roleSession, c stsiface.STSAPI) string {
+	if len(i.AccountId) > 0 {
+		return i.AccountId
+	}
+
+	if rs != nil && rs.profile != nil && len(rs.profile.RoleArn) > 0 {
+		if a, err := arn.Parse(rs.profile.RoleArn); err == nil {
+			return a.AccountID
+		}
+	}
+
+	if rs == nil {
+		return callerAccount(c)
+	}
+
+	rs.acctMu.Lock()
+	defer rs.acctMu.Unlock()
+
+	if len(rs.account) < 1 {
+		rs.account = callerAccount(c)
+	}
+	return rs.account
+}
+
+// callerAccount returns the account ID found by calling GetCallerIdentity, or an empty string if it can not be found
+func callerAccount(c stsiface.STSAPI) string {
+	if c == nil {
+		return ""
+	}
+
+	o, err := c.GetCallerIdentity(new(sts.GetCallerIdentityInput))
+	if err != nil {
+		return ""
+	}
+	return aws.StringValue(o.Account)
+}
+
+// instanceArch maps a GOARCH value to the architecture name EC2 reports in the identity document.  Architectures
+// EC2 has no name for are reported as-is
+func instanceArch(goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	default:
+		return goarch
+	}
+}
+
+func (i *InstanceIdentity) document(rs *roleSession, c stsiface.STSAPI) *instanceIdentityDocument {
+	return &instanceIdentityDocument{
+		AccountId:        i.accountId(rs, c),
+		Architecture:     instanceArch(runtime.GOARCH),
+		AvailabilityZone: i.availabilityZone(rs),
+		ImageId:          i.ImageId,
+		InstanceId:       i.InstanceId,
+		InstanceType:     i.InstanceType,
+		PendingTime:      i.startTime,
+		PrivateIp:        i.PrivateIp,
+		Region:           i.region(rs),
+		Version:          "2017-09-30",
+	}
+}
+
+func (i *InstanceIdentity) iamInfo(rs *roleSession, c stsiface.STSAPI) *iamInfo {
+	info := &iamInfo{Code: "Success", LastUpdated: time.Now().UTC().Truncate(time.Second)}
+
+	if rs != nil && rs.profile != nil && len(rs.profile.RoleArn) > 0 {
+		if a, err := arn.Parse(rs.profile.RoleArn); err == nil {
+			r := strings.Split(a.Resource, "/")
+			info.InstanceProfileArn = fmt.Sprintf("arn:%s:iam::%s:instance-profile/%s", a.Partition, i.accountId(rs, c), r[len(r)-1])
+		}
+	}
+
+	sum := sha256.Sum256([]byte(i.InstanceId + info.InstanceProfileArn))
+	info.InstanceProfileId = "AIPA" + strings.ToUpper(hex.EncodeToString(sum[:]))[:17]
+
+	return info
+}
+
+func instanceIdentityStsClient(rs *roleSession) stsiface.STSAPI {
+	if rs == nil || rs.session == nil {
+		return nil
+	}
+
+	if c := rs.credentials(); c != nil {
+		return sts.New(rs.session.Copy(new(aws.Config).WithCredentials(c)))
+	}
+	return sts.New(rs.session)
+}
+
+// clientSession returns the role session for the client making the request.  If the client's profile is not found, a
+// not found response is written, and nil is returned.
+func (svc *EC2MetadataServer) clientSession(w http.ResponseWriter, r *http.Request) *roleSession {
+	rs, err := svc.sessionFor(r, "")
+	if err != nil {
+		svc.log.Errorf("error finding client profile: %v", err)
+		svc.writeResponse(w, r, "Error finding profile", http.StatusNotFound)
+		return nil
+	}
+	return rs
+}
+
+func (svc *EC2MetadataServer) instanceIdHandler(w http.ResponseWriter, r *http.Request) {
+	svc.writeResponse(w, r, svc.identity.InstanceId, http.StatusOK)
+}
+
+func (svc *EC2MetadataServer) instanceTypeHandler(w http.ResponseWriter, r *http.Request) {
+	svc.writeResponse(w, r, svc.identity.InstanceType, http.StatusOK)
+}
+
+func (svc *EC2MetadataServer) amiIdHandler(w http.ResponseWriter, r *http.Request) {
+	svc.writeResponse(w, r, svc.identity.ImageId, http.StatusOK)
+}
+
+func (svc *EC2MetadataServer) localIpHandler(w http.ResponseWriter, r *http.Request) {
+	svc.writeResponse(w, r, svc.identity.PrivateIp, http.StatusOK)
+}
+
+func (svc *EC2MetadataServer) regionHandler(w http.ResponseWriter, r *http.Request) {
+	if rs := svc.clientSession(w, r); rs != nil {
+		svc.writeResponse(w, r, svc.identity.region(rs), http.StatusOK)
+	}
+}
+
+func (svc *EC2MetadataServer) availabilityZoneHandler(w http.ResponseWriter, r *http.Request) {
+	if rs := svc.clientSession(w, r); rs != nil {
+		svc.writeResponse(w, r, svc.identity.availabilityZone(rs), http.StatusOK)
+	}
+}
+
+func (svc *EC2MetadataServer) iamInfoHandler(w http.ResponseWriter, r *http.Request) {
+	rs := svc.clientSession(w, r)
+	if rs == nil {
+		return
+	}
+
+	if rs.profile == nil || len(rs.profile.RoleArn) < 1 {
+		svc.writeResponse(w, r, "", http.StatusNotFound)
+		return
+	}
+
+	b, err := json.Marshal(svc.identity.iamInfo(rs, instanceIdentityStsClient(rs)))
+	if err != nil {
+		svc.writeResponse(w, r, "error building iam info", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	svc.writeResponse(w, r, string(b), http.StatusOK)
+}
+
+func (svc *EC2MetadataServer) identityDocHandler(w http.ResponseWriter, r *http.Request) {
+	rs := svc.clientSession(w, r)
+	if rs == nil {
+		return
+	}
+
+	b, err := json.MarshalIndent(svc.identity.document(rs, instanceIdentityStsClient(rs)), "", "  ")
+	if err != nil {
+		svc.writeResponse(w, r, "error building identity document", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	svc.writeResponse(w, r, string(b), http.StatusOK)
+}
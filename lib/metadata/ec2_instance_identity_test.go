@@ -0,0 +1,244 @@
+package metadata
+
+import (
+	cfglib "aws-runas/lib/config"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/mmmorris1975/aws-config/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSyntheticInstanceId(t *testing.T) {
+	id := syntheticInstanceId()
+	if !regexp.MustCompile(`^i-[0-9a-f]{17}$`).MatchString(id) {
+		t.Errorf("invalid instance id: %s", id)
+		return
+	}
+
+	if id != syntheticInstanceId() {
+		t.Error("instance id is not stable")
+	}
+}
+
+func TestInstanceIdentity_SetDefaults(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		i := new(InstanceIdentity)
+		i.setDefaults()
+
+		if len(i.InstanceId) < 1 || i.InstanceType != defaultInstanceType || i.ImageId != defaultImageId ||
+			i.PrivateIp != "127.0.0.1" || i.startTime.IsZero() {
+			t.Errorf("data mismatch: %+v", i)
+		}
+	})
+
+	t.Run("explicit", func(t *testing.T) {
+		i := &InstanceIdentity{InstanceId: "i-deadbeef", InstanceType: "m5.large"}
+		i.setDefaults()
+
+		if i.InstanceId != "i-deadbeef" || i.InstanceType != "m5.large" {
+			t.Errorf("data mismatch: %+v", i)
+		}
+	})
+}
+
+func TestInstanceIdentity_AccountId(t *testing.T) {
+	t.Run("explicit", func(t *testing.T) {
+		i := &InstanceIdentity{AccountId: "999999999999"}
+		if a := i.accountId(svc.active, new(mockIdentityStsClient)); a != "999999999999" {
+			t.Errorf("unexpected account id: %s", a)
+		}
+	})
+
+	t.Run("role arn", func(t *testing.T) {
+		i := new(InstanceIdentity)
+		if a := i.accountId(svc.active, new(mockIdentityStsClient)); a != "686784119290" {
+			t.Errorf("unexpected account id: %s", a)
+		}
+	})
+
+	t.Run("caller identity", func(t *testing.T) {
+		rs := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: new(config.AwsConfig)}}
+
+		i := new(InstanceIdentity)
+		if a := i.accountId(rs, new(mockIdentityStsClient)); a != "123456789012" {
+			t.Errorf("unexpected account id: %s", a)
+		}
+	})
+
+	t.Run("cached caller identity", func(t *testing.T) {
+		rs := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: new(config.AwsConfig)}}
+		c := new(mockIdentityStsClient)
+
+		i := new(InstanceIdentity)
+		for x := 0; x < 3; x++ {
+			if a := i.accountId(rs, c); a != "123456789012" {
+				t.Errorf("unexpected account id: %s", a)
+			}
+		}
+
+		if c.calls != 1 {
+			t.Errorf("expected 1 GetCallerIdentity call, got %d", c.calls)
+		}
+	})
+}
+
+func TestInstanceIdentity_AvailabilityZone(t *testing.T) {
+	t.Run("explicit", func(t *testing.T) {
+		i := &InstanceIdentity{AvailabilityZone: "us-west-2c"}
+		if i.availabilityZone(svc.active) != "us-west-2c" || i.region(svc.active) != "us-west-2" {
+			t.Errorf("data mismatch: %s %s", i.availabilityZone(svc.active), i.region(svc.active))
+		}
+	})
+
+	t.Run("explicit region", func(t *testing.T) {
+		i := &InstanceIdentity{Region: "us-east-2"}
+		if i.availabilityZone(svc.active) != "us-east-2a" || i.region(svc.active) != "us-east-2" {
+			t.Errorf("data mismatch: %s %s", i.availabilityZone(svc.active), i.region(svc.active))
+		}
+	})
+}
+
+func TestInstanceIdentity_Document(t *testing.T) {
+	i := new(InstanceIdentity)
+	i.setDefaults()
+
+	d := i.document(svc.active, new(mockIdentityStsClient))
+	if d.Region != "eu-west-1" || d.AvailabilityZone != "eu-west-1a" || d.AccountId != "686784119290" ||
+		d.InstanceId != i.InstanceId {
+		t.Errorf("data mismatch: %+v", d)
+	}
+}
+
+func TestInstanceArch(t *testing.T) {
+	m := map[string]string{"amd64": "x86_64", "386": "i386", "arm64": "arm64", "arm": "arm"}
+	for k, v := range m {
+		if a := instanceArch(k); a != v {
+			t.Errorf("%s: expected %s, got %s", k, v, a)
+		}
+	}
+}
+
+func TestInstanceIdentity_IamInfo(t *testing.T) {
+	i := new(InstanceIdentity)
+	i.setDefaults()
+
+	info := i.iamInfo(svc.active, new(mockIdentityStsClient))
+	if info.Code != "Success" || info.InstanceProfileArn != "arn:aws:iam::686784119290:instance-profile/circleci-role" ||
+		!strings.HasPrefix(info.InstanceProfileId, "AIPA") {
+		t.Errorf("data mismatch: %+v", info)
+	}
+}
+
+func TestInstanceMetadataHandlers(t *testing.T) {
+	svc := &EC2MetadataServer{server: newServer(nil, ""), cr: svc.cr, active: svc.active,
+		identity: &InstanceIdentity{InstanceId: "i-0123456789abcdef0"}}
+	svc.identity.setDefaults()
+
+	tests := []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{instanceIdPath, svc.instanceIdHandler, "i-0123456789abcdef0"},
+		{instanceTypePath, svc.instanceTypeHandler, defaultInstanceType},
+		{amiIdPath, svc.amiIdHandler, defaultImageId},
+		{localIpPath, svc.localIpHandler, "127.0.0.1"},
+		{regionPath, svc.regionHandler, "eu-west-1"},
+		{availabilityZonePath, svc.availabilityZoneHandler, "eu-west-1a"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+			tc.handler(w, r)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Error("bad status code")
+				return
+			}
+
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if string(b) != tc.body {
+				t.Errorf("unexpected body: %s", b)
+			}
+		})
+	}
+
+	t.Run("identity document", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, identityDocPath, nil)
+		w := httptest.NewRecorder()
+		svc.identityDocHandler(w, r)
+
+		res := w.Result()
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" {
+			t.Error("bad response")
+			return
+		}
+
+		d := new(instanceIdentityDocument)
+		if err := json.NewDecoder(res.Body).Decode(d); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if d.InstanceId != "i-0123456789abcdef0" || d.Region != "eu-west-1" {
+			t.Errorf("data mismatch: %+v", d)
+		}
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		for p, h := range map[string]http.HandlerFunc{regionPath: svc.regionHandler,
+			availabilityZonePath: svc.availabilityZoneHandler, identityDocPath: svc.identityDocHandler,
+			iamInfoPath: svc.iamInfoHandler} {
+			r := httptest.NewRequest(http.MethodGet, p, nil)
+			r.Header.Set(ProfileHeader, "bad-profile")
+			w := httptest.NewRecorder()
+			h(w, r)
+
+			b, _ := ioutil.ReadAll(w.Result().Body)
+			if w.Result().StatusCode != http.StatusNotFound || strings.Contains(string(b), "686784119290") {
+				t.Errorf("%s: unexpected response: %d %s", p, w.Result().StatusCode, b)
+			}
+		}
+	})
+
+	t.Run("iam info no role", func(t *testing.T) {
+		svc := &EC2MetadataServer{server: newServer(nil, ""), active: &roleSession{profile: &cfglib.AwsConfig{AwsConfig: new(config.AwsConfig)}}}
+
+		r := httptest.NewRequest(http.MethodGet, iamInfoPath, nil)
+		w := httptest.NewRecorder()
+		svc.iamInfoHandler(w, r)
+
+		if w.Result().StatusCode != http.StatusNotFound {
+			t.Error("bad status code")
+		}
+	})
+}
+
+type mockIdentityStsClient struct {
+	stsiface.STSAPI
+	calls int
+}
+
+func (c *mockIdentityStsClient) GetCallerIdentity(in *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	c.calls++
+	return new(sts.GetCallerIdentityOutput).SetAccount("123456789012").
+		SetArn("arn:aws:iam::123456789012:user/bob").SetUserId("AIDAB0B"), nil
+}
@@ -4,6 +4,7 @@ import (
 	"aws-runas/lib/cache"
 	cfglib "aws-runas/lib/config"
 	credlib "aws-runas/lib/credentials"
+	"aws-runas/lib/httpclient"
 	"aws-runas/lib/identity"
 	"aws-runas/lib/saml"
 	"context"
@@ -14,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/mmmorris1975/aws-config/config"
 	"github.com/mmmorris1975/simple-logger/logger"
@@ -28,6 +30,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -39,25 +42,17 @@ const (
 	listRolesPath    = "/list-roles"
 	refreshPath      = "/refresh"
 	imdsV2Token      = "/latest/api/token"
+
+	// ProfileHeader is the HTTP request header a client can set to select the profile used to serve its credentials
+	ProfileHeader = "X-Aws-Runas-Profile"
 )
 
 var (
 	ec2MdSvcAddr *net.IPAddr
 
-	log        *logger.Logger
-	s          *session.Session
-	usr        *identity.Identity
-	profile    *cfglib.AwsConfig
-	cacheDir   string
-	cr         config.AwsConfigResolver
-	cred       *credentials.Credentials
-	samlClient saml.AwsClient
-
-	sigCh = make(chan os.Signal, 3)
-	srv   = new(http.Server)
-
-	errCredsRequired = errors.New("credentials required")
-	errMfaRequired   = errors.New("mfa token required")
+	errCredsRequired    = errors.New("credentials required")
+	errMfaRequired      = errors.New("mfa token required")
+	errSamlAuthRequired = errors.New("saml authentication required")
 )
 
 func init() {
@@ -107,25 +102,184 @@ type EC2MetadataInput struct {
 	CacheDir string
 	// SamlClient is an optional AWS SAML client to pre-configure the initial SAML client data
 	SamlClient saml.AwsClient
+	// InstanceIdentity is an optional set of attributes to customize the fake EC2 instance identity served by the service
+	InstanceIdentity *InstanceIdentity
+	// Listener is an optional net.Listener the service will accept connections on.  If not provided, the service will
+	// listen on the EC2 metadata service address.
+	Listener net.Listener
+	// Routes maps a local client to the name of the profile used to serve its credentials.  Keys are in the form of
+	// uid:<uid> or pid:<pid>, and are only supported on Linux.  Clients without a route (or ProfileHeader) receive the
+	// credentials for the profile selected in the web interface.
+	Routes map[string]string
+}
+
+// roleSession holds the credential state for a single profile served by the metadata service.  A role session is
+// shared by all of the clients using the profile, so the credential state is only accessed while holding mu, and
+// starting the session or authenticating is serialized by authMu.
+type roleSession struct {
+	profile *cfglib.AwsConfig
+	session *session.Session
+
+	authMu     sync.Mutex
+	mu         sync.Mutex
+	cred       *credentials.Credentials
+	samlClient saml.AwsClient
+	usr        *identity.Identity
+
+	// account caches the GetCallerIdentity lookup for profiles without a role
+	acctMu  sync.Mutex
+	account string
+}
+
+// sessionStart tracks a role session being started for a client, so concurrent requests for the same profile wait for
+// it, instead of starting the profile again
+type sessionStart struct {
+	done chan struct{}
+	rs   *roleSession
+	err  error
+}
+
+func (rs *roleSession) name() string {
+	if rs == nil || rs.profile == nil {
+		return ""
+	}
+	return rs.profile.Profile
+}
+
+// sessionNames returns the role session name and source identity for the profile, from the role_session_name and
+// source_identity templates.  The role session name defaults to the username.
+func (rs *roleSession) sessionNames() (string, string, error) {
+	var err error
+	d := credlib.NewSessionNameData(rs.username(), rs.name())
+
+	n := rs.username()
+	if len(rs.profile.RoleSessionName) > 0 {
+		n, err = credlib.ExpandSessionName(rs.profile.RoleSessionName, d)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	var id string
+	if len(rs.profile.SourceIdentity) > 0 {
+		id, err = credlib.ExpandSessionName(rs.profile.SourceIdentity, d)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return n, id, nil
+}
+
+// partition returns the AWS partition of the first role assumed for the profile, which is the jump role for SAML
+// profiles using a jump role
+func (rs *roleSession) partition() string {
+	if rs.profile == nil {
+		return ""
+	}
+
+	if len(rs.profile.JumpRoleArn.Resource) > 0 {
+		return rs.profile.JumpRoleArn.Partition
+	}
+	return cfglib.ArnPartition(rs.profile.RoleArn)
+}
+
+// sessionKey identifies the settings used to create the AWS session for the role session, role sessions with the same
+// key can share an AWS session
+func (rs *roleSession) sessionKey() string {
+	if rs.profile == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", rs.profile.SourceProfile, rs.partition(), rs.profile.StsRegionalEndpoints,
+		rs.profile.StsEndpointUrl)
+}
+
+func (rs *roleSession) isSaml() bool {
+	return rs.profile.SamlAuthUrl != nil && len(rs.profile.SamlAuthUrl.String()) > 0
+}
+
+func (rs *roleSession) username() string {
+	if u := rs.user(); u != nil {
+		return u.Username
+	}
+	return ""
+}
+
+func (rs *roleSession) credentials() *credentials.Credentials {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.cred
+}
+
+func (rs *roleSession) setCredentials(c *credentials.Credentials) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.cred = c
+}
+
+func (rs *roleSession) client() saml.AwsClient {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.samlClient
+}
+
+func (rs *roleSession) setClient(c saml.AwsClient) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.samlClient = c
+}
+
+func (rs *roleSession) user() *identity.Identity {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.usr
+}
+
+func (rs *roleSession) setUser(u *identity.Identity) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.usr = u
+}
+
+// EC2MetadataServer is the object encapsulating the state of the EC2 metadata service.  The service holds a session
+// for each profile selected in the web interface, or requested by a routed client, so that different local clients
+// can receive credentials for different roles at the same time.
+type EC2MetadataServer struct {
+	*server
+	session  *session.Session
+	cacheDir string
+	cr       config.AwsConfigResolver
+	identity *InstanceIdentity
+	routes   map[string]string
+
+	mu       sync.Mutex
+	sessions map[string]*roleSession
+	starting map[string]*sessionStart
+	active   *roleSession
+
+	// start starts a role session, a field to allow tests to start sessions without calling AWS
+	start func(rs *roleSession) (time.Time, error)
 }
 
 // NewEC2MetadataService starts an HTTP server which will listen on the EC2 metadata service address for handling
 // requests for instance role credentials.  SDKs will do an HTTP GET at '/latest/meta-data/iam/security-credentials/',
 // which returns the name of the instance role in use, it then appends that value to the previous request url
-// and expects the response body to contain the credential data in json format.
+// and expects the response body to contain the credential data in json format.  The network configuration for the
+// metadata service address is managed by this function, which will run until interrupted.
 func NewEC2MetadataService(opts *EC2MetadataInput) error {
-	if err := handleOptions(opts); err != nil {
+	svc, err := NewEC2MetadataServer(opts)
+	if err != nil {
 		return err
 	}
 
 	if runtime.GOOS == "linux" {
-		log.Debug("setting Linux capabilities")
+		svc.log.Debug("setting Linux capabilities")
 		if err := linuxSetCap(); err != nil {
 			return err
 		}
 	}
 
-	lo, err := setupInterface()
+	lo, err := svc.setupInterface()
 	if err != nil {
 		return err
 	}
@@ -133,76 +287,112 @@ func NewEC2MetadataService(opts *EC2MetadataInput) error {
 		if os.Getuid() == 0 {
 			// this will only work if root/administrator
 			if err := removeAddress(lo, ec2MdSvcAddr); err != nil {
-				log.Debugf("Error removing network config: %v", err)
+				svc.log.Debugf("Error removing network config: %v", err)
 			}
 		}
 	}()
 
-	hp := net.JoinHostPort(ec2MdSvcAddr.String(), "80")
-	l, err := net.Listen("tcp4", hp)
-	if err != nil {
-		log.Fatalf("Error creating listener: %v", err)
+	if svc.lsnr == nil {
+		l, err := net.Listen("tcp4", svc.addr)
+		if err != nil {
+			return fmt.Errorf("error creating listener: %v", err)
+		}
+		svc.lsnr = l
 	}
 
-	if err := dropPrivileges(); err != nil {
-		log.Fatalf("Error dropping privileges, will not continue: %v", err)
+	if err := svc.dropPrivileges(); err != nil {
+		return fmt.Errorf("error dropping privileges, will not continue: %v", err)
 	}
 
 	// install signal handler, after the "dangerous" bits, to shutdown gracefully when we get a ^C (SIGINT) or ^\ (SIGQUIT)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 3)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGQUIT)
+	defer signal.Stop(sigCh)
+
 	go func() {
-		for {
-			sig := <-sigCh
-			log.Debugf("Metadata service got signal: %s", sig.String())
-			if srv != nil {
-				if err := srv.Shutdown(context.Background()); err != nil {
-					log.Debugf("Error shutting down metadata service: %v", err)
-				}
-			}
+		select {
+		case sig := <-sigCh:
+			svc.log.Debugf("Metadata service got signal: %s", sig.String())
+			cancel()
+		case <-ctx.Done():
 		}
 	}()
 
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/site.js", jsHandler)
-	http.HandleFunc(authPath, authHandler)
-	http.HandleFunc(profilePath, profileHandler)
-	http.HandleFunc(ec2MdSvcCredPath, credHandler)
-	http.HandleFunc(listRolesPath, listRoleHandler)
-	http.HandleFunc(refreshPath, refreshHandler)
-	http.Handle(imdsV2Token, http.NotFoundHandler()) // disable IMDSv2 (for now?)
+	if err := svc.Start(ctx); err != nil {
+		return err
+	}
 
-	log.Infoln("EC2 Metadata Service ready!")
-	log.Infof("Access the web interface at http://%s and select a role to begin", hp)
-	return srv.Serve(l)
+	svc.log.Infoln("EC2 Metadata Service ready!")
+	svc.log.Infof("Access the web interface at http://%s and select a role to begin", svc.Addr())
+	return svc.Wait()
 }
 
-func handleOptions(opts *EC2MetadataInput) error {
-	log = opts.Logger
-	if log == nil {
-		log = logger.StdLogger
+// NewEC2MetadataServer creates a new EC2MetadataServer using the provided EC2MetadataInput options.  Unless a Listener
+// is provided in the options, the server will listen on the EC2 metadata service address when started, which must
+// already be configured on the system.
+func NewEC2MetadataServer(opts *EC2MetadataInput) (*EC2MetadataServer, error) {
+	if opts.Session == nil {
+		return nil, errors.New("invalid session provided")
 	}
 
-	profile = opts.Config        // may be nil/empty if no profile passed at startup, it's not an error
-	samlClient = opts.SamlClient // may be nil/empty if we're not starting with a SAML profile, it's not an error
+	svc := &EC2MetadataServer{
+		server:   newServer(opts.Logger, net.JoinHostPort(ec2MdSvcAddr.String(), "80")),
+		session:  opts.Session,
+		cacheDir: opts.CacheDir,
+		identity: opts.InstanceIdentity,
+		routes:   opts.Routes,
+		sessions: make(map[string]*roleSession),
+		starting: make(map[string]*sessionStart),
+	}
+	svc.lsnr = opts.Listener
+	svc.start = svc.startSession
 
-	s = opts.Session
-	if s == nil {
-		return errors.New("invalid session provided")
+	if svc.identity == nil {
+		svc.identity = new(InstanceIdentity)
 	}
+	svc.identity.setDefaults()
+
+	// Config may be nil/empty if no profile passed at startup, it's not an error
+	// SamlClient may be nil/empty if we're not starting with a SAML profile, it's not an error
+	// The session isn't started, so it's only served to clients once it's selected in the web interface
+	svc.active = &roleSession{profile: opts.Config, session: opts.Session, samlClient: opts.SamlClient}
 
-	cacheDir = opts.CacheDir
-	if len(cacheDir) < 1 {
+	if len(svc.cacheDir) < 1 {
 		d, err := os.UserCacheDir()
 		if err != nil {
-			log.Debugf("Error finding User Cache Dir: %v, using Temp Dir", err)
+			svc.log.Debugf("Error finding User Cache Dir: %v, using Temp Dir", err)
 			d = os.TempDir()
 		}
-		cacheDir = d
+		svc.cacheDir = d
 	}
 
-	_cr, err := config.NewAwsConfigResolver(nil)
-	cr = _cr
-	return err
+	cr, err := config.NewAwsConfigResolver(nil)
+	if err != nil {
+		return nil, err
+	}
+	svc.cr = cr
+
+	svc.mux.HandleFunc("/", svc.homeHandler)
+	svc.mux.HandleFunc("/site.js", svc.jsHandler)
+	svc.mux.HandleFunc(authPath, svc.authHandler)
+	svc.mux.HandleFunc(profilePath, svc.profileHandler)
+	svc.mux.HandleFunc(ec2MdSvcCredPath, svc.credHandler)
+	svc.mux.HandleFunc(listRolesPath, svc.listRoleHandler)
+	svc.mux.HandleFunc(refreshPath, svc.refreshHandler)
+	svc.mux.HandleFunc(instanceIdPath, svc.instanceIdHandler)
+	svc.mux.HandleFunc(instanceTypePath, svc.instanceTypeHandler)
+	svc.mux.HandleFunc(amiIdPath, svc.amiIdHandler)
+	svc.mux.HandleFunc(localIpPath, svc.localIpHandler)
+	svc.mux.HandleFunc(regionPath, svc.regionHandler)
+	svc.mux.HandleFunc(availabilityZonePath, svc.availabilityZoneHandler)
+	svc.mux.HandleFunc(iamInfoPath, svc.iamInfoHandler)
+	svc.mux.HandleFunc(identityDocPath, svc.identityDocHandler)
+	svc.mux.Handle(imdsV2Token, http.NotFoundHandler()) // disable IMDSv2 (for now?)
+
+	return svc, nil
 }
 
 // Set capabilities to allow us to run without sudo or setuid on Linux. After installing the tool, you must run
@@ -224,12 +414,12 @@ func linuxSetCap() error {
 // admin/sudo privileges on the system, and relies on OS-specific commands under the covers.
 // However, it avoids a bunch of other ugliness to make things work (iptables for linux, not
 // sure about others ... maybe the route command? Regardless, even those require admin/sudo)
-func setupInterface() (string, error) {
+func (svc *EC2MetadataServer) setupInterface() (string, error) {
 	lo, err := discoverLoopback()
 	if err != nil {
 		return "", err
 	}
-	log.Debugf("LOOPBACK INTERFACE: %s", lo)
+	svc.log.Debugf("LOOPBACK INTERFACE: %s", lo)
 
 	if err := addAddress(lo, ec2MdSvcAddr); err != nil {
 		if err := removeAddress(lo, ec2MdSvcAddr); err != nil {
@@ -243,7 +433,7 @@ func setupInterface() (string, error) {
 	return lo, err
 }
 
-func writeResponse(w http.ResponseWriter, r *http.Request, body string, code int) {
+func (svc *EC2MetadataServer) writeResponse(w http.ResponseWriter, r *http.Request, body string, code int) {
 	if code < 100 {
 		code = http.StatusOK
 	}
@@ -257,18 +447,18 @@ func writeResponse(w http.ResponseWriter, r *http.Request, body string, code int
 	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:63342")
 	w.WriteHeader(code)
 	if _, err := w.Write([]byte(body)); err != nil {
-		log.Error(err)
+		svc.log.Error(err)
 	}
 
-	log.Infof("%s %s %s %d %s", r.Method, r.URL.Path, r.Proto, code, contentLength)
+	svc.log.Infof("%s %s %s %d %s", r.Method, r.URL.Path, r.Proto, code, contentLength)
 }
 
-func homeHandler(w http.ResponseWriter, r *http.Request) {
+func (svc *EC2MetadataServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
-	writeResponse(w, r, indexHtml, http.StatusOK)
+	svc.writeResponse(w, r, indexHtml, http.StatusOK)
 }
 
-func jsHandler(w http.ResponseWriter, r *http.Request) {
+func (svc *EC2MetadataServer) jsHandler(w http.ResponseWriter, r *http.Request) {
 	m := make(map[string]interface{})
 	m["auth_ep"] = authPath
 	m["profile_ep"] = profilePath
@@ -277,119 +467,312 @@ func jsHandler(w http.ResponseWriter, r *http.Request) {
 
 	b := new(strings.Builder)
 	if err := siteJs.Execute(b, m); err != nil {
-		log.Error(err)
-		writeResponse(w, r, "Error building content", http.StatusInternalServerError)
+		svc.log.Error(err)
+		svc.writeResponse(w, r, "Error building content", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/javascript")
-	writeResponse(w, r, b.String(), http.StatusOK)
+	svc.writeResponse(w, r, b.String(), http.StatusOK)
 }
 
-func profileHandler(w http.ResponseWriter, r *http.Request) {
+func (svc *EC2MetadataServer) profileHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
-		p, hErr := getProfileConfig(r.Body)
+		p, hErr := svc.getProfileConfig(r.Body)
 		if hErr != nil {
-			writeResponse(w, r, hErr.Error(), hErr.code)
+			svc.writeResponse(w, r, hErr.Error(), hErr.code)
 			return
 		}
-		log.Debugf("retrieved profile %+v", p)
+		svc.log.Debugf("retrieved profile %+v", p)
 
-		if profile == nil || p.SourceProfile != profile.SourceProfile {
-			if err := updateSession(p.SourceProfile); err != nil {
-				log.Debugf("error updating session: %v", err)
-			}
+		rs, err := svc.newRoleSession(p)
+		if err != nil {
+			svc.writeResponse(w, r, fmt.Sprintf("configuration error: %v", err), http.StatusInternalServerError)
+			return
 		}
+		svc.setActive(rs)
 
-		var err error
-		var t time.Time
-		profile, err = cfglib.Wrap(p)
+		t, err := svc.start(rs)
 		if err != nil {
-			writeResponse(w, r, fmt.Sprintf("configuration error: %v", err), http.StatusInternalServerError)
+			switch e := err.(type) {
+			case *handlerError:
+				svc.writeResponse(w, r, e.Error(), e.code)
+			default:
+				if errors.Is(err, errSamlAuthRequired) {
+					svc.samlProfileAuthError(w, r, rs)
+				} else {
+					svc.iamProfileAuthError(w, r, err)
+				}
+			}
 			return
 		}
+		svc.addSession(rs)
 
-		var idp identity.Provider
-		if profile.SamlAuthUrl != nil && len(profile.SamlAuthUrl.String()) > 0 {
-			if hErr := createSamlClient(); hErr != nil {
-				writeResponse(w, r, hErr.Error(), hErr.code)
-				return
-			}
+		svc.writeResponse(w, r, t.Local().String(), http.StatusOK)
+	} else {
+		svc.sendProfile(w, r)
+	}
+}
 
-			// We must fetch the SamlResponse to have valid identity information, this may require auth/re-auth
-			_, err = samlClient.AwsSaml()
-			if err != nil {
-				// assume any error indicates the need to do SAML authentication
-				samlProfileAuthError(w, r)
-				return
-			}
-			d, _ := samlClient.GetSessionDuration()
-			t = time.Now().Add(time.Duration(d) * time.Second)
+// newRoleSession creates the session state for the provided profile.  If the profile uses the same source profile,
+// partition, and STS endpoint as the active session, the AWS session is shared, otherwise a new session using the
+// source profile is created.  The session is not served to clients until it is started, and added using addSession().
+func (svc *EC2MetadataServer) newRoleSession(p *config.AwsConfig) (*roleSession, error) {
+	c, err := cfglib.Wrap(p)
+	if err != nil {
+		return nil, err
+	}
 
-			idp = samlClient
-		} else {
-			cred = createSessionCredentials()
-			log.Debugf("CREDS: %+v", cred)
+	rs := &roleSession{profile: c}
 
-			if _, err = cred.Get(); err != nil {
-				iamProfileAuthError(w, r, err)
-				return
-			}
-			t, _ = cred.ExpiresAt()
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.active != nil && svc.active.profile != nil && svc.active.session != nil &&
+		rs.sessionKey() == svc.active.sessionKey() {
+		rs.session = svc.active.session
+	} else {
+		rs.session = svc.newSession(rs)
+	}
+
+	return rs, nil
+}
+
+// addSession makes the started role session available to clients, replacing any existing session for the profile
+func (svc *EC2MetadataServer) addSession(rs *roleSession) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.sessions[rs.name()] = rs
+}
+
+func (svc *EC2MetadataServer) setActive(rs *roleSession) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.active = rs
+}
+
+func (svc *EC2MetadataServer) activeSession() *roleSession {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.active
+}
+
+// startSession gets the session credentials, or SAML assertion, for the role session so that we're able to assume
+// the role of the profile.  The returned time is the expiration of the session.  An errSamlAuthRequired error, or an
+// error from the session credential provider, indicates the need to authenticate via the web interface.
+func (svc *EC2MetadataServer) startSession(rs *roleSession) (time.Time, error) {
+	var t time.Time
+	var idp identity.Provider
 
-			idp = identity.NewAwsIdentityProvider(s).WithLogger(log)
+	rs.authMu.Lock()
+	defer rs.authMu.Unlock()
+
+	if rs.isSaml() {
+		sc, hErr := svc.createSamlClient(rs)
+		if hErr != nil {
+			return t, hErr
 		}
+		rs.setClient(sc)
 
-		usr, err = idp.GetIdentity()
-		if err != nil {
-			log.Errorf("error resolving identity: %v", err)
+		// We must fetch the SamlResponse to have valid identity information, this may require auth/re-auth
+		if _, err := sc.AwsSaml(); err != nil {
+			// assume any error indicates the need to do SAML authentication
+			return t, errSamlAuthRequired
+		}
+		d, _ := sc.GetSessionDuration()
+		t = time.Now().Add(time.Duration(d) * time.Second)
+
+		idp = sc
+	} else {
+		c := svc.createSessionCredentials(rs)
+		svc.log.Debugf("CREDS: %+v", c)
+
+		if _, err := c.Get(); err != nil {
+			return t, err
 		}
+		t, _ = c.ExpiresAt()
+		rs.setCredentials(c)
+
+		idp = identity.NewAwsIdentityProvider(rs.session).WithLogger(svc.log)
+	}
+
+	usr, err := idp.GetIdentity()
+	if err != nil {
+		svc.log.Errorf("error resolving identity: %v", err)
+	}
+	rs.setUser(usr)
+
+	return t, nil
+}
+
+// sessionFor finds the role session to use for the client request.  A client with a configured route is only served
+// the routed profile, otherwise the session is found using the ProfileHeader request header, the role name in the
+// request path, then the session for the profile selected in the web interface.  If the role name in the request path
+// isn't the profile of the session found for the client, or the profile can't be started, an error is returned, so a
+// client never receives the credentials of a profile it didn't ask for.
+func (svc *EC2MetadataServer) sessionFor(r *http.Request, name string) (*roleSession, error) {
+	var rs *roleSession
+	var err error
 
-		writeResponse(w, r, t.Local().String(), http.StatusOK)
+	if p := svc.routeProfile(r); len(p) > 0 {
+		rs, err = svc.namedSession(p)
+	} else if h := r.Header.Get(ProfileHeader); len(h) > 0 {
+		rs, err = svc.namedSession(h)
+	} else if a := svc.activeSession(); len(name) < 1 || a.name() == name {
+		rs = a
 	} else {
-		sendProfile(w, r)
+		rs, err = svc.namedSession(name)
+	}
+
+	if err != nil {
+		return nil, err
 	}
+
+	if len(name) > 0 && rs.name() != name {
+		return nil, fmt.Errorf("profile %s is not available to the client", name)
+	}
+	return rs, nil
 }
 
-func samlProfileAuthError(w http.ResponseWriter, r *http.Request) {
+// namedSession returns the role session for the named profile, creating and starting it if necessary.  A profile
+// which requires authentication (MFA or SAML login) must first be selected in the web interface.  Concurrent requests
+// for a profile which isn't started wait for a single request to start it, and share the result.
+func (svc *EC2MetadataServer) namedSession(name string) (*roleSession, error) {
+	svc.mu.Lock()
+	if rs, ok := svc.sessions[name]; ok {
+		svc.mu.Unlock()
+		return rs, nil
+	}
+
+	if st, ok := svc.starting[name]; ok {
+		svc.mu.Unlock()
+		<-st.done
+		return st.rs, st.err
+	}
+
+	if svc.starting == nil {
+		svc.starting = make(map[string]*sessionStart)
+	}
+	st := &sessionStart{done: make(chan struct{})}
+	svc.starting[name] = st
+	svc.mu.Unlock()
+
+	st.rs, st.err = svc.resolveSession(name)
+
+	svc.mu.Lock()
+	delete(svc.starting, name)
+	if st.err == nil {
+		svc.sessions[name] = st.rs
+	}
+	svc.mu.Unlock()
+	close(st.done)
+
+	return st.rs, st.err
+}
+
+// resolveSession creates and starts the role session for the named profile
+func (svc *EC2MetadataServer) resolveSession(name string) (*roleSession, error) {
+	p, err := svc.cr.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := svc.newRoleSession(p)
+	if err != nil {
+		return nil, err
+	}
+
+	start := svc.start
+	if start == nil {
+		start = svc.startSession
+	}
+
+	if _, err := start(rs); err != nil {
+		return nil, fmt.Errorf("profile %s requires authentication, select it in the web interface: %v", name, err)
+	}
+	return rs, nil
+}
+
+// routeProfile looks up the local process which made the request, and returns the profile name of any configured
+// route for the PID or UID of that process.  The PID is only looked up if there are PID routes.
+func (svc *EC2MetadataServer) routeProfile(r *http.Request) string {
+	if len(svc.routes) < 1 {
+		return ""
+	}
+
+	if !svc.hasPidRoutes() {
+		uid, err := requestUid(r)
+		if err != nil {
+			svc.log.Debugf("error looking up client owner: %v", err)
+			return ""
+		}
+		svc.log.Debugf("client %s has UID %d", r.RemoteAddr, uid)
+
+		return svc.routes[fmt.Sprintf("uid:%d", uid)]
+	}
+
+	uid, pid, err := requestOwner(r)
+	if err != nil {
+		svc.log.Debugf("error looking up client owner: %v", err)
+		return ""
+	}
+	svc.log.Debugf("client %s has UID %d, PID %d", r.RemoteAddr, uid, pid)
+
+	if p, ok := svc.routes[fmt.Sprintf("pid:%d", pid)]; ok && pid > 0 {
+		return p
+	}
+
+	return svc.routes[fmt.Sprintf("uid:%d", uid)]
+}
+
+func (svc *EC2MetadataServer) hasPidRoutes() bool {
+	for k := range svc.routes {
+		if strings.HasPrefix(k, "pid:") {
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *EC2MetadataServer) samlProfileAuthError(w http.ResponseWriter, r *http.Request, rs *roleSession) {
 	pr := credentialPrompt{
-		Username: aws.String(profile.SamlUsername),
+		Username: aws.String(rs.profile.SamlUsername),
 		Password: aws.String(""),
 		Type:     "saml",
 	}
 
-	if samlClient.Client().MfaType == saml.MfaTypeCode {
+	if rs.client().Client().MfaType == saml.MfaTypeCode {
 		pr.MfaCode = aws.String("")
 	}
 	body, _ := json.Marshal(pr)
 
-	writeResponse(w, r, string(body), http.StatusUnauthorized)
+	svc.writeResponse(w, r, string(body), http.StatusUnauthorized)
 }
 
-func iamProfileAuthError(w http.ResponseWriter, r *http.Request, err error) {
+func (svc *EC2MetadataServer) iamProfileAuthError(w http.ResponseWriter, r *http.Request, err error) {
 	pr := credentialPrompt{MfaCode: aws.String(""), Type: "session"}
 	body, _ := json.Marshal(pr)
 
 	switch t := err.(type) {
 	case *credlib.ErrMfaRequired:
-		writeResponse(w, r, string(body), http.StatusUnauthorized)
+		svc.writeResponse(w, r, string(body), http.StatusUnauthorized)
 		return
 	case awserr.Error:
 		if t.Code() == "AccessDenied" && strings.HasPrefix(t.Message(), "MultiFactorAuthentication failed") {
-			writeResponse(w, r, string(body), http.StatusUnauthorized)
+			svc.writeResponse(w, r, string(body), http.StatusUnauthorized)
 			return
 		}
 	}
 
-	log.Error(err)
-	writeResponse(w, r, "Error getting session credentials", http.StatusInternalServerError)
+	svc.log.Error(err)
+	svc.writeResponse(w, r, "Error getting session credentials", http.StatusInternalServerError)
 }
 
-func createSessionCredentials(mfa ...string) *credentials.Credentials {
-	return credlib.NewSessionTokenCredentials(s, func(pv *credlib.SessionTokenProvider) {
-		pv.Duration = profile.SessionTokenDuration
-		pv.SerialNumber = profile.MfaSerial
-		pv.Log = log
+func (svc *EC2MetadataServer) createSessionCredentials(rs *roleSession, mfa ...string) *credentials.Credentials {
+	return credlib.NewSessionTokenCredentials(rs.session, func(pv *credlib.SessionTokenProvider) {
+		pv.Duration = rs.profile.SessionTokenDuration
+		pv.SerialNumber = rs.profile.MfaSerial
+		pv.Log = svc.log
 		pv.TokenProvider = func() (string, error) {
 			return "", new(credlib.ErrMfaRequired)
 		}
@@ -398,21 +781,27 @@ func createSessionCredentials(mfa ...string) *credentials.Credentials {
 			pv.TokenCode = mfa[0]
 		}
 
-		cf := cacheFile(fmt.Sprintf(".aws_session_token_%s", profile.SourceProfile))
+		cf := svc.cacheFile(fmt.Sprintf(".aws_session_token_%s", rs.profile.SourceProfile))
 		if len(cf) > 0 {
 			pv.Cache = cache.NewFileCredentialCache(cf)
 		}
 	})
 }
 
-func createSamlClient() *handlerError {
-	jar, err := cache.NewCookieJarFile(cacheFile(".saml-client.cookies"))
+func (svc *EC2MetadataServer) createSamlClient(rs *roleSession) (saml.AwsClient, *handlerError) {
+	jar, err := cache.NewCookieJarFile(svc.cacheFile(".saml-client.cookies"))
 	if err != nil {
-		return newHandlerError(err.Error(), http.StatusInternalServerError)
+		return nil, newHandlerError(err.Error(), http.StatusInternalServerError)
 	}
 
-	sc, err := saml.GetClient(profile.SamlProvider, profile.SamlAuthUrl.String(), func(s *saml.BaseAwsClient) {
-		s.Username = profile.SamlUsername
+	hc, err := httpclient.New(rs.profile.HttpClientOptions())
+	if err != nil {
+		return nil, newHandlerError(err.Error(), http.StatusInternalServerError)
+	}
+
+	sc, err := saml.GetClient(rs.profile.SamlProvider, rs.profile.SamlAuthUrl.String(), func(s *saml.BaseAwsClient) {
+		s.SetHttpClient(hc)
+		s.Username = rs.profile.SamlUsername
 		s.Password = os.Getenv("SAML_PASSWORD")
 		s.CredProvider = func(u string, p string) (string, string, error) {
 			return "", "", errCredsRequired
@@ -420,18 +809,18 @@ func createSamlClient() *handlerError {
 		s.MfaTokenProvider = func() (string, error) {
 			return "", errMfaRequired
 		}
+		s.Partition = rs.partition()
 		s.SetCookieJar(jar)
 	})
 
 	if err != nil {
-		return newHandlerError(err.Error(), http.StatusInternalServerError)
+		return nil, newHandlerError(err.Error(), http.StatusInternalServerError)
 	}
-	samlClient = sc
 
-	return nil
+	return sc, nil
 }
 
-func getProfileConfig(r io.Reader) (*config.AwsConfig, *handlerError) {
+func (svc *EC2MetadataServer) getProfileConfig(r io.Reader) (*config.AwsConfig, *handlerError) {
 	if r == nil {
 		return nil, newHandlerError("nil reader", http.StatusInternalServerError)
 	}
@@ -439,79 +828,99 @@ func getProfileConfig(r io.Reader) (*config.AwsConfig, *handlerError) {
 	b := make([]byte, 4096)
 	n, err := r.Read(b)
 	if err != nil && err != io.EOF {
-		log.Error(err)
+		svc.log.Error(err)
 		return nil, newHandlerError("Error reading request data", http.StatusInternalServerError)
 	}
 
 	in := string(b[:n])
-	p, err := cr.Resolve(in)
+	p, err := svc.cr.Resolve(in)
 	if err != nil {
-		log.Error(err)
+		svc.log.Error(err)
 		return nil, newHandlerError("Error resolving profile config", http.StatusInternalServerError)
 	}
 
 	return p, nil
 }
 
-func updateSession(p string) (err error) {
+// newSession creates an AWS session for the source profile of the role session, using a region in the partition of the
+// role, and the STS endpoint settings of the profile, for the STS and IAM API calls
+func (svc *EC2MetadataServer) newSession(rs *roleSession) *session.Session {
 	var sc *aws.Config
-	if s != nil {
-		sc = s.Config
+	if svc.session != nil {
+		sc = svc.session.Config
 	} else {
-		sc = new(aws.Config).WithCredentialsChainVerboseErrors(true).WithLogger(log)
-		if log.Level == logger.DEBUG {
+		sc = new(aws.Config).WithCredentialsChainVerboseErrors(true).WithLogger(svc.log)
+		if svc.log.Level == logger.DEBUG {
 			sc.LogLevel = aws.LogLevel(aws.LogDebug)
 		}
 	}
 
-	o := session.Options{Config: *sc, Profile: p}
-	s = session.Must(session.NewSessionWithOptions(o))
-
-	return nil
+	o := session.Options{Config: *sc, Profile: rs.profile.SourceProfile}
+	o.Config.Region = aws.String(cfglib.PartitionRegion(rs.partition(), aws.StringValue(sc.Region)))
+	o.Config.MergeIn(credlib.StsEndpointConfig(rs.profile.StsRegionalEndpoints, rs.profile.StsEndpointUrl))
+	return session.Must(session.NewSessionWithOptions(o))
 }
 
-func sendProfile(w http.ResponseWriter, r *http.Request) {
-	// return name of active role
-	writeResponse(w, r, profile.Profile, http.StatusOK)
+// return name of the role for the client, which may be different than the profile selected in the web interface
+func (svc *EC2MetadataServer) sendProfile(w http.ResponseWriter, r *http.Request) {
+	rs, err := svc.sessionFor(r, "")
+	if err != nil {
+		svc.log.Errorf("error finding client profile: %v", err)
+		svc.writeResponse(w, r, "Error finding profile", http.StatusNotFound)
+		return
+	}
+
+	svc.writeResponse(w, r, rs.name(), http.StatusOK)
 }
 
-func listRoleHandler(w http.ResponseWriter, r *http.Request) {
-	b, err := json.Marshal(listRoles())
+func (svc *EC2MetadataServer) listRoleHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(svc.listRoles())
 	if err != nil {
-		writeResponse(w, r, "error building role list", http.StatusInternalServerError)
+		svc.writeResponse(w, r, "error building role list", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	writeResponse(w, r, string(b), http.StatusOK)
+	svc.writeResponse(w, r, string(b), http.StatusOK)
 }
 
-func listRoles() []string {
-	if cr != nil {
-		return cr.ListProfiles(true)
+func (svc *EC2MetadataServer) listRoles() []string {
+	if svc.cr != nil {
+		return svc.cr.ListProfiles(true)
 	}
 	return []string{}
 }
 
-func cacheFile(p string) string {
-	if len(cacheDir) > 0 && len(p) > 0 {
-		return filepath.Join(cacheDir, p)
+func (svc *EC2MetadataServer) cacheFile(p string) string {
+	if len(svc.cacheDir) > 0 && len(p) > 0 {
+		return filepath.Join(svc.cacheDir, p)
 	}
 	return ""
 }
 
-func authHandler(w http.ResponseWriter, r *http.Request) {
-	auth, hErr := getAuth(r.Body)
+func (svc *EC2MetadataServer) authHandler(w http.ResponseWriter, r *http.Request) {
+	auth, hErr := svc.getAuth(r.Body)
 	if hErr != nil {
-		writeResponse(w, r, hErr.Error(), hErr.code)
+		svc.writeResponse(w, r, hErr.Error(), hErr.code)
 		return
 	}
 
 	var idp identity.Provider
 	var err error
 
+	// authentication is always done for the profile selected in the web interface
+	rs := svc.activeSession()
+
+	rs.authMu.Lock()
+	defer rs.authMu.Unlock()
+
 	if auth.Type == "saml" {
-		sc := samlClient.Client()
+		c := rs.client()
+		if c == nil {
+			svc.writeResponse(w, r, "profile does not use saml", http.StatusBadRequest)
+			return
+		}
+		sc := c.Client()
 
 		if auth.Username != nil {
 			sc.Username = *auth.Username
@@ -525,54 +934,61 @@ func authHandler(w http.ResponseWriter, r *http.Request) {
 			sc.MfaToken = *auth.MfaCode
 		}
 
-		err = samlClient.Authenticate()
+		err = c.Authenticate()
 		if errors.Is(err, errCredsRequired) {
 			// invalid username or password
 			auth.Password = aws.String("")
-			log.Error("SAML credentials required")
-			writeResponse(w, r, "invalid saml credentials", http.StatusUnauthorized)
+			svc.log.Error("SAML credentials required")
+			svc.writeResponse(w, r, "invalid saml credentials", http.StatusUnauthorized)
 			return
 		} else if errors.Is(err, errMfaRequired) {
 			// invalid mfa
-			log.Error("SAML MFA required")
-			writeResponse(w, r, "saml mfa required", http.StatusUnauthorized)
+			svc.log.Error("SAML MFA required")
+			svc.writeResponse(w, r, "saml mfa required", http.StatusUnauthorized)
 			return
 		} else if err != nil {
-			log.Errorf("error doing SAML authentication: %v", err)
-			writeResponse(w, r, "Login failed", http.StatusUnauthorized)
+			svc.log.Errorf("error doing SAML authentication: %v", err)
+			svc.writeResponse(w, r, "Login failed", http.StatusUnauthorized)
 			return
 		}
 
-		if _, err = samlClient.AwsSaml(); err != nil {
-			log.Errorf("error getting AWS SAML: %v", err)
-			writeResponse(w, r, "Error getting AWS SAML", http.StatusInternalServerError)
+		if _, err = c.AwsSaml(); err != nil {
+			svc.log.Errorf("error getting AWS SAML: %v", err)
+			svc.writeResponse(w, r, "Error getting AWS SAML", http.StatusInternalServerError)
 			return
 		}
 
-		idp = samlClient
+		idp = c
 	} else {
-		cred = createSessionCredentials(*auth.MfaCode)
+		var mfa string
+		if auth.MfaCode != nil {
+			mfa = *auth.MfaCode
+		}
+		c := svc.createSessionCredentials(rs, mfa)
 
-		if _, err = cred.Get(); err != nil {
-			log.Errorf("error getting session credentials: %v", err)
-			writeResponse(w, r, "Error getting session credentials", http.StatusUnauthorized)
+		if _, err = c.Get(); err != nil {
+			svc.log.Errorf("error getting session credentials: %v", err)
+			svc.writeResponse(w, r, "Error getting session credentials", http.StatusUnauthorized)
 			return
 		}
+		rs.setCredentials(c)
 
-		idp = identity.NewAwsIdentityProvider(s).WithLogger(log)
+		idp = identity.NewAwsIdentityProvider(rs.session).WithLogger(svc.log)
 	}
 
-	usr, err = idp.GetIdentity()
+	usr, err := idp.GetIdentity()
 	if err != nil {
-		log.Errorf("error getting identity information: %v", err)
-		writeResponse(w, r, "Error getting identity information", http.StatusInternalServerError)
+		svc.log.Errorf("error getting identity information: %v", err)
+		svc.writeResponse(w, r, "Error getting identity information", http.StatusInternalServerError)
 		return
 	}
+	rs.setUser(usr)
+	svc.addSession(rs)
 
-	writeResponse(w, r, "", http.StatusOK)
+	svc.writeResponse(w, r, "", http.StatusOK)
 }
 
-func getAuth(r io.ReadCloser) (*credentialPrompt, *handlerError) {
+func (svc *EC2MetadataServer) getAuth(r io.ReadCloser) (*credentialPrompt, *handlerError) {
 	if r == nil {
 		return nil, newHandlerError("nil reader", http.StatusInternalServerError)
 	}
@@ -581,57 +997,74 @@ func getAuth(r io.ReadCloser) (*credentialPrompt, *handlerError) {
 	b := make([]byte, 1024) // limit the size of the body we'll accept
 	n, err := r.Read(b)
 	if err != nil && err != io.EOF {
-		log.Error(err)
+		svc.log.Error(err)
 		return nil, newHandlerError("Error reading request data", http.StatusInternalServerError)
 	}
 
 	pr := new(credentialPrompt)
 	if err = json.Unmarshal(b[:n], pr); err != nil {
-		log.Error(err)
+		svc.log.Error(err)
 		return nil, newHandlerError("Error unmarshaling credentials", http.StatusInternalServerError)
 	}
 
 	return pr, nil
 }
 
-func credHandler(w http.ResponseWriter, r *http.Request) {
+func (svc *EC2MetadataServer) credHandler(w http.ResponseWriter, r *http.Request) {
 	var b []byte
-	var err error
 
 	p := strings.Split(r.URL.Path, "/")[1:]
-	if len(p[len(p)-1]) < 1 {
-		sendProfile(w, r)
+	name := p[len(p)-1]
+	if len(name) < 1 {
+		svc.sendProfile(w, r)
 	} else {
-		if profile.SamlAuthUrl != nil && len(profile.SamlAuthUrl.String()) > 0 {
+		rs, err := svc.sessionFor(r, name)
+		if err != nil {
+			svc.log.Errorf("error finding client profile: %v", err)
+			svc.writeResponse(w, r, "Error finding profile", http.StatusNotFound)
+			return
+		}
+
+		if rs.isSaml() {
 			// assume role with SAML
-			b, err = assumeSamlRole()
+			b, err = svc.assumeSamlRole(rs)
 		} else {
 			// assume IAM role
-			b, err = assumeRole()
+			b, err = svc.assumeRole(rs)
 		}
 
 		if err != nil {
-			log.Errorf("AssumeRole: %v", err)
-			writeResponse(w, r, "Error getting role credentials", http.StatusInternalServerError)
+			svc.log.Errorf("AssumeRole: %v", err)
+			svc.writeResponse(w, r, "Error getting role credentials", http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		writeResponse(w, r, string(b), http.StatusOK)
+		svc.writeResponse(w, r, string(b), http.StatusOK)
 	}
 }
 
-func assumeRoleCredentials(c client.ConfigProvider) *credentials.Credentials {
-	return credlib.NewAssumeRoleCredentials(c, profile.RoleArn, func(p *credlib.AssumeRoleProvider) {
-		p.Log = log
-		p.RoleSessionName = usr.Username
-		p.ExternalID = profile.ExternalId
+func (svc *EC2MetadataServer) assumeRoleCredentials(c client.ConfigProvider, rs *roleSession) (*credentials.Credentials, error) {
+	n, id, err := rs.sessionNames()
+	if err != nil {
+		return nil, err
+	}
+
+	return credlib.NewAssumeRoleCredentials(c, rs.profile.RoleArn, func(p *credlib.AssumeRoleProvider) {
+		p.Log = svc.log
+		p.RoleSessionName = n
+		p.SourceIdentity = id
+		p.ExternalID = rs.profile.ExternalId
+		p.Tags = rs.profile.SessionTags
+		p.TransitiveTagKeys = rs.profile.TransitiveTagKeys
+		p.Policy = rs.profile.SessionPolicy
+		p.PolicyArns = rs.profile.SessionPolicyArns
 		p.Duration = credlib.AssumeRoleDefaultDuration
 		p.ExpiryWindow = p.Duration / 10
-	})
+	}), nil
 }
 
-func fetchCredentials(c *credentials.Credentials) ([]byte, error) {
+func (svc *EC2MetadataServer) fetchCredentials(c *credentials.Credentials) ([]byte, error) {
 	v, err := c.Get()
 	if err != nil {
 		return nil, err
@@ -648,64 +1081,89 @@ func fetchCredentials(c *credentials.Credentials) ([]byte, error) {
 		Expiration:      time.Now().Add(credlib.AssumeRoleMinDuration).Add(1 * time.Second).UTC(),
 		LastUpdated:     time.Now().UTC(),
 	}
-	log.Debugf("%+v", output)
+	svc.log.Debugf("%+v", output)
 
 	return json.Marshal(output)
 }
 
-func assumeRole() ([]byte, error) {
-	log.Debugf("ROLE ARN: %s", profile.RoleArn)
-	ar := assumeRoleCredentials(s.Copy(new(aws.Config).WithCredentials(cred)))
-	return fetchCredentials(ar)
+func (svc *EC2MetadataServer) assumeRole(rs *roleSession) ([]byte, error) {
+	svc.log.Debugf("ROLE ARN: %s", rs.profile.RoleArn)
+	ar, err := svc.assumeRoleCredentials(rs.session.Copy(new(aws.Config).WithCredentials(rs.credentials())), rs)
+	if err != nil {
+		return nil, err
+	}
+	return svc.fetchCredentials(ar)
 }
 
-func assumeSamlRole() ([]byte, error) {
+func (svc *EC2MetadataServer) assumeSamlRole(rs *roleSession) ([]byte, error) {
 	var c *credentials.Credentials
 
-	samlDoc, err := samlClient.AwsSaml()
+	// the SAML client may refresh the assertion, which must not happen while the client is authenticating
+	rs.authMu.Lock()
+	samlDoc, err := rs.client().AwsSaml()
+	rs.authMu.Unlock()
 	if err != nil {
 		// todo handle error ... maybe?  the workflow before we get here requires that we've already called this successfully
 	}
 
-	sc := credlib.NewSamlRoleCredentials(s, profile.RoleArn, samlDoc, func(p *credlib.SamlRoleProvider) {
-		p.Log = log
-		p.RoleSessionName = usr.Username
+	// AssumeRoleWithSAML may use a different STS endpoint than the other STS API calls
+	samlSes := rs.session
+	if len(rs.profile.SamlStsEndpoint) > 0 {
+		samlSes = rs.session.Copy(credlib.StsEndpointConfig(endpoints.UnsetSTSEndpoint, rs.profile.SamlStsEndpoint))
+	}
+
+	n, _, err := rs.sessionNames()
+	if err != nil {
+		return nil, err
+	}
+
+	sc := credlib.NewSamlRoleCredentials(samlSes, rs.profile.RoleArn, samlDoc, func(p *credlib.SamlRoleProvider) {
+		p.Log = svc.log
+		p.RoleSessionName = n
 		p.Duration = credlib.AssumeRoleDefaultDuration
 
-		if len(profile.JumpRoleArn.Resource) > 0 {
-			p.RoleARN = profile.JumpRoleArn.String()
+		if len(rs.profile.JumpRoleArn.Resource) > 0 {
+			p.RoleARN = rs.profile.JumpRoleArn.String()
+		} else {
+			p.Policy = rs.profile.SessionPolicy
+			p.PolicyArns = rs.profile.SessionPolicyArns
 		}
 
 		p.ExpiryWindow = p.Duration / 10
 	})
 
-	if len(profile.JumpRoleArn.Resource) > 0 {
-		profile.MfaSerial = "" // explicitly unset MfaSerial, just to be extra sure
-		c = assumeRoleCredentials(s.Copy(new(aws.Config).WithCredentials(sc)))
+	if len(rs.profile.JumpRoleArn.Resource) > 0 {
+		// assumeRoleCredentials never uses the MfaSerial of the profile, since MFA is handled by SAML
+		c, err = svc.assumeRoleCredentials(rs.session.Copy(new(aws.Config).WithCredentials(sc)), rs)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		c = sc
 	}
 
-	return fetchCredentials(c)
+	return svc.fetchCredentials(c)
 }
 
 // only actually works for IAM roles, not SAML roles, since we don't cache the Assumed Role credentials
 // only the IAM Session Token credentials, which aren't used with SAML
-func refreshHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost && cred != nil {
-		log.Debug("Expiring credentials for refresh")
-		cred.Expire()
+func (svc *EC2MetadataServer) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	rs := svc.activeSession()
+
+	if r.Method == http.MethodPost && rs != nil && rs.credentials() != nil {
+		svc.log.Debug("Expiring credentials for refresh")
+		rs.credentials().Expire()
 
-		if profile != nil {
-			cf := cacheFile(fmt.Sprintf(".aws_session_token_%s", profile.SourceProfile))
+		if rs.profile != nil {
+			cf := svc.cacheFile(fmt.Sprintf(".aws_session_token_%s", rs.profile.SourceProfile))
 			if len(cf) > 0 {
 				if err := os.Remove(cf); err != nil {
-					log.Debugf("Error removing cached credentials: %v", err)
+					svc.log.Debugf("Error removing cached credentials: %v", err)
 				}
 			}
 		}
 	}
-	writeResponse(w, r, "success", http.StatusOK)
+	svc.writeResponse(w, r, "success", http.StatusOK)
 }
 
 var indexHtml = `
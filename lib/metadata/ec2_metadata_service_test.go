@@ -2,8 +2,13 @@ package metadata
 
 import (
 	cfglib "aws-runas/lib/config"
+	"aws-runas/lib/identity"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/mmmorris1975/aws-config/config"
 	"github.com/mmmorris1975/simple-logger/logger"
 	"io/ioutil"
@@ -12,29 +17,34 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+var svc *EC2MetadataServer
+
 func TestMain(m *testing.M) {
 	os.Setenv("AWS_CONFIG_FILE", "../../.aws/config")
-	log = logger.StdLogger
-	s = session.Must(session.NewSession())
+	log := logger.StdLogger
 
 	var err error
-	cr, err = config.NewAwsConfigResolver(nil)
+	svc, err = NewEC2MetadataServer(&EC2MetadataInput{Logger: log, Session: session.Must(session.NewSession()), CacheDir: os.TempDir()})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	p, err := cr.Resolve("circle-role")
+	p, err := svc.cr.Resolve("circle-role")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	profile, err = cfglib.Wrap(p)
+	svc.active.profile, err = cfglib.Wrap(p)
 	if err != nil {
 		log.Fatal(err)
 	}
+	svc.sessions[svc.active.name()] = svc.active
 
 	os.Exit(m.Run())
 }
@@ -44,7 +54,7 @@ func TestWriteResponse(t *testing.T) {
 
 	t.Run("empty body", func(t *testing.T) {
 		w := httptest.NewRecorder()
-		writeResponse(w, r, "", http.StatusOK)
+		svc.writeResponse(w, r, "", http.StatusOK)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -68,7 +78,7 @@ func TestWriteResponse(t *testing.T) {
 	t.Run("zero code", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		b := "body"
-		writeResponse(w, r, b, 0)
+		svc.writeResponse(w, r, b, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -93,7 +103,7 @@ func TestWriteResponse(t *testing.T) {
 		w := httptest.NewRecorder()
 		w.Header().Set("Content-Type", "application/json")
 		b := "body"
-		writeResponse(w, r, b, 0)
+		svc.writeResponse(w, r, b, 0)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -118,7 +128,7 @@ func TestWriteResponse(t *testing.T) {
 func TestHomeHandler(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
-	homeHandler(w, r)
+	svc.homeHandler(w, r)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -142,7 +152,7 @@ func TestHomeHandler(t *testing.T) {
 func TestJsHandler(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/site.js", nil)
 	w := httptest.NewRecorder()
-	jsHandler(w, r)
+	svc.jsHandler(w, r)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -166,7 +176,7 @@ func TestJsHandler(t *testing.T) {
 func TestGetProfileConfig(t *testing.T) {
 	t.Run("empty reader", func(t *testing.T) {
 		// returns default profile
-		c, err := getProfileConfig(strings.NewReader(""))
+		c, err := svc.getProfileConfig(strings.NewReader(""))
 		if err != nil {
 			t.Error(err)
 			return
@@ -179,7 +189,7 @@ func TestGetProfileConfig(t *testing.T) {
 	})
 
 	t.Run("nil reader", func(t *testing.T) {
-		_, err := getProfileConfig(nil)
+		_, err := svc.getProfileConfig(nil)
 		if err == nil {
 			t.Error("did not receive expected error")
 			return
@@ -187,7 +197,7 @@ func TestGetProfileConfig(t *testing.T) {
 	})
 
 	t.Run("bad profile", func(t *testing.T) {
-		_, err := getProfileConfig(strings.NewReader("bad-profile"))
+		_, err := svc.getProfileConfig(strings.NewReader("bad-profile"))
 		if err == nil {
 			t.Error("did not receive expected error")
 			return
@@ -195,7 +205,7 @@ func TestGetProfileConfig(t *testing.T) {
 	})
 
 	t.Run("good", func(t *testing.T) {
-		c, err := getProfileConfig(strings.NewReader("circle-role"))
+		c, err := svc.getProfileConfig(strings.NewReader("circle-role"))
 		if err != nil {
 			t.Error(err)
 			return
@@ -216,7 +226,7 @@ func TestGetProfileConfig(t *testing.T) {
 func TestSendProfile(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/profile", nil)
 	w := httptest.NewRecorder()
-	sendProfile(w, r)
+	svc.sendProfile(w, r)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -232,7 +242,7 @@ func TestSendProfile(t *testing.T) {
 		return
 	}
 
-	if string(b) != profile.Profile {
+	if string(b) != svc.active.name() {
 		t.Error("unexpected profile")
 		return
 	}
@@ -240,7 +250,7 @@ func TestSendProfile(t *testing.T) {
 
 func TestGetAuth(t *testing.T) {
 	t.Run("nil reader", func(t *testing.T) {
-		_, err := getAuth(nil)
+		_, err := svc.getAuth(nil)
 		if err == nil {
 			t.Error("did not receive expected error")
 			return
@@ -253,7 +263,7 @@ func TestGetAuth(t *testing.T) {
 	})
 
 	t.Run("empty reader", func(t *testing.T) {
-		_, err := getAuth(ioutil.NopCloser(strings.NewReader("")))
+		_, err := svc.getAuth(ioutil.NopCloser(strings.NewReader("")))
 		if err == nil {
 			t.Error("did not receive expected error")
 			return
@@ -267,7 +277,7 @@ func TestGetAuth(t *testing.T) {
 	})
 
 	t.Run("good", func(t *testing.T) {
-		c, err := getAuth(ioutil.NopCloser(strings.NewReader(`{"mfa_code": "654321"}`)))
+		c, err := svc.getAuth(ioutil.NopCloser(strings.NewReader(`{"mfa_code": "654321"}`)))
 		if err != nil {
 			t.Error(err)
 			return
@@ -289,7 +299,7 @@ func TestCredHandler(t *testing.T) {
 	// can only test the bare-path request, otherwise we're calling out to AWS
 	r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath, nil)
 	w := httptest.NewRecorder()
-	credHandler(w, r)
+	svc.credHandler(w, r)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -305,19 +315,19 @@ func TestCredHandler(t *testing.T) {
 		return
 	}
 
-	if string(b) != profile.Profile {
+	if string(b) != svc.active.name() {
 		t.Error("unexpected profile name")
 		return
 	}
 }
 
 func TestRefreshHandler(t *testing.T) {
-	cred = credentials.NewCredentials(new(mockProvider))
-
 	t.Run("nil role", func(t *testing.T) {
+		svc := &EC2MetadataServer{server: newServer(nil, ""), active: &roleSession{cred: credentials.NewCredentials(new(mockProvider))}}
+
 		r := httptest.NewRequest(http.MethodPost, refreshPath, nil)
 		w := httptest.NewRecorder()
-		refreshHandler(w, r)
+		svc.refreshHandler(w, r)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -329,16 +339,18 @@ func TestRefreshHandler(t *testing.T) {
 	})
 
 	t.Run("with role", func(t *testing.T) {
-		profile = &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{SourceProfile: "some-profile"}}
-		cacheDir = os.TempDir()
-		defer func() {
-			profile = nil
-			cacheDir = ""
-		}()
+		svc := &EC2MetadataServer{
+			server:   newServer(nil, ""),
+			cacheDir: os.TempDir(),
+			active: &roleSession{
+				profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{SourceProfile: "some-profile"}},
+				cred:    credentials.NewCredentials(new(mockProvider)),
+			},
+		}
 
 		r := httptest.NewRequest(http.MethodPost, refreshPath, nil)
 		w := httptest.NewRecorder()
-		refreshHandler(w, r)
+		svc.refreshHandler(w, r)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -353,7 +365,7 @@ func TestRefreshHandler(t *testing.T) {
 func TestListRolesHandler(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, listRolesPath, nil)
 	w := httptest.NewRecorder()
-	listRoleHandler(w, r)
+	svc.listRoleHandler(w, r)
 
 	res := w.Result()
 	defer res.Body.Close()
@@ -375,9 +387,9 @@ func TestListRolesHandler(t *testing.T) {
 }
 
 func TestCacheFile(t *testing.T) {
-	cacheDir = os.TempDir()
+	svc := &EC2MetadataServer{server: newServer(nil, ""), cacheDir: os.TempDir()}
 	t.Run("empty profile", func(t *testing.T) {
-		p := cacheFile("")
+		p := svc.cacheFile("")
 		if len(p) > 0 {
 			t.Errorf("unexpected cache file name")
 			return
@@ -385,7 +397,7 @@ func TestCacheFile(t *testing.T) {
 	})
 
 	t.Run("good", func(t *testing.T) {
-		p := cacheFile("mock_test")
+		p := svc.cacheFile("mock_test")
 		if len(p) < 1 {
 			t.Errorf("bad cache file name")
 			return
@@ -398,8 +410,8 @@ func TestCacheFile(t *testing.T) {
 	})
 
 	t.Run("empty cache dir", func(t *testing.T) {
-		cacheDir = ""
-		p := cacheFile("test")
+		svc.cacheDir = ""
+		p := svc.cacheFile("test")
 		if len(p) > 0 {
 			t.Errorf("unexpected cache file name")
 			return
@@ -407,33 +419,211 @@ func TestCacheFile(t *testing.T) {
 	})
 }
 
-func TestHandleOptions(t *testing.T) {
-	md := &EC2MetadataInput{
-		Session: s,
-	}
-	err := handleOptions(md)
+func TestNewEC2MetadataServer(t *testing.T) {
+	t.Run("nil session", func(t *testing.T) {
+		if _, err := NewEC2MetadataServer(new(EC2MetadataInput)); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	svc, err := NewEC2MetadataServer(&EC2MetadataInput{Session: svc.session})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
 	t.Run("nil logger", func(t *testing.T) {
-		if log == nil {
+		if svc.log == nil {
 			t.Error("configured a nil logger")
 		}
 	})
 
 	t.Run("empty cache", func(t *testing.T) {
-		if len(cacheDir) < 1 {
+		if len(svc.cacheDir) < 1 {
 			t.Error("empty cache dir")
 		}
 	})
 
 	t.Run("nil config resolver", func(t *testing.T) {
-		if cr == nil {
+		if svc.cr == nil {
 			t.Error("nil config resolver")
 		}
 	})
+
+	t.Run("instance identity", func(t *testing.T) {
+		if svc.identity == nil || len(svc.identity.InstanceId) < 1 {
+			t.Error("instance identity not configured")
+		}
+	})
+
+	t.Run("handlers", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, instanceIdPath, nil)
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, r)
+
+		b, _ := ioutil.ReadAll(w.Result().Body)
+		if w.Result().StatusCode != http.StatusOK || string(b) != svc.identity.InstanceId {
+			t.Errorf("unexpected response: %d %s", w.Result().StatusCode, b)
+		}
+	})
+}
+
+func TestSessionFor(t *testing.T) {
+	def := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{Profile: "default-role"}}}
+	other := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{Profile: "other-role"}}}
+
+	svc := &EC2MetadataServer{
+		server:   newServer(nil, ""),
+		cr:       svc.cr,
+		active:   def,
+		sessions: map[string]*roleSession{"default-role": def, "other-role": other},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath, nil)
+		if rs, err := svc.sessionFor(r, ""); err != nil || rs != def {
+			t.Error("did not get default session")
+		}
+	})
+
+	t.Run("path", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath+"other-role", nil)
+		if rs, err := svc.sessionFor(r, "other-role"); err != nil || rs != other {
+			t.Error("did not get path session")
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath, nil)
+		r.Header.Set(ProfileHeader, "other-role")
+		if rs, err := svc.sessionFor(r, ""); err != nil || rs != other {
+			t.Error("did not get header session")
+		}
+	})
+
+	t.Run("bad header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath, nil)
+		r.Header.Set(ProfileHeader, "bad-profile")
+		if _, err := svc.sessionFor(r, ""); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("unknown path with header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath+"bad-profile", nil)
+		r.Header.Set(ProfileHeader, "other-role")
+		if _, err := svc.sessionFor(r, "bad-profile"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("unknown path", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath+"bad-profile", nil)
+		if _, err := svc.sessionFor(r, "bad-profile"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("path with header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath+"other-role", nil)
+		r.Header.Set(ProfileHeader, "other-role")
+		if rs, err := svc.sessionFor(r, "other-role"); err != nil || rs != other {
+			t.Error("did not get header session")
+		}
+	})
+
+	t.Run("path not matching header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath+"default-role", nil)
+		r.Header.Set(ProfileHeader, "other-role")
+		if _, err := svc.sessionFor(r, "default-role"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestNamedSession(t *testing.T) {
+	t.Run("concurrent start", func(t *testing.T) {
+		var calls int32
+		svc := &EC2MetadataServer{server: newServer(nil, ""), cr: svc.cr, active: svc.active, sessions: make(map[string]*roleSession)}
+		svc.start = func(rs *roleSession) (time.Time, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(50 * time.Millisecond)
+			rs.setCredentials(credentials.NewStaticCredentials("AKIAMOCK", "MockSecret", ""))
+			rs.setUser(&identity.Identity{Username: "bob"})
+			return time.Now().Add(1 * time.Hour), nil
+		}
+
+		res := make([]*roleSession, 10)
+		wg := new(sync.WaitGroup)
+		for i := range res {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rs, err := svc.namedSession("circle-role")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res[i] = rs
+			}(i)
+		}
+		wg.Wait()
+
+		if calls != 1 {
+			t.Errorf("expected 1 session start, got %d", calls)
+		}
+
+		for _, rs := range res {
+			if rs != res[0] || rs.credentials() == nil || rs.username() != "bob" {
+				t.Error("did not get the started session")
+				return
+			}
+		}
+	})
+
+	t.Run("concurrent failure", func(t *testing.T) {
+		svc := &EC2MetadataServer{server: newServer(nil, ""), cr: svc.cr, active: svc.active, sessions: make(map[string]*roleSession)}
+		svc.start = func(rs *roleSession) (time.Time, error) {
+			time.Sleep(50 * time.Millisecond)
+			return time.Time{}, errSamlAuthRequired
+		}
+
+		wg := new(sync.WaitGroup)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := svc.namedSession("circle-role"); err == nil {
+					t.Error("did not receive expected error")
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(svc.sessions) > 0 || len(svc.starting) > 0 {
+			t.Errorf("failed session was published: %v %v", svc.sessions, svc.starting)
+		}
+	})
+}
+
+func TestSendProfileWithHeader(t *testing.T) {
+	other := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{Profile: "other-role"}}}
+	svc := &EC2MetadataServer{server: newServer(nil, ""), active: svc.active, sessions: map[string]*roleSession{"other-role": other}}
+
+	r := httptest.NewRequest(http.MethodGet, ec2MdSvcCredPath, nil)
+	r.Header.Set(ProfileHeader, "other-role")
+	w := httptest.NewRecorder()
+	svc.credHandler(w, r)
+
+	b, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(b) != "other-role" {
+		t.Errorf("unexpected profile name: %s", b)
+	}
 }
 
 func TestCheckSudoEnv(t *testing.T) {
@@ -551,3 +741,94 @@ func (p *mockProvider) IsExpired() bool {
 func (p *mockProvider) Retrieve() (credentials.Value, error) {
 	return credentials.Value{}, nil
 }
+
+func TestRoleSession_sessionNames(t *testing.T) {
+	newSession := func(name, id string) *roleSession {
+		c := &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{Profile: "admin", RoleSessionName: name}, SourceIdentity: id}
+		return &roleSession{profile: c, usr: &identity.Identity{Username: "bob"}}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		n, id, err := newSession("", "").sessionNames()
+		if err != nil || n != "bob" || len(id) > 0 {
+			t.Errorf("unexpected session names: %s %s %v", n, id, err)
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		n, id, err := newSession("{{.Username}}-{{.Profile}}", "{{.Username}}").sessionNames()
+		if err != nil || n != "bob-admin" || id != "bob" {
+			t.Errorf("unexpected session names: %s %s %v", n, id, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, _, err := newSession("", "{{.Username}} smith").sessionNames(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestRoleSession_partition(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:iam::1234567890:role/Admin":        "aws",
+		"arn:aws-us-gov:iam::1234567890:role/Admin": "aws-us-gov",
+		"arn:aws-cn:iam::1234567890:role/Admin":     "aws-cn",
+		"":                                          "",
+	}
+
+	for a, p := range tests {
+		rs := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{RoleArn: a}}}
+		if v := rs.partition(); v != p {
+			t.Errorf("unexpected partition for %s: %s", a, v)
+		}
+	}
+
+	t.Run("jump role", func(t *testing.T) {
+		j, _ := arn.Parse("arn:aws-us-gov:iam::1234567890:role/Jump")
+		rs := &roleSession{profile: &cfglib.AwsConfig{AwsConfig: new(config.AwsConfig), JumpRoleArn: j}}
+		if v := rs.partition(); v != "aws-us-gov" {
+			t.Errorf("unexpected partition: %s", v)
+		}
+	})
+}
+
+func TestEC2MetadataServer_newSession(t *testing.T) {
+	s := &EC2MetadataServer{server: newServer(svc.log, ""),
+		session: session.Must(session.NewSession(new(aws.Config).WithRegion("us-west-2")))}
+
+	newRoleSession := func(roleArn string) *roleSession {
+		return &roleSession{profile: &cfglib.AwsConfig{AwsConfig: &config.AwsConfig{RoleArn: roleArn}}}
+	}
+
+	tests := map[string]string{
+		"arn:aws:iam::1234567890:role/Admin":        "us-west-2",
+		"arn:aws-us-gov:iam::1234567890:role/Admin": "us-gov-west-1",
+		"arn:aws-cn:iam::1234567890:role/Admin":     "cn-north-1",
+		"":                                          "us-west-2",
+	}
+
+	for a, r := range tests {
+		if v := aws.StringValue(s.newSession(newRoleSession(a)).Config.Region); v != r {
+			t.Errorf("unexpected region for role %s: %s", a, v)
+		}
+	}
+
+	if aws.StringValue(s.session.Config.Region) != "us-west-2" {
+		t.Error("server session region was modified")
+	}
+
+	t.Run("sts endpoint", func(t *testing.T) {
+		rs := newRoleSession("arn:aws:iam::1234567890:role/Admin")
+		rs.profile.StsRegionalEndpoints = endpoints.RegionalSTSEndpoint
+		rs.profile.StsEndpointUrl = "https://vpce-0123.sts.us-west-2.vpce.amazonaws.com"
+
+		if e := s.newSession(rs).ClientConfig(sts.EndpointsID).Endpoint; e != rs.profile.StsEndpointUrl {
+			t.Errorf("unexpected sts endpoint: %s", e)
+		}
+
+		if rs.sessionKey() == newRoleSession("arn:aws:iam::1234567890:role/Admin").sessionKey() {
+			t.Error("role sessions with different sts endpoints have the same session key")
+		}
+	})
+}
@@ -1,13 +1,19 @@
 package metadata
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/mmmorris1975/simple-logger/logger"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"runtime"
 	"time"
 )
 
@@ -22,59 +28,86 @@ type EcsMetadataInput struct {
 	Credentials *credentials.Credentials
 	// Logger is the logging object to configure for the service.  If not provided, a standard logger is configured.
 	Logger *logger.Logger
+	// Address is the host, or host:port, the service will listen on.  If not provided, the service will listen on a
+	// random port on the loopback address.
+	Address string
+	// RestrictUid will only serve credentials to clients running as the same user as this process.  Only supported on Linux.
+	RestrictUid bool
 }
 
-// ecsMetadataService is the object encapsulating the details of the service
-type ecsMetadataService struct {
+// EcsMetadataServer is the object encapsulating the details of the service
+type EcsMetadataServer struct {
+	*server
 	// Url is the fully-formed URL to use for retrieving credentials from the service
-	Url  *url.URL
-	lsnr net.Listener
+	Url *url.URL
+	// AuthToken is the value clients must send in the Authorization header of the request, and is provided to the SDKs
+	// using the AWS_CONTAINER_AUTHORIZATION_TOKEN environment variable
+	AuthToken   string
+	cred        *credentials.Credentials
+	restrictUid bool
 }
 
-// NewEcsMetadataService creates a new ecsMetadataService object using the provided EcsMetadataInput options.
-func NewEcsMetadataService(opts *EcsMetadataInput) (*ecsMetadataService, error) {
-	cred = opts.Credentials
-	log = logger.StdLogger
-	if opts.Logger != nil {
-		log = opts.Logger
+// NewEcsMetadataServer creates a new EcsMetadataServer object using the provided EcsMetadataInput options.  By default,
+// the server will listen on the loopback address on a randomly chosen port, which is available in the Url field.  A random
+// authorization token is generated for each server, and requests without the token are rejected.
+func NewEcsMetadataServer(opts *EcsMetadataInput) (*EcsMetadataServer, error) {
+	s := &EcsMetadataServer{server: newServer(opts.Logger, ""), cred: opts.Credentials, restrictUid: opts.RestrictUid}
+
+	if s.restrictUid && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("client uid restriction is not supported on %s", runtime.GOOS)
 	}
 
-	// The SDK seems to only support listening on "localhost" and 127.0.0.1, not the ::1 IPv6 loopback, try not to be clever
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t, err := newAuthToken()
 	if err != nil {
 		return nil, err
 	}
+	s.AuthToken = t
 
-	u, _ := url.Parse(fmt.Sprintf("http://%s%s", l.Addr(), ecsCredentialsPath))
-
-	return &ecsMetadataService{Url: u, lsnr: l}, nil
-}
+	// The SDK seems to only support listening on "localhost" and 127.0.0.1, not the ::1 IPv6 loopback, try not to be clever
+	addr := "127.0.0.1:0"
+	if len(opts.Address) > 0 {
+		addr = opts.Address
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "0")
+		}
+	}
 
-// Run starts the HTTP server used to fetch credentials.  The HTTP server will listen on the loopback address on a
-// randomly chosen port.
-func (s *ecsMetadataService) Run() {
-	http.HandleFunc(ecsCredentialsPath, ecsHandler)
-	if err := http.Serve(s.lsnr, nil); err != nil && log != nil {
-		log.Error(err)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
 	}
+	s.lsnr = l
+
+	s.Url, _ = url.Parse(fmt.Sprintf("http://%s%s", l.Addr(), ecsCredentialsPath))
+	s.mux.HandleFunc(ecsCredentialsPath, s.ecsHandler)
+
+	return s, nil
 }
 
-func ecsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *EcsMetadataServer) ecsHandler(w http.ResponseWriter, r *http.Request) {
 	var rc = http.StatusOK
 
-	v, err := cred.Get()
+	if err := s.authorize(r); err != nil {
+		s.log.Warnf("rejected credential request from %s: %v", r.RemoteAddr, err)
+		rc = http.StatusForbidden
+		j, _ := json.Marshal(&ecsCredentialError{Code: rc, Message: err.Error()})
+		http.Error(w, string(j), rc)
+		return
+	}
+
+	v, err := s.cred.Get()
 	if err != nil {
 		rc = http.StatusInternalServerError
 		j, err := json.Marshal(&ecsCredentialError{Code: rc, Message: err.Error()})
-		if err != nil && log != nil {
-			log.Warnf("error converting error message to json: %v", err)
+		if err != nil {
+			s.log.Warnf("error converting error message to json: %v", err)
 		}
 
 		http.Error(w, string(j), rc)
 		return
 	}
 
-	e, err := cred.ExpiresAt()
+	e, err := s.cred.ExpiresAt()
 	if err != nil {
 		e = time.Now()
 	}
@@ -85,20 +118,46 @@ func ecsHandler(w http.ResponseWriter, r *http.Request) {
 		Token:           v.SessionToken,
 		Expiration:      e.UTC().Format(time.RFC3339),
 	}
-
-	if log != nil {
-		log.Debugf("ECS endpoint credentials: %+v", c)
-	}
+	s.log.Debugf("ECS endpoint credentials: %+v", c)
 
 	j, err := json.Marshal(&c)
-	if err != nil && log != nil {
-		log.Warnf("error converting credentials to json: %v", err)
+	if err != nil {
+		s.log.Warnf("error converting credentials to json: %v", err)
 	}
 
 	w.WriteHeader(rc)
 	w.Write(j)
 }
 
+// authorize checks that the request contains the expected authorization token and, if configured, was made by a
+// process owned by the same user as this process
+func (s *EcsMetadataServer) authorize(r *http.Request) error {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.AuthToken)) != 1 {
+		return errors.New("invalid authorization token")
+	}
+
+	if s.restrictUid {
+		uid, err := requestUid(r)
+		if err != nil {
+			return err
+		}
+
+		if uid != os.Getuid() {
+			return fmt.Errorf("client uid %d not allowed", uid)
+		}
+	}
+
+	return nil
+}
+
+func newAuthToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 type ecsCredentialError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
@@ -8,21 +8,22 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
-func TestNewEcsMetadataService(t *testing.T) {
+func TestNewEcsMetadataServer(t *testing.T) {
 	t.Run("nil opts", func(t *testing.T) {
 		defer func() {
 			if x := recover(); x == nil {
-				t.Errorf("Did not receive expected panic calling NewEcsMetadataService with nil config")
+				t.Errorf("Did not receive expected panic calling NewEcsMetadataServer with nil config")
 			}
 		}()
-		NewEcsMetadataService(nil)
+		NewEcsMetadataServer(nil)
 	})
 
 	t.Run("empty opts", func(t *testing.T) {
-		ecs, err := NewEcsMetadataService(new(EcsMetadataInput))
+		ecs, err := NewEcsMetadataServer(new(EcsMetadataInput))
 		if err != nil {
 			t.Error(err)
 			return
@@ -34,7 +35,7 @@ func TestNewEcsMetadataService(t *testing.T) {
 	})
 
 	t.Run("with opts", func(t *testing.T) {
-		ecs, err := NewEcsMetadataService(&EcsMetadataInput{Logger: logger.StdLogger})
+		ecs, err := NewEcsMetadataServer(&EcsMetadataInput{Logger: logger.StdLogger})
 
 		if err != nil {
 			t.Error(err)
@@ -45,17 +46,55 @@ func TestNewEcsMetadataService(t *testing.T) {
 			t.Errorf("unexpected url scheme: %s", ecs.Url.Scheme)
 		}
 	})
+
+	t.Run("with address", func(t *testing.T) {
+		for _, a := range []string{"127.0.0.1", "127.0.0.1:0"} {
+			ecs, err := NewEcsMetadataServer(&EcsMetadataInput{Address: a})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if ecs.Url.Hostname() != "127.0.0.1" || ecs.Url.Port() == "0" {
+				t.Errorf("unexpected url: %s", ecs.Url)
+			}
+		}
+	})
+
+	t.Run("bad address", func(t *testing.T) {
+		if _, err := NewEcsMetadataServer(&EcsMetadataInput{Address: "not-an-address:-1"}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("auth token", func(t *testing.T) {
+		a, err := NewEcsMetadataServer(new(EcsMetadataInput))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		b, err := NewEcsMetadataServer(new(EcsMetadataInput))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(a.AuthToken) != 64 || a.AuthToken == b.AuthToken {
+			t.Errorf("invalid auth tokens: %s, %s", a.AuthToken, b.AuthToken)
+		}
+	})
 }
 
 func TestEcsHandler(t *testing.T) {
-	log = logger.StdLogger
 	t.Run("good", func(t *testing.T) {
-		cred = credentials.NewStaticCredentials("MockAK", "MockSK", "MockToken")
+		s := &EcsMetadataServer{server: newServer(nil, ""), cred: credentials.NewStaticCredentials("MockAK", "MockSK", "MockToken"), AuthToken: "t0k3n"}
 
 		r := httptest.NewRequest(http.MethodGet, ecsCredentialsPath, nil)
+		r.Header.Set("Authorization", "t0k3n")
 		w := httptest.NewRecorder()
 
-		ecsHandler(w, r)
+		s.ecsHandler(w, r)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -83,12 +122,13 @@ func TestEcsHandler(t *testing.T) {
 
 	t.Run("bad", func(t *testing.T) {
 		p := credentials.ErrorProvider{Err: fmt.Errorf("bad times"), ProviderName: "Error Provider"}
-		cred = credentials.NewCredentials(&p)
+		s := &EcsMetadataServer{server: newServer(nil, ""), cred: credentials.NewCredentials(&p), AuthToken: "t0k3n"}
 
 		r := httptest.NewRequest(http.MethodGet, ecsCredentialsPath, nil)
+		r.Header.Set("Authorization", "t0k3n")
 		w := httptest.NewRecorder()
 
-		ecsHandler(w, r)
+		s.ecsHandler(w, r)
 
 		res := w.Result()
 		defer res.Body.Close()
@@ -113,4 +153,31 @@ func TestEcsHandler(t *testing.T) {
 			t.Error("mismatched error text")
 		}
 	})
+
+	for _, tok := range []string{"", "bad"} {
+		t.Run(fmt.Sprintf("unauthorized %q", tok), func(t *testing.T) {
+			s := &EcsMetadataServer{server: newServer(nil, ""), cred: credentials.NewStaticCredentials("MockAK", "MockSK", "MockToken"), AuthToken: "t0k3n"}
+
+			r := httptest.NewRequest(http.MethodGet, ecsCredentialsPath, nil)
+			if len(tok) > 0 {
+				r.Header.Set("Authorization", tok)
+			}
+			w := httptest.NewRecorder()
+
+			s.ecsHandler(w, r)
+
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusForbidden {
+				t.Errorf("unexpected response code: %d", res.StatusCode)
+				return
+			}
+
+			b, _ := ioutil.ReadAll(res.Body)
+			if strings.Contains(string(b), "MockAK") {
+				t.Error("credentials returned to unauthorized request")
+			}
+		})
+	}
 }
@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mmmorris1975/simple-logger/logger"
+	"net"
+	"net/http"
+)
+
+// server is the HTTP server lifecycle shared by the metadata services.  Each server has its own http.ServeMux, so
+// any number of services can run in the same process.
+type server struct {
+	log  *logger.Logger
+	mux  *http.ServeMux
+	srv  *http.Server
+	addr string
+	lsnr net.Listener
+	done chan struct{}
+	err  error
+}
+
+func newServer(l *logger.Logger, addr string) *server {
+	if l == nil {
+		l = logger.StdLogger
+	}
+
+	mux := http.NewServeMux()
+	return &server{log: l, mux: mux, srv: &http.Server{Handler: mux}, addr: addr}
+}
+
+// ServeHTTP dispatches the request to the handler registered for the request path, allowing the service to be
+// embedded in another HTTP server, or tested using the httptest package.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Addr returns the network address the service is listening on, or nil if the service is not listening
+func (s *server) Addr() net.Addr {
+	if s.lsnr == nil {
+		return nil
+	}
+	return s.lsnr.Addr()
+}
+
+// Start begins serving requests in the background.  The service will shut down when the provided context is done,
+// or when Shutdown() is called.
+func (s *server) Start(ctx context.Context) error {
+	if s.done != nil {
+		return errors.New("service already started")
+	}
+
+	if s.lsnr == nil {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.lsnr = l
+	}
+
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(s.lsnr); err != nil && err != http.ErrServerClosed {
+			s.err = err
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := s.Shutdown(context.Background()); err != nil {
+				s.log.Debugf("error shutting down metadata service: %v", err)
+			}
+		case <-s.done:
+		}
+	}()
+
+	return nil
+}
+
+// Wait blocks until the service stops, and returns any error encountered while serving requests
+func (s *server) Wait() error {
+	if s.done == nil {
+		return errors.New("service not started")
+	}
+
+	<-s.done
+	return s.err
+}
+
+// Shutdown gracefully stops the service, waiting for active requests to complete until the provided context is done
+func (s *server) Shutdown(ctx context.Context) error {
+	if s.done == nil && s.lsnr != nil {
+		// listener was created, but never served
+		defer s.lsnr.Close()
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+// requestUid returns the UID of the local process which made the HTTP request
+func requestUid(r *http.Request) (int, error) {
+	ra, la, err := requestAddrs(r)
+	if err != nil {
+		return -1, err
+	}
+
+	uid, _, err := clientSocket(ra, la)
+	return uid, err
+}
+
+// requestOwner returns the UID and PID of the local process which made the HTTP request.  Finding the PID is much more
+// expensive than the UID, so use requestUid() if the PID isn't needed.
+func requestOwner(r *http.Request) (int, int, error) {
+	ra, la, err := requestAddrs(r)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	return clientOwner(ra, la)
+}
+
+// requestAddrs returns the client and server addresses of the HTTP request
+func requestAddrs(r *http.Request) (net.Addr, net.Addr, error) {
+	la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil, nil, errors.New("server address not found in request")
+	}
+
+	ra, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client address: %v", err)
+	}
+
+	return ra, la, nil
+}
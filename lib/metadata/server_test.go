@@ -0,0 +1,102 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_Lifecycle(t *testing.T) {
+	t.Run("multiple servers", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		servers := make([]*EcsMetadataServer, 0)
+		for _, k := range []string{"AK1", "AK2"} {
+			s, err := NewEcsMetadataServer(&EcsMetadataInput{Credentials: credentials.NewStaticCredentials(k, "SK", "")})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			servers = append(servers, s)
+		}
+
+		for i, k := range []string{"AK1", "AK2"} {
+			req, _ := http.NewRequest(http.MethodGet, servers[i].Url.String(), nil)
+			req.Header.Set("Authorization", servers[i].AuthToken)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+
+			c := new(ecsCredentials)
+			if err := json.NewDecoder(res.Body).Decode(c); err != nil {
+				t.Error(err)
+			}
+			res.Body.Close()
+
+			if c.AccessKeyId != k {
+				t.Errorf("unexpected credentials from server %d: %s", i, c.AccessKeyId)
+			}
+		}
+
+		cancel()
+		for _, s := range servers {
+			if err := s.Wait(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		s, err := NewEcsMetadataServer(&EcsMetadataInput{Credentials: credentials.NewStaticCredentials("AK", "SK", "")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Start(context.Background()); err == nil {
+			t.Error("did not receive expected error starting a running server")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := s.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+
+		if err := s.Wait(); err != nil {
+			t.Error(err)
+		}
+
+		if _, err := http.Get(s.Url.String()); err == nil {
+			t.Error("server still accepting requests after shutdown")
+		}
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		s := newServer(nil, "127.0.0.1:0")
+		if err := s.Wait(); err == nil {
+			t.Error("did not receive expected error")
+		}
+
+		if s.Addr() != nil {
+			t.Error("unexpected listener address")
+		}
+
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package picker
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Match checks if the characters of query appear, in order, in s (ignoring case).  The returned score is lower for
+// better matches, rewarding consecutive characters and matches at the start of words.  Any string matches an empty query
+// with a score of 0.
+func Match(s, query string) (int, bool) {
+	str := []rune(strings.ToLower(s))
+	q := []rune(strings.ToLower(strings.TrimSpace(query)))
+
+	if len(q) < 1 {
+		return 0, true
+	}
+
+	score := 0
+	last := -1
+	i := 0
+	for pos, r := range str {
+		if r != q[i] {
+			continue
+		}
+
+		switch {
+		case last < 0:
+			// distance to the first match
+			score += pos
+		case pos == last+1:
+			// consecutive characters cost nothing
+		default:
+			score += 1 + pos - last
+		}
+
+		if pos > 0 && !isWordChar(str[pos-1]) {
+			score -= 2
+		}
+
+		last = pos
+		i++
+		if i == len(q) {
+			return score, true
+		}
+	}
+
+	return 0, false
+}
+
+// Filter returns the items matching the query, best match first.  Items with the same score keep their order.
+func Filter(items []*Item, query string) []*Item {
+	type scored struct {
+		item  *Item
+		score int
+	}
+
+	m := make([]scored, 0)
+	for _, i := range items {
+		if s, ok := Match(i.searchText(), query); ok {
+			m = append(m, scored{i, s})
+		}
+	}
+
+	sort.SliceStable(m, func(i, j int) bool { return m[i].score < m[j].score })
+
+	res := make([]*Item, len(m))
+	for i := range m {
+		res[i] = m[i].item
+	}
+	return res
+}
+
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
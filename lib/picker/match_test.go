@@ -0,0 +1,76 @@
+package picker
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	t.Run("empty query", func(t *testing.T) {
+		if s, ok := Match("anything", " "); !ok || s != 0 {
+			t.Errorf("unexpected match: %d %v", s, ok)
+		}
+	})
+
+	t.Run("subsequence", func(t *testing.T) {
+		if _, ok := Match("prod-admin", "PrdAdm"); !ok {
+			t.Error("did not match")
+		}
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		if _, ok := Match("prod-admin", "admprod"); ok {
+			t.Error("unexpected match")
+		}
+	})
+
+	t.Run("consecutive is better", func(t *testing.T) {
+		a, _ := Match("admin", "adm")
+		b, _ := Match("a-d-m", "adm")
+		if a >= b {
+			t.Errorf("consecutive match scored %d, split match scored %d", a, b)
+		}
+	})
+
+	t.Run("word start is better", func(t *testing.T) {
+		a, _ := Match("dev-admin", "adm")
+		b, _ := Match("devadmin", "adm")
+		if a >= b {
+			t.Errorf("word start match scored %d, other match scored %d", a, b)
+		}
+	})
+}
+
+func TestFilter(t *testing.T) {
+	items := []*Item{
+		{Name: "dev-readonly", AccountId: "111111111111", Role: "ReadOnly"},
+		{Name: "prod-admin", AccountId: "222222222222", Alias: "production", Role: "Admin"},
+		{Name: "dev-admin", AccountId: "111111111111", Role: "Admin"},
+	}
+
+	t.Run("all", func(t *testing.T) {
+		if m := Filter(items, ""); len(m) != 3 || m[0] != items[0] {
+			t.Errorf("unexpected matches: %v", m)
+		}
+	})
+
+	t.Run("best first", func(t *testing.T) {
+		m := Filter(items, "devadm")
+		if len(m) != 1 || m[0] != items[2] {
+			t.Errorf("unexpected matches: %v", m)
+		}
+	})
+
+	t.Run("account and alias", func(t *testing.T) {
+		if m := Filter(items, "2222"); len(m) != 1 || m[0] != items[1] {
+			t.Errorf("unexpected matches: %v", m)
+		}
+
+		if m := Filter(items, "production"); len(m) != 1 || m[0] != items[1] {
+			t.Errorf("unexpected matches: %v", m)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		if m := Filter(items, "zzz"); len(m) > 0 {
+			t.Errorf("unexpected matches: %v", m)
+		}
+	})
+}
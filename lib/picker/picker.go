@@ -0,0 +1,310 @@
+package picker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxLines is the number of items shown by the interactive picker, if MaxLines isn't set
+const DefaultMaxLines = 10
+
+// ErrCancelled is returned by Pick() if the user didn't choose an item
+var ErrCancelled = errors.New("no profile selected")
+
+// Item is a profile, or role, which can be chosen with the picker
+type Item struct {
+	// Name is the profile name, or role ARN, used when the item is chosen
+	Name      string
+	AccountId string
+	Alias     string
+	Role      string
+}
+
+func (i *Item) searchText() string {
+	return strings.Join([]string{i.Name, i.AccountId, i.Alias, i.Role}, " ")
+}
+
+// Picker lets the user choose one of the Items.  If Ansi is true, the items are filtered as the user types (using the
+// arrow keys to move through the matches), otherwise a numbered list of the items is shown, and the user enters the
+// number of an item, or text to filter the list.
+type Picker struct {
+	Items    []*Item
+	Ansi     bool
+	MaxLines int
+	In       io.Reader
+	Out      io.Writer
+	widths   [3]int
+}
+
+// NewPicker creates a Picker for the items, reading from stdin and writing to stderr (so the output of the program can
+// be used with eval), using ANSI escape sequences if the terminal supports them
+func NewPicker(items []*Item) *Picker {
+	return &Picker{
+		Items:    items,
+		Ansi:     AnsiTerminal(),
+		MaxLines: DefaultMaxLines,
+		In:       os.Stdin,
+		Out:      os.Stderr,
+	}
+}
+
+// Interactive returns true if stdin and stderr are both terminals, so the user can be asked to choose a profile
+func Interactive() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// AnsiTerminal returns true if the terminal is expected to support ANSI escape sequences.  The legacy Windows console
+// is assumed not to support them, unless running in Windows Terminal, ConEmu, or a terminal setting TERM.
+func AnsiTerminal() bool {
+	t := os.Getenv("TERM")
+	if t == "dumb" {
+		return false
+	}
+
+	if runtime.GOOS == "windows" {
+		return len(t) > 0 || len(os.Getenv("WT_SESSION")) > 0 || os.Getenv("ConEmuANSI") == "ON"
+	}
+	return true
+}
+
+// Pick asks the user to choose an item.  ErrCancelled is returned if the user quits without choosing an item.
+func (p *Picker) Pick() (*Item, error) {
+	if len(p.Items) < 1 {
+		return nil, errors.New("no profiles found")
+	}
+
+	if p.MaxLines < 1 {
+		p.MaxLines = DefaultMaxLines
+	}
+
+	for _, i := range p.Items {
+		for c, s := range []string{i.Name, i.AccountId, i.Alias} {
+			if len(s) > p.widths[c] {
+				p.widths[c] = len(s)
+			}
+		}
+	}
+
+	if p.Ansi {
+		return p.pickAnsi()
+	}
+	return p.pickNumbered()
+}
+
+func (p *Picker) format(i *Item) string {
+	return strings.TrimRight(fmt.Sprintf("%-*s  %-*s  %-*s  %s", p.widths[0], i.Name, p.widths[1], i.AccountId,
+		p.widths[2], i.Alias, i.Role), " ")
+}
+
+// pickNumbered shows the numbered list of matching items, and reads a line of input.  A number selects the item,
+// anything else filters the list.  An empty line, or the end of the input, cancels the picker.
+func (p *Picker) pickNumbered() (*Item, error) {
+	r := bufio.NewReader(p.In)
+	items := p.Items
+
+	for {
+		for n, i := range items {
+			fmt.Fprintf(p.Out, "%3d) %s\n", n+1, p.format(i))
+		}
+		fmt.Fprintf(p.Out, "Select a profile [1-%d], or enter text to filter the list: ", len(items))
+
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if len(line) < 1 {
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, ErrCancelled
+		}
+
+		if n, err := strconv.Atoi(line); err == nil {
+			if n > 0 && n <= len(items) {
+				return items[n-1], nil
+			}
+			fmt.Fprintf(p.Out, "invalid selection: %d\n", n)
+			continue
+		}
+
+		m := Filter(p.Items, line)
+		switch len(m) {
+		case 0:
+			fmt.Fprintf(p.Out, "no profiles match '%s'\n", line)
+			items = p.Items
+		case 1:
+			return m[0], nil
+		default:
+			items = m
+		}
+	}
+}
+
+// pickAnsi draws the query, and the best matches below it, redrawing them as the user types.  The terminal is put in
+// raw mode, if the input is a terminal, so each key is read as it's typed.
+func (p *Picker) pickAnsi() (*Item, error) {
+	if f, ok := p.In.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		st, err := terminal.MakeRaw(int(f.Fd()))
+		if err != nil {
+			return nil, err
+		}
+		defer terminal.Restore(int(f.Fd()), st)
+	}
+
+	width := 0
+	if f, ok := p.Out.(*os.File); ok {
+		if w, _, err := terminal.GetSize(int(f.Fd())); err == nil {
+			width = w
+		}
+	}
+
+	r := bufio.NewReader(p.In)
+	query := make([]rune, 0)
+	sel := 0
+	matches := p.Items
+
+	// clear the picker from the screen when done
+	defer fmt.Fprint(p.Out, "\r\x1b[J")
+
+	for {
+		p.draw(string(query), matches, sel, width)
+
+		k, err := readKey(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k {
+		case keyEnter:
+			if len(matches) > 0 {
+				return matches[sel], nil
+			}
+		case keyCancel:
+			return nil, ErrCancelled
+		case keyUp:
+			if sel > 0 {
+				sel--
+			}
+		case keyDown:
+			if sel < len(matches)-1 && sel < p.MaxLines-1 {
+				sel++
+			}
+		case keyBackspace:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+			}
+		case keyClear:
+			query = query[:0]
+		case keyNone:
+			continue
+		default:
+			query = append(query, rune(k))
+		}
+
+		matches = Filter(p.Items, string(query))
+		if sel >= len(matches) {
+			sel = 0
+		}
+	}
+}
+
+// draw writes the prompt line, followed by the matches, then moves the cursor back to the end of the prompt line.  The
+// lines are shortened to the width of the terminal (if known), so the cursor movement isn't confused by wrapped lines.
+func (p *Picker) draw(query string, matches []*Item, sel int, width int) {
+	sb := new(strings.Builder)
+	prompt := fmt.Sprintf("profile (%d/%d)> %s", len(matches), len(p.Items), query)
+	sb.WriteString("\r\x1b[J")
+	sb.WriteString(prompt)
+
+	lines := 0
+	for n, i := range matches {
+		if n >= p.MaxLines {
+			break
+		}
+
+		s := p.format(i)
+		if width > 2 && len(s) > width-2 {
+			s = s[:width-2]
+		}
+
+		if n == sel {
+			sb.WriteString("\r\n\x1b[7m> " + s + "\x1b[0m")
+		} else {
+			sb.WriteString("\r\n  " + s)
+		}
+		lines++
+	}
+
+	if lines > 0 {
+		sb.WriteString(fmt.Sprintf("\x1b[%dA", lines))
+	}
+	sb.WriteString(fmt.Sprintf("\r\x1b[%dC", len([]rune(prompt))))
+
+	fmt.Fprint(p.Out, sb.String())
+}
+
+const (
+	keyNone      = 0
+	keyEnter     = -1
+	keyCancel    = -2
+	keyUp        = -3
+	keyDown      = -4
+	keyBackspace = -5
+	keyClear     = -6
+)
+
+// readKey reads a key press from the terminal, returning the printable character, or one of the key constants.  The
+// arrow keys send an escape sequence, an escape without a sequence following it is treated as a cancel.
+func readKey(r *bufio.Reader) (int, error) {
+	c, _, err := r.ReadRune()
+	if err != nil {
+		if err == io.EOF {
+			return keyCancel, nil
+		}
+		return keyNone, err
+	}
+
+	switch c {
+	case '\r', '\n':
+		return keyEnter, nil
+	case 3, 4: // Ctrl-C, Ctrl-D
+		return keyCancel, nil
+	case 16: // Ctrl-P
+		return keyUp, nil
+	case 14: // Ctrl-N
+		return keyDown, nil
+	case 8, 127:
+		return keyBackspace, nil
+	case 21: // Ctrl-U
+		return keyClear, nil
+	case 27:
+		if r.Buffered() < 2 {
+			return keyCancel, nil
+		}
+
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return keyNone, err
+		}
+
+		if b[0] == '[' || b[0] == 'O' {
+			switch b[1] {
+			case 'A':
+				return keyUp, nil
+			case 'B':
+				return keyDown, nil
+			}
+		}
+		return keyNone, nil
+	}
+
+	if c < ' ' {
+		return keyNone, nil
+	}
+	return int(c), nil
+}
@@ -0,0 +1,138 @@
+package picker
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPicker_Pick(t *testing.T) {
+	t.Run("no items", func(t *testing.T) {
+		if _, err := newPicker("1\n", false).Pick(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("numbered", func(t *testing.T) {
+		p := newPicker("2\n", false, testItems()...)
+		i, err := p.Pick()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		out := p.Out.(*bytes.Buffer).String()
+		if i.Name != "prod-admin" || !strings.Contains(out, "  2) prod-admin    222222222222  production  Admin\n") {
+			t.Errorf("unexpected selection %s, output: %s", i.Name, out)
+		}
+	})
+
+	t.Run("numbered filter", func(t *testing.T) {
+		p := newPicker("dev\n2\n", false, testItems()...)
+		i, err := p.Pick()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// the filtered list is numbered from 1
+		if i.Name != "dev-admin" {
+			t.Errorf("unexpected selection %s", i.Name)
+		}
+	})
+
+	t.Run("numbered single match", func(t *testing.T) {
+		i, err := newPicker("readonly\n", false, testItems()...).Pick()
+		if err != nil || i.Name != "dev-readonly" {
+			t.Errorf("unexpected selection %v: %v", i, err)
+		}
+	})
+
+	t.Run("numbered invalid", func(t *testing.T) {
+		i, err := newPicker("7\nzzz\n3\n", false, testItems()...).Pick()
+		if err != nil || i.Name != "dev-admin" {
+			t.Errorf("unexpected selection %v: %v", i, err)
+		}
+	})
+
+	t.Run("numbered cancel", func(t *testing.T) {
+		if _, err := newPicker("\n", false, testItems()...).Pick(); err != ErrCancelled {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+
+	t.Run("ansi", func(t *testing.T) {
+		p := newPicker("adm\x1b[B\r", true, testItems()...)
+		i, err := p.Pick()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// dev-admin is the best match, the down arrow selects the next one
+		if i.Name != "prod-admin" {
+			t.Errorf("unexpected selection %s", i.Name)
+		}
+
+		if out := p.Out.(*bytes.Buffer).String(); !strings.Contains(out, "profile (2/3)> adm") {
+			t.Errorf("unexpected output: %q", out)
+		}
+	})
+
+	t.Run("ansi edit", func(t *testing.T) {
+		i, err := newPicker("xx\x7f\x7f\x15prod\x1b[A\r", true, testItems()...).Pick()
+		if err != nil || i.Name != "prod-admin" {
+			t.Errorf("unexpected selection %v: %v", i, err)
+		}
+	})
+
+	t.Run("ansi no match", func(t *testing.T) {
+		// enter does nothing without a match, and the end of the input cancels
+		if _, err := newPicker("zzz\r", true, testItems()...).Pick(); err != ErrCancelled {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+
+	t.Run("ansi cancel", func(t *testing.T) {
+		if _, err := newPicker("\x03", true, testItems()...).Pick(); err != ErrCancelled {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+}
+
+func TestReadKey(t *testing.T) {
+	tests := map[string]int{
+		"a":      'a',
+		"\r":     keyEnter,
+		"\x1b":   keyCancel,
+		"\x1b[A": keyUp,
+		"\x1bOB": keyDown,
+		"\x1b[C": keyNone,
+		"\x10":   keyUp,
+		"\x0e":   keyDown,
+		"\x08":   keyBackspace,
+		"\x15":   keyClear,
+		"\x01":   keyNone,
+		"":       keyCancel,
+	}
+
+	for in, want := range tests {
+		k, err := readKey(bufio.NewReader(strings.NewReader(in)))
+		if err != nil || k != want {
+			t.Errorf("readKey(%q) = %d, %v, want %d", in, k, err, want)
+		}
+	}
+}
+
+func newPicker(in string, ansi bool, items ...*Item) *Picker {
+	return &Picker{Items: items, Ansi: ansi, In: strings.NewReader(in), Out: new(bytes.Buffer)}
+}
+
+func testItems() []*Item {
+	return []*Item{
+		{Name: "dev-readonly", AccountId: "111111111111", Role: "ReadOnly"},
+		{Name: "prod-admin", AccountId: "222222222222", Alias: "production", Role: "Admin"},
+		{Name: "dev-admin", AccountId: "111111111111", Role: "Admin"},
+	}
+}
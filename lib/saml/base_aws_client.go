@@ -26,6 +26,10 @@ type BaseAwsClient struct {
 	MfaTokenProvider func() (string, error)
 	MfaType          string
 	MfaToken         string
+	// Partition is the AWS partition of the roles, which selects the AWS service provider URN, default is aws
+	Partition string
+	// Provider is the name of the SAML provider (like okta, or keycloak) of the client, set by GetClient()
+	Provider string
 }
 
 func newBaseAwsClient(authUrl string) (*BaseAwsClient, error) {
@@ -61,6 +65,22 @@ func (c *BaseAwsClient) SetCookieJar(jar http.CookieJar) {
 	c.httpClient.Jar = jar
 }
 
+// SetHttpClient configures the SAML client to use the transport and timeout of the http.Client, like the clients created
+// by httpclient.New(), for proxy, TLS, and timeout settings.  The redirect policy and cookie jar of the SAML client are
+// not changed.
+func (c *BaseAwsClient) SetHttpClient(hc *http.Client) {
+	c.setHttpClient()
+	c.httpClient.Transport = hc.Transport
+	c.httpClient.Timeout = hc.Timeout
+}
+
+// ClearSaml discards the SAMLResponse retrieved by AwsSaml(), so the next call to AwsSaml() requests a new SAMLResponse
+// from the identity provider.  A SAMLResponse can only be used with AWS for a few minutes after it's issued.
+func (c *BaseAwsClient) ClearSaml() {
+	c.rawSamlResponse = ""
+	c.decodedSaml = ""
+}
+
 // GetIdentity retrieves the RoleSessionName attribute from the data returned by AwsSaml()
 func (c *BaseAwsClient) GetIdentity() (*identity.Identity, error) {
 	return c.getIdentity()
@@ -108,11 +128,29 @@ func (c *BaseAwsClient) getIdentity() (*identity.Identity, error) {
 		return nil, fmt.Errorf("unable to find RoleSessionName attribute in SAML doc")
 	}
 
-	return &identity.Identity{
+	id := &identity.Identity{
 		IdentityType: "user",
 		Username:     m[1],
 		Provider:     IdentityProviderSaml,
-	}, nil
+		Partition:    c.Partition,
+	}
+
+	if rd, err := c.roleDetails(); err == nil && len(rd.partition) > 0 {
+		id.Partition = rd.partition
+	}
+
+	return id, nil
+}
+
+// awsUrn returns the well known SAML URN of the AWS service provider for the partition
+func (c *BaseAwsClient) awsUrn() string {
+	switch c.Partition {
+	case "aws-us-gov":
+		return AwsUrnGovCloud
+	case "aws-cn":
+		return AwsUrnChina
+	}
+	return AwsUrn
 }
 
 func (c *BaseAwsClient) roleDetails() (*RoleDetails, error) {
@@ -123,7 +161,8 @@ func (c *BaseAwsClient) roleDetails() (*RoleDetails, error) {
 		return nil, err
 	}
 
-	re, err := regexp.Compile(`>(arn:aws:iam::\d+:(?:role|saml-provider)/.*?),(arn:aws:iam::\d+:(?:role|saml-provider)/.*?)<`)
+	// the partition (aws, aws-us-gov, aws-cn, ...) is the same for the role and the principal
+	re, err := regexp.Compile(`>(arn:(aws[\w-]*):iam::\d+:(?:role|saml-provider)/.*?),(arn:aws[\w-]*:iam::\d+:(?:role|saml-provider)/.*?)<`)
 	if err != nil {
 		return nil, err
 	}
@@ -131,10 +170,11 @@ func (c *BaseAwsClient) roleDetails() (*RoleDetails, error) {
 	m := re.FindAllStringSubmatch(c.decodedSaml, -1)
 	if m != nil {
 		for _, r := range m {
-			if strings.Contains(":role/", r[1]) {
-				rd.details[r[1]] = r[2]
+			rd.partition = r[2]
+			if strings.Contains(r[1], ":role/") {
+				rd.details[r[1]] = r[3]
 			} else {
-				rd.details[r[2]] = r[1]
+				rd.details[r[3]] = r[1]
 			}
 		}
 	}
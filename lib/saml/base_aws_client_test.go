@@ -1,8 +1,14 @@
 package saml
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
 	"net/http/cookiejar"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBaseAwsClient_Client(t *testing.T) {
@@ -12,6 +18,36 @@ func TestBaseAwsClient_Client(t *testing.T) {
 	}
 }
 
+func TestBaseAwsClient_SetHttpClient(t *testing.T) {
+	c := new(BaseAwsClient)
+	jar, _ := cookiejar.New(nil)
+	c.SetCookieJar(jar)
+
+	tr := new(http.Transport)
+	c.SetHttpClient(&http.Client{Transport: tr, Timeout: 10 * time.Second})
+
+	if c.httpClient.Transport != tr || c.httpClient.Timeout != 10*time.Second {
+		t.Error("http client settings not applied")
+	}
+
+	if c.httpClient.Jar != jar || c.httpClient.CheckRedirect == nil {
+		t.Error("saml client settings were not preserved")
+	}
+}
+
+func TestBaseAwsClient_ClearSaml(t *testing.T) {
+	c := goodClient()
+	if _, err := c.GetIdentity(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	c.ClearSaml()
+	if len(c.rawSamlResponse) > 0 || len(c.decodedSaml) > 0 {
+		t.Error("saml response not cleared")
+	}
+}
+
 func TestBaseAwsClient_GetIdentity(t *testing.T) {
 	t.Run("good", func(t *testing.T) {
 		c := goodClient()
@@ -84,6 +120,78 @@ func TestBaseAwsClient_Roles(t *testing.T) {
 	})
 }
 
+func TestBaseAwsClient_RoleDetails(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		rd, err := goodClient().RoleDetails()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, r := range rd.Roles() {
+			if !strings.Contains(r, ":role/") {
+				t.Errorf("unexpected role: %s", r)
+			}
+		}
+
+		if rd.Partition() != "aws" {
+			t.Errorf("unexpected partition: %s", rd.Partition())
+		}
+	})
+
+	for _, p := range []string{"aws", "aws-us-gov", "aws-cn"} {
+		t.Run(p, func(t *testing.T) {
+			role := fmt.Sprintf("arn:%s:iam::1234567890:role/Admin", p)
+			prin := fmt.Sprintf("arn:%s:iam::1234567890:saml-provider/mySSO", p)
+
+			// role and principal may be in either order
+			c := partitionClient(fmt.Sprintf(">%s,%s<", role, prin), fmt.Sprintf(">%s,%s<", prin,
+				strings.Replace(role, "Admin", "ReadOnly", 1)))
+
+			rd, err := c.RoleDetails()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			r := rd.Roles()
+			sort.Strings(r)
+			if len(r) != 2 || r[0] != role || rd.Principals()[0] != prin || rd.Partition() != p {
+				t.Errorf("unexpected role details: %s", rd)
+			}
+
+			if rd.Principal(r[1]) != prin || len(rd.Principal("arn:aws:iam::1234567890:role/Other")) > 0 {
+				t.Errorf("unexpected principal for %s: %s", r[1], rd.Principal(r[1]))
+			}
+
+			id, err := c.GetIdentity()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if id.Partition != p {
+				t.Errorf("unexpected identity partition: %s", id.Partition)
+			}
+		})
+	}
+}
+
+func TestBaseAwsClient_awsUrn(t *testing.T) {
+	tests := map[string]string{
+		"":           AwsUrn,
+		"aws":        AwsUrn,
+		"aws-us-gov": AwsUrnGovCloud,
+		"aws-cn":     AwsUrnChina,
+	}
+
+	for p, u := range tests {
+		if v := (&BaseAwsClient{Partition: p}).awsUrn(); v != u {
+			t.Errorf("unexpected urn for partition %s: %s", p, v)
+		}
+	}
+}
+
 func TestBaseAwsClient_SetCookieJar(t *testing.T) {
 	j, err := cookiejar.New(nil)
 	if err != nil {
@@ -104,6 +212,17 @@ func goodClient() *BaseAwsClient {
 	return c
 }
 
+func partitionClient(roles ...string) *BaseAwsClient {
+	doc := `<saml:Attribute Name="https://aws.amazon.com/SAML/Attributes/RoleSessionName"><saml:AttributeValue>my-saml-user</saml:AttributeValue></saml:Attribute>`
+	for _, r := range roles {
+		doc += fmt.Sprintf("<saml:AttributeValue%s/saml:AttributeValue>", r)
+	}
+
+	c, _ := newBaseAwsClient("http://example.com/auth/saml")
+	c.rawSamlResponse = base64.StdEncoding.EncodeToString([]byte(doc))
+	return c
+}
+
 func badClient() *BaseAwsClient {
 	c, _ := newBaseAwsClient("http://example.com/auth/saml")
 	c.rawSamlResponse = ""
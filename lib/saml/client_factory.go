@@ -13,7 +13,15 @@ func GetClient(provider, authUrl string, options ...func(s *BaseAwsClient)) (Aws
 	var err error
 
 	if len(provider) < 1 {
-		r, err := http.Head(authUrl)
+		// the detection request uses the HTTP settings configured by the options, and follows redirects
+		b := new(BaseAwsClient)
+		for _, f := range options {
+			f(b)
+		}
+		b.setHttpClient()
+
+		hc := &http.Client{Transport: b.httpClient.Transport, Timeout: b.httpClient.Timeout}
+		r, err := hc.Head(authUrl)
 		if err != nil {
 			return nil, err
 		}
@@ -41,6 +49,7 @@ func GetClient(provider, authUrl string, options ...func(s *BaseAwsClient)) (Aws
 		return nil, err
 	}
 
+	c.Client().Provider = provider
 	for _, f := range options {
 		f(c.Client())
 	}
@@ -18,6 +18,10 @@ func TestGetClientMock(t *testing.T) {
 	if _, ok := c.(*mockSamlClient); !ok {
 		t.Error("did not get correct client type")
 	}
+
+	if c.Client().Provider != "mock" {
+		t.Errorf("unexpected provider: %s", c.Client().Provider)
+	}
 }
 
 func TestGetClientUnknown(t *testing.T) {
@@ -53,6 +57,11 @@ func TestGetClientForgerock(t *testing.T) {
 	if _, ok := c.(*forgerockSamlClient); !ok {
 		t.Error("did not get correct client type")
 	}
+
+	// the detected provider is recorded
+	if c.Client().Provider != "forgerock" {
+		t.Errorf("unexpected provider: %s", c.Client().Provider)
+	}
 }
 
 func TestGetClientKeycloak(t *testing.T) {
@@ -80,7 +80,7 @@ func (c *forgerockSamlClient) AwsSaml() (string, error) {
 		return c.rawSamlResponse, nil
 	}
 
-	u, err := url.Parse(fmt.Sprintf("%s/idpssoinit?metaAlias=/%s/saml-idp&spEntityID=%s", c.baseUrl, c.realm, AwsUrn))
+	u, err := url.Parse(fmt.Sprintf("%s/idpssoinit?metaAlias=/%s/saml-idp&spEntityID=%s", c.baseUrl, c.realm, c.awsUrn()))
 	if err != nil {
 		return "", err
 	}
@@ -65,7 +65,7 @@ func (c oktaSamlClient) auth() error {
 	}
 
 	authUrl := fmt.Sprintf("%s://%s/api/v1/authn", c.authUrl.Scheme, c.authUrl.Host)
-	res, err := http.Post(authUrl, "application/json", bytes.NewReader(j))
+	res, err := c.httpClient.Post(authUrl, "application/json", bytes.NewReader(j))
 	if err != nil {
 		return err
 	}
@@ -202,7 +202,7 @@ func (c oktaSamlClient) handleTokenMfa(token string, verifyUrl string) (*apiResp
 
 	mfa := mfaResponse{Token: token, Code: c.MfaToken}
 	data, _ := json.Marshal(mfa)
-	res, err := http.Post(verifyUrl, "application/json", bytes.NewReader(data))
+	res, err := c.httpClient.Post(verifyUrl, "application/json", bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
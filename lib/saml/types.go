@@ -10,6 +10,10 @@ import (
 const (
 	// AwsUrn is the well known SAML URL for AWS
 	AwsUrn = "urn:amazon:webservices"
+	// AwsUrnGovCloud is the well known SAML URL for the AWS GovCloud (US) partition
+	AwsUrnGovCloud = "urn:amazon:webservices:govcloud"
+	// AwsUrnChina is the well known SAML URL for the AWS China partition
+	AwsUrnChina = "urn:amazon:webservices:cn"
 	// MfaTypeNone indicates that no MFA should be attempted regardless of the state of other MFA configuration
 	MfaTypeNone = "none"
 	// MfaTypeAuto indicates that the MFA type to use should be auto detected (as determined by each concrete provider)
@@ -37,7 +41,13 @@ type AwsClient interface {
 // RoleDetails is a type which holds the details of the AWS roles defined in a SAMLResponse.
 // It includes both the IAM Role ARN, as well as the SAML SSO Principal ARN.
 type RoleDetails struct {
-	details map[string]string
+	details   map[string]string
+	partition string
+}
+
+// Partition returns the AWS partition (like aws, aws-us-gov, or aws-cn) of the roles in the SAMLResponse
+func (r *RoleDetails) Partition() string {
+	return r.partition
 }
 
 // Roles will enumerate the list of IAM roles found in the SAMLResponse document
@@ -58,6 +68,12 @@ func (r *RoleDetails) Principals() []string {
 	return rd
 }
 
+// Principal returns the AWS SAML integration principal ARN for the role, or an empty string if the role isn't in the
+// SAMLResponse
+func (r *RoleDetails) Principal(role string) string {
+	return r.details[role]
+}
+
 func (r *RoleDetails) String() string {
 	sb := new(strings.Builder)
 	for k, v := range r.details {
@@ -0,0 +1,514 @@
+package ssm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// the version reported to the agent, which must be below 1.1.70 so the agent does not expect multiplexed port
+	// forwarding connections, which the native client does not support
+	nativeClientVersion = "1.0.0.0"
+	// the max size of the payload sent in each input_stream_data message
+	maxPayloadSize = 1024
+	// how long to wait for an acknowledgement before sending a message again
+	resendTimeout = 3 * time.Second
+	// how often to check for messages which need to be sent again
+	resendInterval = 500 * time.Millisecond
+)
+
+// handshake action types and status values
+const (
+	actionSessionType   = "SessionType"
+	actionKmsEncryption = "KMSEncryption"
+
+	actionSuccess     = 1
+	actionFailed      = 2
+	actionUnsupported = 3
+)
+
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestId            string
+	TokenValue           string
+	ClientId             string
+	ClientVersion        string
+}
+
+type acknowledgeContent struct {
+	MessageType         string `json:"AcknowledgedMessageType"`
+	MessageId           string `json:"AcknowledgedMessageId"`
+	SequenceNumber      int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage bool   `json:"IsSequentialMessage"`
+}
+
+type handshakeRequest struct {
+	AgentVersion           string
+	RequestedClientActions []struct {
+		ActionType       string
+		ActionParameters json.RawMessage
+	}
+}
+
+type handshakeResponse struct {
+	ClientVersion          string
+	ProcessedClientActions []processedClientAction
+	Errors                 []string
+}
+
+type processedClientAction struct {
+	ActionType   string
+	ActionStatus int
+	Error        string `json:",omitempty"`
+}
+
+type handshakeComplete struct {
+	HandshakeTimeToComplete time.Duration
+	CustomerMessage         string
+}
+
+type sessionTypeRequest struct {
+	SessionType string
+}
+
+type terminalSize struct {
+	Cols uint32 `json:"cols"`
+	Rows uint32 `json:"rows"`
+}
+
+type channelClosed struct {
+	SessionId string
+	Output    string
+}
+
+type pendingMessage struct {
+	msg  *agentMessage
+	sent time.Time
+}
+
+// dataChannel is the client side of the SSM session websocket data channel.  Output from the session is available by
+// calling Read(), and input to the session is sent by calling Write().  Stream data messages are sent with increasing
+// sequence numbers, and re-sent until they are acknowledged by the agent.  Messages received from the agent are
+// acknowledged, and processed in sequence number order.
+type dataChannel struct {
+	ws  *websocket.Conn
+	log func(string, ...interface{})
+
+	wmu     sync.Mutex // serializes websocket writes
+	mu      sync.Mutex // protects the fields below
+	outSeq  int64
+	inSeq   int64
+	unacked map[int64]*pendingMessage
+	inBuf   map[int64]*agentMessage
+	err     error
+
+	sessionType   string
+	sessionId     string // set by the handler, for information only
+	target        string // set by the handler, for information only
+	handshakeDone chan struct{}
+	data          chan []byte
+	buf           []byte
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// openDataChannel connects to the session stream URL returned by the StartSession API, and sends the token to open
+// the data channel.  The session handshake with the agent happens in the background, use waitHandshake() to know when
+// the session is ready for input.
+func openDataChannel(url, token string, log func(string, ...interface{})) (*dataChannel, error) {
+	cfg, err := websocket.NewConfig(url, "https://localhost/")
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if log == nil {
+		log = func(string, ...interface{}) {}
+	}
+
+	c := &dataChannel{
+		ws:            ws,
+		log:           log,
+		unacked:       make(map[int64]*pendingMessage),
+		inBuf:         make(map[int64]*agentMessage),
+		handshakeDone: make(chan struct{}),
+		data:          make(chan []byte, 64),
+		done:          make(chan struct{}),
+	}
+
+	in := &openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestId:            newUuid().String(),
+		TokenValue:           token,
+		ClientId:             newUuid().String(),
+		ClientVersion:        nativeClientVersion,
+	}
+
+	b, err := json.Marshal(in)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	// the open message is the only text message sent on the websocket
+	if err := websocket.Message.Send(ws, string(b)); err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	go c.resendLoop()
+
+	return c, nil
+}
+
+// waitHandshake blocks until the session handshake with the agent is complete, the channel is closed, or the timeout
+// expires
+func (c *dataChannel) waitHandshake(timeout time.Duration) error {
+	select {
+	case <-c.handshakeDone:
+		return nil
+	case <-c.done:
+		if err := c.error(); err != nil {
+			return err
+		}
+		return errors.New("data channel closed during handshake")
+	case <-time.After(timeout):
+		return errors.New("timeout waiting for session handshake")
+	}
+}
+
+// Read reads output data from the session, returning io.EOF when the data channel is closed
+func (c *dataChannel) Read(p []byte) (int, error) {
+	if len(c.buf) < 1 {
+		select {
+		case b := <-c.data:
+			c.buf = b
+		case <-c.done:
+			// drain any data received before closing
+			select {
+			case b := <-c.data:
+				c.buf = b
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write sends input data to the session, after the session handshake is complete
+func (c *dataChannel) Write(p []byte) (int, error) {
+	select {
+	case <-c.handshakeDone:
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	}
+
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	n := 0
+	for len(p) > 0 {
+		l := len(p)
+		if l > maxPayloadSize {
+			l = maxPayloadSize
+		}
+
+		b := make([]byte, l)
+		copy(b, p[:l])
+		if err := c.sendStreamData(payloadOutput, b); err != nil {
+			return n, err
+		}
+
+		n += l
+		p = p[l:]
+	}
+
+	return n, nil
+}
+
+// setTerminalSize sends the size of the local terminal to the session
+func (c *dataChannel) setTerminalSize(rows, cols int) error {
+	b, err := json.Marshal(&terminalSize{Cols: uint32(cols), Rows: uint32(rows)})
+	if err != nil {
+		return err
+	}
+	return c.sendStreamData(payloadSize, b)
+}
+
+// keepAlive sends an empty input message to the session, to reset the session idle timeout
+func (c *dataChannel) keepAlive() error {
+	return c.sendStreamData(payloadOutput, []byte{})
+}
+
+// sendFlag sends a flag message to the session, used to control port forwarding sessions
+func (c *dataChannel) sendFlag(flag uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, flag)
+	return c.sendStreamData(payloadFlag, b)
+}
+
+// Close closes the websocket, and stops the background processing for the channel
+func (c *dataChannel) Close() error {
+	c.close(nil)
+	return c.ws.Close()
+}
+
+func (c *dataChannel) close(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+	})
+}
+
+func (c *dataChannel) error() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *dataChannel) sendStreamData(payloadType uint32, payload []byte) error {
+	c.mu.Lock()
+	m := newAgentMessage(msgInputStreamData, c.outSeq, 0, payloadType, payload)
+	c.unacked[m.sequenceNumber] = &pendingMessage{msg: m, sent: time.Now()}
+	c.outSeq++
+	c.mu.Unlock()
+
+	return c.send(m)
+}
+
+func (c *dataChannel) send(m *agentMessage) error {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return websocket.Message.Send(c.ws, b)
+}
+
+func (c *dataChannel) readLoop() {
+	for {
+		var b []byte
+		if err := websocket.Message.Receive(c.ws, &b); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			c.close(err)
+			return
+		}
+
+		m := new(agentMessage)
+		if err := m.UnmarshalBinary(b); err != nil {
+			c.log("invalid message from agent: %v", err)
+			continue
+		}
+
+		if err := c.handleMessage(m); err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+func (c *dataChannel) handleMessage(m *agentMessage) error {
+	switch m.messageType {
+	case msgOutputStreamData:
+		if err := c.acknowledge(m); err != nil {
+			return err
+		}
+		return c.handleStreamData(m)
+	case msgAcknowledge:
+		a := new(acknowledgeContent)
+		if err := json.Unmarshal(m.payload, a); err != nil {
+			c.log("invalid acknowledge message: %v", err)
+			return nil
+		}
+
+		c.mu.Lock()
+		delete(c.unacked, a.SequenceNumber)
+		c.mu.Unlock()
+	case msgChannelClosed:
+		cc := new(channelClosed)
+		if err := json.Unmarshal(m.payload, cc); err == nil && len(cc.Output) > 0 {
+			c.log("channel closed: %s", cc.Output)
+		}
+		c.close(nil)
+	case msgStartPublication, msgPausePublication:
+		c.log("received %s message", m.messageType)
+	default:
+		c.log("unknown message type: %s", m.messageType)
+	}
+	return nil
+}
+
+// handleStreamData processes the stream data messages from the agent in sequence number order, buffering messages
+// received out of order, and discarding messages already processed
+func (c *dataChannel) handleStreamData(m *agentMessage) error {
+	c.mu.Lock()
+	if m.sequenceNumber < c.inSeq {
+		c.mu.Unlock()
+		return nil
+	}
+
+	c.inBuf[m.sequenceNumber] = m
+	ready := make([]*agentMessage, 0)
+	for {
+		n, ok := c.inBuf[c.inSeq]
+		if !ok {
+			break
+		}
+
+		delete(c.inBuf, c.inSeq)
+		ready = append(ready, n)
+		c.inSeq++
+	}
+	c.mu.Unlock()
+
+	for _, r := range ready {
+		if err := c.processPayload(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *dataChannel) processPayload(m *agentMessage) error {
+	switch m.payloadType {
+	case payloadOutput, payloadError:
+		select {
+		case c.data <- m.payload:
+		case <-c.done:
+		}
+	case payloadHandshakeRequest:
+		return c.handshake(m.payload)
+	case payloadHandshakeComplete:
+		hc := new(handshakeComplete)
+		if err := json.Unmarshal(m.payload, hc); err == nil && len(hc.CustomerMessage) > 0 {
+			c.log("%s", hc.CustomerMessage)
+		}
+		close(c.handshakeDone)
+	case payloadFlag:
+		if len(m.payload) >= 4 && binary.BigEndian.Uint32(m.payload) == flagConnectToPortError {
+			return errors.New("agent failed to connect to the remote port")
+		}
+	default:
+		c.log("unhandled payload type: %d", m.payloadType)
+	}
+	return nil
+}
+
+// handshake responds to the agent handshake request.  Only the session type action is supported, sessions requiring
+// KMS encryption will fail.
+func (c *dataChannel) handshake(p []byte) error {
+	req := new(handshakeRequest)
+	if err := json.Unmarshal(p, req); err != nil {
+		return fmt.Errorf("invalid handshake request: %v", err)
+	}
+	c.log("agent version: %s", req.AgentVersion)
+
+	res := &handshakeResponse{ClientVersion: nativeClientVersion, Errors: make([]string, 0)}
+	var hsErr error
+
+	for _, a := range req.RequestedClientActions {
+		pa := processedClientAction{ActionType: a.ActionType, ActionStatus: actionSuccess}
+
+		switch a.ActionType {
+		case actionSessionType:
+			st := new(sessionTypeRequest)
+			if err := json.Unmarshal(a.ActionParameters, st); err != nil {
+				pa.ActionStatus = actionFailed
+				pa.Error = err.Error()
+			}
+			c.sessionType = st.SessionType
+		case actionKmsEncryption:
+			pa.ActionStatus = actionFailed
+			pa.Error = "KMS encryption is not supported by this client"
+			hsErr = errors.New("sessions using KMS encryption are not supported by the native client, use the session-manager-plugin")
+		default:
+			pa.ActionStatus = actionUnsupported
+			pa.Error = fmt.Sprintf("unsupported action %s", a.ActionType)
+		}
+
+		if len(pa.Error) > 0 {
+			res.Errors = append(res.Errors, pa.Error)
+		}
+		res.ProcessedClientActions = append(res.ProcessedClientActions, pa)
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendStreamData(payloadHandshakeResponse, b); err != nil {
+		return err
+	}
+	return hsErr
+}
+
+func (c *dataChannel) acknowledge(m *agentMessage) error {
+	a := &acknowledgeContent{
+		MessageType:         m.messageType,
+		MessageId:           m.messageId.String(),
+		SequenceNumber:      m.sequenceNumber,
+		IsSequentialMessage: true,
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	return c.send(newAgentMessage(msgAcknowledge, 0, 3, 0, b))
+}
+
+// resendLoop sends stream data messages again if they have not been acknowledged within the resend timeout
+func (c *dataChannel) resendLoop() {
+	t := time.NewTicker(resendInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.mu.Lock()
+			resend := make([]*agentMessage, 0)
+			for _, p := range c.unacked {
+				if time.Since(p.sent) > resendTimeout {
+					p.sent = time.Now()
+					resend = append(resend, p.msg)
+				}
+			}
+			c.mu.Unlock()
+
+			for _, m := range resend {
+				c.log("resending message %d", m.sequenceNumber)
+				if err := c.send(m); err != nil {
+					c.log("error resending message: %v", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package ssm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockAgent is a stand-in for the SSM service side of the session data channel.  Stream data sent by the client is
+// echoed back, split in to 2 messages which are sent out of order, and with a duplicate message.
+type mockAgent struct {
+	token     string
+	kms       bool
+	dropFirst string // payload which is not acknowledged the first time it is received
+
+	mu       sync.Mutex
+	ws       *websocket.Conn
+	seq      int64
+	acked    map[int64]bool
+	flags    []uint32
+	sizes    []terminalSize
+	dropped  bool
+	seen     map[int64]int
+	sessions int
+}
+
+func newMockAgent() (*mockAgent, *httptest.Server) {
+	a := &mockAgent{token: "mock-token", acked: make(map[int64]bool), seen: make(map[int64]int)}
+	s := httptest.NewServer(websocket.Handler(a.handle))
+	return a, s
+}
+
+func (a *mockAgent) handle(ws *websocket.Conn) {
+	// each connection is a new session
+	a.mu.Lock()
+	a.ws = ws
+	a.seq = 0
+	a.seen = make(map[int64]int)
+	a.sessions++
+	a.mu.Unlock()
+
+	var s string
+	if err := websocket.Message.Receive(ws, &s); err != nil {
+		return
+	}
+
+	in := new(openDataChannelInput)
+	if err := json.Unmarshal([]byte(s), in); err != nil || in.TokenValue != a.token {
+		return
+	}
+
+	req := `{"AgentVersion":"3.0.0.0","RequestedClientActions":[{"ActionType":"SessionType","ActionParameters":{"SessionType":"Standard_Stream"}}]}`
+	if a.kms {
+		req = `{"AgentVersion":"3.0.0.0","RequestedClientActions":[{"ActionType":"KMSEncryption","ActionParameters":{"KMSKeyId":"key"}}]}`
+	}
+	a.sendOutput(payloadHandshakeRequest, []byte(req))
+
+	for {
+		var b []byte
+		if err := websocket.Message.Receive(ws, &b); err != nil {
+			return
+		}
+
+		m := new(agentMessage)
+		if err := m.UnmarshalBinary(b); err != nil {
+			return
+		}
+
+		if m.messageType == msgAcknowledge {
+			ack := new(acknowledgeContent)
+			_ = json.Unmarshal(m.payload, ack)
+			a.mu.Lock()
+			a.acked[ack.SequenceNumber] = true
+			a.mu.Unlock()
+			continue
+		}
+
+		a.mu.Lock()
+		if string(m.payload) == a.dropFirst && !a.dropped {
+			a.dropped = true
+			a.mu.Unlock()
+			continue
+		}
+		a.seen[m.sequenceNumber]++
+		dup := a.seen[m.sequenceNumber] > 1
+		a.mu.Unlock()
+
+		a.ack(m)
+		if dup {
+			continue
+		}
+
+		switch m.payloadType {
+		case payloadHandshakeResponse:
+			res := new(handshakeResponse)
+			_ = json.Unmarshal(m.payload, res)
+			if len(res.Errors) > 0 {
+				a.close()
+				return
+			}
+			a.sendOutput(payloadHandshakeComplete, []byte(`{"HandshakeTimeToComplete":1000000,"CustomerMessage":""}`))
+		case payloadOutput:
+			if string(m.payload) == "exit" {
+				a.close()
+				return
+			}
+			a.echo(m.payload)
+		case payloadSize:
+			sz := new(terminalSize)
+			_ = json.Unmarshal(m.payload, sz)
+			a.mu.Lock()
+			a.sizes = append(a.sizes, *sz)
+			a.mu.Unlock()
+		case payloadFlag:
+			a.mu.Lock()
+			a.flags = append(a.flags, binary.BigEndian.Uint32(m.payload))
+			a.mu.Unlock()
+		}
+	}
+}
+
+func (a *mockAgent) sessionCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sessions
+}
+
+func (a *mockAgent) echo(p []byte) {
+	if len(p) < 2 {
+		a.sendOutput(payloadOutput, p)
+		return
+	}
+
+	a.mu.Lock()
+	s := a.seq
+	a.seq += 2
+	a.mu.Unlock()
+
+	first := newAgentMessage(msgOutputStreamData, s, 0, payloadOutput, p[:len(p)/2])
+	a.send(newAgentMessage(msgOutputStreamData, s+1, 0, payloadOutput, p[len(p)/2:]))
+	a.send(first)
+	a.send(first)
+}
+
+func (a *mockAgent) sendOutput(pt uint32, p []byte) {
+	a.mu.Lock()
+	s := a.seq
+	a.seq++
+	a.mu.Unlock()
+	a.send(newAgentMessage(msgOutputStreamData, s, 0, pt, p))
+}
+
+func (a *mockAgent) ack(m *agentMessage) {
+	b, _ := json.Marshal(&acknowledgeContent{MessageType: m.messageType, MessageId: m.messageId.String(),
+		SequenceNumber: m.sequenceNumber, IsSequentialMessage: true})
+	a.send(newAgentMessage(msgAcknowledge, 0, 3, 0, b))
+}
+
+func (a *mockAgent) close() {
+	a.send(newAgentMessage(msgChannelClosed, 0, 0, 0, []byte(`{"SessionId":"mock","Output":"bye"}`)))
+}
+
+func (a *mockAgent) send(m *agentMessage) {
+	b, _ := m.MarshalBinary()
+	a.mu.Lock()
+	ws := a.ws
+	a.mu.Unlock()
+	_ = websocket.Message.Send(ws, b)
+}
+
+func wsUrl(s *httptest.Server) string {
+	return strings.Replace(s.URL, "http://", "ws://", 1)
+}
+
+func TestOpenDataChannel(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		a, s := newMockAgent()
+		defer s.Close()
+
+		c, err := openDataChannel(wsUrl(s), a.token, t.Logf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		if err := c.waitHandshake(5 * time.Second); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if c.sessionType != "Standard_Stream" {
+			t.Errorf("unexpected session type: %s", c.sessionType)
+		}
+
+		if _, err := c.Write([]byte("hello world")); err != nil {
+			t.Error(err)
+			return
+		}
+
+		b := make([]byte, 11)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(b) != "hello world" {
+			t.Errorf("unexpected output: %s", b)
+		}
+
+		// handshake request, handshake complete, and both parts of the output.  Acknowledgements are sent before the
+		// data is available to Read(), but may not be processed by the agent yet
+		for i := int64(0); i < 4; i++ {
+			var ok bool
+			for n := 0; n < 20 && !ok; n++ {
+				a.mu.Lock()
+				ok = a.acked[i]
+				a.mu.Unlock()
+				if !ok {
+					time.Sleep(50 * time.Millisecond)
+				}
+			}
+
+			if !ok {
+				t.Errorf("message %d not acknowledged", i)
+			}
+		}
+	})
+
+	t.Run("bad url", func(t *testing.T) {
+		if _, err := openDataChannel("ws://127.0.0.1:0/", "x", nil); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		_, s := newMockAgent()
+		defer s.Close()
+
+		c, err := openDataChannel(wsUrl(s), "bad", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		if err := c.waitHandshake(5 * time.Second); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("kms", func(t *testing.T) {
+		a, s := newMockAgent()
+		a.kms = true
+		defer s.Close()
+
+		c, err := openDataChannel(wsUrl(s), a.token, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		if err := c.waitHandshake(5 * time.Second); err == nil || !strings.Contains(err.Error(), "KMS") {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+}
+
+func TestDataChannel_Resend(t *testing.T) {
+	a, s := newMockAgent()
+	a.dropFirst = "resend"
+	defer s.Close()
+
+	c, err := openDataChannel(wsUrl(s), a.token, t.Logf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	if err := c.waitHandshake(5 * time.Second); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Write([]byte("resend")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	b := make([]byte, 6)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(b) != "resend" {
+		t.Errorf("unexpected output: %s", b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.unacked) > 0 {
+		t.Error("found unacknowledged messages")
+	}
+}
+
+func TestDataChannel_Close(t *testing.T) {
+	a, s := newMockAgent()
+	defer s.Close()
+
+	c, err := openDataChannel(wsUrl(s), a.token, t.Logf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	if err := c.waitHandshake(5 * time.Second); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := c.setTerminalSize(24, 80); err != nil {
+		t.Error(err)
+		return
+	}
+
+	out := new(bytes.Buffer)
+	if err := streamMode(strings.NewReader("exit"), out)(c); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Error("wrote to closed channel")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.sizes) != 1 || a.sizes[0].Rows != 24 || a.sizes[0].Cols != 80 {
+		t.Errorf("unexpected terminal size: %+v", a.sizes)
+	}
+}
+
+func TestForward(t *testing.T) {
+	a, s := newMockAgent()
+	defer s.Close()
+
+	c, err := openDataChannel(wsUrl(s), a.token, t.Logf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	if err := c.waitHandshake(5 * time.Second); err != nil {
+		t.Error(err)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer l.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- forward(c, accept(l)) }()
+
+	for _, msg := range []string{"ping", "pong"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+
+		if string(b) != msg {
+			t.Errorf("unexpected output: %s", b)
+		}
+	}
+
+	// wait for the disconnect flag from the 2nd connection
+	time.Sleep(250 * time.Millisecond)
+	a.mu.Lock()
+	flags := a.flags
+	a.mu.Unlock()
+	a.close()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout waiting for forward to return")
+	}
+
+	if len(flags) != 2 || flags[0] != flagDisconnectToPort {
+		t.Errorf("unexpected flags: %v", flags)
+	}
+}
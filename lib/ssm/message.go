@@ -0,0 +1,177 @@
+package ssm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// message types of the SSM session data channel
+const (
+	msgInputStreamData  = "input_stream_data"
+	msgOutputStreamData = "output_stream_data"
+	msgAcknowledge      = "acknowledge"
+	msgChannelClosed    = "channel_closed"
+	msgStartPublication = "start_publication"
+	msgPausePublication = "pause_publication"
+)
+
+// payload types of stream data messages
+const (
+	payloadOutput            uint32 = 1
+	payloadError             uint32 = 2
+	payloadSize              uint32 = 3
+	payloadParameter         uint32 = 4
+	payloadHandshakeRequest  uint32 = 5
+	payloadHandshakeResponse uint32 = 6
+	payloadHandshakeComplete uint32 = 7
+	payloadEncChallengeReq   uint32 = 8
+	payloadEncChallengeResp  uint32 = 9
+	payloadFlag              uint32 = 10
+)
+
+// values of flag payloads, used by port forwarding sessions
+const (
+	flagDisconnectToPort   uint32 = 1
+	flagTerminateSession   uint32 = 2
+	flagConnectToPortError uint32 = 3
+)
+
+// the layout of the binary message header, all integers are big-endian.  The header length field holds the offset
+// of the payload length field, not the actual length of the header.
+const (
+	msgTypeLength     = 32
+	msgTypeOffset     = 4
+	schemaOffset      = 36
+	createdOffset     = 40
+	seqOffset         = 48
+	flagsOffset       = 56
+	msgIdOffset       = 64
+	digestOffset      = 80
+	payloadTypeOffset = 112
+	payloadLenOffset  = 116
+	payloadOffset     = 120
+)
+
+// agentMessage is the binary message exchanged with the SSM agent over the session websocket
+type agentMessage struct {
+	messageType    string
+	schemaVersion  uint32
+	createdDate    time.Time
+	sequenceNumber int64
+	flags          uint64
+	messageId      uuid
+	payloadType    uint32
+	payload        []byte
+}
+
+func newAgentMessage(msgType string, seq int64, flags uint64, payloadType uint32, payload []byte) *agentMessage {
+	return &agentMessage{
+		messageType:    msgType,
+		schemaVersion:  1,
+		createdDate:    time.Now(),
+		sequenceNumber: seq,
+		flags:          flags,
+		messageId:      newUuid(),
+		payloadType:    payloadType,
+		payload:        payload,
+	}
+}
+
+// MarshalBinary serializes the message in the wire format expected by the SSM agent
+func (m *agentMessage) MarshalBinary() ([]byte, error) {
+	if len(m.messageType) > msgTypeLength {
+		return nil, fmt.Errorf("message type %s too long", m.messageType)
+	}
+
+	b := make([]byte, payloadOffset+len(m.payload))
+	binary.BigEndian.PutUint32(b, payloadLenOffset)
+
+	// message type is right-padded with spaces
+	copy(b[msgTypeOffset:schemaOffset], bytes.Repeat([]byte(" "), msgTypeLength))
+	copy(b[msgTypeOffset:], m.messageType)
+
+	binary.BigEndian.PutUint32(b[schemaOffset:], m.schemaVersion)
+	binary.BigEndian.PutUint64(b[createdOffset:], uint64(m.createdDate.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint64(b[seqOffset:], uint64(m.sequenceNumber))
+	binary.BigEndian.PutUint64(b[flagsOffset:], m.flags)
+	m.messageId.put(b[msgIdOffset:digestOffset])
+
+	d := sha256.Sum256(m.payload)
+	copy(b[digestOffset:payloadTypeOffset], d[:])
+
+	binary.BigEndian.PutUint32(b[payloadTypeOffset:], m.payloadType)
+	binary.BigEndian.PutUint32(b[payloadLenOffset:], uint32(len(m.payload)))
+	copy(b[payloadOffset:], m.payload)
+
+	return b, nil
+}
+
+// UnmarshalBinary parses a message received from the SSM agent, validating the payload length and digest
+func (m *agentMessage) UnmarshalBinary(b []byte) error {
+	if len(b) < payloadOffset {
+		return errors.New("message too short")
+	}
+
+	hl := binary.BigEndian.Uint32(b)
+	if int(hl)+4 > len(b) {
+		return errors.New("invalid message header length")
+	}
+
+	m.messageType = strings.TrimRight(string(b[msgTypeOffset:schemaOffset]), " \x00")
+	m.schemaVersion = binary.BigEndian.Uint32(b[schemaOffset:])
+	m.createdDate = time.Unix(0, int64(binary.BigEndian.Uint64(b[createdOffset:]))*int64(time.Millisecond))
+	m.sequenceNumber = int64(binary.BigEndian.Uint64(b[seqOffset:]))
+	m.flags = binary.BigEndian.Uint64(b[flagsOffset:])
+	m.messageId = getUuid(b[msgIdOffset:digestOffset])
+	m.payloadType = binary.BigEndian.Uint32(b[payloadTypeOffset:])
+
+	pl := binary.BigEndian.Uint32(b[payloadLenOffset:])
+	start := int(hl) + 4
+	if start+int(pl) > len(b) {
+		return errors.New("invalid message payload length")
+	}
+	m.payload = b[start : start+int(pl)]
+
+	d := sha256.Sum256(m.payload)
+	if !bytes.Equal(d[:], b[digestOffset:payloadTypeOffset]) {
+		return errors.New("invalid message payload digest")
+	}
+
+	return nil
+}
+
+// uuid is a random (version 4) UUID, used as the message ID
+type uuid [16]byte
+
+func newUuid() uuid {
+	var u uuid
+	_, _ = rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return u
+}
+
+// the agent expects the least significant 8 bytes of the UUID before the most significant 8 bytes
+func (u uuid) put(b []byte) {
+	copy(b, u[8:])
+	copy(b[8:], u[:8])
+}
+
+func getUuid(b []byte) uuid {
+	var u uuid
+	copy(u[8:], b[:8])
+	copy(u[:8], b[8:16])
+	return u
+}
+
+func (u uuid) String() string {
+	h := hex.EncodeToString(u[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:])
+}
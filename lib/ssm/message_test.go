@@ -0,0 +1,83 @@
+package ssm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestAgentMessage_MarshalBinary(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		m := newAgentMessage(msgInputStreamData, 5, 0, payloadOutput, []byte("hello"))
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(b) != payloadOffset+5 || binary.BigEndian.Uint32(b) != payloadLenOffset {
+			t.Error("invalid header")
+		}
+
+		if string(b[msgTypeOffset:schemaOffset]) != "input_stream_data               " {
+			t.Errorf("unexpected message type field: '%s'", b[msgTypeOffset:schemaOffset])
+		}
+
+		n := new(agentMessage)
+		if err := n.UnmarshalBinary(b); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if n.messageType != m.messageType || n.sequenceNumber != 5 || n.payloadType != payloadOutput ||
+			n.messageId != m.messageId || string(n.payload) != "hello" || n.schemaVersion != 1 {
+			t.Errorf("data mismatch: %+v", n)
+		}
+	})
+
+	t.Run("long type", func(t *testing.T) {
+		m := newAgentMessage("this_message_type_is_longer_than_32_bytes", 0, 0, 0, nil)
+		if _, err := m.MarshalBinary(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestAgentMessage_UnmarshalBinary(t *testing.T) {
+	b, _ := newAgentMessage(msgOutputStreamData, 1, 0, payloadOutput, []byte("data")).MarshalBinary()
+
+	t.Run("short", func(t *testing.T) {
+		if err := new(agentMessage).UnmarshalBinary(b[:50]); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad length", func(t *testing.T) {
+		c := append([]byte{}, b...)
+		binary.BigEndian.PutUint32(c[payloadLenOffset:], 100)
+		if err := new(agentMessage).UnmarshalBinary(c); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad digest", func(t *testing.T) {
+		c := append([]byte{}, b...)
+		c[len(c)-1] = 'X'
+		if err := new(agentMessage).UnmarshalBinary(c); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestUuid(t *testing.T) {
+	u := newUuid()
+	if len(u.String()) != 36 || u.String()[14] != '4' {
+		t.Errorf("invalid uuid: %s", u)
+	}
+
+	b := make([]byte, 16)
+	u.put(b)
+	if !bytes.Equal(b[:8], u[8:]) || getUuid(b) != u {
+		t.Error("data mismatch")
+	}
+}
@@ -0,0 +1,278 @@
+package ssm
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"time"
+)
+
+const (
+	pluginName       = "session-manager-plugin"
+	handshakeTimeout = 30 * time.Second
+	// SSM sessions are closed after 20 minutes without input by default
+	keepAliveInterval = 5 * time.Minute
+)
+
+// sessionMode handles the local side of a native client session, using the data channel to communicate with the agent
+type sessionMode func(c *dataChannel) error
+
+// run starts the session described by the StartSessionInput.  The session-manager-plugin is used if it is installed,
+// unless the handler was configured to use the native client.  Otherwise the session is handled by the native client,
+// using the provided mode.
+func (h *sessionHandler) run(in *ssm.StartSessionInput, mode sessionMode) error {
+	if !h.native {
+		if _, err := exec.LookPath(pluginName); err == nil {
+			c, err := h.cmd(in)
+			if err != nil {
+				return err
+			}
+
+			if h.testing {
+				return nil
+			}
+			return c.Run()
+		}
+		h.debug("%s not found, using native client", pluginName)
+	}
+
+	return h.runNative(in, mode)
+}
+
+func (h *sessionHandler) runNative(in *ssm.StartSessionInput, mode sessionMode) error {
+	out, err := h.client.StartSession(in)
+	if err != nil {
+		return err
+	}
+
+	if h.testing {
+		return nil
+	}
+
+	id := aws.StringValue(out.SessionId)
+	defer func() {
+		if _, err := h.client.TerminateSession(&ssm.TerminateSessionInput{SessionId: out.SessionId}); err != nil {
+			h.debug("error terminating session %s: %v", id, err)
+		}
+	}()
+
+	c, err := openDataChannel(aws.StringValue(out.StreamUrl), aws.StringValue(out.TokenValue), h.debug)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.sessionId = id
+	c.target = aws.StringValue(in.Target)
+
+	if err := c.waitHandshake(handshakeTimeout); err != nil {
+		return err
+	}
+	h.debug("session %s started", id)
+
+	return mode(c)
+}
+
+// shellMode connects the local terminal to a shell session.  If stdin is a terminal, it is put in raw mode for the
+// duration of the session, and changes to the terminal size are sent to the agent.  If the handler is configured to
+// record sessions, the session output (and input, if enabled) is also written to the recording.
+func (h *sessionHandler) shellMode(c *dataChannel) error {
+	var in io.Reader = os.Stdin
+	var out io.Writer = os.Stdout
+
+	if h.recording != nil {
+		w, ht, err := terminal.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			w, ht = 80, 24
+		}
+
+		rec, err := h.recording.open(c.target, c.sessionId, w, ht)
+		if err != nil {
+			return fmt.Errorf("unable to create session recording: %v", err)
+		}
+		defer rec.Close()
+
+		fmt.Fprintf(os.Stderr, "Recording session to %s\n", rec.name)
+		in, out = rec.reader(in), rec.writer(out)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		st, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(fd, st)
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchTerminalSize(c, stop)
+	}
+
+	return streamMode(in, out)(c)
+}
+
+// streamMode copies data between the data channel and the provided reader and writer, until the data channel is closed,
+// or the reader returns EOF.  Used for shell and ssh sessions.
+func streamMode(r io.Reader, w io.Writer) sessionMode {
+	return func(c *dataChannel) error {
+		errCh := make(chan error, 2)
+
+		go func() {
+			_, err := io.Copy(c, r)
+			errCh <- err
+		}()
+
+		go func() {
+			_, err := io.Copy(w, c)
+			errCh <- err
+		}()
+
+		if err := <-errCh; err != nil && err != io.ErrClosedPipe {
+			return err
+		}
+		return c.error()
+	}
+}
+
+// forwardMode listens on the local port lp, and forwards connections to the session until interrupted.  The agent only
+// supports a single connection per session, so connections are handled one at a time.  When a local connection closes,
+// the agent is told to disconnect from the remote port, and will reconnect for the next local connection.
+func forwardMode(lp string) sessionMode {
+	return func(c *dataChannel) error {
+		l, err := listen(lp)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt)
+		defer signal.Stop(sigCh)
+
+		go func() {
+			select {
+			case <-sigCh:
+				l.Close()
+			case <-c.done:
+			}
+		}()
+
+		return forward(c, accept(l))
+	}
+}
+
+// listen opens the local port forwarding listener on port lp, if lp is 0, a random port is chosen
+func listen(lp string) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", lp))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Port %d opened, waiting for connections...\n", l.Addr().(*net.TCPAddr).Port)
+	return l, nil
+}
+
+// accept returns the connections accepted by the listener, the channel is closed when the listener is closed
+func accept(l net.Listener) <-chan net.Conn {
+	conns := make(chan net.Conn)
+	go func() {
+		defer close(conns)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return conns
+}
+
+// forward sends the local connections to the session, until the data channel or the connection channel is closed.
+// While there is no local connection, an empty message is sent to the agent at the keep alive interval, so the session
+// is not closed by the idle session timeout.
+func forward(c *dataChannel, conns <-chan net.Conn) error {
+	// a single reader of the data channel, so data is not lost between local connections
+	data := make(chan []byte)
+	go func() {
+		defer close(data)
+		for {
+			b := make([]byte, 32*1024)
+			n, err := c.Read(b)
+			if err != nil {
+				return
+			}
+
+			select {
+			case data <- b[:n]:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	t := time.NewTicker(keepAliveInterval)
+	defer t.Stop()
+
+	for {
+		var conn net.Conn
+		select {
+		case _, ok := <-data:
+			// data received without a local connection is discarded
+			if !ok {
+				return c.error()
+			}
+			continue
+		case <-t.C:
+			if err := c.keepAlive(); err != nil {
+				return err
+			}
+			continue
+		case conn = <-conns:
+			if conn == nil {
+				return nil
+			}
+		}
+
+		if done := forwardConn(c, conn, data); done {
+			return c.error()
+		}
+
+		if err := c.sendFlag(flagDisconnectToPort); err != nil {
+			return err
+		}
+	}
+}
+
+// forwardConn copies data between the local connection and the data channel, returning true if the data channel was
+// closed, or false if the local connection was closed
+func forwardConn(c *dataChannel, conn net.Conn, data <-chan []byte) bool {
+	defer conn.Close()
+
+	connDone := make(chan struct{})
+	go func() {
+		defer close(connDone)
+		_, _ = io.Copy(c, conn)
+	}()
+
+	for {
+		select {
+		case b, ok := <-data:
+			if !ok {
+				return true
+			}
+
+			if _, err := conn.Write(b); err != nil {
+				return false
+			}
+		case <-connDone:
+			return false
+		}
+	}
+}
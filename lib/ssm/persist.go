@@ -0,0 +1,181 @@
+package ssm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reconnectMinDelay = 1 * time.Second
+	reconnectMaxDelay = 1 * time.Minute
+)
+
+// PortMapping describes a persistent port forwarding session from a local port to a port on the target instance, or
+// to a port on a remote host reachable from the target instance, if RemoteHost is set.
+type PortMapping struct {
+	LocalPort  string
+	Target     string
+	RemoteHost string
+	RemotePort string
+}
+
+// ParsePortMapping parses a port mapping in the format local:target:remote.  The target may be any of the formats
+// supported by resolveTarget(), including formats which contain a ':', like tag:Name=value.  If the local port is 0, a
+// random, open local port is chosen, and kept for the lifetime of the forwarding session.
+func ParsePortMapping(s string) (*PortMapping, error) {
+	f := strings.Index(s, ":")
+	l := strings.LastIndex(s, ":")
+	if f < 0 || f == l {
+		return nil, fmt.Errorf("invalid port mapping '%s', must be local:target:remote", s)
+	}
+
+	m := &PortMapping{LocalPort: s[:f], Target: s[f+1 : l], RemotePort: s[l+1:]}
+	if len(m.Target) < 1 {
+		return nil, fmt.Errorf("invalid port mapping '%s', missing target", s)
+	}
+
+	if _, err := strconv.ParseUint(m.LocalPort, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid local port in port mapping '%s'", s)
+	}
+
+	if p, err := strconv.ParseUint(m.RemotePort, 10, 16); err != nil || p < 1 {
+		return nil, fmt.Errorf("invalid remote port in port mapping '%s'", s)
+	}
+
+	return m, nil
+}
+
+// String returns the port mapping in the format accepted by ParsePortMapping
+func (m *PortMapping) String() string {
+	if len(m.RemoteHost) > 0 {
+		return fmt.Sprintf("%s:%s:%s:%s", m.LocalPort, m.Target, m.RemoteHost, m.RemotePort)
+	}
+	return fmt.Sprintf("%s:%s:%s", m.LocalPort, m.Target, m.RemotePort)
+}
+
+// ForwardPorts will open persistent SSM port-forwarding sessions for each of the provided mappings, and blocks until
+// interrupted.  The local listener for each mapping is kept open for the lifetime of the call, and a new session is
+// started whenever a session ends, such as when the idle session timeout is reached, or the credentials expire.  Since
+// the local listener is managed directly, persistent sessions always use the built-in session client.
+func (h *sessionHandler) ForwardPorts(mappings ...*PortMapping) error {
+	if len(mappings) < 1 {
+		return errors.New("no port mappings provided")
+	}
+
+	inputs := make([]*ssm.StartSessionInput, len(mappings))
+	for i, m := range mappings {
+		host, rp := m.RemoteHost, m.RemotePort
+
+		if len(host) > 0 {
+			var err error
+			host, rp, err = h.resolveRemoteHost(host, rp)
+			if err != nil {
+				return err
+			}
+		}
+
+		id, err := h.resolveTarget(m.Target)
+		if err != nil {
+			return err
+		}
+
+		inputs[i] = portForwardInput(id, m.LocalPort, host, rp)
+	}
+
+	if h.testing {
+		for _, in := range inputs {
+			if _, err := h.client.StartSession(in); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	listeners := make([]net.Listener, 0, len(mappings))
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, m := range mappings {
+		l, err := listen(m.LocalPort)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	defer signal.Stop(sigCh)
+
+	go func() {
+		<-sigCh
+		close(stop)
+		closeAll()
+	}()
+
+	wg := new(sync.WaitGroup)
+	for i, in := range inputs {
+		wg.Add(1)
+		go func(m *PortMapping, in *ssm.StartSessionInput, l net.Listener) {
+			defer wg.Done()
+			h.persist(m, in, accept(l), stop)
+		}(mappings[i], in, listeners[i])
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// persist runs port forwarding sessions for the mapping, until the stop channel is closed.  Failed sessions are retried
+// with an increasing delay, which is reset once a session has stayed up for a while.  A new StartSession call is made
+// for each session, so the handler's credentials are refreshed as needed.
+func (h *sessionHandler) persist(m *PortMapping, in *ssm.StartSessionInput, conns <-chan net.Conn, stop <-chan struct{}) {
+	delay := reconnectMinDelay
+
+	for {
+		start := time.Now()
+		err := h.runNative(in, func(c *dataChannel) error {
+			return forward(c, conns)
+		})
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "session for %s failed: %v\n", m, err)
+		} else {
+			h.debug("session for %s closed", m)
+		}
+
+		if time.Since(start) > reconnectMaxDelay {
+			delay = reconnectMinDelay
+		}
+
+		fmt.Fprintf(os.Stderr, "reconnecting %s in %s\n", m, delay)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package ssm
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// mockStreamClient returns the URL of a mock agent from StartSession
+type mockStreamClient struct {
+	mockSsmClient
+	url string
+}
+
+func (c *mockStreamClient) StartSession(in *ssm.StartSessionInput) (*ssm.StartSessionOutput, error) {
+	o, err := c.mockSsmClient.StartSession(in)
+	if err != nil {
+		return nil, err
+	}
+	o.TokenValue = aws.String("mock-token")
+	return o.SetStreamUrl(c.url), nil
+}
+
+func (c *mockStreamClient) TerminateSession(in *ssm.TerminateSessionInput) (*ssm.TerminateSessionOutput, error) {
+	return &ssm.TerminateSessionOutput{SessionId: in.SessionId}, nil
+}
+
+func TestParsePortMapping(t *testing.T) {
+	good := []struct {
+		in     string
+		target string
+		lp     string
+		rp     string
+	}{
+		{"8080:i-deadbeef:80", "i-deadbeef", "8080", "80"},
+		{"2222:tag:Role=bastion:22", "tag:Role=bastion", "2222", "22"},
+		{"5432:10.0.0.1:5432", "10.0.0.1", "5432", "5432"},
+	}
+
+	for _, tc := range good {
+		t.Run(tc.in, func(t *testing.T) {
+			m, err := ParsePortMapping(tc.in)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if m.Target != tc.target || m.LocalPort != tc.lp || m.RemotePort != tc.rp || m.String() != tc.in {
+				t.Errorf("data mismatch: %+v", m)
+			}
+		})
+	}
+
+	bad := []string{"", "8080", "8080:80", "8080::80", "x:i-deadbeef:80", "8080:i-deadbeef:99999",
+		"8080:i-deadbeef:"}
+	for _, b := range bad {
+		t.Run("bad "+b, func(t *testing.T) {
+			if _, err := ParsePortMapping(b); err == nil {
+				t.Error("did not receive expected error")
+			}
+		})
+	}
+}
+
+func TestSessionHandler_ForwardPorts(t *testing.T) {
+	h := &sessionHandler{
+		client:  new(mockSsmClient),
+		ec2:     new(mockEc2Client),
+		rds:     new(mockRdsClient),
+		log:     aws.NewDefaultLogger(),
+		testing: true,
+	}
+
+	t.Run("good", func(t *testing.T) {
+		m := []*PortMapping{
+			{LocalPort: "8080", Target: "i-deadbeef", RemotePort: "80"},
+			{LocalPort: "5432", Target: "tag:Role=bastion", RemoteHost: "rds:my-db"},
+		}
+
+		if err := h.ForwardPorts(m...); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if err := h.ForwardPorts(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad target", func(t *testing.T) {
+		if err := h.ForwardPorts(&PortMapping{LocalPort: "8080", Target: "nope", RemotePort: "80"}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestSessionHandler_persist(t *testing.T) {
+	a, s := newMockAgent()
+	defer s.Close()
+
+	h := &sessionHandler{client: &mockStreamClient{url: wsUrl(s)}, log: aws.NewDefaultLogger()}
+	m := &PortMapping{LocalPort: "8080", Target: "i-deadbeef", RemotePort: "80"}
+
+	conns := make(chan net.Conn)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.persist(m, portForwardInput("i-deadbeef", "8080", "", "80"), conns, stop)
+	}()
+
+	ping := func(msg string) {
+		l, r := net.Pipe()
+		defer l.Close()
+		conns <- r
+
+		if _, err := l.Write([]byte(msg)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(l, b); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if string(b) != msg {
+			t.Errorf("unexpected output: %s", b)
+		}
+	}
+
+	ping("first")
+
+	// end the session, a new session should be started for the next connection
+	a.close()
+	for i := 0; i < 50 && a.sessionCount() < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	ping("second")
+
+	close(stop)
+	close(conns)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("timeout waiting for persist to return")
+	}
+
+	if n := a.sessionCount(); n != 2 {
+		t.Errorf("unexpected session count: %d", n)
+	}
+}
@@ -0,0 +1,44 @@
+package ssm
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// the prefix of a remote host which is an RDS DB instance or cluster identifier
+const rdsHostPrefix = "rds:"
+
+// resolveRdsEndpoint returns the address and port of the endpoint for the RDS DB instance, or DB cluster, with the
+// provided identifier.  DB instances are checked first, then DB clusters.
+func (h *sessionHandler) resolveRdsEndpoint(id string) (string, string, error) {
+	i, err := h.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: aws.String(id)})
+	if err == nil {
+		if len(i.DBInstances) > 0 && i.DBInstances[0].Endpoint != nil {
+			e := i.DBInstances[0].Endpoint
+			h.debug("resolved RDS instance %s to %s:%d", id, aws.StringValue(e.Address), aws.Int64Value(e.Port))
+			return aws.StringValue(e.Address), fmt.Sprintf("%d", aws.Int64Value(e.Port)), nil
+		}
+		return "", "", fmt.Errorf("RDS instance %s does not have an endpoint", id)
+	}
+
+	if e, ok := err.(awserr.Error); !ok || e.Code() != rds.ErrCodeDBInstanceNotFoundFault {
+		return "", "", err
+	}
+
+	c, err := h.rds.DescribeDBClusters(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(id)})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == rds.ErrCodeDBClusterNotFoundFault {
+			return "", "", fmt.Errorf("no RDS instance or cluster found with identifier %s", id)
+		}
+		return "", "", err
+	}
+
+	if len(c.DBClusters) > 0 && c.DBClusters[0].Endpoint != nil {
+		e := c.DBClusters[0]
+		h.debug("resolved RDS cluster %s to %s:%d", id, aws.StringValue(e.Endpoint), aws.Int64Value(e.Port))
+		return aws.StringValue(e.Endpoint), fmt.Sprintf("%d", aws.Int64Value(e.Port)), nil
+	}
+	return "", "", fmt.Errorf("RDS cluster %s does not have an endpoint", id)
+}
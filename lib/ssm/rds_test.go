@@ -0,0 +1,71 @@
+package ssm
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"testing"
+)
+
+type mockRdsClient struct {
+	rdsiface.RDSAPI
+}
+
+func (c *mockRdsClient) DescribeDBInstances(in *rds.DescribeDBInstancesInput) (*rds.DescribeDBInstancesOutput, error) {
+	switch aws.StringValue(in.DBInstanceIdentifier) {
+	case "my-db":
+		e := new(rds.Endpoint).SetAddress("my-db.abc123.us-east-1.rds.amazonaws.com").SetPort(5432)
+		return &rds.DescribeDBInstancesOutput{DBInstances: []*rds.DBInstance{{Endpoint: e}}}, nil
+	case "creating-db":
+		return &rds.DescribeDBInstancesOutput{DBInstances: []*rds.DBInstance{{}}}, nil
+	case "error":
+		return nil, errors.New("mock DescribeDBInstances error")
+	}
+	return nil, awserr.New(rds.ErrCodeDBInstanceNotFoundFault, "not found", nil)
+}
+
+func (c *mockRdsClient) DescribeDBClusters(in *rds.DescribeDBClustersInput) (*rds.DescribeDBClustersOutput, error) {
+	if aws.StringValue(in.DBClusterIdentifier) == "my-cluster" {
+		cl := new(rds.DBCluster).SetEndpoint("my-cluster.cluster-abc123.us-east-1.rds.amazonaws.com").SetPort(3306)
+		return &rds.DescribeDBClustersOutput{DBClusters: []*rds.DBCluster{cl}}, nil
+	}
+	return nil, awserr.New(rds.ErrCodeDBClusterNotFoundFault, "not found", nil)
+}
+
+func TestSessionHandler_ResolveRdsEndpoint(t *testing.T) {
+	h := &sessionHandler{rds: new(mockRdsClient)}
+
+	t.Run("instance", func(t *testing.T) {
+		a, p, err := h.resolveRdsEndpoint("my-db")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if a != "my-db.abc123.us-east-1.rds.amazonaws.com" || p != "5432" {
+			t.Errorf("unexpected endpoint: %s:%s", a, p)
+		}
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		a, p, err := h.resolveRdsEndpoint("my-cluster")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if a != "my-cluster.cluster-abc123.us-east-1.rds.amazonaws.com" || p != "3306" {
+			t.Errorf("unexpected endpoint: %s:%s", a, p)
+		}
+	})
+
+	for _, v := range []string{"creating-db", "error", "not-found"} {
+		t.Run(v, func(t *testing.T) {
+			if _, _, err := h.resolveRdsEndpoint(v); err == nil {
+				t.Error("did not receive expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package ssm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// asciicast v2 event types
+const (
+	castOutput = "o"
+	castInput  = "i"
+)
+
+// Recording configures the recording of shell sessions to asciicast v2 files in Dir.  The Profile and RoleArn are
+// included in the header of the recording, to identify the credentials used for the session.  Only the session output
+// is recorded, unless Input is set.  Recorded input includes anything typed during the session, including passwords
+// and tokens, which are stored in plain text.
+type Recording struct {
+	Dir     string
+	Profile string
+	RoleArn string
+	Input   bool
+}
+
+// castHeader is the asciicast v2 header, with additional attributes identifying the session
+type castHeader struct {
+	Version    int               `json:"version"`
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Timestamp  int64             `json:"timestamp"`
+	Title      string            `json:"title,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Profile    string            `json:"profile,omitempty"`
+	RoleArn    string            `json:"role_arn,omitempty"`
+	InstanceId string            `json:"instance_id"`
+	SessionId  string            `json:"session_id"`
+}
+
+// recorder writes the output of a session, and the input if enabled, as asciicast v2 events
+type recorder struct {
+	name  string
+	input bool
+	w     io.WriteCloser
+	start time.Time
+	mu    sync.Mutex
+	// the incomplete UTF-8 sequence at the end of the data for each event type
+	partial map[string][]byte
+}
+
+// open creates the recording file for the session, using the instance ID, session ID, and terminal size for the header
+func (r *Recording) open(instanceId, sessionId string, width, height int) (*recorder, error) {
+	dir := r.Dir
+	if strings.HasPrefix(dir, "~/") {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(h, dir[2:])
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	name := filepath.Join(dir, fmt.Sprintf("%s_%s_%s.cast", now.UTC().Format("20060102T150405Z"), instanceId, sessionId))
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &castHeader{
+		Version:    2,
+		Width:      width,
+		Height:     height,
+		Timestamp:  now.Unix(),
+		Title:      fmt.Sprintf("aws-runas shell %s", instanceId),
+		Env:        map[string]string{"SHELL": os.Getenv("SHELL"), "TERM": os.Getenv("TERM")},
+		Profile:    r.Profile,
+		RoleArn:    r.RoleArn,
+		InstanceId: instanceId,
+		SessionId:  sessionId,
+	}
+
+	rec, err := newRecorder(f, h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rec.name = name
+	rec.start = now
+	rec.input = r.Input
+
+	return rec, nil
+}
+
+// newRecorder writes the header to w, and returns a recorder which writes events to w
+func newRecorder(w io.WriteCloser, h *castHeader) (*recorder, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(w, "%s\n", b); err != nil {
+		return nil, err
+	}
+
+	return &recorder{w: w, start: time.Now(), partial: make(map[string][]byte)}, nil
+}
+
+// event writes the data as an event of the given type.  Data ending with an incomplete UTF-8 sequence is held until the
+// rest of the sequence is received, since event data must be valid UTF-8.
+func (r *recorder) event(kind string, p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := append(r.partial[kind], p...)
+
+	// find the start of a possibly incomplete rune in the last 3 bytes
+	n := len(data)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+
+	r.partial[kind] = append([]byte{}, data[n:]...)
+	if n < 1 {
+		return nil
+	}
+
+	e, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, string(data[:n])})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(r.w, "%s\n", e)
+	return err
+}
+
+// Close writes any held data, and closes the recording
+func (r *recorder) Close() error {
+	for _, k := range []string{castInput, castOutput} {
+		if len(r.partial[k]) > 0 {
+			p := r.partial[k]
+			r.partial[k] = nil
+
+			e, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), k, string(p)})
+			_, _ = fmt.Fprintf(r.w, "%s\n", e)
+		}
+	}
+	return r.w.Close()
+}
+
+// reader returns a reader which records the data read from rd as input events.  If input recording is not enabled,
+// rd is returned unchanged.
+func (r *recorder) reader(rd io.Reader) io.Reader {
+	if !r.input {
+		return rd
+	}
+	return &recordingReader{r: rd, rec: r}
+}
+
+// writer returns a writer which records the data written to w as output events
+func (r *recorder) writer(w io.Writer) io.Writer {
+	return &recordingWriter{w: w, rec: r}
+}
+
+type recordingReader struct {
+	r   io.Reader
+	rec *recorder
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if e := r.rec.event(castInput, p[:n]); e != nil {
+			return n, fmt.Errorf("error recording session: %v", e)
+		}
+	}
+	return n, err
+}
+
+type recordingWriter struct {
+	w   io.Writer
+	rec *recorder
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		if e := w.rec.event(castOutput, p[:n]); e != nil {
+			return n, fmt.Errorf("error recording session: %v", e)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,187 @@
+package ssm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func castEvents(t *testing.T, s string) (*castHeader, [][]interface{}) {
+	sc := bufio.NewScanner(strings.NewReader(s))
+	if !sc.Scan() {
+		t.Fatal("missing header")
+	}
+
+	h := new(castHeader)
+	if err := json.Unmarshal(sc.Bytes(), h); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([][]interface{}, 0)
+	for sc.Scan() {
+		e := make([]interface{}, 0)
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return h, events
+}
+
+func TestRecorder(t *testing.T) {
+	t.Run("events", func(t *testing.T) {
+		b := new(bytes.Buffer)
+		r, err := newRecorder(nopWriteCloser{b}, &castHeader{Version: 2, Width: 80, Height: 24, InstanceId: "i-deadbeef",
+			SessionId: "mock-session"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r.input = true
+
+		in, _ := ioutil.ReadAll(r.reader(strings.NewReader("ls\r")))
+		out := new(bytes.Buffer)
+		if _, err := r.writer(out).Write([]byte("file.txt\r\n")); err != nil {
+			t.Error(err)
+			return
+		}
+		r.Close()
+
+		if string(in) != "ls\r" || out.String() != "file.txt\r\n" {
+			t.Errorf("data mismatch: %q %q", in, out.String())
+		}
+
+		h, e := castEvents(t, b.String())
+		if h.Version != 2 || h.InstanceId != "i-deadbeef" || h.SessionId != "mock-session" {
+			t.Errorf("unexpected header: %+v", h)
+		}
+
+		if len(e) != 2 || e[0][1] != castInput || e[0][2] != "ls\r" || e[1][1] != castOutput || e[1][2] != "file.txt\r\n" {
+			t.Errorf("unexpected events: %v", e)
+		}
+	})
+
+	t.Run("split utf8", func(t *testing.T) {
+		b := new(bytes.Buffer)
+		r, _ := newRecorder(nopWriteCloser{b}, new(castHeader))
+
+		// € is 3 bytes, split across writes
+		euro := []byte("€")
+		_ = r.event(castOutput, append([]byte("a"), euro[:1]...))
+		_ = r.event(castOutput, euro[1:2])
+		_ = r.event(castOutput, append(euro[2:], 'b'))
+		_ = r.event(castOutput, euro[:2])
+		r.Close()
+
+		_, e := castEvents(t, b.String())
+		if len(e) != 3 || e[0][2] != "a" || e[1][2] != "€b" || e[2][1] != castOutput {
+			t.Errorf("unexpected events: %v", e)
+		}
+	})
+}
+
+func TestRecording_open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Recording{Dir: filepath.Join(dir, "casts"), Profile: "my-profile", RoleArn: "arn:aws:iam::1234567890:role/Admin"}
+	rec, err := r.open("i-deadbeef", "mock-session", 120, 40)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := rec.event(castOutput, []byte("hello")); err != nil {
+		t.Error(err)
+	}
+	rec.Close()
+
+	if !strings.HasSuffix(rec.name, "_i-deadbeef_mock-session.cast") || filepath.Dir(rec.name) != r.Dir {
+		t.Errorf("unexpected file name: %s", rec.name)
+	}
+
+	b, err := ioutil.ReadFile(rec.name)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h, e := castEvents(t, string(b))
+	if h.Profile != "my-profile" || h.RoleArn != r.RoleArn || h.Width != 120 || h.Height != 40 || h.Timestamp < 1 {
+		t.Errorf("unexpected header: %+v", h)
+	}
+
+	if len(e) != 1 || e[0][2] != "hello" {
+		t.Errorf("unexpected events: %v", e)
+	}
+}
+
+func TestRecording_openInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("output only", func(t *testing.T) {
+		rec, err := (&Recording{Dir: dir}).open("i-deadbeef", "output-only", 80, 24)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		in := strings.NewReader("s3cr3t\r")
+		if rec.reader(in) != in {
+			t.Error("input was recorded without being enabled")
+		}
+		rec.Close()
+	})
+
+	t.Run("input", func(t *testing.T) {
+		rec, err := (&Recording{Dir: dir, Input: true}).open("i-deadbeef", "input", 80, 24)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, _ = ioutil.ReadAll(rec.reader(strings.NewReader("ls\r")))
+		rec.Close()
+
+		b, _ := ioutil.ReadFile(rec.name)
+		if _, e := castEvents(t, string(b)); len(e) != 1 || e[0][1] != castInput {
+			t.Errorf("unexpected events: %v", e)
+		}
+	})
+}
+
+func TestSessionHandler_StartSessionRecording(t *testing.T) {
+	h := &sessionHandler{
+		client:    new(mockSsmClient),
+		log:       aws.NewDefaultLogger(),
+		recording: &Recording{Dir: os.TempDir()},
+		testing:   true,
+	}
+
+	if err := h.StartSession("i-deadbeef"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,31 @@
+// +build !windows
+
+package ssm
+
+import (
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchTerminalSize sends the current terminal size to the agent, and again each time the terminal is resized
+func watchTerminalSize(c *dataChannel, stop <-chan struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	defer signal.Stop(ch)
+
+	for {
+		if w, h, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil {
+			if err := c.setTerminalSize(h, w); err != nil {
+				c.log("error setting terminal size: %v", err)
+			}
+		}
+
+		select {
+		case <-ch:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// +build windows
+
+package ssm
+
+import (
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"time"
+)
+
+// watchTerminalSize sends the current terminal size to the agent, and polls for changes, since windows has no signal
+// for terminal resize events
+func watchTerminalSize(c *dataChannel, stop <-chan struct{}) {
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+
+	var lw, lh int
+	for {
+		if w, h, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil && (w != lw || h != lh) {
+			lw, lh = w, h
+			if err := c.setTerminalSize(h, w); err != nil {
+				c.log("error setting terminal size: %v", err)
+			}
+		}
+
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package ssm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const runShellScriptDocument = "AWS-RunShellScript"
+
+// the max number of instance IDs allowed in a SendCommand request
+const maxCommandInstanceIds = 50
+
+// how often the status and output of a command are checked, a var to allow tests to run faster
+var commandPollInterval = 2 * time.Second
+
+// invocation tracks the output of the command on a single instance, which has already been printed
+type invocation struct {
+	instanceId string
+	stdout     int
+	stderr     int
+	status     string
+	code       int64
+	done       bool
+}
+
+// RunCommand runs the shell command on the targets using the AWS-RunShellScript document, and waits for the command to
+// complete.  The output of each instance is printed as it becomes available, with each line prefixed by the instance ID,
+// stdout is written to os.Stdout, and stderr is written to os.Stderr.  A single target in the form tag:Key=value, or
+// tag:Key, is passed to SSM to resolve, otherwise the targets are resolved as described by resolveTarget(), except that
+// all matching instances are used.  The command runs on the instances matching any of the targets.  An error is
+// returned if the command did not succeed on all of the target instances.
+func (h *sessionHandler) RunCommand(targets []string, command string) error {
+	return h.runCommand(targets, command, os.Stdout, os.Stderr)
+}
+
+func (h *sessionHandler) runCommand(targets []string, command string, stdout, stderr io.Writer) error {
+	in, err := h.sendCommandInput(targets, command)
+	if err != nil {
+		return err
+	}
+
+	out, err := h.client.SendCommand(in)
+	if err != nil {
+		return err
+	}
+
+	id := aws.StringValue(out.Command.CommandId)
+	h.debug("sent command %s", id)
+
+	invs, err := h.waitCommand(id, stdout, stderr)
+	if err != nil {
+		return err
+	}
+
+	if len(invs) < 1 {
+		return errors.New("no instances matched the command targets")
+	}
+
+	failed := 0
+	for _, i := range invs {
+		if i.status != ssm.CommandInvocationStatusSuccess {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d of %d instances", failed, len(invs))
+	}
+	return nil
+}
+
+func (h *sessionHandler) sendCommandInput(targets []string, command string) (*ssm.SendCommandInput, error) {
+	if len(targets) < 1 {
+		return nil, errors.New("no command targets provided")
+	}
+
+	if len(strings.TrimSpace(command)) < 1 {
+		return nil, errors.New("empty command")
+	}
+
+	in := &ssm.SendCommandInput{
+		DocumentName: aws.String(runShellScriptDocument),
+		Parameters:   map[string][]*string{"commands": {aws.String(command)}},
+		// run the command on every target, even if some of them fail
+		MaxErrors: aws.String("100%"),
+	}
+
+	// SSM finds the instances for a single tag target.  SSM requires an instance to match all of the Targets, so
+	// multiple targets are resolved here, like the other target forms, to run the command on any matching instance.
+	if len(targets) == 1 && strings.HasPrefix(targets[0], "tag:") {
+		t := targets[0]
+		if i := strings.Index(t, "="); i > 0 {
+			in.Targets = []*ssm.Target{{Key: aws.String(t[:i]), Values: aws.StringSlice(strings.Split(t[i+1:], ","))}}
+		} else {
+			in.Targets = []*ssm.Target{{Key: aws.String("tag-key"), Values: aws.StringSlice([]string{t[4:]})}}
+		}
+		return in, nil
+	}
+
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		matches := []*instanceInfo{{id: t}}
+		if !instanceIdRe.MatchString(t) {
+			var err error
+			if matches, err = h.findTarget(t); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, m := range matches {
+			if !seen[m.id] {
+				seen[m.id] = true
+				ids = append(ids, m.id)
+			}
+		}
+	}
+
+	if len(ids) > maxCommandInstanceIds {
+		return nil, fmt.Errorf("targets matched %d instances, the maximum is %d", len(ids), maxCommandInstanceIds)
+	}
+
+	h.debug("resolved command targets to instances %v", ids)
+	in.InstanceIds = aws.StringSlice(ids)
+	return in, nil
+}
+
+// waitCommand polls the status of the command and its invocations, printing any new output, until the command, and all
+// of its invocations, are complete.  The invocations are returned sorted by instance ID.
+func (h *sessionHandler) waitCommand(id string, stdout, stderr io.Writer) ([]*invocation, error) {
+	invs := make(map[string]*invocation)
+	list := make([]*invocation, 0)
+
+	for {
+		status, err := h.commandStatus(id)
+		if err != nil {
+			return nil, err
+		}
+
+		err = h.client.ListCommandInvocationsPages(&ssm.ListCommandInvocationsInput{CommandId: aws.String(id)},
+			func(o *ssm.ListCommandInvocationsOutput, b bool) bool {
+				for _, i := range o.CommandInvocations {
+					iid := aws.StringValue(i.InstanceId)
+					if _, ok := invs[iid]; !ok {
+						invs[iid] = &invocation{instanceId: iid}
+						list = append(list, invs[iid])
+					}
+				}
+				return true
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Slice(list, func(i, j int) bool { return list[i].instanceId < list[j].instanceId })
+
+		pending := 0
+		for _, i := range list {
+			if i.done {
+				continue
+			}
+
+			if err := h.updateInvocation(id, i, stdout, stderr); err != nil {
+				return nil, err
+			}
+
+			if !i.done {
+				pending++
+			}
+		}
+
+		if isCommandDone(status) && pending < 1 {
+			break
+		}
+
+		time.Sleep(commandPollInterval)
+	}
+
+	return list, nil
+}
+
+func (h *sessionHandler) commandStatus(id string) (string, error) {
+	out, err := h.client.ListCommands(&ssm.ListCommandsInput{CommandId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+
+	if len(out.Commands) < 1 {
+		return "", fmt.Errorf("command %s not found", id)
+	}
+	return aws.StringValue(out.Commands[0].Status), nil
+}
+
+// updateInvocation prints the new output of the command invocation, only printing complete lines until the invocation
+// is done
+func (h *sessionHandler) updateInvocation(id string, i *invocation, stdout, stderr io.Writer) error {
+	out, err := h.client.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+		CommandId:  aws.String(id),
+		InstanceId: aws.String(i.instanceId),
+	})
+	if err != nil {
+		if e, ok := err.(awserr.Error); ok && e.Code() == ssm.ErrCodeInvocationDoesNotExist {
+			// not ready yet
+			return nil
+		}
+		return err
+	}
+
+	i.status = aws.StringValue(out.Status)
+	i.code = aws.Int64Value(out.ResponseCode)
+	i.done = isCommandDone(i.status)
+
+	prefix := fmt.Sprintf("[%s] ", i.instanceId)
+	i.stdout = printLines(stdout, prefix, aws.StringValue(out.StandardOutputContent), i.stdout, i.done)
+	i.stderr = printLines(stderr, prefix, aws.StringValue(out.StandardErrorContent), i.stderr, i.done)
+
+	if i.done && i.status != ssm.CommandInvocationStatusSuccess {
+		fmt.Fprintf(stderr, "%scommand %s, exit code %d\n", prefix, strings.ToLower(i.status), i.code)
+	}
+	return nil
+}
+
+// printLines writes the lines of s after the offset to w, with each line prefixed.  Unless all is true, only complete
+// lines are written.  The offset of the unwritten data in s is returned.
+func printLines(w io.Writer, prefix, s string, offset int, all bool) int {
+	if offset >= len(s) {
+		return offset
+	}
+
+	n := s[offset:]
+	if !all {
+		i := strings.LastIndex(n, "\n")
+		if i < 0 {
+			return offset
+		}
+		n = n[:i+1]
+	}
+
+	for _, l := range strings.SplitAfter(n, "\n") {
+		if len(l) > 0 {
+			fmt.Fprint(w, prefix, strings.TrimSuffix(l, "\n"), "\n")
+		}
+	}
+
+	return offset + len(n)
+}
+
+func isCommandDone(status string) bool {
+	switch status {
+	case ssm.CommandStatusSuccess, ssm.CommandStatusFailed, ssm.CommandStatusCancelled, ssm.CommandStatusTimedOut:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package ssm
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockCommandClient simulates a command which runs on 2 instances, with output arriving over several polls.  The
+// command fails on instance i-00000000000000002 if the command is "fail".
+type mockCommandClient struct {
+	mockSsmClient
+	mu    sync.Mutex
+	in    *ssm.SendCommandInput
+	polls int
+}
+
+func (c *mockCommandClient) SendCommand(in *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.in = in
+	return &ssm.SendCommandOutput{Command: &ssm.Command{CommandId: aws.String("mock-command")}}, nil
+}
+
+func (c *mockCommandClient) ListCommands(in *ssm.ListCommandsInput) (*ssm.ListCommandsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.polls++
+
+	s := ssm.CommandStatusInProgress
+	if c.polls > 3 {
+		s = ssm.CommandStatusSuccess
+		if c.failing() {
+			s = ssm.CommandStatusFailed
+		}
+	}
+	return &ssm.ListCommandsOutput{Commands: []*ssm.Command{{CommandId: in.CommandId, Status: aws.String(s)}}}, nil
+}
+
+func (c *mockCommandClient) ListCommandInvocationsPages(in *ssm.ListCommandInvocationsInput,
+	fn func(*ssm.ListCommandInvocationsOutput, bool) bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o := new(ssm.ListCommandInvocationsOutput)
+	if c.polls > 1 {
+		for _, id := range []string{"i-00000000000000001", "i-00000000000000002"} {
+			o.CommandInvocations = append(o.CommandInvocations, &ssm.CommandInvocation{CommandId: in.CommandId,
+				InstanceId: aws.String(id)})
+		}
+	}
+
+	fn(o, true)
+	return nil
+}
+
+func (c *mockCommandClient) GetCommandInvocation(in *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(in.InstanceId)
+	if c.polls < 3 && id == "i-00000000000000002" {
+		return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "not yet", nil)
+	}
+
+	o := &ssm.GetCommandInvocationOutput{InstanceId: in.InstanceId, Status: aws.String(ssm.CommandInvocationStatusInProgress),
+		StandardOutputContent: aws.String("line 1\nline"), ResponseCode: aws.Int64(-1)}
+
+	if c.polls > 3 {
+		o.SetStatus(ssm.CommandInvocationStatusSuccess).SetResponseCode(0).SetStandardOutputContent("line 1\nline 2")
+		if id == "i-00000000000000002" && c.failing() {
+			o.SetStatus(ssm.CommandInvocationStatusFailed).SetResponseCode(1).SetStandardErrorContent("oops\n")
+		}
+	}
+	return o, nil
+}
+
+func (c *mockCommandClient) failing() bool {
+	return aws.StringValue(c.in.Parameters["commands"][0]) == "fail"
+}
+
+func TestSessionHandler_RunCommand(t *testing.T) {
+	commandPollInterval = 10 * time.Millisecond
+
+	newHandler := func() (*sessionHandler, *mockCommandClient) {
+		c := new(mockCommandClient)
+		return &sessionHandler{client: c, ec2: new(mockEc2Client), log: aws.NewDefaultLogger()}, c
+	}
+
+	t.Run("good", func(t *testing.T) {
+		h, c := newHandler()
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+		if err := h.runCommand([]string{"tag:Env=dev"}, "uptime", stdout, stderr); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(c.in.Targets) != 1 || *c.in.Targets[0].Key != "tag:Env" || *c.in.Targets[0].Values[0] != "dev" ||
+			*c.in.DocumentName != runShellScriptDocument {
+			t.Errorf("unexpected command input: %+v", c.in)
+		}
+
+		// output from each instance is interleaved as it arrives
+		want := "[i-00000000000000001] line 1\n[i-00000000000000002] line 1\n[i-00000000000000001] line 2\n" +
+			"[i-00000000000000002] line 2\n"
+		if stdout.String() != want {
+			t.Errorf("unexpected output: %s", stdout.String())
+		}
+
+		if stderr.Len() > 0 {
+			t.Errorf("unexpected stderr: %s", stderr.String())
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		h, _ := newHandler()
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+
+		err := h.runCommand([]string{"tag:Env"}, "fail", stdout, stderr)
+		if err == nil || !strings.Contains(err.Error(), "1 of 2") {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+
+		if !strings.Contains(stderr.String(), "[i-00000000000000002] oops\n") ||
+			!strings.Contains(stderr.String(), "exit code 1") {
+			t.Errorf("unexpected stderr: %s", stderr.String())
+		}
+	})
+
+	t.Run("instances", func(t *testing.T) {
+		h, c := newHandler()
+		if err := h.runCommand([]string{"i-deadbeef", "tag:Role=bastion", "i-deadbeef"}, "uptime", new(bytes.Buffer),
+			new(bytes.Buffer)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(c.in.Targets) > 0 || len(c.in.InstanceIds) < 2 || *c.in.InstanceIds[0] != "i-deadbeef" {
+			t.Errorf("unexpected command input: %+v", c.in)
+		}
+	})
+
+	t.Run("multiple tags", func(t *testing.T) {
+		h, c := newHandler()
+		if err := h.runCommand([]string{"tag:Role=bastion", "tag:Role=app"}, "uptime", new(bytes.Buffer),
+			new(bytes.Buffer)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// the union of the instances matching each tag, not the instances matching both
+		ids := aws.StringValueSlice(c.in.InstanceIds)
+		if len(c.in.Targets) > 0 || len(ids) != 3 || ids[0] != "i-0123456789abcdef0" || ids[2] != "i-00000000000000002" {
+			t.Errorf("unexpected command input: %+v", c.in)
+		}
+	})
+
+	t.Run("tag values", func(t *testing.T) {
+		h, c := newHandler()
+		if err := h.runCommand([]string{"i-deadbeef", "tag:Role=bastion,app"}, "uptime", new(bytes.Buffer),
+			new(bytes.Buffer)); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(c.in.InstanceIds) != 4 {
+			t.Errorf("unexpected command input: %+v", c.in)
+		}
+	})
+
+	t.Run("no targets", func(t *testing.T) {
+		h, _ := newHandler()
+		if err := h.runCommand(nil, "uptime", new(bytes.Buffer), new(bytes.Buffer)); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("empty command", func(t *testing.T) {
+		h, _ := newHandler()
+		if err := h.runCommand([]string{"tag:Env=dev"}, " ", new(bytes.Buffer), new(bytes.Buffer)); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad target", func(t *testing.T) {
+		h, _ := newHandler()
+		if err := h.runCommand([]string{"nope"}, "uptime", new(bytes.Buffer), new(bytes.Buffer)); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestPrintLines(t *testing.T) {
+	b := new(bytes.Buffer)
+
+	o := printLines(b, "> ", "a\nb", 0, false)
+	if o != 2 || b.String() != "> a\n" {
+		t.Errorf("unexpected output: %d %q", o, b.String())
+	}
+
+	o = printLines(b, "> ", "a\nbc", o, true)
+	if o != 4 || b.String() != "> a\n> bc\n" {
+		t.Errorf("unexpected output: %d %q", o, b.String())
+	}
+
+	if o = printLines(b, "> ", "a\nbc", o, true); o != 4 {
+		t.Errorf("unexpected offset: %d", o)
+	}
+}
@@ -2,28 +2,40 @@ package ssm
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 type sessionHandler struct {
-	client   ssmiface.SSMAPI
-	cfg      aws.Config
-	log      aws.Logger
-	region   string
-	endpoint string
-	testing  bool
+	client    ssmiface.SSMAPI
+	ec2       ec2iface.EC2API
+	rds       rdsiface.RDSAPI
+	cfg       aws.Config
+	log       aws.Logger
+	region    string
+	endpoint  string
+	chooser   func(string, []*instanceInfo) (*instanceInfo, error)
+	native    bool
+	recording *Recording
+	testing   bool
 }
 
-// NewSsmHandler creates the handler type needed to create shell and port-forwarding sessions
+// NewSsmHandler creates the handler type needed to create shell, port-forwarding, and ssh sessions
 func NewSsmHandler(c client.ConfigProvider) *sessionHandler {
 	s := ssm.New(c)
-	return &sessionHandler{client: s, cfg: s.Config, region: s.SigningRegion, endpoint: s.Endpoint, log: aws.NewDefaultLogger()}
+	return &sessionHandler{client: s, ec2: ec2.New(c), rds: rds.New(c), cfg: s.Config, region: s.SigningRegion, endpoint: s.Endpoint,
+		chooser: promptInstance, log: aws.NewDefaultLogger()}
 }
 
 // WithLogger is a fluent method used with NewSsmHandler to configure a conforming logging type
@@ -32,44 +44,124 @@ func (h *sessionHandler) WithLogger(l aws.Logger) *sessionHandler {
 	return h
 }
 
-// StartSession will initiate an SSM shell session with the provided target EC2 instance
-func (h *sessionHandler) StartSession(target string) error {
-	in := ssm.StartSessionInput{Target: aws.String(target)}
+// WithNativeClient is a fluent method used with NewSsmHandler to always handle sessions with the built-in client,
+// instead of the session-manager-plugin.  The built-in client is used regardless of this setting if the
+// session-manager-plugin is not installed.
+func (h *sessionHandler) WithNativeClient(b bool) *sessionHandler {
+	h.native = b
+	return h
+}
+
+// WithRecording is a fluent method used with NewSsmHandler to record shell sessions as asciicast v2 files, using the
+// provided configuration.  Recorded sessions always use the built-in session client.
+func (h *sessionHandler) WithRecording(r *Recording) *sessionHandler {
+	h.recording = r
+	return h
+}
 
-	c, err := h.cmd(&in)
+// StartSession will initiate an SSM shell session with the provided target EC2 instance.  See resolveTarget() for
+// the supported target formats.
+func (h *sessionHandler) StartSession(target string) error {
+	id, err := h.resolveTarget(target)
 	if err != nil {
 		return err
 	}
 
-	if h.testing {
-		return nil
+	in := ssm.StartSessionInput{Target: aws.String(id)}
+
+	if h.recording != nil {
+		// the plugin manages the terminal itself, so the session I/O can only be recorded with the built-in client
+		return h.runNative(&in, h.shellMode)
 	}
-	return c.Run()
+	return h.run(&in, h.shellMode)
 }
 
 // ForwardPort will open an SSM port-forwarding session with the provided target EC2 instance using the
 // provided local and remote ports (lp and rp, respectively).  If lp is 0, a random, open local port is chosen.
 func (h *sessionHandler) ForwardPort(target, lp, rp string) error {
-	params := map[string][]*string{
-		"localPortNumber": {aws.String(lp)},
-		"portNumber":      {aws.String(rp)},
+	id, err := h.resolveTarget(target)
+	if err != nil {
+		return err
 	}
 
-	in := ssm.StartSessionInput{
-		DocumentName: aws.String("AWS-StartPortForwardingSession"),
-		Target:       aws.String(target),
-		Parameters:   params,
+	return h.run(portForwardInput(id, lp, "", rp), forwardMode(lp))
+}
+
+// ForwardPortToRemoteHost will open an SSM port-forwarding session with the provided target EC2 instance, forwarding
+// the local port lp to port rp on the remote host, using the target as a bastion.  The remote host may be specified as
+// rds:<identifier>, to connect to the endpoint of the RDS DB instance or cluster with that identifier.  The remote port
+// is optional for RDS hosts, and defaults to the port of the endpoint.  If lp is 0, a random, open local port is chosen.
+func (h *sessionHandler) ForwardPortToRemoteHost(target, lp, host, rp string) error {
+	host, rp, err := h.resolveRemoteHost(host, rp)
+	if err != nil {
+		return err
 	}
 
-	c, err := h.cmd(&in)
+	id, err := h.resolveTarget(target)
 	if err != nil {
 		return err
 	}
 
-	if h.testing {
-		return nil
+	return h.run(portForwardInput(id, lp, host, rp), forwardMode(lp))
+}
+
+// SshProxy will open an SSM ssh session with the provided target EC2 instance using the provided remote port.  The
+// session uses stdin and stdout for the connection data, so it is usable as the ssh ProxyCommand.  See resolveTarget()
+// for the supported target formats.
+func (h *sessionHandler) SshProxy(target, port string) error {
+	id, err := h.resolveTarget(target)
+	if err != nil {
+		return err
+	}
+
+	in := ssm.StartSessionInput{
+		DocumentName: aws.String("AWS-StartSSHSession"),
+		Target:       aws.String(id),
+		Parameters:   map[string][]*string{"portNumber": {aws.String(port)}},
+	}
+
+	return h.run(&in, streamMode(os.Stdin, os.Stdout))
+}
+
+// resolveRemoteHost returns the address and port of the remote host, looking up the endpoint of rds:<identifier> hosts
+func (h *sessionHandler) resolveRemoteHost(host, rp string) (string, string, error) {
+	if strings.HasPrefix(host, rdsHostPrefix) {
+		a, p, err := h.resolveRdsEndpoint(strings.TrimPrefix(host, rdsHostPrefix))
+		if err != nil {
+			return "", "", err
+		}
+
+		host = a
+		if len(rp) < 1 {
+			rp = p
+		}
+	}
+
+	if len(host) < 1 || len(rp) < 1 {
+		return "", "", errors.New("remote host and port are required")
+	}
+	return host, rp, nil
+}
+
+// portForwardInput returns the StartSessionInput for a port forwarding session to the target instance id.  If host is
+// not empty, the session forwards to port rp on the remote host, otherwise to port rp on the target instance.
+func portForwardInput(id, lp, host, rp string) *ssm.StartSessionInput {
+	params := map[string][]*string{
+		"localPortNumber": {aws.String(lp)},
+		"portNumber":      {aws.String(rp)},
+	}
+
+	doc := "AWS-StartPortForwardingSession"
+	if len(host) > 0 {
+		doc = "AWS-StartPortForwardingSessionToRemoteHost"
+		params["host"] = []*string{aws.String(host)}
+	}
+
+	return &ssm.StartSessionInput{
+		DocumentName: aws.String(doc),
+		Target:       aws.String(id),
+		Parameters:   params,
 	}
-	return c.Run()
 }
 
 func (h *sessionHandler) cmd(input *ssm.StartSessionInput) (*exec.Cmd, error) {
@@ -88,7 +180,7 @@ func (h *sessionHandler) cmd(input *ssm.StartSessionInput) (*exec.Cmd, error) {
 		return nil, err
 	}
 
-	c := exec.Command("session-manager-plugin", string(outJ), h.region, "StartSession", "", string(inJ), h.endpoint)
+	c := exec.Command(pluginName, string(outJ), h.region, "StartSession", "", string(inJ), h.endpoint)
 	c.Stdin = os.Stdin
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
@@ -19,7 +19,9 @@ func (c *mockSsmClient) StartSession(input *ssm.StartSessionInput) (*ssm.StartSe
 		return nil, fmt.Errorf(ssm.ErrCodeInvalidTarget)
 	}
 
-	if input.DocumentName != nil && *input.DocumentName != "AWS-StartPortForwardingSession" && *input.DocumentName != "SSM-SessionManagerRunShell" {
+	if input.DocumentName != nil && *input.DocumentName != "AWS-StartPortForwardingSession" && *input.DocumentName != "SSM-SessionManagerRunShell" &&
+		*input.DocumentName != "AWS-StartSSHSession" &&
+		*input.DocumentName != "AWS-StartPortForwardingSessionToRemoteHost" {
 		return nil, fmt.Errorf(ssm.ErrCodeInvalidDocument)
 	}
 
@@ -31,6 +33,46 @@ func (c *mockSsmClient) StartSession(input *ssm.StartSessionInput) (*ssm.StartSe
 	return o, nil
 }
 
+// mock SSM agent status, instances not listed are not managed by SSM
+var mockPingStatus = map[string]string{
+	"i-deadbeef":           ssm.PingStatusOnline,
+	"i-0123456789abcdef0":  ssm.PingStatusOnline,
+	"mi-0123456789abcdef0": ssm.PingStatusOnline,
+	"i-00000000000000001":  ssm.PingStatusOnline,
+	"i-00000000000000002":  ssm.PingStatusOnline,
+	"i-0fedcba9876543210":  ssm.PingStatusOnline,
+	"i-0aaaaaaaaaaaaaaaa":  ssm.PingStatusOnline,
+	"i-0dddddddddddddddd":  ssm.PingStatusConnectionLost,
+}
+
+// mock SSM managed (hybrid) instances
+var mockManagedInstances = []*ssm.InstanceInformation{
+	new(ssm.InstanceInformation).SetInstanceId("mi-0123456789abcdef0").SetName("onprem-01").
+		SetComputerName("db-01.corp.example.com").SetIPAddress("192.168.1.10").SetPingStatus(ssm.PingStatusOnline),
+	new(ssm.InstanceInformation).SetInstanceId("mi-0fedcba9876543210").SetComputerName("build-01").
+		SetIPAddress("192.168.1.11").SetPingStatus(ssm.PingStatusOnline),
+}
+
+func (c *mockSsmClient) DescribeInstanceInformationPages(in *ssm.DescribeInstanceInformationInput,
+	fn func(*ssm.DescribeInstanceInformationOutput, bool) bool) error {
+	o := new(ssm.DescribeInstanceInformationOutput)
+	if aws.StringValue(in.Filters[0].Key) == "ResourceType" {
+		o.InstanceInformationList = mockManagedInstances
+		fn(o, true)
+		return nil
+	}
+
+	for _, id := range in.Filters[0].Values {
+		if s, ok := mockPingStatus[*id]; ok {
+			o.InstanceInformationList = append(o.InstanceInformationList,
+				new(ssm.InstanceInformation).SetInstanceId(*id).SetPingStatus(s))
+		}
+	}
+
+	fn(o, true)
+	return nil
+}
+
 func TestNewSsmHandler(t *testing.T) {
 	t.Run("good", func(t *testing.T) {
 		h := NewSsmHandler(session.Must(session.NewSession(new(aws.Config).WithRegion("us-east-1"))))
@@ -95,6 +137,77 @@ func TestSessionHandler_ForwardPort(t *testing.T) {
 	}
 }
 
+func TestSessionHandler_ForwardPortToRemoteHost(t *testing.T) {
+	h := &sessionHandler{
+		client:   new(mockSsmClient),
+		ec2:      new(mockEc2Client),
+		rds:      new(mockRdsClient),
+		log:      aws.NewDefaultLogger(),
+		region:   "us-east-1",
+		endpoint: "ep-mock",
+		testing:  true,
+	}
+
+	t.Run("host", func(t *testing.T) {
+		if err := h.ForwardPortToRemoteHost("tag:Role=bastion", "0", "db.example.com", "5432"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("rds", func(t *testing.T) {
+		if err := h.ForwardPortToRemoteHost("i-deadbeef", "5432", "rds:my-db", ""); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("rds with port", func(t *testing.T) {
+		if err := h.ForwardPortToRemoteHost("i-deadbeef", "5432", "rds:my-cluster", "3307"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("missing port", func(t *testing.T) {
+		if err := h.ForwardPortToRemoteHost("i-deadbeef", "0", "db.example.com", ""); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+
+	t.Run("bad rds", func(t *testing.T) {
+		if err := h.ForwardPortToRemoteHost("i-deadbeef", "0", "rds:not-found", ""); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestSessionHandler_SshProxy(t *testing.T) {
+	h := &sessionHandler{
+		client:   new(mockSsmClient),
+		ec2:      new(mockEc2Client),
+		log:      aws.NewDefaultLogger(),
+		region:   "us-east-1",
+		endpoint: "ep-mock",
+		testing:  true,
+	}
+
+	t.Run("instance id", func(t *testing.T) {
+		if err := h.SshProxy("i-deadbeef", "22"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("name tag", func(t *testing.T) {
+		if err := h.SshProxy("web", "22"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		if err := h.SshProxy("nope", "22"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
 func TestCmd(t *testing.T) {
 	h := &sessionHandler{client: new(mockSsmClient), region: "us-east-1"}
 
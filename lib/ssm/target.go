@@ -0,0 +1,322 @@
+package ssm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the max number of values allowed for the InstanceIds filter of DescribeInstanceInformation
+const maxInstanceInfoIds = 50
+
+var instanceIdRe = regexp.MustCompile(`^m?i-[[:xdigit:]]{8,17}$`)
+
+// instanceInfo contains the details of an instance matching a target
+type instanceInfo struct {
+	id         string
+	name       string
+	privateIp  string
+	pingStatus string
+}
+
+func (i *instanceInfo) String() string {
+	s := i.id
+
+	d := make([]string, 0)
+	for _, v := range []string{i.name, i.privateIp, i.pingStatus} {
+		if len(v) > 0 {
+			d = append(d, v)
+		}
+	}
+
+	if len(d) > 0 {
+		s = fmt.Sprintf("%s (%s)", s, strings.Join(d, ", "))
+	}
+	return s
+}
+
+// resolveTarget returns the instance ID of the SSM managed instance for the provided target, which may be specified as:
+//   - an instance ID (i-xxxx or mi-xxxx)
+//   - Name=value, to look up the instance by the value of the Name tag
+//   - tag:Key=value, to look up the instance by the value of an arbitrary tag, multiple values are separated by commas
+//   - a private IP address
+//   - a private DNS name
+//   - any other value is looked up by the value of the Name tag, then private DNS name
+//
+// Names and IP addresses which do not match an EC2 instance are looked up using the name, computer name and IP address
+// of the SSM managed (mi-xxxx) instances.  Only running instances which are online with SSM are considered.  If the
+// target matches more than one instance, the handler's chooser is called to select the instance.
+func (h *sessionHandler) resolveTarget(target string) (string, error) {
+	if len(target) < 1 {
+		return "", errors.New("empty target")
+	}
+
+	matches := []*instanceInfo{{id: target}}
+	if !instanceIdRe.MatchString(target) {
+		var err error
+		if matches, err = h.findTarget(target); err != nil {
+			return "", err
+		}
+	}
+
+	if err := h.setPingStatus(matches); err != nil {
+		// most likely missing IAM permissions, let StartSession sort out if the instance is usable
+		h.debug("error getting SSM instance information: %v", err)
+	}
+
+	online := make([]*instanceInfo, 0)
+	for _, m := range matches {
+		// an empty ping status means we couldn't look it up
+		if m.pingStatus == ssm.PingStatusOnline || len(m.pingStatus) < 1 {
+			online = append(online, m)
+		}
+	}
+
+	switch len(online) {
+	case 0:
+		return "", pingStatusError(matches)
+	case 1:
+		h.debug("resolved target %s to instance %s", target, online[0].id)
+		return online[0].id, nil
+	}
+
+	if h.chooser == nil {
+		return "", multipleMatchError(target, online)
+	}
+
+	i, err := h.chooser(target, online)
+	if err != nil {
+		return "", err
+	}
+	return i.id, nil
+}
+
+// findTarget returns the running EC2 instances matching the target, trying each of the filters for the target type
+// until one of them returns a match.  If no EC2 instances match, the SSM managed instances are checked for targets
+// other than tags.
+func (h *sessionHandler) findTarget(target string) ([]*instanceInfo, error) {
+	for _, f := range targetFilters(target) {
+		m, err := h.findInstances(f)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(m) > 0 {
+			return m, nil
+		}
+	}
+
+	if !strings.HasPrefix(target, "tag:") {
+		m, err := h.findManagedInstances(strings.TrimPrefix(target, "Name="))
+		if err != nil {
+			// most likely missing IAM permissions, report that the target wasn't found
+			h.debug("error getting SSM managed instance information: %v", err)
+		}
+
+		if len(m) > 0 {
+			return m, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no running instance found for target %s", target)
+}
+
+func targetFilters(target string) []*ec2.Filter {
+	newFilter := func(name string, value ...string) *ec2.Filter {
+		return &ec2.Filter{Name: aws.String(name), Values: aws.StringSlice(value)}
+	}
+
+	switch {
+	case strings.HasPrefix(target, "Name="):
+		return []*ec2.Filter{newFilter("tag:Name", strings.TrimPrefix(target, "Name="))}
+	case strings.HasPrefix(target, "tag:"):
+		if i := strings.Index(target, "="); i > 0 {
+			// match any of the values, like SSM does for tag targets
+			return []*ec2.Filter{newFilter(target[:i], strings.Split(target[i+1:], ",")...)}
+		}
+		return []*ec2.Filter{newFilter("tag-key", strings.TrimPrefix(target, "tag:"))}
+	case net.ParseIP(target) != nil:
+		return []*ec2.Filter{newFilter("private-ip-address", target)}
+	case strings.HasPrefix(target, "ip-") && strings.Contains(target, "."):
+		// likely a private DNS name, save an API call
+		return []*ec2.Filter{newFilter("private-dns-name", target), newFilter("tag:Name", target)}
+	}
+
+	return []*ec2.Filter{newFilter("tag:Name", target), newFilter("private-dns-name", target)}
+}
+
+func (h *sessionHandler) findInstances(filter *ec2.Filter) ([]*instanceInfo, error) {
+	in := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			filter,
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{ec2.InstanceStateNameRunning})},
+		},
+	}
+
+	info := make([]*instanceInfo, 0)
+	err := h.ec2.DescribeInstancesPages(in, func(o *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, r := range o.Reservations {
+			for _, i := range r.Instances {
+				ii := &instanceInfo{id: aws.StringValue(i.InstanceId), privateIp: aws.StringValue(i.PrivateIpAddress)}
+				for _, t := range i.Tags {
+					if aws.StringValue(t.Key) == "Name" {
+						ii.name = aws.StringValue(t.Value)
+					}
+				}
+				info = append(info, ii)
+			}
+		}
+		return true
+	})
+
+	return info, err
+}
+
+// findManagedInstances returns the SSM managed instances whose name, computer name, or IP address matches the target.
+// A computer name also matches using the host name without the domain.  DescribeInstanceInformation can not filter on
+// these attributes, so all of the managed instances are checked.
+func (h *sessionHandler) findManagedInstances(target string) ([]*instanceInfo, error) {
+	in := &ssm.DescribeInstanceInformationInput{
+		Filters: []*ssm.InstanceInformationStringFilter{
+			{Key: aws.String("ResourceType"), Values: aws.StringSlice([]string{ssm.ResourceTypeManagedInstance})},
+		},
+	}
+
+	isIp := net.ParseIP(target) != nil
+	info := make([]*instanceInfo, 0)
+	err := h.client.DescribeInstanceInformationPages(in, func(o *ssm.DescribeInstanceInformationOutput, last bool) bool {
+		for _, v := range o.InstanceInformationList {
+			cn := aws.StringValue(v.ComputerName)
+
+			var match bool
+			if isIp {
+				match = aws.StringValue(v.IPAddress) == target
+			} else {
+				match = strings.EqualFold(aws.StringValue(v.Name), target) || strings.EqualFold(cn, target) ||
+					strings.EqualFold(strings.SplitN(cn, ".", 2)[0], target)
+			}
+
+			if match {
+				name := aws.StringValue(v.Name)
+				if len(name) < 1 {
+					name = cn
+				}
+
+				info = append(info, &instanceInfo{id: aws.StringValue(v.InstanceId), name: name,
+					privateIp: aws.StringValue(v.IPAddress), pingStatus: aws.StringValue(v.PingStatus)})
+			}
+		}
+		return true
+	})
+
+	return info, err
+}
+
+// setPingStatus looks up the SSM agent status for the instances.  Instances which are not managed by SSM will have
+// their ping status set to "NotManaged".
+func (h *sessionHandler) setPingStatus(info []*instanceInfo) error {
+	m := make(map[string]*instanceInfo)
+	for _, i := range info {
+		m[i.id] = i
+	}
+
+	for s := 0; s < len(info); s += maxInstanceInfoIds {
+		e := s + maxInstanceInfoIds
+		if e > len(info) {
+			e = len(info)
+		}
+
+		ids := make([]string, 0)
+		for _, i := range info[s:e] {
+			ids = append(ids, i.id)
+		}
+
+		in := &ssm.DescribeInstanceInformationInput{
+			Filters: []*ssm.InstanceInformationStringFilter{
+				{Key: aws.String("InstanceIds"), Values: aws.StringSlice(ids)},
+			},
+		}
+
+		err := h.client.DescribeInstanceInformationPages(in, func(o *ssm.DescribeInstanceInformationOutput, last bool) bool {
+			for _, v := range o.InstanceInformationList {
+				if i, ok := m[aws.StringValue(v.InstanceId)]; ok {
+					i.pingStatus = aws.StringValue(v.PingStatus)
+				}
+			}
+			return true
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, i := range info {
+		if len(i.pingStatus) < 1 {
+			i.pingStatus = "NotManaged"
+		}
+	}
+
+	return nil
+}
+
+func pingStatusError(info []*instanceInfo) error {
+	msg := make([]string, 0)
+	for _, i := range info {
+		if i.pingStatus == "NotManaged" {
+			msg = append(msg, fmt.Sprintf("instance %s is not managed by SSM", i.id))
+		} else {
+			msg = append(msg, fmt.Sprintf("instance %s SSM agent status is %s", i.id, i.pingStatus))
+		}
+	}
+	return errors.New(strings.Join(msg, ", "))
+}
+
+func multipleMatchError(target string, info []*instanceInfo) error {
+	s := make([]string, 0)
+	for _, i := range info {
+		s = append(s, i.String())
+	}
+	return fmt.Errorf("target %s matches multiple instances: %s", target, strings.Join(s, ", "))
+}
+
+// promptInstance is the default chooser, which prompts on the terminal to select one of the instances matching a target
+func promptInstance(target string, info []*instanceInfo) (*instanceInfo, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, multipleMatchError(target, info)
+	}
+	return chooseInstance(os.Stdin, os.Stderr, target, info)
+}
+
+func chooseInstance(r io.Reader, w io.Writer, target string, info []*instanceInfo) (*instanceInfo, error) {
+	fmt.Fprintf(w, "Multiple instances match target %s\n", target)
+	for i, v := range info {
+		fmt.Fprintf(w, "  %d) %s\n", i+1, v)
+	}
+
+	s := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "Select instance [1-%d]: ", len(info))
+		if !s.Scan() {
+			if s.Err() != nil {
+				return nil, s.Err()
+			}
+			return nil, io.EOF
+		}
+
+		if n, err := strconv.Atoi(strings.TrimSpace(s.Text())); err == nil && n > 0 && n <= len(info) {
+			return info[n-1], nil
+		}
+		fmt.Fprintln(w, "Invalid selection")
+	}
+}
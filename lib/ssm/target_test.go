@@ -0,0 +1,172 @@
+package ssm
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"io"
+	"strings"
+	"testing"
+)
+
+type mockEc2Client struct {
+	ec2iface.EC2API
+}
+
+// mock instances, keyed by filter name and value
+var mockInstances = map[string][]*ec2.Instance{
+	"tag:Name=web":                {mockInstance("i-0123456789abcdef0", "web", "10.1.1.1")},
+	"tag:Name=app":                {mockInstance("i-00000000000000001", "app", "10.1.1.2"), mockInstance("i-00000000000000002", "app", "10.1.1.3")},
+	"tag:Role=bastion":            {mockInstance("i-0123456789abcdef0", "web", "10.1.1.1")},
+	"tag-key=Role":                {mockInstance("i-0123456789abcdef0", "web", "10.1.1.1")},
+	"tag:Role=app":                {mockInstance("i-00000000000000001", "app", "10.1.1.2"), mockInstance("i-00000000000000002", "app", "10.1.1.3")},
+	"private-ip-address=10.1.2.3": {mockInstance("i-0fedcba9876543210", "", "10.1.2.3")},
+	"private-dns-name=ip-10-1-2-3.ec2.internal": {mockInstance("i-0fedcba9876543210", "", "10.1.2.3")},
+	"tag:Name=ip-10-9-9-9.ec2.internal":         {mockInstance("i-0aaaaaaaaaaaaaaaa", "ip-10-9-9-9.ec2.internal", "10.9.9.9")},
+	"tag:Name=offline":                          {mockInstance("i-0dddddddddddddddd", "offline", "10.1.1.4")},
+	"tag:Name=unmanaged":                        {mockInstance("i-0eeeeeeeeeeeeeeee", "unmanaged", "10.1.1.5")},
+	"tag:Name=mixed":                            {mockInstance("i-0dddddddddddddddd", "mixed", "10.1.1.4"), mockInstance("i-0123456789abcdef0", "mixed", "10.1.1.1")},
+	"tag:Name=error":                            nil,
+}
+
+func mockInstance(id, name, ip string) *ec2.Instance {
+	i := new(ec2.Instance).SetInstanceId(id).SetPrivateIpAddress(ip)
+	if len(name) > 0 {
+		i.Tags = []*ec2.Tag{new(ec2.Tag).SetKey("Name").SetValue(name)}
+	}
+	return i
+}
+
+func (c *mockEc2Client) DescribeInstancesPages(in *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	f := in.Filters[0]
+
+	// instances matching any of the filter values
+	i := make([]*ec2.Instance, 0)
+	for _, v := range f.Values {
+		m, ok := mockInstances[aws.StringValue(f.Name)+"="+aws.StringValue(v)]
+		if ok && m == nil {
+			return errors.New("mock DescribeInstances error")
+		}
+		i = append(i, m...)
+	}
+
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: i}}}, true)
+	return nil
+}
+
+func TestSessionHandler_ResolveTarget(t *testing.T) {
+	h := &sessionHandler{client: new(mockSsmClient), ec2: new(mockEc2Client)}
+
+	tests := []struct {
+		target string
+		id     string
+	}{
+		{"i-deadbeef", "i-deadbeef"},
+		{"i-0123456789abcdef0", "i-0123456789abcdef0"},
+		{"mi-0123456789abcdef0", "mi-0123456789abcdef0"},
+		{"web", "i-0123456789abcdef0"},
+		{"Name=web", "i-0123456789abcdef0"},
+		{"tag:Role=bastion", "i-0123456789abcdef0"},
+		{"tag:Role", "i-0123456789abcdef0"},
+		{"10.1.2.3", "i-0fedcba9876543210"},
+		{"ip-10-1-2-3.ec2.internal", "i-0fedcba9876543210"},
+		{"ip-10-9-9-9.ec2.internal", "i-0aaaaaaaaaaaaaaaa"},
+		{"mixed", "i-0123456789abcdef0"},
+		// SSM managed instances
+		{"onprem-01", "mi-0123456789abcdef0"},
+		{"Name=onprem-01", "mi-0123456789abcdef0"},
+		{"db-01.corp.example.com", "mi-0123456789abcdef0"},
+		{"DB-01", "mi-0123456789abcdef0"},
+		{"192.168.1.10", "mi-0123456789abcdef0"},
+		{"build-01", "mi-0fedcba9876543210"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.target, func(t *testing.T) {
+			id, err := h.resolveTarget(tc.target)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if id != tc.id {
+				t.Errorf("unexpected instance id: %s", id)
+			}
+		})
+	}
+
+	for _, v := range []string{"", "app", "nope", "offline", "unmanaged", "i-0eeeeeeeeeeeeeeee", "error", "tag:Name=build-01",
+		"192.168.1.99"} {
+		t.Run("bad "+v, func(t *testing.T) {
+			if _, err := h.resolveTarget(v); err == nil {
+				t.Error("did not receive expected error")
+			}
+		})
+	}
+
+	t.Run("status errors", func(t *testing.T) {
+		_, err := h.resolveTarget("offline")
+		if err == nil || !strings.Contains(err.Error(), ssm.PingStatusConnectionLost) {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		_, err = h.resolveTarget("unmanaged")
+		if err == nil || !strings.Contains(err.Error(), "not managed") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("chooser", func(t *testing.T) {
+		h := &sessionHandler{client: new(mockSsmClient), ec2: new(mockEc2Client)}
+		h.chooser = func(target string, info []*instanceInfo) (*instanceInfo, error) {
+			if len(info) != 2 {
+				t.Errorf("unexpected choices: %v", info)
+			}
+			return info[1], nil
+		}
+
+		id, err := h.resolveTarget("app")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if id != "i-00000000000000002" {
+			t.Errorf("unexpected instance id: %s", id)
+		}
+	})
+}
+
+func TestChooseInstance(t *testing.T) {
+	info := []*instanceInfo{
+		{id: "i-00000000000000001", name: "app", privateIp: "10.1.1.2", pingStatus: ssm.PingStatusOnline},
+		{id: "i-00000000000000002", name: "app", privateIp: "10.1.1.3", pingStatus: ssm.PingStatusOnline},
+	}
+
+	t.Run("good", func(t *testing.T) {
+		w := new(bytes.Buffer)
+		i, err := chooseInstance(strings.NewReader("x\n3\n2\n"), w, "app", info)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if i.id != "i-00000000000000002" {
+			t.Errorf("unexpected instance: %s", i)
+		}
+
+		if !strings.Contains(w.String(), "1) i-00000000000000001 (app, 10.1.1.2, Online)") ||
+			strings.Count(w.String(), "Invalid selection") != 2 {
+			t.Errorf("unexpected output: %s", w.String())
+		}
+	})
+
+	t.Run("eof", func(t *testing.T) {
+		if _, err := chooseInstance(strings.NewReader(""), new(bytes.Buffer), "app", info); err != io.EOF {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -4,10 +4,13 @@ import (
 	"aws-runas/lib/cache"
 	"aws-runas/lib/config"
 	credlib "aws-runas/lib/credentials"
+	"aws-runas/lib/httpclient"
 	"aws-runas/lib/identity"
 	"aws-runas/lib/metadata"
 	"aws-runas/lib/saml"
 	"aws-runas/lib/ssm"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +20,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/iam/iamiface"
@@ -24,7 +28,8 @@ import (
 	"github.com/dustin/go-humanize"
 	cfglib "github.com/mmmorris1975/aws-config/config"
 	"github.com/mmmorris1975/simple-logger/logger"
-	"net"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -33,6 +38,7 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -49,6 +55,7 @@ var (
 	samlClient saml.AwsClient
 	idp        identity.Provider
 	usr        *identity.Identity
+	chain      *config.RoleChain
 
 	log        = logger.StdLogger
 	sigCh      = make(chan os.Signal, 3)
@@ -57,12 +64,34 @@ var (
 
 func main() {
 	p := kingpin.Parse()
-	profile = coalesce(execArgs.profile, shellArgs.profile, fwdArgs.profile, pwdArgs.profile, aws.String("default"))
+	profile = coalesce(execArgs.profile, shellArgs.profile, fwdArgs.profile, sshArgs.profile, runArgs.profile, pwdArgs.profile, discoverArgs.profile)
 
 	if *verbose {
 		log.SetLevel(logger.DEBUG)
 	}
 
+	// the pick command, or no profile in a terminal, lets the user choose the profile, then continues like exec
+	if p == pick.FullCommand() || (p == exe.FullCommand() && profile == nil && pickOnEmptyProfile()) {
+		pp, err := pickProfile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		profile = &pp
+
+		if p == pick.FullCommand() {
+			execArgs.cmd = pickArgs.cmd
+		}
+	}
+
+	if profile == nil {
+		profile = aws.String("default")
+	}
+
+	if strings.HasPrefix(p, agentCmd.FullCommand()+" ") {
+		runAgent(p)
+		os.Exit(0)
+	}
+
 	if err := resolveConfig(); err != nil {
 		log.Fatal(err)
 	}
@@ -72,12 +101,28 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *explain {
+		explainRoleChain(os.Stdout)
+		os.Exit(0)
+	}
+
 	awsSession()
 
-	if err := awsUser(); err != nil {
-		log.Fatal(err)
+	if p == discover.FullCommand() {
+		if err := discoverProfiles(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// when the credential agent is running, it provides the credentials, and the identity of the user isn't needed
+	c := agentCredentials()
+	if c == nil {
+		if err := awsUser(); err != nil {
+			log.Fatal(err)
+		}
+		log.Debugf("USER: %+v", usr)
 	}
-	log.Debugf("USER: %+v", usr)
 
 	switch {
 	case *listMfa:
@@ -102,36 +147,32 @@ func main() {
 				Session:    ses,
 				CacheDir:   filepath.Dir(sessionCredCacheName()),
 				SamlClient: samlClient,
+				Routes:     *ec2Routes,
+				InstanceIdentity: &metadata.InstanceIdentity{
+					InstanceId:       aws.StringValue(coalesce(ec2InstanceId, &cfg.Ec2InstanceId)),
+					Region:           aws.StringValue(coalesce(ec2Region, &cfg.Ec2Region)),
+					AvailabilityZone: aws.StringValue(coalesce(ec2AvailZone, &cfg.Ec2AvailabilityZone)),
+				},
 			}
 
-			log.Fatal(metadata.NewEC2MetadataService(opts))
+			if err := metadata.NewEC2MetadataService(opts); err != nil {
+				log.Fatal(err)
+			}
 		}
 	default:
-		var c *credentials.Credentials
-
-		if usr.IdentityType == "user" {
-			checkRefresh()
-
-			if usr.Provider == saml.IdentityProviderSaml {
-				var err error
-				c, err = handleSamlUserCredentials()
-				if err != nil {
-					log.Fatal(err)
-				}
-			} else {
-				c = handleAwsUserCredentials()
+		if c == nil {
+			var err error
+			if c, err = profileCredentials(); err != nil {
+				log.Fatal(err)
 			}
+		}
 
-			if *showExpire {
-				if *outputFmt == "json" {
-					// todo
-				} else {
-					printCredExpire(c)
-				}
+		if *showExpire && (usr == nil || usr.IdentityType == "user") {
+			if *outputFmt == "json" {
+				// todo
+			} else {
+				printCredExpire(c)
 			}
-		} else {
-			// possibly on EC2 ... do AssumeRole directly
-			c = assumeRoleCredentials(ses)
 		}
 
 		if *whoAmI {
@@ -153,20 +194,82 @@ func main() {
 
 		switch p {
 		case shell.FullCommand():
-			h := ssm.NewSsmHandler(ses.Copy(new(aws.Config).WithCredentials(c).WithLogger(log)))
+			h := ssm.NewSsmHandler(ses.Copy(new(aws.Config).WithCredentials(c).WithLogger(log))).WithNativeClient(*ssmNative)
+
+			recDir := *shellArgs.recordDir
+			if len(recDir) < 1 {
+				recDir = cfg.SsmRecordDir
+			}
+
+			if len(recDir) > 0 {
+				h.WithRecording(&ssm.Recording{Dir: recDir, Profile: *profile, RoleArn: cfg.RoleArn,
+					Input: *shellArgs.recordIn || cfg.SsmRecordInput})
+			}
+
 			if err := h.StartSession(*shellArgs.target); err != nil {
 				log.Fatal(err)
 			}
 		case fwd.FullCommand():
-			host, remPort, err := net.SplitHostPort(*fwdArgs.target)
-			if err != nil {
-				log.Fatal(err)
+			locPort := fmt.Sprintf("%d", *fwdArgs.localPort)
+			h := ssm.NewSsmHandler(ses.Copy(new(aws.Config).WithCredentials(c).WithLogger(log))).WithNativeClient(*ssmNative)
+
+			// port mappings from the profile are only used if nothing was specified on the command line
+			maps := *fwdArgs.mappings
+			if len(maps) < 1 && len(*fwdArgs.target) < 1 {
+				maps = cfg.SsmPortForwards
 			}
 
-			locPort := fmt.Sprintf("%d", *fwdArgs.localPort)
+			if len(maps) > 0 {
+				pm, err := parsePortMappings(maps)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				if err := h.ForwardPorts(pm...); err != nil {
+					log.Fatal(err)
+				}
+				break
+			}
+
+			var host, remHost, remPort string
+			if len(*fwdArgs.remote) > 0 {
+				var err error
+				host = *fwdArgs.target
+				remHost, remPort, err = splitTarget(*fwdArgs.remote)
+				if err != nil || remHost == "rds" {
+					// port is optional for rds:<identifier> remote hosts
+					remHost, remPort = *fwdArgs.remote, ""
+				}
+			} else {
+				var err error
+				host, remPort, err = splitTarget(*fwdArgs.target)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			var err error
+			switch {
+			case *fwdArgs.persist:
+				err = h.ForwardPorts(&ssm.PortMapping{LocalPort: locPort, Target: host, RemoteHost: remHost, RemotePort: remPort})
+			case len(remHost) > 0:
+				err = h.ForwardPortToRemoteHost(host, locPort, remHost, remPort)
+			default:
+				err = h.ForwardPort(host, locPort, remPort)
+			}
 
-			h := ssm.NewSsmHandler(ses.Copy(new(aws.Config).WithCredentials(c).WithLogger(log)))
-			if err := h.ForwardPort(host, locPort, remPort); err != nil {
+			if err != nil {
+				log.Fatal(err)
+			}
+		case ssh.FullCommand():
+			h := ssm.NewSsmHandler(ses.Copy(new(aws.Config).WithCredentials(c).WithLogger(log))).WithNativeClient(*ssmNative)
+			if err := h.SshProxy(*sshArgs.target, *sshArgs.port); err != nil {
+				log.Fatal(err)
+			}
+		case runCmd.FullCommand():
+			targets, cmd := runCommandArgs(*runArgs.targets, *runArgs.cmd)
+			h := ssm.NewSsmHandler(ses.Copy(new(aws.Config).WithCredentials(c).WithLogger(log))).WithNativeClient(*ssmNative)
+			if err := h.RunCommand(targets, strings.Join(cmd, " ")); err != nil {
 				log.Fatal(err)
 			}
 		default:
@@ -181,7 +284,15 @@ func main() {
 			if len(cmd) > 0 {
 				if !*envFlag {
 					runEcsSvc(c)
+
+					if *ctrFlag || len(*ctrAddr) > 0 {
+						cmd = injectContainerEnv(cmd,
+							"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_AUTHORIZATION_TOKEN")
+					}
 				}
+				// the watcher only runs for the lifetime of the command
+				ctx, cancel := context.WithCancel(context.Background())
+				go newExpiryWatcher(c).run(ctx)
 
 				wrapped := wrapCmd(cmd)
 				c := exec.Command(wrapped[0], wrapped[1:]...)
@@ -190,6 +301,7 @@ func main() {
 				c.Stderr = os.Stderr
 
 				err = c.Run()
+				cancel()
 				if err != nil {
 					log.Debug("Error running command")
 					log.Fatalf("%v", err)
@@ -319,17 +431,90 @@ func runEcsSvc(c *credentials.Credentials) {
 		os.Setenv(v, os.DevNull)
 	}
 
-	in := &metadata.EcsMetadataInput{Credentials: c, Logger: log}
-	s, err := metadata.NewEcsMetadataService(in)
+	if *ctrFlag || len(*ctrAddr) > 0 {
+		a, err := containerAddress(*ctrAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s, err := newContainerServer(c, a)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := s.Start(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+
+		for k, v := range containerCredentialsEnv(s) {
+			os.Setenv(k, v)
+		}
+		log.Debugf("container credential provider endpoint: %s", s.Url.String())
+		return
+	}
+
+	// only serve credentials to processes running as the same user on systems where we can look that up, unless disabled
+	// for commands which run their children as another user
+	in := &metadata.EcsMetadataInput{Credentials: c, Logger: log, RestrictUid: *restrictUid && runtime.GOOS == "linux"}
+	s, err := metadata.NewEcsMetadataServer(in)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
 	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", s.Url.String())
-	go s.Run()
+	os.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", s.AuthToken)
 	log.Debugf("http credential provider endpoint: %s", s.Url.String())
 }
 
+// runCommandArgs returns the targets and command for run-command.  Since flags are not parsed after the first positional
+// argument, any --targets (or -t) flags following the profile name are found at the start of args, along with the '--'
+// separating them from the command.
+func runCommandArgs(targets []string, args []string) ([]string, []string) {
+	t := append([]string{}, targets...)
+
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; {
+		case a == "--":
+			return t, args[i+1:]
+		case (a == "--targets" || a == "-t") && i+1 < len(args):
+			i++
+			t = append(t, args[i])
+		case strings.HasPrefix(a, "--targets="):
+			t = append(t, strings.TrimPrefix(a, "--targets="))
+		default:
+			return t, args[i:]
+		}
+	}
+	return t, []string{}
+}
+
+// parsePortMappings parses the list of local:target:remote port mappings
+func parsePortMappings(maps []string) ([]*ssm.PortMapping, error) {
+	pm := make([]*ssm.PortMapping, len(maps))
+	for i, m := range maps {
+		p, err := ssm.ParsePortMapping(m)
+		if err != nil {
+			return nil, err
+		}
+		pm[i] = p
+	}
+	return pm, nil
+}
+
+// splitTarget splits a forwarding target in the form of target:port.  Unlike net.SplitHostPort(), the target part may
+// contain a ':', like tag:Role=bastion:22
+func splitTarget(t string) (string, string, error) {
+	i := strings.LastIndex(t, ":")
+	if i < 1 || i == len(t)-1 {
+		return "", "", fmt.Errorf("invalid target %s, must be in the form of target:port", t)
+	}
+	return t[:i], t[i+1:], nil
+}
+
 func wrapCmd(cmd []string) []string {
 	// If on a non-windows platform, with the SHELL environment variable set, and a call to
 	// exec.LookPath() for the command fails, run the command in a sub-shell so we can support shell aliases.
@@ -362,6 +547,26 @@ func wrapCmd(cmd []string) []string {
 	return newCmd
 }
 
+// appendUnique returns the list with the values appended in order, skipping any value already in the list (including
+// one appended earlier in the same call), so values from the command line can be merged with those in the profile
+// without sending duplicate tag keys or policy ARNs to STS
+func appendUnique(list []string, vals ...string) []string {
+	for _, v := range vals {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 // return the 1st non-nil value with a length > 0, otherwise return nil
 func coalesce(vals ...*string) *string {
 	for _, v := range vals {
@@ -416,6 +621,21 @@ func resolveConfig() error {
 			return err
 		}
 	}
+
+	// the resolver only follows a single source_profile, get the config of every profile in longer role chains
+	p := *profile
+	if len(usrCfg.RoleArn) > 0 {
+		p = usrCfg.SourceProfile
+	}
+
+	chainCfg, err := resolveRoleChain(res, p, usrCfg.RoleArn)
+	if err != nil {
+		return err
+	}
+
+	if chainCfg != nil {
+		resolvedProfile = chainCfg
+	}
 	log.Debugf("USER Config: %+v", usrCfg)
 	log.Debugf("PROFILE Config: %+v", resolvedProfile)
 
@@ -446,7 +666,12 @@ func resolveConfig() error {
 	log.Debugf("MERGED Config: %+v", mergedCfg)
 
 	cfg, err = finalConfig(mergedCfg)
-	return err
+	if err != nil {
+		return err
+	}
+
+	finalizeRoleChain()
+	return nil
 }
 
 func finalConfig(cfg *cfglib.AwsConfig) (*config.AwsConfig, error) {
@@ -484,6 +709,32 @@ func finalConfig(cfg *cfglib.AwsConfig) (*config.AwsConfig, error) {
 		newCfg.SamlProvider = *samlProvider
 	}
 
+	if sessionTags != nil && len(*sessionTags) > 0 {
+		if newCfg.SessionTags == nil {
+			newCfg.SessionTags = make(map[string]string)
+		}
+
+		for k, v := range *sessionTags {
+			newCfg.SessionTags[k] = v
+		}
+	}
+
+	if transitiveTags != nil && len(*transitiveTags) > 0 {
+		newCfg.TransitiveTagKeys = appendUnique(newCfg.TransitiveTagKeys, *transitiveTags...)
+	}
+
+	if policyFile != nil && len(*policyFile) > 0 {
+		b, err := ioutil.ReadFile(*policyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read session policy: %v", err)
+		}
+		newCfg.SessionPolicy = string(b)
+	}
+
+	if policyArns != nil && len(*policyArns) > 0 {
+		newCfg.SessionPolicyArns = appendUnique(newCfg.SessionPolicyArns, *policyArns...)
+	}
+
 	log.Debugf("FINAL Config: %+v", newCfg)
 	return newCfg, nil
 }
@@ -491,10 +742,18 @@ func finalConfig(cfg *cfglib.AwsConfig) (*config.AwsConfig, error) {
 func awsSession() {
 	var p string
 
-	sc := new(aws.Config).WithRegion(cfg.Region).WithCredentialsChainVerboseErrors(true).WithLogger(log)
+	// STS and IAM calls must use a region in the partition of the role, or the partition of the configured region if
+	// no roles are assumed
+	r := config.PartitionRegion(rolePartition(), cfg.Region)
+	if r != cfg.Region {
+		log.Debugf("using region %s for the %s partition", r, rolePartition())
+	}
+
+	sc := new(aws.Config).WithRegion(r).WithCredentialsChainVerboseErrors(true).WithLogger(log)
 	if *verbose {
 		sc.LogLevel = aws.LogLevel(aws.LogDebug)
 	}
+	sc.MergeIn(credlib.StsEndpointConfig(cfg.StsRegionalEndpoints, cfg.StsEndpointUrl))
 
 	// profile was not a role ARN (implies that it's a profile in the config file)
 	if *profile != cfg.RoleArn {
@@ -520,11 +779,23 @@ func awsSession() {
 	ses = session.Must(session.NewSessionWithOptions(opts))
 }
 
+// rolePartition returns the AWS partition (like aws, aws-us-gov, or aws-cn) of the first role assumed for the profile,
+// or an empty string if the profile does not assume a role
+func rolePartition() string {
+	a := cfg.RoleArn
+	if hasRoleChain() {
+		a = chain.Hops[0].RoleArn
+	} else if len(cfg.JumpRoleArn.Resource) > 0 {
+		a = cfg.JumpRoleArn.String()
+	}
+	return config.ArnPartition(a)
+}
+
 func awsUser() error {
 	var err error
 
 	// default to AWS IAM identity, switch to SAML identity if SamlAuthUrl config attribute is set
-	idp = identity.NewAwsIdentityProvider(ses)
+	idp = identity.NewAwsIdentityProvider(ses).WithWildcardExpansion(*expandRoles)
 	if cfg.SamlAuthUrl != nil && len(cfg.SamlAuthUrl.String()) > 0 {
 		log.Debug("Using SAML Identity")
 		samlClient, err = samlClientWithReauth()
@@ -546,7 +817,59 @@ func awsUser() error {
 	return nil
 }
 
+// resolveSessionNames expands the role_session_name and source_identity templates using the identity of the user, and
+// the profile name.  The role session name defaults to the username.
+func resolveSessionNames() error {
+	d := credlib.NewSessionNameData(usr.Username, *profile)
+
+	n, err := expandSessionName(cfg.RoleSessionName, d)
+	if err != nil {
+		return err
+	}
+	cfg.RoleSessionName = n
+
+	if len(cfg.SourceIdentity) > 0 {
+		id, err := credlib.ExpandSessionName(cfg.SourceIdentity, d)
+		if err != nil {
+			return fmt.Errorf("invalid source_identity: %v", err)
+		}
+		cfg.SourceIdentity = id
+	}
+
+	if hasRoleChain() {
+		for _, h := range chain.Hops {
+			hd := *d
+			hd.Profile = h.Profile
+
+			if h.RoleSessionName, err = expandSessionName(h.RoleSessionName, &hd); err != nil {
+				return err
+			}
+			h.SourceIdentity = cfg.SourceIdentity
+		}
+	}
+
+	return nil
+}
+
+func expandSessionName(tmpl string, d *credlib.SessionNameData) (string, error) {
+	if len(tmpl) < 1 {
+		return d.Username, nil
+	}
+
+	n, err := credlib.ExpandSessionName(tmpl, d)
+	if err != nil {
+		return "", fmt.Errorf("invalid role_session_name: %v", err)
+	}
+	return n, nil
+}
+
 func samlClientWithReauth() (saml.AwsClient, error) {
+	return newSamlClient(cfg, rolePartition())
+}
+
+// newSamlClient returns an authenticated SAML client for the identity provider of the profile configuration c, for
+// roles in the partition p
+func newSamlClient(c *config.AwsConfig, p string) (saml.AwsClient, error) {
 	jar, err := cache.NewCookieJarFile(cookieFile)
 	if err != nil {
 		return nil, err
@@ -561,14 +884,21 @@ func samlClientWithReauth() (saml.AwsClient, error) {
 	}
 
 	sp := "auto-detect"
-	if len(cfg.SamlProvider) > 0 {
-		sp = cfg.SamlProvider
+	if len(c.SamlProvider) > 0 {
+		sp = c.SamlProvider
+	}
+	hc, err := httpclient.New(c.HttpClientOptions())
+	if err != nil {
+		return nil, err
 	}
+
 	log.Debugf("divining SAML client (%s)", sp)
-	c, err := saml.GetClient(cfg.SamlProvider, cfg.SamlAuthUrl.String(), func(s *saml.BaseAwsClient) {
-		s.Username = cfg.SamlUsername
+	sc, err := saml.GetClient(c.SamlProvider, c.SamlAuthUrl.String(), func(s *saml.BaseAwsClient) {
+		s.SetHttpClient(hc)
+		s.Username = c.SamlUsername
 		s.Password = *samlPass
 		s.MfaToken = *mfaCode
+		s.Partition = p
 		s.SetCookieJar(jar)
 	})
 	if err != nil {
@@ -579,13 +909,13 @@ func samlClientWithReauth() (saml.AwsClient, error) {
 	// Assume any failure necessitates a re-auth.  Retry AwsSaml() to validate
 	log.Debugln("checking SAML response")
 	var s string
-	if s, err = c.AwsSaml(); err != nil {
+	if s, err = sc.AwsSaml(); err != nil {
 		log.Debugln("doing SAML authentication")
-		if err = c.Authenticate(); err != nil {
+		if err = sc.Authenticate(); err != nil {
 			return nil, err
 		}
 
-		if s, err = c.AwsSaml(); err != nil {
+		if s, err = sc.AwsSaml(); err != nil {
 			return nil, err
 		}
 	}
@@ -598,12 +928,12 @@ func samlClientWithReauth() (saml.AwsClient, error) {
 
 	log.Debugf("SAMLResponse:\n%s", s)
 
-	rd, err := c.RoleDetails()
+	rd, err := sc.RoleDetails()
 	if err != nil {
 		return nil, err
 	}
 	log.Debugf("SAML Role Details:\n%s", rd.String())
-	return c, nil
+	return sc, nil
 }
 
 func printMfa(c iamiface.IAMAPI) {
@@ -623,7 +953,24 @@ func printMfa(c iamiface.IAMAPI) {
 	}
 }
 
+// policyRoleProvider is an identity provider which can show the policy allowing each role
+type policyRoleProvider interface {
+	PolicyRoles(user ...string) ([]*identity.PolicyRole, error)
+}
+
 func printRoles() {
+	if p, ok := idp.(policyRoleProvider); ok {
+		roles, err := p.PolicyRoles()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := writePolicyRoles(os.Stdout, roles); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	roles, err := idp.Roles()
 	if err != nil {
 		log.Fatal(err)
@@ -640,6 +987,84 @@ func printRoles() {
 	}
 }
 
+// writePolicyRoles writes a table of the roles, with the user or group and policy allowing each role, if the role is
+// allowed, denied, or conditional, and any conditions of the policies, or the roles as a JSON list if the json output
+// format is selected.  Unlike the plain role list, wildcard and denied roles are kept, since the policy they come from
+// is shown.
+func writePolicyRoles(w io.Writer, roles []*identity.PolicyRole) error {
+	if *outputFmt == "json" {
+		b, err := json.MarshalIndent(roles, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	fmt.Fprintf(w, "Available role ARNs for %s\n", usr.Username)
+	if len(roles) < 1 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  ROLE ARN\tSOURCE\tPOLICY\tSTATUS\tNOTES")
+	for _, r := range roles {
+		fmt.Fprintf(tw, "  %s\t%s\t%s (%s)\t%s\t%s\n", r.Arn, r.Source, r.Policy, r.PolicyType, r.Status, policyRoleNotes(r))
+	}
+	return tw.Flush()
+}
+
+// policyRoleNotes describes the conditions and wildcards of the role, and the policy denying it
+func policyRoleNotes(r *identity.PolicyRole) string {
+	notes := make([]string, 0)
+
+	if len(r.DeniedBy) > 0 {
+		notes = append(notes, "denied by "+r.DeniedBy)
+	}
+
+	if r.MfaRequired {
+		notes = append(notes, "MFA required")
+	}
+
+	if len(r.Conditions) > 0 {
+		notes = append(notes, "conditions: "+strings.Join(r.Conditions, ","))
+	}
+
+	if len(r.Pattern) > 0 {
+		notes = append(notes, "from "+r.Pattern)
+	}
+
+	if len(r.NotResource) > 0 {
+		notes = append(notes, "except "+strings.Join(r.NotResource, ","))
+	} else if r.Wildcard() {
+		notes = append(notes, "wildcard")
+	}
+
+	return strings.Join(notes, "; ")
+}
+
+// profileCredentials returns the credentials for the profile, using the identity of the user to determine how they
+// are retrieved
+func profileCredentials() (*credentials.Credentials, error) {
+	if err := resolveSessionNames(); err != nil {
+		return nil, err
+	}
+
+	if usr.IdentityType == "user" {
+		checkRefresh()
+
+		if usr.Provider == saml.IdentityProviderSaml {
+			return handleSamlUserCredentials()
+		}
+		return handleAwsUserCredentials(), nil
+	} else if hasRoleChain() {
+		return roleChainCredentials(nil, chain.Hops, *mfaCode), nil
+	}
+
+	// possibly on EC2 ... do AssumeRole directly
+	return assumeRoleCredentials(ses), nil
+}
+
 func handleSamlUserCredentials() (*credentials.Credentials, error) {
 	var c *credentials.Credentials
 
@@ -652,36 +1077,104 @@ func handleSamlUserCredentials() (*credentials.Credentials, error) {
 		return c, err
 	}
 
-	sc := credlib.NewSamlRoleCredentials(ses, cfg.RoleArn, samlDoc, func(p *credlib.SamlRoleProvider) {
+	var sp *credlib.SamlRoleProvider
+	sc := credlib.NewSamlRoleCredentials(samlSession(), cfg.RoleArn, samlDoc, func(p *credlib.SamlRoleProvider) {
+		sp = p
 		p.Log = log
-		p.RoleSessionName = usr.Username
+		p.RoleSessionName = cfg.RoleSessionName
 		p.Duration = cfg.CredentialsDuration
 		p.Cache = cache.NewFileCredentialCache(roleCredCacheName())
+		p.Policy = cfg.SessionPolicy
+		p.PolicyArns = cfg.SessionPolicyArns
 
+		// the session policy applies to the role assumed using the jump role credentials
 		if len(cfg.JumpRoleArn.Resource) > 0 {
 			p.RoleARN = cfg.JumpRoleArn.String()
 			p.Cache = cache.NewFileCredentialCache(jumpRoleCredCacheName())
 			p.Duration = cfg.SessionTokenDuration
+			p.Policy = ""
+			p.PolicyArns = nil
+		}
+
+		// the SAML identity assumes the first role in a role chain, instead of the jump role
+		if hasRoleChain() {
+			p.RoleARN = chain.Hops[0].RoleArn
+			p.Cache = cache.NewFileCredentialCache(hopCredCacheName(chain.Hops[0]))
+			p.Duration = chain.Hops[0].Duration
+			p.Policy = chain.Hops[0].SessionPolicy
+			p.PolicyArns = chain.Hops[0].SessionPolicyArns
 		}
 
 		p.ExpiryWindow = p.Duration / 10
 	})
+	watchCredentials("SAML role credentials", sc, samlRenewal(sc, sp))
 
-	if len(cfg.JumpRoleArn.Resource) > 0 {
+	if hasRoleChain() {
+		c = roleChainCredentials(sc, chain.Hops[1:], *mfaCode)
+	} else if len(cfg.JumpRoleArn.Resource) > 0 {
 		cfg.MfaSerial = "" // explicitly unset MfaSerial since MFA is handled by SAML
 		s := ses.Copy(new(aws.Config).WithCredentials(sc))
 
 		c = assumeRoleCredentials(s)
 	} else {
+		if len(cfg.SessionTags) > 0 || len(cfg.SourceIdentity) > 0 {
+			log.Warn("session tags and source identity for SAML roles must be set by the identity provider, ignoring")
+		}
 		c = sc
 	}
 
 	return c, nil
 }
 
+// samlSession returns the session used for AssumeRoleWithSAML, which may use a different STS endpoint than the other
+// STS API calls
+func samlSession() *session.Session {
+	if len(cfg.SamlStsEndpoint) > 0 {
+		return ses.Copy(credlib.StsEndpointConfig(endpoints.UnsetSTSEndpoint, cfg.SamlStsEndpoint))
+	}
+	return ses
+}
+
+// samlRenewal returns a function which renews the SAML role credentials using a new SAMLResponse, authenticating with
+// the identity provider if the identity provider session has expired.  The password and MFA prompts read from the
+// terminal, since the wrapped command is using the standard input of the program.
+func samlRenewal(c *credentials.Credentials, p *credlib.SamlRoleProvider) func() error {
+	return func() error {
+		return withTty(func(tty *os.File) error {
+			sc := samlClient.Client()
+			sc.ClearSaml()
+
+			s, err := samlClient.AwsSaml()
+			if err != nil {
+				cp, mp := sc.CredProvider, sc.MfaTokenProvider
+				sc.CredProvider, sc.MfaTokenProvider = credlib.TtyCredProvider(tty), credlib.ReaderMfaTokenProvider(tty)
+				err = samlClient.Authenticate()
+				sc.CredProvider, sc.MfaTokenProvider = cp, mp
+
+				if err != nil {
+					return err
+				}
+
+				if s, err = samlClient.AwsSaml(); err != nil {
+					return err
+				}
+			}
+
+			p.RenewWithAssertion(s)
+			c.Expire()
+			_, err = c.Get()
+			return err
+		})
+	}
+}
+
 func handleAwsUserCredentials() *credentials.Credentials {
 	var c *credentials.Credentials
 
+	if hasRoleChain() && !*sesCreds {
+		return roleChainUserCredentials()
+	}
+
 	if cfg.CredentialsDuration > 1*time.Hour && len(cfg.RoleArn) > 0 {
 		c = assumeRoleCredentials(ses)
 	} else {
@@ -710,7 +1203,8 @@ func sessionTokenCredentials(c client.ConfigProvider) *credentials.Credentials {
 		ew = credlib.SessionTokenMinDuration / 10
 	}
 
-	return credlib.NewSessionTokenCredentials(c, func(p *credlib.SessionTokenProvider) {
+	var sp *credlib.SessionTokenProvider
+	sc := credlib.NewSessionTokenCredentials(c, func(p *credlib.SessionTokenProvider) {
 		p.Cache = cache.NewFileCredentialCache(sessionCredCacheName())
 		p.Duration = cfg.SessionTokenDuration
 		p.ExpiryWindow = ew
@@ -718,7 +1212,13 @@ func sessionTokenCredentials(c client.ConfigProvider) *credentials.Credentials {
 		p.SerialNumber = cfg.MfaSerial
 		p.TokenCode = *mfaCode
 		p.TokenProvider = credlib.StdinMfaTokenProvider
+		sp = p
 	})
+
+	if len(cfg.MfaSerial) > 0 {
+		watchCredentials("session token credentials", sc, ttyRenewal(sc, sp.RenewWithTokenProvider))
+	}
+	return sc
 }
 
 func assumeRoleCredentials(c client.ConfigProvider) *credentials.Credentials {
@@ -731,17 +1231,29 @@ func assumeRoleCredentials(c client.ConfigProvider) *credentials.Credentials {
 		ew = credlib.AssumeRoleMinDuration / 10
 	}
 
-	return credlib.NewAssumeRoleCredentials(c, cfg.RoleArn, func(p *credlib.AssumeRoleProvider) {
+	var rp *credlib.AssumeRoleProvider
+	rc := credlib.NewAssumeRoleCredentials(c, cfg.RoleArn, func(p *credlib.AssumeRoleProvider) {
 		p.Cache = cache.NewFileCredentialCache(roleCredCacheName())
 		p.Duration = cfg.CredentialsDuration
 		p.ExternalID = cfg.ExternalId
 		p.ExpiryWindow = ew
 		p.Log = log
-		p.RoleSessionName = usr.Username
+		p.RoleSessionName = cfg.RoleSessionName
+		p.SourceIdentity = cfg.SourceIdentity
 		p.SerialNumber = cfg.MfaSerial
 		p.TokenCode = *mfaCode
 		p.TokenProvider = credlib.StdinMfaTokenProvider
+		p.Tags = cfg.SessionTags
+		p.TransitiveTagKeys = cfg.TransitiveTagKeys
+		p.Policy = cfg.SessionPolicy
+		p.PolicyArns = cfg.SessionPolicyArns
+		rp = p
 	})
+
+	if len(cfg.MfaSerial) > 0 {
+		watchCredentials("role credentials", rc, ttyRenewal(rc, rp.RenewWithTokenProvider))
+	}
+	return rc
 }
 
 func sessionCredCacheName() string {
@@ -760,23 +1272,82 @@ func sessionCredCacheName() string {
 }
 
 func roleCredCacheName() string {
+	return roleCacheFile(roleCacheProfile(), configRoleHop())
+}
+
+func roleCacheProfile() string {
 	p := *profile
 	if *profile == cfg.RoleArn {
 		a, _ := arn.Parse(*profile) // if we get this far, it's assumed the ARN will parse
-		r := strings.Split(a.Resource, "/")
-		p = fmt.Sprintf("%s-%s", a.AccountID, r[len(r)-1])
+		p = arnCacheName(a)
+	}
+	return p
+}
+
+// arnCacheName returns the cache file name for a role ARN, using the account ID and role name.  Roles outside of the
+// commercial partition include the partition in the name, so credentials from different partitions never share a
+// cache file.
+func arnCacheName(a arn.ARN) string {
+	r := strings.Split(a.Resource, "/")
+	p := fmt.Sprintf("%s-%s", a.AccountID, r[len(r)-1])
+
+	if a.Partition != endpoints.AwsPartitionID {
+		p = fmt.Sprintf("%s-%s", a.Partition, p)
 	}
+	return p
+}
 
-	f := cacheFile(fmt.Sprintf("%s_%s", assumeRoleCachePrefix, p))
+// roleCacheFile returns the assume role cache file for the profile.  Credentials with session tags, session policies or
+// a source identity are cached in a file which identifies them, so credentials with a different set of tags,
+// permissions or source identity are never loaded from the same cache.
+func roleCacheFile(p string, h *config.RoleHop) string {
+	f := cacheFile(fmt.Sprintf("%s_%s%s", assumeRoleCachePrefix, p, sessionCacheSuffix(h)))
 	log.Debugf("AssumeRole CACHE PATH: %s", f)
 	return f
 }
 
-func jumpRoleCredCacheName() string {
-	r := strings.Split(cfg.JumpRoleArn.Resource, "/")
-	p := fmt.Sprintf("%s-%s", cfg.JumpRoleArn.AccountID, r[len(r)-1])
+func sessionCacheSuffix(h *config.RoleHop) string {
+	if len(h.SessionTags) < 1 && len(h.TransitiveTagKeys) < 1 && len(h.SessionPolicy) < 1 &&
+		len(h.SessionPolicyArns) < 1 && len(h.SourceIdentity) < 1 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(h.SessionTags))
+	for k := range h.SessionTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	t := append([]string{}, h.TransitiveTagKeys...)
+	sort.Strings(t)
+
+	a := append([]string{}, h.SessionPolicyArns...)
+	sort.Strings(a)
+
+	// whitespace in the policy document doesn't change the permissions, so don't let it change the cache file
+	pol := compactPolicy(h.SessionPolicy)
+
+	s := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(s, "%s=%s\n", k, h.SessionTags[k])
+	}
+	fmt.Fprintf(s, "transitive=%s\n", strings.Join(t, ","))
 
-	f := cacheFile(fmt.Sprintf("%s_%s", jumpRoleCachePrefix, p))
+	// only include the policies in the hash if set, so the cache file for tagged credentials is unchanged
+	if len(pol) > 0 || len(a) > 0 {
+		fmt.Fprintf(s, "policy=%s\n", pol)
+		fmt.Fprintf(s, "policy_arns=%s\n", strings.Join(a, ","))
+	}
+
+	if len(h.SourceIdentity) > 0 {
+		fmt.Fprintf(s, "source_identity=%s\n", h.SourceIdentity)
+	}
+
+	return fmt.Sprintf("_%x", s.Sum(nil)[:6])
+}
+
+func jumpRoleCredCacheName() string {
+	f := cacheFile(fmt.Sprintf("%s_%s", jumpRoleCachePrefix, arnCacheName(cfg.JumpRoleArn)))
 	log.Debugf("SAML JumpRole CACHE PATH: %s", f)
 	return f
 }
@@ -847,6 +1418,8 @@ func checkRefresh() {
 				log.Errorf("error removing role cred cache: %v", err)
 			}
 		}
+
+		removeRoleChainCaches()
 	}
 }
 
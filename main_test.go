@@ -4,6 +4,8 @@ import (
 	"aws-runas/lib/config"
 	"aws-runas/lib/identity"
 	"aws-runas/lib/saml"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
@@ -141,6 +143,86 @@ func TestAwsSession(t *testing.T) {
 			t.Error("data mismatch")
 		}
 	})
+
+	t.Run("sts endpoint", func(t *testing.T) {
+		defer func() { cfg.StsEndpointUrl = "" }()
+		profile = aws.String("aProfile")
+		cfg = emptyConfig
+		cfg.Region = "us-east-1"
+		cfg.StsEndpointUrl = "https://vpce-0123.sts.us-east-1.vpce.amazonaws.com"
+
+		awsSession()
+
+		if e := ses.ClientConfig(sts.EndpointsID).Endpoint; e != cfg.StsEndpointUrl {
+			t.Errorf("unexpected sts endpoint: %s", e)
+		}
+
+		if e := ses.ClientConfig(iam.EndpointsID).Endpoint; e != "https://iam.amazonaws.com" {
+			t.Errorf("unexpected iam endpoint: %s", e)
+		}
+	})
+
+	t.Run("partition", func(t *testing.T) {
+		defer func() { cfg.RoleArn = "" }()
+		profile = aws.String("aProfile")
+		cfg = emptyConfig
+
+		tests := []struct {
+			arn, region, want string
+		}{
+			{"arn:aws:iam::1234567890:role/Role", "us-west-1", "us-west-1"},
+			{"arn:aws-us-gov:iam::1234567890:role/Role", "us-gov-east-1", "us-gov-east-1"},
+			{"arn:aws-us-gov:iam::1234567890:role/Role", "us-east-1", "us-gov-west-1"},
+			{"arn:aws-cn:iam::1234567890:role/Role", "cn-northwest-1", "cn-northwest-1"},
+			{"arn:aws-cn:iam::1234567890:role/Role", "", "cn-north-1"},
+		}
+
+		for _, tc := range tests {
+			cfg.RoleArn = tc.arn
+			cfg.Region = tc.region
+			awsSession()
+
+			// the configured region is unchanged, since it is passed to the wrapped command
+			if *ses.Config.Region != tc.want || cfg.Region != tc.region {
+				t.Errorf("unexpected region for %s in %s: %s", tc.arn, tc.region, *ses.Config.Region)
+			}
+		}
+	})
+}
+
+func TestRolePartition(t *testing.T) {
+	defer func() { chain = nil }()
+	cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig)}
+
+	t.Run("role", func(t *testing.T) {
+		cfg.RoleArn = "arn:aws-us-gov:iam::1234567890:role/Role"
+		if p := rolePartition(); p != "aws-us-gov" {
+			t.Errorf("unexpected partition: %s", p)
+		}
+	})
+
+	t.Run("jump role", func(t *testing.T) {
+		cfg.JumpRoleArn, _ = arn.Parse("arn:aws-cn:iam::1234567890:role/Jump")
+		if p := rolePartition(); p != "aws-cn" {
+			t.Errorf("unexpected partition: %s", p)
+		}
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		chain = &config.RoleChain{Hops: []*config.RoleHop{{RoleArn: "arn:aws:iam::1234567890:role/First"},
+			{RoleArn: "arn:aws:iam::1234567890:role/Second"}}}
+		if p := rolePartition(); p != "aws" {
+			t.Errorf("unexpected partition: %s", p)
+		}
+	})
+
+	t.Run("no role", func(t *testing.T) {
+		chain = nil
+		cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig)}
+		if p := rolePartition(); len(p) > 0 {
+			t.Errorf("unexpected partition: %s", p)
+		}
+	})
 }
 
 func TestPrintRoles(t *testing.T) {
@@ -180,6 +262,83 @@ func Example_printRoles() {
 	//   arn:aws:iam::1234567890:role/Admin
 }
 
+func Example_writePolicyRoles() {
+	usr = &identity.Identity{
+		IdentityType: "user",
+		Username:     "mock-user",
+	}
+
+	roles := []*identity.PolicyRole{
+		{Arn: "arn:aws:iam::1234567890:role/Admin", Source: "user/mock-user", Policy: "admin", PolicyType: "inline",
+			Conditions: []string{"aws:MultiFactorAuthPresent"}, MfaRequired: true, Status: identity.RoleConditional},
+		{Arn: "arn:aws:iam::1234567890:role/Dev", Source: "group/dev", Policy: "dev-roles", PolicyType: "managed",
+			Pattern: "arn:aws:iam::1234567890:role/D*", Status: identity.RoleAllowed},
+		{Arn: "arn:aws:iam::1234567890:role/Prod", Source: "group/dev", Policy: "dev-roles", PolicyType: "managed",
+			Pattern: "arn:aws:iam::1234567890:role/*", Status: identity.RoleDenied, DeniedBy: "permissions boundary"},
+		{Arn: "*", Source: "group/dev", Policy: "all-roles", PolicyType: "managed", NotResource: []string{"arn:aws:iam::*:role/Admin"},
+			Status: identity.RoleAllowed},
+	}
+
+	writePolicyRoles(os.Stdout, roles)
+	// Output:
+	// Available role ARNs for mock-user
+	//   ROLE ARN                            SOURCE          POLICY               STATUS       NOTES
+	//   arn:aws:iam::1234567890:role/Admin  user/mock-user  admin (inline)       conditional  MFA required; conditions: aws:MultiFactorAuthPresent
+	//   arn:aws:iam::1234567890:role/Dev    group/dev       dev-roles (managed)  allowed      from arn:aws:iam::1234567890:role/D*
+	//   arn:aws:iam::1234567890:role/Prod   group/dev       dev-roles (managed)  denied       denied by permissions boundary; from arn:aws:iam::1234567890:role/*
+	//   *                                   group/dev       all-roles (managed)  allowed      except arn:aws:iam::*:role/Admin
+}
+
+func TestWritePolicyRoles(t *testing.T) {
+	usr = &identity.Identity{
+		IdentityType: "user",
+		Username:     "mock-user",
+	}
+
+	roles := []*identity.PolicyRole{
+		{Arn: "arn:aws:iam::1234567890:role/*", Source: "user/mock-user", Policy: "admin", PolicyType: "inline"},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		defer func(f string) { *outputFmt = f }(*outputFmt)
+		*outputFmt = "json"
+
+		b := new(bytes.Buffer)
+		if err := writePolicyRoles(b, roles); err != nil {
+			t.Error(err)
+			return
+		}
+
+		r := make([]*identity.PolicyRole, 0)
+		if err := json.Unmarshal(b.Bytes(), &r); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(r) != 1 || r[0].Arn != roles[0].Arn || r[0].Source != "user/mock-user" {
+			t.Errorf("unexpected roles: %s", b.String())
+		}
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		if n := policyRoleNotes(roles[0]); n != "wildcard" {
+			t.Errorf("unexpected notes: %s", n)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		b := new(bytes.Buffer)
+		if err := writePolicyRoles(b, []*identity.PolicyRole{}); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if b.String() != "Available role ARNs for mock-user\n" {
+			t.Errorf("unexpected output: %s", b.String())
+		}
+	})
+}
+
 func Test_printMfa(t *testing.T) {
 	usr = &identity.Identity{
 		IdentityType: "user",
@@ -356,6 +515,32 @@ func TestUpdateEnv(t *testing.T) {
 	})
 }
 
+func TestSplitTarget(t *testing.T) {
+	tests := map[string][]string{
+		"i-deadbeef:22":          {"i-deadbeef", "22"},
+		"tag:Role=bastion:8080":  {"tag:Role=bastion", "8080"},
+		"ip-10-1-2-3.local:5432": {"ip-10-1-2-3.local", "5432"},
+	}
+
+	for k, v := range tests {
+		h, p, err := splitTarget(k)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if h != v[0] || p != v[1] {
+			t.Errorf("unexpected target for %s: %s, %s", k, h, p)
+		}
+	}
+
+	for _, v := range []string{"i-deadbeef", "i-deadbeef:", ":22", ""} {
+		if _, _, err := splitTarget(v); err == nil {
+			t.Errorf("did not receive expected error for %s", v)
+		}
+	}
+}
+
 func TestWrapCmd(t *testing.T) {
 	t.Run("unwrapped", func(t *testing.T) {
 		cmd := wrapCmd([]string{"true"})
@@ -460,6 +645,30 @@ func TestRoleCredCacheName(t *testing.T) {
 			t.Error("data mismatch")
 		}
 	})
+
+	t.Run("partition arn profile", func(t *testing.T) {
+		defer func() { cfg.RoleArn = "" }()
+
+		for _, p := range []string{"aws-us-gov", "aws-cn"} {
+			profile = aws.String(fmt.Sprintf("arn:%s:iam::1234567890:role/managed-role/AcctAdmin", p))
+			cfg.RoleArn = *profile
+
+			if f := roleCredCacheName(); !strings.HasSuffix(f, fmt.Sprintf(".aws_assume_role_%s-1234567890-AcctAdmin", p)) {
+				t.Errorf("unexpected cache file: %s", f)
+			}
+		}
+	})
+}
+
+func TestJumpRoleCredCacheName(t *testing.T) {
+	cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig)}
+
+	for p, n := range map[string]string{"aws": "1234567890-Jump", "aws-us-gov": "aws-us-gov-1234567890-Jump"} {
+		cfg.JumpRoleArn, _ = arn.Parse(fmt.Sprintf("arn:%s:iam::1234567890:role/Jump", p))
+		if f := jumpRoleCredCacheName(); !strings.HasSuffix(f, "_"+n) {
+			t.Errorf("unexpected cache file: %s", f)
+		}
+	}
 }
 
 func TestSessionCredCacheName(t *testing.T) {
@@ -697,3 +906,191 @@ func (c *mockSamlClient) GetSessionDuration() (int64, error) {
 	}
 	return 12345, nil
 }
+
+func TestParsePortMappings(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		pm, err := parsePortMappings([]string{"8080:i-deadbeef:80", "2222:tag:Role=bastion:22"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(pm) != 2 || pm[1].Target != "tag:Role=bastion" || pm[1].LocalPort != "2222" {
+			t.Errorf("data mismatch: %+v", pm)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		if _, err := parsePortMappings([]string{"8080:i-deadbeef:80", "i-deadbeef:80"}); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestRunCommandArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		args    []string
+		wantT   string
+		wantC   string
+	}{
+		{"flags after profile", nil, []string{"--targets", "tag:Env=dev", "--", "uptime"}, "tag:Env=dev", "uptime"},
+		{"flags before profile", []string{"tag:Env=dev"}, []string{"--", "uptime", "-a"}, "tag:Env=dev", "uptime -a"},
+		{"mixed", []string{"i-deadbeef"}, []string{"-t", "web", "--targets=db", "ls", "-l"}, "i-deadbeef web db", "ls -l"},
+		{"no separator", []string{"web"}, []string{"uptime"}, "web", "uptime"},
+		{"empty", nil, nil, "", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tg, c := runCommandArgs(tc.targets, tc.args)
+			if strings.Join(tg, " ") != tc.wantT || strings.Join(c, " ") != tc.wantC {
+				t.Errorf("unexpected result: %v %v", tg, c)
+			}
+		})
+	}
+}
+
+func TestSessionCacheSuffix(t *testing.T) {
+	if s := sessionCacheSuffix(new(config.RoleHop)); len(s) > 0 {
+		t.Errorf("unexpected suffix for no tags: %s", s)
+	}
+
+	tags := func(tags map[string]string, transitive []string) string {
+		return sessionCacheSuffix(&config.RoleHop{SessionTags: tags, TransitiveTagKeys: transitive})
+	}
+
+	a := tags(map[string]string{"a": "1", "b": "2"}, []string{"b", "a"})
+	b := tags(map[string]string{"b": "2", "a": "1"}, []string{"a", "b"})
+	if len(a) < 2 || a != b {
+		t.Errorf("suffix mismatch for equal tags: %s %s", a, b)
+	}
+
+	if a == tags(map[string]string{"a": "1", "b": "3"}, []string{"a", "b"}) ||
+		a == tags(map[string]string{"a": "1", "b": "2"}, []string{"a"}) {
+		t.Error("same suffix for different tags")
+	}
+
+	t.Run("policy", func(t *testing.T) {
+		p := sessionCacheSuffix(&config.RoleHop{SessionPolicy: `{"Version": "2012-10-17"}`})
+		if len(p) < 2 || p != sessionCacheSuffix(&config.RoleHop{SessionPolicy: "{\n  \"Version\":\"2012-10-17\"\n}"}) {
+			t.Errorf("suffix mismatch for equal policies: %s", p)
+		}
+
+		arns := sessionCacheSuffix(&config.RoleHop{SessionPolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}})
+		if len(arns) < 2 || arns == p || p == sessionCacheSuffix(&config.RoleHop{SessionPolicy: `{"Version": "2008-10-17"}`}) {
+			t.Error("same suffix for different policies")
+		}
+	})
+
+	t.Run("source identity", func(t *testing.T) {
+		id := sessionCacheSuffix(&config.RoleHop{SourceIdentity: "alice"})
+		if len(id) < 2 || id == sessionCacheSuffix(&config.RoleHop{SourceIdentity: "bob"}) {
+			t.Error("same suffix for different source identities")
+		}
+
+		// tags alone keep the suffix they had before source identities were cached separately
+		if a != tags(map[string]string{"a": "1", "b": "2"}, []string{"a", "b"}) ||
+			a == sessionCacheSuffix(&config.RoleHop{SessionTags: map[string]string{"a": "1", "b": "2"},
+				TransitiveTagKeys: []string{"a", "b"}, SourceIdentity: "alice"}) {
+			t.Error("unexpected suffix for tags with source identity")
+		}
+	})
+}
+
+func TestFinalConfigSessionTags(t *testing.T) {
+	defer func() {
+		sessionTags = new(map[string]string)
+		transitiveTags = new([]string)
+	}()
+
+	sessionTags = &map[string]string{"Project": "runas", "Team": "ops"}
+	transitiveTags = &[]string{"Team", "Team"}
+
+	c, err := finalConfig(new(cfglib.AwsConfig))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(c.SessionTags) != 2 || c.SessionTags["Team"] != "ops" || len(c.TransitiveTagKeys) != 1 {
+		t.Errorf("unexpected session tags: %v %v", c.SessionTags, c.TransitiveTagKeys)
+	}
+}
+
+func TestFinalConfigSessionPolicy(t *testing.T) {
+	defer func() {
+		policyFile = new(string)
+		policyArns = new([]string)
+	}()
+
+	policyFile = aws.String("lib/config/test/policy.json")
+	policyArns = &[]string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}
+
+	c, err := finalConfig(new(cfglib.AwsConfig))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(c.SessionPolicy, "ec2:Describe*") || len(c.SessionPolicyArns) != 1 {
+		t.Errorf("unexpected session policy: %s %v", c.SessionPolicy, c.SessionPolicyArns)
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		policyFile = aws.String("nope.json")
+		if _, err := finalConfig(new(cfglib.AwsConfig)); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
+
+func TestResolveSessionNames(t *testing.T) {
+	defer func() { chain = nil }()
+
+	usr = &identity.Identity{Username: "bob"}
+	profile = aws.String("workload")
+
+	t.Run("default", func(t *testing.T) {
+		cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig)}
+		if err := resolveSessionNames(); err != nil || cfg.RoleSessionName != "bob" || len(cfg.SourceIdentity) > 0 {
+			t.Errorf("unexpected session names: %s %s %v", cfg.RoleSessionName, cfg.SourceIdentity, err)
+		}
+	})
+
+	t.Run("templates", func(t *testing.T) {
+		cfg = &config.AwsConfig{AwsConfig: &cfglib.AwsConfig{RoleSessionName: "{{.Username}}-{{.Profile}}"},
+			SourceIdentity: "{{.Username}}"}
+		chain = &config.RoleChain{Hops: []*config.RoleHop{
+			{Profile: "admin", RoleSessionName: "{{.Profile}}.{{.Username}}"},
+			{Profile: "workload"},
+		}}
+
+		if err := resolveSessionNames(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if cfg.RoleSessionName != "bob-workload" || cfg.SourceIdentity != "bob" {
+			t.Errorf("unexpected session names: %s %s", cfg.RoleSessionName, cfg.SourceIdentity)
+		}
+
+		if chain.Hops[0].RoleSessionName != "admin.bob" || chain.Hops[1].RoleSessionName != "bob" {
+			t.Errorf("unexpected role session names: %s %s", chain.Hops[0].RoleSessionName, chain.Hops[1].RoleSessionName)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		chain = nil
+		cfg = &config.AwsConfig{AwsConfig: &cfglib.AwsConfig{RoleSessionName: "{{.Username}} smith"}}
+		if err := resolveSessionNames(); err == nil {
+			t.Error("did not receive expected error")
+		}
+
+		cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig), SourceIdentity: "{{.Nope}}"}
+		if err := resolveSessionNames(); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"aws-runas/lib/config"
+	"aws-runas/lib/picker"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	cfglib "github.com/mmmorris1975/aws-config/config"
+	"os"
+	"sort"
+	"strings"
+)
+
+// pickOnEmptyProfile returns true if the user should be asked to choose a profile, because none was given on the command
+// line (or in the environment), and the program is running in a terminal.  Options which select a mode other than
+// running a command, or printing credentials, keep using the default profile.
+func pickOnEmptyProfile() bool {
+	for _, b := range []*bool{listRoles, listMfa, updateFlag, diagFlag, ec2MdFlag, explain, whoAmI, showExpire, ctrFlag} {
+		if b != nil && *b {
+			return false
+		}
+	}
+
+	if (ctrAddr != nil && len(*ctrAddr) > 0) || (ec2Routes != nil && len(*ec2Routes) > 0) {
+		return false
+	}
+	return picker.Interactive()
+}
+
+// pickProfile asks the user to choose one of the profiles in the config file.  If --pick-saml is set, the roles available
+// from the SAML identity provider of the default profile (or the profile in the AWS_DEFAULT_PROFILE environment variable)
+// can be chosen too.
+func pickProfile() (string, error) {
+	cp, err := cfglib.NewIniConfigProvider(nil)
+	if err != nil {
+		return "", err
+	}
+
+	items, aliases := profileItems(cp)
+	if pickSaml != nil && *pickSaml {
+		items = append(items, samlRoleItems(items, aliases)...)
+	}
+
+	i, err := picker.NewPicker(items).Pick()
+	if err != nil {
+		return "", err
+	}
+
+	log.Debugf("picked profile %s", i.Name)
+	return i.Name, nil
+}
+
+// profileItems returns the picker items for the profiles in the config file, and the account aliases found in the
+// account_alias attribute of the profiles, by account ID.  Only the attributes in the profile itself are used, so
+// values aren't inherited from a source_profile in a different account.
+func profileItems(cp cfglib.AwsConfigProvider) ([]*picker.Item, map[string]string) {
+	items := make([]*picker.Item, 0)
+	aliases := make(map[string]string)
+
+	for _, p := range cp.ListProfiles(false) {
+		i := &picker.Item{Name: p}
+		items = append(items, i)
+
+		c, err := cp.Config(p)
+		if err != nil {
+			log.Debugf("error reading profile %s: %v", p, err)
+			continue
+		}
+
+		i.AccountId, i.Role = splitRoleArn(c.RoleArn)
+		i.Alias = strings.TrimSpace(c.Get("account_alias"))
+
+		if len(i.AccountId) > 0 && len(i.Alias) > 0 {
+			aliases[i.AccountId] = i.Alias
+		}
+	}
+
+	for _, i := range items {
+		if len(i.Alias) < 1 {
+			i.Alias = aliases[i.AccountId]
+		}
+	}
+
+	return items, aliases
+}
+
+// samlRoleItems returns the picker items for the roles in the SAMLResponse from the identity provider of the default
+// profile, skipping roles already used by a profile.  Choosing one of these uses the role ARN as the profile.  Any
+// error is logged, and no items are returned, since the profiles in the config file can still be chosen.
+func samlRoleItems(profiles []*picker.Item, aliases map[string]string) []*picker.Item {
+	items := make([]*picker.Item, 0)
+
+	p := "default"
+	if v, ok := os.LookupEnv("AWS_DEFAULT_PROFILE"); ok {
+		p = v
+	}
+
+	c, err := discoveryConfig(p)
+	if err != nil {
+		log.Debugf("unable to resolve profile %s for SAML role discovery: %v", p, err)
+		return items
+	}
+
+	if c.SamlAuthUrl == nil || len(c.SamlAuthUrl.String()) < 1 {
+		return items
+	}
+
+	a := c.RoleArn
+	if len(c.JumpRoleArn.Resource) > 0 {
+		a = c.JumpRoleArn.String()
+	}
+
+	sc, err := newSamlClient(c, config.ArnPartition(a))
+	if err != nil {
+		log.Warnf("unable to get SAML roles: %v", err)
+		return items
+	}
+
+	rd, err := sc.RoleDetails()
+	if err != nil {
+		log.Warnf("unable to get SAML roles: %v", err)
+		return items
+	}
+
+	used := make(map[string]bool)
+	for _, i := range profiles {
+		if len(i.AccountId) > 0 {
+			used[i.AccountId+"/"+i.Role] = true
+		}
+	}
+
+	roles := rd.Roles()
+	sort.Strings(roles)
+
+	for _, r := range roles {
+		a, n := splitRoleArn(r)
+		if len(a) < 1 || used[a+"/"+n] {
+			continue
+		}
+		items = append(items, &picker.Item{Name: r, AccountId: a, Alias: aliases[a], Role: n})
+	}
+
+	return items
+}
+
+// discoveryConfig returns the configuration of the profile used to discover the SAML roles, resolved from the config
+// file and environment like the profile of the program, without changing the configuration of the program
+func discoveryConfig(p string) (*config.AwsConfig, error) {
+	res, err := cfglib.NewAwsConfigResolver(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := res.Resolve(p)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := cfglib.NewEnvConfigProvider().Config()
+	if err != nil {
+		return nil, err
+	}
+
+	mc, err := res.Merge(rc, env)
+	if err != nil {
+		return nil, err
+	}
+	mc.Profile = p
+
+	return finalConfig(mc)
+}
+
+// splitRoleArn returns the account ID and role name (without the path) from the role ARN
+func splitRoleArn(r string) (string, string) {
+	a, err := arn.Parse(r)
+	if err != nil {
+		return "", ""
+	}
+
+	res := a.Resource
+	if i := strings.LastIndex(res, "/"); i >= 0 {
+		res = res[i+1:]
+	}
+	return a.AccountID, res
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"aws-runas/lib/config"
+	"github.com/aws/aws-sdk-go/aws"
+	cfglib "github.com/mmmorris1975/aws-config/config"
+	"os"
+	"testing"
+)
+
+func TestProfileItems(t *testing.T) {
+	cp, err := cfglib.NewIniConfigProvider([]byte(`
+[default]
+region = us-east-1
+
+[profile admin]
+role_arn = arn:aws:iam::123456789012:role/Admin
+account_alias = production
+
+[profile readonly]
+source_profile = admin
+role_arn = arn:aws:iam::123456789012:role/ops/ReadOnly
+
+[profile other]
+source_profile = admin
+role_arn = arn:aws:iam::210987654321:role/Admin
+`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	items, aliases := profileItems(cp)
+	if len(items) != 4 || aliases["123456789012"] != "production" {
+		t.Errorf("unexpected items: %d, aliases: %v", len(items), aliases)
+		return
+	}
+
+	p := make(map[string]string)
+	for _, i := range items {
+		p[i.Name] = i.AccountId + " " + i.Alias + " " + i.Role
+	}
+
+	// the alias of another profile in the same account is used, but not inherited from the source_profile
+	if p["default"] != "  " || p["readonly"] != "123456789012 production ReadOnly" || p["other"] != "210987654321  Admin" {
+		t.Errorf("unexpected items: %v", p)
+	}
+}
+
+func TestSplitRoleArn(t *testing.T) {
+	t.Run("role", func(t *testing.T) {
+		if a, r := splitRoleArn("arn:aws-us-gov:iam::123456789012:role/path/to/Role"); a != "123456789012" || r != "Role" {
+			t.Errorf("unexpected account %s, role %s", a, r)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if a, r := splitRoleArn("my-profile"); len(a) > 0 || len(r) > 0 {
+			t.Errorf("unexpected account %s, role %s", a, r)
+		}
+	})
+}
+
+func TestPickOnEmptyProfile(t *testing.T) {
+	for _, b := range []*bool{whoAmI, showExpire, ctrFlag, listRoles} {
+		*b = true
+		if pickOnEmptyProfile() {
+			t.Error("picker enabled with a non-exec mode flag")
+		}
+		*b = false
+	}
+
+	*ctrAddr = "127.0.0.1:8080"
+	defer func() { *ctrAddr = "" }()
+	if pickOnEmptyProfile() {
+		t.Error("picker enabled with --container-addr")
+	}
+}
+
+func TestSamlRoleItemsKeepsGlobals(t *testing.T) {
+	oldProfile, oldCfg := profile, cfg
+	defer func() { profile, cfg = oldProfile, oldCfg }()
+
+	c := new(config.AwsConfig)
+	profile = aws.String("picked")
+	cfg = c
+
+	if items := samlRoleItems(nil, nil); len(items) > 0 {
+		t.Errorf("unexpected items: %v", items)
+	}
+
+	if *profile != "picked" || cfg != c {
+		t.Errorf("globals changed, profile: %s, config: %+v", *profile, cfg)
+	}
+}
+
+func TestDiscoveryConfig(t *testing.T) {
+	os.Setenv("AWS_CONFIG_FILE", ".aws/config")
+	defer os.Unsetenv("AWS_CONFIG_FILE")
+
+	oldProfile, oldCfg := profile, cfg
+	defer func() { profile, cfg = oldProfile, oldCfg }()
+
+	c := new(config.AwsConfig)
+	profile = aws.String("picked")
+	cfg = c
+
+	t.Run("good", func(t *testing.T) {
+		dc, err := discoveryConfig("circle-role")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if dc.Profile != "circle-role" || dc.RoleArn != "arn:aws:iam::686784119290:role/circleci-role" {
+			t.Errorf("unexpected config: %+v", dc)
+		}
+
+		if *profile != "picked" || cfg != c {
+			t.Errorf("globals changed, profile: %s, config: %+v", *profile, cfg)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		if _, err := discoveryConfig("not-a-profile"); err == nil {
+			t.Error("did not receive expected error")
+		}
+	})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"aws-runas/lib/cache"
+	"aws-runas/lib/config"
+	credlib "aws-runas/lib/credentials"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	cfglib "github.com/mmmorris1975/aws-config/config"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS limits the duration of credentials for a role assumed using the credentials of another role
+const chainedRoleMaxDuration = 1 * time.Hour
+
+// resolveRoleChain finds the chain of roles for the profile p, with roleArn (if set) as the last role in the chain.  If
+// there is more than 1 role in the chain, the configuration of every profile in the chain is returned, merged with the
+// default profile, otherwise nil is returned, since the config resolver already handles a single source_profile.
+func resolveRoleChain(res cfglib.AwsConfigResolver, p, roleArn string) (*cfglib.AwsConfig, error) {
+	chain = &config.RoleChain{SourceProfile: p}
+
+	if len(p) > 0 {
+		ip, err := cfglib.NewIniConfigProvider(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		chain, err = config.ResolveRoleChain(ip, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(roleArn) > 0 {
+		chain.Hops = append(chain.Hops, &config.RoleHop{Profile: roleArn, RoleArn: roleArn})
+	}
+
+	if len(chain.Hops) < 2 {
+		return nil, nil
+	}
+
+	d, err := res.Resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Merge(append([]*cfglib.AwsConfig{d}, chain.Profiles...)...)
+}
+
+// finalizeRoleChain sets the source profile of the config to the start of the role chain, and applies the command line
+// options to the last role in the chain.  The duration of roles after the first is limited to 1 hour.
+func finalizeRoleChain() {
+	if chain == nil || len(chain.Hops) < 2 {
+		return
+	}
+
+	cfg.SourceProfile = chain.SourceProfile
+	last := chain.Hops[len(chain.Hops)-1]
+
+	if extnId != nil && len(*extnId) > 0 {
+		last.ExternalId = *extnId
+	}
+
+	if mfaSerial != nil && len(*mfaSerial) > 0 {
+		last.MfaSerial = *mfaSerial
+	}
+
+	if roleDuration != nil && *roleDuration > 0 {
+		last.Duration = *roleDuration
+	}
+
+	if sessionTags != nil && len(*sessionTags) > 0 {
+		if last.SessionTags == nil {
+			last.SessionTags = make(map[string]string)
+		}
+
+		for k, v := range *sessionTags {
+			last.SessionTags[k] = v
+		}
+	}
+
+	if transitiveTags != nil && len(*transitiveTags) > 0 {
+		last.TransitiveTagKeys = appendUnique(last.TransitiveTagKeys, *transitiveTags...)
+	}
+
+	if policyFile != nil && len(*policyFile) > 0 {
+		last.SessionPolicy = cfg.SessionPolicy
+	}
+
+	if policyArns != nil && len(*policyArns) > 0 {
+		last.SessionPolicyArns = appendUnique(last.SessionPolicyArns, *policyArns...)
+	}
+
+	for i, h := range chain.Hops {
+		if i > 0 && h.Duration > chainedRoleMaxDuration {
+			log.Warnf("duration of chained role %s limited to %s", h.Profile, chainedRoleMaxDuration)
+			h.Duration = chainedRoleMaxDuration
+		}
+	}
+}
+
+// configRoleHop returns the settings for the role of the profile, when the profile does not use a role chain
+func configRoleHop() *config.RoleHop {
+	return &config.RoleHop{Profile: *profile, RoleArn: cfg.RoleArn, ExternalId: cfg.ExternalId,
+		MfaSerial: cfg.MfaSerial, Duration: cfg.CredentialsDuration, RoleSessionName: cfg.RoleSessionName,
+		SourceIdentity: cfg.SourceIdentity, SessionTags: cfg.SessionTags, TransitiveTagKeys: cfg.TransitiveTagKeys, SessionPolicy: cfg.SessionPolicy,
+		SessionPolicyArns: cfg.SessionPolicyArns}
+}
+
+// hasRoleChain returns true if more than 1 role must be assumed to get the credentials for the profile
+func hasRoleChain() bool {
+	return chain != nil && len(chain.Hops) > 1
+}
+
+// roleChainUserCredentials returns the credentials for the last role in the chain, starting with the credentials of an
+// IAM user.  Like handleAwsUserCredentials(), the first role is assumed using session token credentials, which handle
+// the MFA for the first role, unless the role credentials are valid for more than 1 hour.
+func roleChainUserCredentials() *credentials.Credentials {
+	first := chain.Hops[0]
+	if first.Duration > chainedRoleMaxDuration {
+		return roleChainCredentials(nil, chain.Hops, *mfaCode)
+	}
+
+	cfg.MfaSerial = first.MfaSerial
+	sc := sessionTokenCredentials(ses)
+
+	h := *first
+	h.MfaSerial = "" // explicitly unset MfaSerial since MFA is handled in the session credentials
+
+	code := *mfaCode
+	if len(first.MfaSerial) > 0 {
+		code = ""
+	}
+
+	return roleChainCredentials(sc, append([]*config.RoleHop{&h}, chain.Hops[1:]...), code)
+}
+
+// roleChainCredentials assumes each role in hops, using the credentials of the previous role.  The first role is assumed
+// using the credentials in c, or the session credentials if c is nil.  The MFA token code, if provided, is only used for
+// the first role requiring MFA, since a token code can not be used more than once.
+func roleChainCredentials(c *credentials.Credentials, hops []*config.RoleHop, code string) *credentials.Credentials {
+	for _, h := range hops {
+		var s client.ConfigProvider = ses
+		if c != nil {
+			s = ses.Copy(new(aws.Config).WithCredentials(c))
+		}
+
+		c = chainedRoleCredentials(s, h, code)
+		if len(h.MfaSerial) > 0 {
+			code = ""
+		}
+	}
+	return c
+}
+
+func chainedRoleCredentials(c client.ConfigProvider, h *config.RoleHop, code string) *credentials.Credentials {
+	ew := h.Duration / 10
+	if h.Duration < credlib.AssumeRoleMinDuration {
+		ew = credlib.AssumeRoleMinDuration / 10
+	}
+
+	var rp *credlib.AssumeRoleProvider
+	rc := credlib.NewAssumeRoleCredentials(c, h.RoleArn, func(p *credlib.AssumeRoleProvider) {
+		rp = p
+		p.Cache = cache.NewFileCredentialCache(hopCredCacheName(h))
+		p.Duration = h.Duration
+		p.ExternalID = h.ExternalId
+		p.ExpiryWindow = ew
+		p.Log = log
+		p.RoleSessionName = h.RoleSessionName
+		p.SerialNumber = h.MfaSerial
+		p.TokenCode = code
+		p.TokenProvider = credlib.StdinMfaTokenProvider
+		p.Tags = h.SessionTags
+		p.TransitiveTagKeys = h.TransitiveTagKeys
+		p.Policy = h.SessionPolicy
+		p.PolicyArns = h.SessionPolicyArns
+		p.SourceIdentity = h.SourceIdentity
+	})
+
+	if len(h.MfaSerial) > 0 {
+		watchCredentials(fmt.Sprintf("role credentials for %s", h.Profile), rc, ttyRenewal(rc, rp.RenewWithTokenProvider))
+	}
+	return rc
+}
+
+// hopCredCacheName returns the cache file for a role in the chain.  The last role uses the same cache file name as a
+// profile without a role chain, the other roles use the cache of their profile.
+func hopCredCacheName(h *config.RoleHop) string {
+	p := h.Profile
+	if p == *profile {
+		p = roleCacheProfile()
+	}
+	return roleCacheFile(p, h)
+}
+
+func removeRoleChainCaches() {
+	if !hasRoleChain() {
+		return
+	}
+
+	for _, h := range chain.Hops {
+		if err := os.Remove(hopCredCacheName(h)); err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorf("error removing role cred cache: %v", err)
+			}
+		}
+	}
+}
+
+// explainRoleChain writes the source of the credentials for the profile, and the settings for each role which is assumed
+// to get the profile credentials, without calling any AWS APIs
+func explainRoleChain(w io.Writer) {
+	src := fmt.Sprintf("profile %s", *profile)
+	if len(cfg.SourceProfile) > 0 {
+		src = fmt.Sprintf("profile %s", cfg.SourceProfile)
+	} else if *profile == cfg.RoleArn {
+		src = "default credentials"
+	}
+
+	if cfg.SamlAuthUrl != nil && len(cfg.SamlAuthUrl.String()) > 0 {
+		src = fmt.Sprintf("SAML identity from %s", cfg.SamlAuthUrl)
+	}
+
+	hops := make([]*config.RoleHop, 0)
+	if hasRoleChain() {
+		hops = chain.Hops
+	} else if len(cfg.RoleArn) > 0 {
+		hops = append(hops, configRoleHop())
+	}
+
+	fmt.Fprintf(w, "PROFILE: %s\n", *profile)
+	fmt.Fprintf(w, "CREDENTIALS: %s\n", src)
+	if len(cfg.SourceIdentity) > 0 {
+		fmt.Fprintf(w, "SOURCE IDENTITY: %s\n", cfg.SourceIdentity)
+	}
+
+	if len(hops) < 1 {
+		fmt.Fprintln(w, "No roles are assumed for this profile")
+		return
+	}
+
+	for i, h := range hops {
+		d := h.Duration
+		if d < 1 {
+			d = credlib.AssumeRoleDefaultDuration
+		}
+
+		n := h.RoleSessionName
+		if len(n) < 1 {
+			n = "<identity username>"
+		}
+
+		fmt.Fprintf(w, "%d. %s\n", i+1, h.RoleArn)
+		if h.Profile != h.RoleArn {
+			fmt.Fprintf(w, "   profile: %s\n", h.Profile)
+		}
+
+		if len(h.ExternalId) > 0 {
+			fmt.Fprintf(w, "   external id: %s\n", h.ExternalId)
+		}
+
+		if len(h.MfaSerial) > 0 {
+			fmt.Fprintf(w, "   mfa serial: %s\n", h.MfaSerial)
+		}
+
+		if len(h.SessionTags) > 0 {
+			fmt.Fprintf(w, "   session tags: %s\n", formatTags(h.SessionTags, h.TransitiveTagKeys))
+		}
+
+		if len(h.SessionPolicy) > 0 {
+			fmt.Fprintf(w, "   session policy: %s\n", compactPolicy(h.SessionPolicy))
+		}
+
+		if len(h.SessionPolicyArns) > 0 {
+			fmt.Fprintf(w, "   session policy arns: %s\n", strings.Join(h.SessionPolicyArns, ", "))
+		}
+
+		fmt.Fprintf(w, "   duration: %s\n", d)
+		fmt.Fprintf(w, "   session name: %s\n", n)
+		fmt.Fprintf(w, "   cache: %s\n", hopCredCacheName(h))
+	}
+}
+
+// formatTags returns the tags as a sorted list of key=value, with transitive tags marked with a '*'
+func formatTags(tags map[string]string, transitive []string) string {
+	t := make([]string, 0, len(tags))
+	for k, v := range tags {
+		s := fmt.Sprintf("%s=%s", k, v)
+		for _, x := range transitive {
+			if x == k {
+				s += "*"
+				break
+			}
+		}
+		t = append(t, s)
+	}
+	sort.Strings(t)
+	return strings.Join(t, ", ")
+}
+
+// compactPolicy returns the policy document without insignificant whitespace, or the policy as-is if it is not valid
+func compactPolicy(p string) string {
+	if c, err := credlib.CompactSessionPolicy(p); err == nil {
+		return c
+	}
+	return p
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"aws-runas/lib/config"
+	"aws-runas/lib/identity"
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/awstesting/mock"
+	cfglib "github.com/mmmorris1975/aws-config/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveRoleChain(t *testing.T) {
+	os.Setenv("AWS_CONFIG_FILE", ".aws/config")
+	defer os.Unsetenv("AWS_CONFIG_FILE")
+	defer func() { chain = nil }()
+
+	roleDuration = new(time.Duration)
+	extnId = aws.String("")
+	mfaSerial = aws.String("")
+
+	t.Run("chain", func(t *testing.T) {
+		profile = aws.String("chain-workload")
+
+		if err := resolveConfig(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !hasRoleChain() || len(chain.Hops) != 2 || cfg.SourceProfile != "circleci" || cfg.Region != "us-west-1" ||
+			cfg.RoleArn != "arn:aws:iam::0987654321:role/Workload" {
+			t.Errorf("unexpected chain config: %+v %+v", chain, cfg.AwsConfig)
+			return
+		}
+
+		first, last := chain.Hops[0], chain.Hops[1]
+		if first.Profile != "chain-admin" || first.Duration != 2*time.Hour || len(first.MfaSerial) < 1 {
+			t.Errorf("unexpected first role: %+v", first)
+		}
+
+		// chained role duration is limited to 1 hour
+		if last.ExternalId != "wkld" || last.Duration != chainedRoleMaxDuration || last.RoleSessionName != "deployer" {
+			t.Errorf("unexpected last role: %+v", last)
+		}
+	})
+
+	t.Run("arn profile", func(t *testing.T) {
+		os.Setenv("AWS_DEFAULT_PROFILE", "chain-admin")
+		defer os.Unsetenv("AWS_DEFAULT_PROFILE")
+		profile = aws.String("arn:aws:iam::1234567890:role/Admin")
+
+		if err := resolveConfig(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !hasRoleChain() || chain.Hops[1].RoleArn != *profile || cfg.SourceProfile != "circleci" ||
+			cfg.RoleArn != *profile {
+			t.Errorf("unexpected chain config: %+v %+v", chain, cfg.AwsConfig)
+		}
+	})
+
+	t.Run("single role", func(t *testing.T) {
+		profile = aws.String("circle-role")
+
+		if err := resolveConfig(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if hasRoleChain() || cfg.SourceProfile != "circleci" {
+			t.Errorf("unexpected chain config: %+v %+v", chain, cfg.AwsConfig)
+		}
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		profile = aws.String("chain-loop")
+
+		if err := resolveConfig(); err == nil || !strings.Contains(err.Error(), "loop") {
+			t.Errorf("did not receive expected error: %v", err)
+		}
+	})
+}
+
+func TestRoleChainCredentials(t *testing.T) {
+	defer func() { chain = nil }()
+
+	ses = mock.Session
+	usr = &identity.Identity{Username: "bob"}
+	mfaCode = aws.String("123456")
+	profile = aws.String("workload")
+	cfg = &config.AwsConfig{AwsConfig: new(cfglib.AwsConfig)}
+
+	chain = &config.RoleChain{SourceProfile: "user", Hops: []*config.RoleHop{
+		{Profile: "admin", RoleArn: "arn:aws:iam::1111111111:role/Admin", MfaSerial: "mfa"},
+		{Profile: "workload", RoleArn: "arn:aws:iam::2222222222:role/Workload"},
+	}}
+
+	t.Run("session token", func(t *testing.T) {
+		if c := roleChainUserCredentials(); c == nil {
+			t.Error("nil credentials")
+		}
+
+		// mfa is handled by the session token, and the chain config is not modified
+		if cfg.MfaSerial != "mfa" || chain.Hops[0].MfaSerial != "mfa" {
+			t.Errorf("unexpected mfa serial: %s", cfg.MfaSerial)
+		}
+	})
+
+	t.Run("long first role", func(t *testing.T) {
+		chain.Hops[0].Duration = 4 * time.Hour
+		if c := roleChainUserCredentials(); c == nil {
+			t.Error("nil credentials")
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		if f := hopCredCacheName(chain.Hops[0]); filepath.Base(f) != assumeRoleCachePrefix+"_admin" {
+			t.Errorf("unexpected cache file: %s", f)
+		}
+
+		if hopCredCacheName(chain.Hops[1]) != roleCredCacheName() {
+			t.Error("last role does not use the profile cache")
+		}
+	})
+
+	t.Run("explain", func(t *testing.T) {
+		cfg.SourceProfile = "user"
+		b := new(bytes.Buffer)
+		explainRoleChain(b)
+
+		s := b.String()
+		if !strings.Contains(s, "CREDENTIALS: profile user") || !strings.Contains(s, "1. arn:aws:iam::1111111111:role/Admin") ||
+			!strings.Contains(s, "2. arn:aws:iam::2222222222:role/Workload") || !strings.Contains(s, "duration: 4h0m0s") ||
+			!strings.Contains(s, "mfa serial: mfa") {
+			t.Errorf("unexpected explain output:\n%s", s)
+		}
+		cfg.SourceProfile = ""
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		h := &config.RoleHop{Profile: "admin", SessionTags: map[string]string{"Team": "ops", "Project": "runas"},
+			TransitiveTagKeys: []string{"Team"}}
+
+		if hopCredCacheName(h) == hopCredCacheName(chain.Hops[0]) {
+			t.Error("tagged role uses the same cache as the untagged role")
+		}
+
+		if s := formatTags(h.SessionTags, h.TransitiveTagKeys); s != "Project=runas, Team=ops*" {
+			t.Errorf("unexpected tags: %s", s)
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		h := &config.RoleHop{Profile: "admin", SessionPolicy: `{ "Version": "2012-10-17" }`,
+			SessionPolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}
+
+		if hopCredCacheName(h) == hopCredCacheName(chain.Hops[0]) {
+			t.Error("scoped role uses the same cache as the unscoped role")
+		}
+
+		cfg.SourceProfile = "user"
+		defer func() { cfg.SourceProfile = "" }()
+
+		b := new(bytes.Buffer)
+		hops := chain.Hops
+		chain.Hops = []*config.RoleHop{hops[0], h}
+		defer func() { chain.Hops = hops }()
+
+		explainRoleChain(b)
+		if !strings.Contains(b.String(), `session policy: {"Version":"2012-10-17"}`) ||
+			!strings.Contains(b.String(), "session policy arns: arn:aws:iam::aws:policy/ReadOnlyAccess") {
+			t.Errorf("unexpected explain output:\n%s", b.String())
+		}
+	})
+
+	t.Run("explain no role", func(t *testing.T) {
+		chain = nil
+		cfg.RoleArn = ""
+		b := new(bytes.Buffer)
+		explainRoleChain(b)
+
+		if !strings.Contains(b.String(), "No roles are assumed") {
+			t.Errorf("unexpected explain output:\n%s", b.String())
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"aws-runas/lib/httpclient"
 	"fmt"
 	"net/http"
 	"strings"
@@ -13,15 +14,29 @@ var (
 )
 
 func versionCheck(ver string) error {
-	http.DefaultClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+	o := new(httpclient.Options)
+	if cfg != nil {
+		o = cfg.HttpClientOptions()
+		// the client certificate is only for the SAML identity provider
+		o.ClientCert = ""
+		o.ClientKey = ""
+	}
+
+	hc, err := httpclient.New(o)
+	if err != nil {
+		return err
+	}
+
+	hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		// Don't follow redirects, just return 1st response
 		return http.ErrUseLastResponse
 	}
 
-	res, err := http.Head(ghUrl)
+	res, err := hc.Head(ghUrl)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusFound {
 		url, err := res.Location()